@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/youzan/nsq/internal/ext"
+	"github.com/youzan/nsq/internal/http_api"
+	"github.com/youzan/nsq/nsqd"
+)
+
+// the binary export file begins with the magic and a byte for the ext flag
+// of the topic, then each message is the 4 bytes length and the raw data in
+// the topic disk queue.
+var binaryExportMagic = []byte("NSQEXPv1")
+
+// exportedMessage is the line of the json export file
+type exportedMessage struct {
+	ID        uint64 `json:"id"`
+	TraceID   uint64 `json:"trace_id"`
+	Timestamp int64  `json:"timestamp"`
+	Attempts  uint16 `json:"attempts"`
+	Offset    int64  `json:"offset"`
+	ExtVer    uint8  `json:"ext_ver"`
+	Ext       string `json:"ext,omitempty"`
+	Body      []byte `json:"body"`
+}
+
+func newExportedMessage(msg *nsqd.Message, offset nsqd.BackendOffset) *exportedMessage {
+	return &exportedMessage{
+		ID:        uint64(msg.ID),
+		TraceID:   msg.TraceID,
+		Timestamp: msg.Timestamp,
+		Attempts:  msg.Attempts,
+		Offset:    int64(offset),
+		ExtVer:    uint8(msg.ExtVer),
+		Ext:       string(msg.ExtBytes),
+		Body:      msg.Body,
+	}
+}
+
+// export the messages between the start and end offset, the start will be
+// the confirmed of the channel if not given, so the pending backlog of the
+// channel can be exported.
+func exportData(backendName string, topicDataPath string, queueStart nsqd.BackendQueueEnd,
+	queueEnd nsqd.BackendQueueEnd) {
+	if *exportFile == "" {
+		log.Fatal("--export_file is required")
+	}
+	if *exportFormat != "json" && *exportFormat != "binary" {
+		log.Fatal("--export_format should be json or binary")
+	}
+	startOffset := nsqd.BackendOffset(*exportStartOffset)
+	if *exportStartOffset < 0 {
+		startOffset = queueStart.Offset()
+		if *viewCh != "" {
+			confirmed, err := nsqd.GetChannelConfirmedForRead(*topic, *partition, *viewCh, topicDataPath)
+			if err != nil {
+				log.Fatalf("read channel %v confirmed failed: %v", *viewCh, err)
+			}
+			startOffset = confirmed.Offset()
+		}
+	}
+	endOffset := queueEnd.Offset()
+	if *exportEndOffset >= 0 && nsqd.BackendOffset(*exportEndOffset) < endOffset {
+		endOffset = nsqd.BackendOffset(*exportEndOffset)
+	}
+	if startOffset < queueStart.Offset() {
+		log.Fatalf("export start %v is less than the queue start %v", startOffset, queueStart.Offset())
+	}
+	log.Printf("exporting messages from %v to %v, queue start: %v, end: %v\n",
+		startOffset, endOffset, queueStart.Offset(), queueEnd.Offset())
+
+	f, err := os.OpenFile(*exportFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		log.Fatalf("open export file failed: %v", err)
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	if *exportFormat == "binary" {
+		w.Write(binaryExportMagic)
+		if *isExt {
+			w.WriteByte(1)
+		} else {
+			w.WriteByte(0)
+		}
+	}
+
+	backendReader := nsqd.NewDiskQueueSnapshot(backendName, topicDataPath, queueEnd)
+	defer backendReader.Close()
+	backendReader.SetQueueStart(queueStart)
+	err = backendReader.SeekTo(startOffset)
+	if err != nil {
+		log.Fatalf("seek to %v failed: %v", startOffset, err)
+	}
+	cnt := 0
+	lenBuf := make([]byte, 4)
+	for {
+		ret := backendReader.ReadOne()
+		if ret.Err == io.EOF || (ret.Err == nil && ret.Offset >= endOffset) {
+			break
+		}
+		if ret.Err != nil {
+			log.Fatalf("read data at %v error: %v", ret.Offset, ret.Err)
+		}
+		if *exportFormat == "binary" {
+			binary.BigEndian.PutUint32(lenBuf, uint32(len(ret.Data)))
+			w.Write(lenBuf)
+			_, err = w.Write(ret.Data)
+		} else {
+			var msg *nsqd.Message
+			msg, err = nsqd.DecodeMessage(ret.Data, *isExt)
+			if err != nil {
+				log.Fatalf("decode data at %v error: %v", ret.Offset, err)
+			}
+			var line []byte
+			line, err = json.Marshal(newExportedMessage(msg, ret.Offset))
+			if err == nil {
+				line = append(line, '\n')
+				_, err = w.Write(line)
+			}
+		}
+		if err != nil {
+			log.Fatalf("write export file failed: %v", err)
+		}
+		cnt++
+	}
+	err = w.Flush()
+	if err != nil {
+		log.Fatalf("write export file failed: %v", err)
+	}
+	log.Printf("exported %v messages to %v\n", cnt, *exportFile)
+}
+
+type exportReader interface {
+	next() (*exportedMessage, error)
+}
+
+type jsonExportReader struct {
+	dec *json.Decoder
+}
+
+func (r *jsonExportReader) next() (*exportedMessage, error) {
+	var m exportedMessage
+	err := r.dec.Decode(&m)
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+type binaryExportReader struct {
+	r     *bufio.Reader
+	isExt bool
+}
+
+func newBinaryExportReader(r *bufio.Reader) (*binaryExportReader, error) {
+	header := make([]byte, len(binaryExportMagic)+1)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+	if string(header[:len(binaryExportMagic)]) != string(binaryExportMagic) {
+		return nil, errors.New("invalid binary export file")
+	}
+	return &binaryExportReader{r: r, isExt: header[len(binaryExportMagic)] == 1}, nil
+}
+
+func (r *binaryExportReader) next() (*exportedMessage, error) {
+	lenBuf := make([]byte, 4)
+	_, err := io.ReadFull(r.r, lenBuf)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(lenBuf))
+	_, err = io.ReadFull(r.r, data)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	msg, err := nsqd.DecodeMessage(data, r.isExt)
+	if err != nil {
+		return nil, err
+	}
+	return newExportedMessage(msg, 0), nil
+}
+
+// get the json header to publish the imported message. The original timestamp
+// is always kept in the header as metadata only, nsqd still stores the publish
+// time as the message timestamp since the timestamp based consume offset
+// search depends on the increasing timestamps in the queue. The original
+// header of the message is kept only if withExt is true.
+func getImportJsonHeader(m *exportedMessage, withExt bool) ([]byte, error) {
+	header := make(map[string]interface{})
+	switch ext.ExtVer(m.ExtVer) {
+	case ext.JSON_HEADER_EXT_VER:
+		if withExt && len(m.Ext) > 0 {
+			err := json.Unmarshal([]byte(m.Ext), &header)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case ext.TAG_EXT_VER:
+		if withExt && len(m.Ext) > 0 {
+			header[ext.CLIENT_DISPATCH_TAG_KEY] = m.Ext
+		}
+	}
+	header[ext.MSG_ORIG_TIMESTAMP_KEY] = strconv.FormatInt(m.Timestamp, 10)
+	return json.Marshal(header)
+}
+
+// import the exported messages by publishing them to the topic partition
+// on the nsqd
+func importData() {
+	if *exportFile == "" {
+		log.Fatal("--export_file is required")
+	}
+	if *importNsqdHTTPAddr == "" {
+		log.Fatal("--import_nsqd_http_address is required")
+	}
+	f, err := os.Open(*exportFile)
+	if err != nil {
+		log.Fatalf("open export file failed: %v", err)
+	}
+	defer f.Close()
+	var r exportReader
+	br := bufio.NewReader(f)
+	if *exportFormat == "binary" {
+		r, err = newBinaryExportReader(br)
+		if err != nil {
+			log.Fatalf("read export file failed: %v", err)
+		}
+	} else if *exportFormat == "json" {
+		r = &jsonExportReader{dec: json.NewDecoder(br)}
+	} else {
+		log.Fatal("--export_format should be json or binary")
+	}
+
+	client := http_api.NewClient(nil)
+	cnt := 0
+	pubWithoutHeader := false
+	for {
+		m, err := r.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatalf("read export file failed after %v messages: %v", cnt, err)
+		}
+		if !pubWithoutHeader {
+			header, err := getImportJsonHeader(m, *importWithExt)
+			if err != nil {
+				log.Fatalf("invalid json header of message %v: %v", m.ID, err)
+			}
+			// the ext param will be unescaped again by nsqd
+			endpoint := fmt.Sprintf("http://%s/pub_ext?topic=%s&partition=%v&ext=%s", *importNsqdHTTPAddr,
+				url.QueryEscape(*topic), *partition, url.QueryEscape(url.QueryEscape(string(header))))
+			_, err = client.POSTV1WithContent(endpoint, string(m.Body))
+			if err != nil && !*importWithExt && strings.Contains(err.Error(), ext.E_EXT_NOT_SUPPORT) {
+				// the non-ext topic can ignore the internal header only if
+				// allow-ext-compatible is enabled on nsqd
+				log.Printf("the topic does not accept the json header, the original timestamp will not be kept")
+				pubWithoutHeader = true
+			} else if err != nil {
+				log.Fatalf("publish message %v failed after %v messages: %v", m.ID, cnt, err)
+			}
+		}
+		if pubWithoutHeader {
+			endpoint := fmt.Sprintf("http://%s/pub?topic=%s&partition=%v", *importNsqdHTTPAddr,
+				url.QueryEscape(*topic), *partition)
+			_, err = client.POSTV1WithContent(endpoint, string(m.Body))
+			if err != nil {
+				log.Fatalf("publish message %v failed after %v messages: %v", m.ID, cnt, err)
+			}
+		}
+		cnt++
+	}
+	log.Printf("imported %v messages to %v-%v\n", cnt, *topic, *partition)
+}
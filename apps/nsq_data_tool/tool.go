@@ -19,7 +19,7 @@ var (
 	topic              = flag.String("topic", "", "NSQ topic")
 	partition          = flag.Int("partition", -1, "NSQ topic partition")
 	dataPath           = flag.String("data_path", "", "the data path of nsqd")
-	view               = flag.String("view", "commitlog", "commitlog | topicdata | delayedqueue")
+	view               = flag.String("view", "commitlog", "commitlog | topicdata | delayedqueue | export | import")
 	searchMode         = flag.String("search_mode", "count", "the view start of mode. (count|id|timestamp|virtual_offset)")
 	viewStart          = flag.Int64("view_start", 0, "the start count of message.")
 	viewStartID        = flag.Int64("view_start_id", 0, "the start id of message.")
@@ -28,6 +28,14 @@ var (
 	viewCnt            = flag.Int("view_cnt", 1, "the total count need to be viewed. should less than 1,000,000")
 	viewCh             = flag.String("view_channel", "", "channel detail need to view")
 	logLevel           = flag.Int("level", 3, "log level")
+	exportFile         = flag.String("export_file", "", "the file to export the messages to or import the messages from")
+	exportFormat       = flag.String("export_format", "json", "the format of the export file. (json|binary)")
+	exportStartOffset  = flag.Int64("export_start_offset", -1, "the queue offset to start export, default is the confirmed of the view_channel or the queue start")
+	exportEndOffset    = flag.Int64("export_end_offset", -1, "the queue offset to stop export, default is the queue end")
+	importNsqdHTTPAddr = flag.String("import_nsqd_http_address", "", "the nsqd http address to publish the imported messages to the topic partition")
+	importWithExt      = flag.Bool("import_with_ext", true, "keep the original json header ext of the imported messages, should be false for the topic without ext. The original timestamp is always sent in the ##orig_timestamp header as metadata")
+	verify             = flag.Bool("verify", false, "verify the commit log, the topic data and the channel meta, all the topics in the data_path will be verified if no topic given")
+	verifyRepair       = flag.Bool("verify_repair", false, "truncate the corrupted data to the last consistent commit log while verifying, the nsqd should be stopped")
 	//TODO: add ext ver for decode message
 	isExt = flag.Bool("ext", false, "is there extension for message ")
 )
@@ -49,12 +57,23 @@ func main() {
 	nsqd.NsqLogger().SetLevel(int32(*logLevel))
 	consistence.SetCoordLogger(levellogger.NewSimpleLog(), int32(*logLevel))
 
+	if *verify {
+		if *dataPath == "" {
+			log.Fatal("--data_path is required")
+		}
+		verifyData()
+		return
+	}
 	if *topic == "" {
 		log.Fatal("--topic is required\n")
 	}
 	if *partition == -1 {
 		log.Fatal("--partition is required")
 	}
+	if *view == "import" {
+		importData()
+		return
+	}
 	if *dataPath == "" {
 		log.Fatal("--data_path is required")
 	}
@@ -83,6 +102,10 @@ func main() {
 			return
 		}
 	}
+	if *view == "export" {
+		exportData(backendName, topicDataPath, backendWriter.GetQueueReadStart(), backendWriter.GetQueueReadEnd())
+		return
+	}
 	if *view == "delayedqueue" {
 		opts := &nsqd.Options{
 			MaxBytesPerFile: 1024 * 1024 * 100,
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/youzan/nsq/consistence"
+	"github.com/youzan/nsq/nsqd"
+)
+
+// the commit logs read in one batch while verifying
+const verifyLogBatch = 1000
+
+type verifyTopicInfo struct {
+	Name      string `json:"name"`
+	Partition int    `json:"partition"`
+	Ext       bool   `json:"ext"`
+}
+
+// verifyReport is the result of one topic partition, the problems found and
+// the data repaired are all recorded.
+type verifyReport struct {
+	name     string
+	checked  int64
+	problems []string
+	repaired []string
+}
+
+func (r *verifyReport) problem(f string, args ...interface{}) {
+	r.problems = append(r.problems, fmt.Sprintf(f, args...))
+}
+
+func (r *verifyReport) repair(f string, args ...interface{}) {
+	r.repaired = append(r.repaired, fmt.Sprintf(f, args...))
+}
+
+func (r *verifyReport) print() {
+	status := "OK"
+	if len(r.problems) > 0 {
+		status = "CORRUPTED"
+		if len(r.repaired) > 0 {
+			status = "REPAIRED"
+		}
+	}
+	fmt.Printf("[%v] %v, checked %v commit logs\n", status, r.name, r.checked)
+	for _, p := range r.problems {
+		fmt.Printf("    problem: %v\n", p)
+	}
+	for _, p := range r.repaired {
+		fmt.Printf("    repaired: %v\n", p)
+	}
+}
+
+// verifyQueue is the disk queue checked with the commit log, both the topic
+// queue and the delayed queue are supported.
+type verifyQueue interface {
+	GetDiskQueueSnapshot() *nsqd.DiskQueueSnapshot
+	ResetBackendEndNoLock(nsqd.BackendOffset, int64) error
+	TotalDataSize() int64
+	TotalMessageCnt() uint64
+}
+
+type topicQueueForVerify struct {
+	name     string
+	dataPath string
+	backend  nsqd.BackendQueueWriter
+}
+
+func (q *topicQueueForVerify) GetDiskQueueSnapshot() *nsqd.DiskQueueSnapshot {
+	snap := nsqd.NewDiskQueueSnapshot(q.name, q.dataPath, q.backend.GetQueueReadEnd())
+	snap.SetQueueStart(q.backend.GetQueueReadStart())
+	return snap
+}
+
+func (q *topicQueueForVerify) ResetBackendEndNoLock(vend nsqd.BackendOffset, totalCnt int64) error {
+	return q.backend.ResetWriteEnd(vend, totalCnt)
+}
+
+func (q *topicQueueForVerify) TotalDataSize() int64 {
+	return int64(q.backend.GetQueueWriteEnd().Offset())
+}
+
+func (q *topicQueueForVerify) TotalMessageCnt() uint64 {
+	return uint64(q.backend.GetQueueWriteEnd().TotalMsgCnt())
+}
+
+// load the topics from the nsqd metadata in the data path, the topic in the
+// command line will be used if no metadata.
+func loadTopicsForVerify() []verifyTopicInfo {
+	var topics []verifyTopicInfo
+	files, _ := filepath.Glob(path.Join(*dataPath, "nsqd.*.dat"))
+	for _, fn := range files {
+		data, err := ioutil.ReadFile(fn)
+		if err != nil {
+			log.Printf("read nsqd metadata %v failed: %v\n", fn, err)
+			continue
+		}
+		var meta struct {
+			Topics []verifyTopicInfo `json:"topics"`
+		}
+		err = json.Unmarshal(data, &meta)
+		if err != nil {
+			log.Printf("parse nsqd metadata %v failed: %v\n", fn, err)
+			continue
+		}
+		for _, t := range meta.Topics {
+			if *topic != "" && t.Name != *topic {
+				continue
+			}
+			if *partition != -1 && t.Partition != *partition {
+				continue
+			}
+			topics = append(topics, t)
+		}
+	}
+	if len(topics) == 0 && *topic != "" && *partition != -1 {
+		topics = append(topics, verifyTopicInfo{Name: *topic, Partition: *partition, Ext: *isExt})
+	}
+	return topics
+}
+
+func verifyData() {
+	topics := loadTopicsForVerify()
+	if len(topics) == 0 {
+		log.Fatal("no topic found to verify, --topic and --partition are required if no nsqd metadata")
+	}
+	corrupted := 0
+	for _, t := range topics {
+		reports := verifyTopicPartition(t, *verifyRepair)
+		for _, r := range reports {
+			r.print()
+			if len(r.problems) > 0 && len(r.repaired) == 0 {
+				corrupted++
+			}
+		}
+	}
+	log.Printf("verified %v topic partitions, %v corrupted without repaired\n", len(topics), corrupted)
+	if corrupted > 0 {
+		os.Exit(1)
+	}
+}
+
+func verifyTopicPartition(t verifyTopicInfo, repair bool) []*verifyReport {
+	fullName := nsqd.GetTopicFullName(t.Name, t.Partition)
+	topicDataPath := path.Join(*dataPath, t.Name)
+	r := &verifyReport{name: fullName}
+	reports := []*verifyReport{r}
+	logPath := consistence.GetTopicPartitionBasePath(*dataPath, t.Name, t.Partition)
+	logMgr, err := consistence.InitTopicCommitLogMgr(t.Name, t.Partition, logPath, 0)
+	if err != nil {
+		r.problem("load commit log failed: %v", err)
+		return reports
+	}
+	defer logMgr.Close()
+	var backend nsqd.BackendQueueWriter
+	if repair {
+		backend, err = nsqd.NewDiskQueueWriter(getBackendName(t.Name, t.Partition), topicDataPath,
+			1024*1024*1024, 1, 1024*1024*100, 1)
+	} else {
+		backend, err = nsqd.NewDiskQueueWriterForRead(getBackendName(t.Name, t.Partition), topicDataPath,
+			1024*1024*1024, 1, 1024*1024*100, 1)
+	}
+	if err != nil {
+		r.problem("load disk queue failed: %v", err)
+		return reports
+	}
+	q := &topicQueueForVerify{
+		name:     getBackendName(t.Name, t.Partition),
+		dataPath: topicDataPath,
+		backend:  backend,
+	}
+	verifyLogQueue(r, logMgr, q, func(b []byte) (*nsqd.Message, error) {
+		return nsqd.DecodeMessage(b, t.Ext)
+	}, repair)
+	verifyChannels(r, t, topicDataPath, backend, repair)
+	backend.Close()
+
+	dqPath := path.Join(logPath, "delayed_queue")
+	if _, err := os.Stat(dqPath); err != nil {
+		return reports
+	}
+	dr := &verifyReport{name: fullName + " delayed queue"}
+	reports = append(reports, dr)
+	delayedLogMgr, err := consistence.InitTopicCommitLogMgr(t.Name, t.Partition, dqPath, 0)
+	if err != nil {
+		dr.problem("load delayed commit log failed: %v", err)
+		return reports
+	}
+	defer delayedLogMgr.Close()
+	opts := &nsqd.Options{
+		MaxBytesPerFile: 1024 * 1024 * 100,
+		MaxMsgSize:      1024 * 1024 * 100,
+	}
+	var delayQ *nsqd.DelayQueue
+	if repair {
+		delayQ, err = nsqd.NewDelayQueue(t.Name, t.Partition, topicDataPath, opts, nil, t.Ext)
+	} else {
+		delayQ, err = nsqd.NewDelayQueueForRead(t.Name, t.Partition, topicDataPath, opts, nil, t.Ext)
+	}
+	if err != nil {
+		dr.problem("load delayed queue failed: %v", err)
+		return reports
+	}
+	defer delayQ.Close()
+	err = delayQ.CheckConsistence()
+	if err != nil {
+		dr.problem("delayed queue db check failed: %v", err)
+	}
+	verifyLogQueue(dr, delayedLogMgr, delayQ, func(b []byte) (*nsqd.Message, error) {
+		return nsqd.DecodeDelayedMessage(b, t.Ext)
+	}, repair)
+	return reports
+}
+
+// check the commit log is continuous with the previous one
+func checkCommitLog(prev *consistence.CommitLogData, l *consistence.CommitLogData) string {
+	if l.MsgNum <= 0 || l.MsgSize <= 0 || l.LastMsgLogID < l.LogID {
+		return fmt.Sprintf("invalid commit log %v", l)
+	}
+	if prev == nil {
+		return ""
+	}
+	if l.LogID <= prev.LastMsgLogID {
+		return fmt.Sprintf("log id %v is not increased after %v", l.LogID, prev.LastMsgLogID)
+	}
+	if l.MsgOffset != prev.MsgOffset+int64(prev.MsgSize) {
+		return fmt.Sprintf("message offset %v is not continuous with the previous %v:%v",
+			l.MsgOffset, prev.MsgOffset, prev.MsgSize)
+	}
+	if l.MsgCnt != prev.MsgCnt+int64(prev.MsgNum) {
+		return fmt.Sprintf("message count %v is not continuous with the previous %v:%v",
+			l.MsgCnt, prev.MsgCnt, prev.MsgNum)
+	}
+	return ""
+}
+
+// check the messages in the queue are the same with the commit log
+func checkCommitLogData(snap *nsqd.DiskQueueSnapshot, readPos *int64, l *consistence.CommitLogData,
+	decode func([]byte) (*nsqd.Message, error)) string {
+	if *readPos != l.MsgOffset {
+		err := snap.SeekTo(nsqd.BackendOffset(l.MsgOffset))
+		if err != nil {
+			return fmt.Sprintf("seek to the message offset %v failed: %v", l.MsgOffset, err)
+		}
+	}
+	// the read position is unknown until the batch checked
+	*readPos = -1
+	size := int64(0)
+	for i := int32(0); i < l.MsgNum; i++ {
+		ret := snap.ReadOne()
+		if ret.Err != nil {
+			return fmt.Sprintf("read the message at %v failed: %v", l.MsgOffset+size, ret.Err)
+		}
+		size += int64(ret.MovedSize)
+		msg, err := decode(ret.Data)
+		if err != nil {
+			return fmt.Sprintf("decode the message at %v failed: %v", ret.Offset, err)
+		}
+		if int64(msg.ID) < l.LogID || int64(msg.ID) > l.LastMsgLogID {
+			return fmt.Sprintf("message id %v at %v is not in the commit log %v", msg.ID, ret.Offset, l)
+		}
+	}
+	if size != int64(l.MsgSize) {
+		return fmt.Sprintf("the messages size %v is not matched with the commit log %v", size, l)
+	}
+	*readPos = l.MsgOffset + size
+	return ""
+}
+
+// walk all the commit logs and the queue data, the queue and the commit log
+// will be truncated to the last consistent log if repair enabled.
+func verifyLogQueue(r *verifyReport, logMgr *consistence.TopicCommitLogMgr, q verifyQueue,
+	decode func([]byte) (*nsqd.Message, error), repair bool) {
+	queueEnd := q.TotalDataSize()
+	queueEndCnt := int64(q.TotalMessageCnt())
+	logStart, _, err := logMgr.GetLogStartInfo()
+	if err != nil {
+		if err == consistence.ErrCommitLogEOF {
+			if queueEndCnt > 0 {
+				r.problem("commit log is empty while the queue end is %v:%v", queueEnd, queueEndCnt)
+			}
+			return
+		}
+		r.problem("get commit log start failed: %v", err)
+		return
+	}
+	snap := q.GetDiskQueueSnapshot()
+	defer snap.Close()
+	queueStart := int64(snap.GetQueueReadStart().Offset())
+
+	var lastGood *consistence.CommitLogData
+	lastGoodIndex := int64(-1)
+	badReason := ""
+	readPos := int64(-1)
+	countIndex := logStart.SegmentStartCount
+VERIFY:
+	for {
+		index, offset, err := logMgr.ConvertToOffsetIndex(countIndex)
+		if err != nil {
+			if err != consistence.ErrCommitLogOutofBound {
+				badReason = fmt.Sprintf("locate the commit log %v failed: %v", countIndex, err)
+			}
+			break
+		}
+		logs, err := logMgr.GetCommitLogsV2(index, offset, verifyLogBatch)
+		if err != nil && err != consistence.ErrCommitLogEOF {
+			badReason = fmt.Sprintf("read the commit log at %v:%v failed: %v", index, offset, err)
+			break
+		}
+		if len(logs) == 0 {
+			break
+		}
+		for i := range logs {
+			l := logs[i]
+			reason := checkCommitLog(lastGood, &l)
+			// the data before the queue start has been cleaned
+			if reason == "" && l.MsgOffset >= queueStart {
+				reason = checkCommitLogData(snap, &readPos, &l, decode)
+			}
+			if reason != "" {
+				badReason = fmt.Sprintf("commit log %v at %v: %v", countIndex, l.LogID, reason)
+				break VERIFY
+			}
+			lastGood = &l
+			lastGoodIndex = countIndex
+			countIndex++
+			r.checked++
+		}
+	}
+
+	if lastGood == nil {
+		if badReason != "" {
+			r.problem("%v, no consistent commit log found, the data should be synced from the other replicas", badReason)
+		}
+		return
+	}
+	goodEnd := lastGood.MsgOffset + int64(lastGood.MsgSize)
+	goodEndCnt := lastGood.MsgCnt + int64(lastGood.MsgNum) - 1
+	if badReason != "" {
+		r.problem("%v, the last consistent commit log is %v", badReason, lastGood)
+	}
+	endMismatch := queueEnd != goodEnd || queueEndCnt != goodEndCnt
+	if endMismatch {
+		r.problem("queue end %v:%v is not matched with the commit log end %v:%v",
+			queueEnd, queueEndCnt, goodEnd, goodEndCnt)
+	}
+	if !repair || (badReason == "" && !endMismatch) {
+		return
+	}
+	if badReason != "" {
+		index, offset, err := logMgr.ConvertToOffsetIndex(lastGoodIndex)
+		if err == nil {
+			_, err = logMgr.TruncateToOffsetV2(index, offset+int64(consistence.GetLogDataSize()))
+		}
+		if err != nil {
+			r.problem("truncate the commit log to %v failed: %v", lastGood, err)
+			return
+		}
+		r.repair("commit log truncated to %v at %v:%v", lastGood, index, offset)
+	}
+	if queueEnd < goodEnd {
+		r.problem("queue end %v is less than the commit log end %v, can not be repaired", queueEnd, goodEnd)
+		return
+	}
+	if endMismatch || badReason != "" {
+		err = q.ResetBackendEndNoLock(nsqd.BackendOffset(goodEnd), goodEndCnt)
+		if err != nil {
+			r.problem("reset the queue end to %v:%v failed: %v", goodEnd, goodEndCnt, err)
+			return
+		}
+		r.repair("queue end reset from %v:%v to %v:%v", queueEnd, queueEndCnt, goodEnd, goodEndCnt)
+	}
+}
+
+// check the confirmed position of the channels is in the queue
+func verifyChannels(r *verifyReport, t verifyTopicInfo, topicDataPath string,
+	backend nsqd.BackendQueueWriter, repair bool) {
+	channels, err := nsqd.LoadChannelMetaForRead(topicDataPath, t.Partition)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			r.problem("load channel meta failed: %v", err)
+		}
+		return
+	}
+	start := backend.GetQueueReadStart()
+	end := backend.GetQueueWriteEnd()
+	for _, ch := range channels {
+		confirmed, err := nsqd.GetChannelConfirmedForRead(t.Name, t.Partition, ch.Name, topicDataPath)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				r.problem("channel %v load confirmed failed: %v", ch.Name, err)
+			}
+			continue
+		}
+		if confirmed.Offset() < start.Offset() {
+			// the channel will be moved to the queue start while loading
+			r.problem("channel %v confirmed %v:%v is less than the queue start %v:%v", ch.Name,
+				confirmed.Offset(), confirmed.TotalMsgCnt(), start.Offset(), start.TotalMsgCnt())
+			continue
+		}
+		if confirmed.Offset() <= end.Offset() && confirmed.TotalMsgCnt() <= end.TotalMsgCnt() {
+			continue
+		}
+		r.problem("channel %v confirmed %v:%v is beyond the queue end %v:%v", ch.Name,
+			confirmed.Offset(), confirmed.TotalMsgCnt(), end.Offset(), end.TotalMsgCnt())
+		if !repair {
+			continue
+		}
+		fixed, err := nsqd.FixChannelConfirmedForRead(t.Name, t.Partition, ch.Name, topicDataPath, end)
+		if err != nil {
+			r.problem("channel %v reset confirmed failed: %v", ch.Name, err)
+		} else if fixed {
+			r.repair("channel %v confirmed reset to the queue end %v:%v", ch.Name, end.Offset(), end.TotalMsgCnt())
+		}
+	}
+}
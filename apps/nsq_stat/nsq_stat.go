@@ -27,6 +27,7 @@ var (
 	channel          = flag.String("channel", "", "NSQ channel")
 	statusEvery      = flag.Duration("status-every", -1, "(deprecated) duration of time between polling/printing output")
 	interval         = flag.Duration("interval", 2*time.Second, "duration of time between polling/printing output")
+	showLag          = flag.Bool("lag", false, "show the consume lag of each partition for the channel (all channels if no channel given), require --lookupd-http-address")
 	countNum         = numValue{}
 	nsqdHTTPAddrs    = app.StringArray{}
 	lookupdHTTPAddrs = app.StringArray{}
@@ -119,6 +120,37 @@ func statLoop(interval time.Duration, topic string, channel string,
 	os.Exit(0)
 }
 
+func lagLoop(interval time.Duration, topic string, channel string, lookupdHTTPAddrs []string) {
+	ci := clusterinfo.New(nil, http_api.NewClient(nil))
+	for i := 0; !countNum.isSet || countNum.value > i; i++ {
+		topicLag, err := ci.GetLookupdTopicLag(topic, channel, lookupdHTTPAddrs)
+		if err != nil {
+			log.Fatalf("ERROR: failed to get topic lag - %s", err)
+		}
+		for _, e := range topicLag.Errors {
+			log.Printf("WARNING: %s", e)
+		}
+
+		fmt.Printf("%-20s %5s %-21s %12s %12s %12s %10s %14s %12s\n",
+			"channel", "part", "node", "confirmed", "end", "commit-log",
+			"lag-msgs", "lag-bytes", "lag-time")
+		for _, c := range topicLag.Channels {
+			for _, p := range c.Partitions {
+				fmt.Printf("%-20s %5s %-21s %12d %12d %12d %10d %14d %12s\n",
+					c.ChannelName, p.TopicPartition, p.Node,
+					p.ConfirmedCount, p.EndCount, p.CommitLogCount,
+					p.LagCount, p.LagBytes, time.Duration(p.LagTimeMs)*time.Millisecond)
+			}
+			fmt.Printf("%-20s %5s %-21s %12s %12s %12s %10d %14d %12s\n",
+				c.ChannelName, "total", "", "", "", "",
+				c.LagCount, c.LagBytes, time.Duration(c.MaxLagTime)*time.Millisecond)
+		}
+		fmt.Println()
+		time.Sleep(interval)
+	}
+	os.Exit(0)
+}
+
 func checkAddrs(addrs []string) error {
 	for _, a := range addrs {
 		if strings.HasPrefix(a, "http") {
@@ -136,8 +168,11 @@ func main() {
 		return
 	}
 
-	if *topic == "" || *channel == "" {
-		log.Fatal("--topic and --channel are required")
+	if *topic == "" {
+		log.Fatal("--topic is required")
+	}
+	if *channel == "" && !*showLag {
+		log.Fatal("--channel is required")
 	}
 
 	intvl := *interval
@@ -159,6 +194,9 @@ func main() {
 	if len(nsqdHTTPAddrs) > 0 && len(lookupdHTTPAddrs) > 0 {
 		log.Fatal("use --nsqd-http-address or --lookupd-http-address not both")
 	}
+	if *showLag && len(lookupdHTTPAddrs) == 0 {
+		log.Fatal("--lag requires --lookupd-http-address")
+	}
 
 	if err := checkAddrs(nsqdHTTPAddrs); err != nil {
 		log.Fatalf("--nsqd-http-address error - %s", err)
@@ -171,7 +209,11 @@ func main() {
 	termChan := make(chan os.Signal, 1)
 	signal.Notify(termChan, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
 
-	go statLoop(intvl, *topic, *channel, nsqdHTTPAddrs, lookupdHTTPAddrs)
+	if *showLag {
+		go lagLoop(intvl, *topic, *channel, lookupdHTTPAddrs)
+	} else {
+		go statLoop(intvl, *topic, *channel, nsqdHTTPAddrs, lookupdHTTPAddrs)
+	}
 
 	<-termChan
 }
@@ -86,6 +86,7 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 
 	flagSet.String("cluster-id", opts.ClusterID, "cluster id for nsq")
 	flagSet.String("cluster-leadership-addresses", opts.ClusterLeadershipAddresses, "cluster leadership server list for nsq")
+	flagSet.String("cluster-leadership-type", opts.ClusterLeadershipType, "cluster leadership type, etcd or raft (use the rpc addresses of nsqlookupd as the leadership addresses)")
 
 	flagSet.String("https-address", opts.HTTPSAddress, "<addr>:<port> to listen on for HTTPS clients")
 	flagSet.String("http-address", opts.HTTPAddress, "<addr>:<port> to listen on for HTTP clients")
@@ -96,6 +97,7 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 	flagSet.Var(&authHTTPAddresses, "auth-http-address", "<addr>:<port> to query auth server (may be given multiple times)")
 	flagSet.String("broadcast-address", opts.BroadcastAddress, "address that will be registered with lookupd (defaults to the OS hostname)")
 	flagSet.String("broadcast-interface", opts.BroadcastInterface, "address that will be registered with lookupd (defaults to the OS hostname)")
+	flagSet.String("zone", opts.Zone, "the zone (or rack) label of this node, the replicas of topic will be spread across different zones")
 	lookupdTCPAddrs := app.StringArray{}
 	flagSet.Var(&lookupdTCPAddrs, "lookupd-tcp-address", "lookupd TCP address (may be given multiple times)")
 	flagSet.String("lookup-ping-interval", opts.LookupPingInterval.String(), "duration between ping to nsqlookup")
@@ -113,6 +115,9 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 	flagSet.Int64("max-msg-size", opts.MaxMsgSize, "maximum size of a single message in bytes")
 	flagSet.Duration("max-req-timeout", opts.MaxReqTimeout, "maximum requeuing timeout for a message")
 	flagSet.Duration("req-to-end-threshold", opts.ReqToEndThreshold, "duration threshold for requeue message to queue end")
+	flagSet.Duration("max-pub-delay", opts.MaxPubDelay, "maximum delay duration for a delayed pub message")
+	flagSet.Duration("tx-check-timeout", opts.TxCheckTimeout, "duration before checking back the producer for the uncommitted transaction message")
+	flagSet.Int("tx-max-check-count", opts.TxMaxCheckCount, "max check back times before rolling back the uncommitted transaction message")
 	// remove, deprecated
 	flagSet.Int64("max-message-size", opts.MaxMsgSize, "(deprecated use --max-msg-size) maximum size of a single message in bytes")
 	flagSet.Int64("max-body-size", opts.MaxBodySize, "maximum size of a single command body")
@@ -130,6 +135,7 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 	flagSet.String("statsd-interval", opts.StatsdInterval.String(), "duration between pushing to statsd")
 	flagSet.Bool("statsd-mem-stats", opts.StatsdMemStats, "toggle sending memory and GC stats to statsd")
 	flagSet.String("statsd-prefix", opts.StatsdPrefix, "prefix used for keys sent to statsd (%s for host replacement)")
+	flagSet.String("metrics-sink", opts.MetricsSink, "the sink for pushing stats to the statsd-address: statsd, graphite, influx (<addr>:<port> or http write url) or json-file (file path)")
 
 	// End to end percentile flags
 	e2eProcessingLatencyPercentiles := app.FloatArray{}
@@ -152,12 +158,16 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 	flagSet.Bool("snappy", opts.SnappyEnabled, "enable snappy feature negotiation (client compression)")
 	flagSet.Int("log-level", int(opts.LogLevel), "log verbose level")
 	flagSet.String("log-dir", opts.LogDir, "directory for logs")
-	flagSet.String("remote-tracer", opts.RemoteTracer, "server for message tracing")
+	flagSet.String("remote-tracer", opts.RemoteTracer, "server for message tracing, the http(s)://host:port/v1/traces or file:///path will export the otlp/json spans")
 	flagSet.Int("retention-days", int(opts.RetentionDays), "the default retention days for topic data")
 	flagSet.Int64("retention-size-per-day", int64(opts.RetentionSizePerDay), "the default retention bytes in a day for topic data")
+	flagSet.String("archive-url", opts.ArchiveURL, "archive the old topic segments to the directory (file:///path) or the s3 compatible store (s3://access:secret@host:port/bucket/prefix?region=xx&secure=true)")
+	flagSet.Duration("archive-after", opts.ArchiveAfter, "archive the topic segments not written for this duration")
 	flagSet.Bool("start-as-fix-mode", opts.StartAsFixMode, "enable data fix at start")
 	flagSet.Bool("allow-ext-compatible", opts.AllowExtCompatible, "allow pub ext to non-ext topic(ignore ext) .")
 	flagSet.Bool("allow-sub-ext-compatible", opts.AllowSubExtCompatible, "allow sub ext-topic without ext in message.")
+	flagSet.Int64("catchup-rate-limit", opts.CatchupRateLimit, "the max bytes per second for all the topics pulling data from leader while catching up, 0 means no limit")
+	flagSet.Int64("topic-catchup-rate-limit", opts.TopicCatchupRateLimit, "the max bytes per second for each topic partition pulling data from leader while catching up, 0 means no limit")
 
 	flagSet.Duration("queue-scan-interval", opts.QueueScanInterval, "scan interval")
 	flagSet.Duration("queue-scan-refresh-interval", opts.QueueScanRefreshInterval, "scan refresh interval for new channels")
@@ -271,5 +281,6 @@ func (p *program) Stop() error {
 	if p.nsqdServer != nil {
 		p.nsqdServer.Exit()
 	}
+	nsqd.StopMsgTracer()
 	return nil
 }
@@ -33,6 +33,8 @@ var (
 	reverseProxyPort   = flagSet.String("reverse-proxy-port", "", "<port> for reverse proxy")
 
 	clusterLeadershipAddresses = flagSet.String("cluster-leadership-addresses", "", " the cluster leadership server list")
+	clusterLeadershipType      = flagSet.String("cluster-leadership-type", "etcd", "the cluster leadership type, etcd or raft (embedded in nsqlookupd)")
+	dataPath                   = flagSet.String("data-path", "", "path to store the embedded raft leadership data")
 	clusterID                  = flagSet.String("cluster-id", "nsq-test-cluster", "the cluster id used for separating different nsq cluster.")
 
 	inactiveProducerTimeout  = flagSet.Duration("inactive-producer-timeout", 60*time.Second, "duration of time a producer will remain in the active list since its last ping")
@@ -41,6 +43,8 @@ var (
 	logLevel                 = flagSet.Int("log-level", 1, "log verbose level")
 	logDir                   = flagSet.String("log-dir", "", "directory for log file")
 	allowWriteWithNoChannels = flagSet.Bool("allow-write-with-nochannels", false, "allow write to topic with no channels")
+	primaryZone              = flagSet.String("primary-zone", "", "the topic leaders will prefer the nsqd nodes in this zone")
+	balanceDryRun            = flagSet.Bool("balance-dry-run", false, "only generate the balance plan, the plan should be applied by manual")
 	balanceInterval          = app.StringArray{}
 )
 
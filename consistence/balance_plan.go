@@ -0,0 +1,466 @@
+package consistence
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+const (
+	BalanceStepPending   = "pending"
+	BalanceStepRunning   = "running"
+	BalanceStepDone      = "done"
+	BalanceStepFailed    = "failed"
+	BalanceStepCancelled = "cancelled"
+
+	maxBalancePlanSteps = 50
+	// max time waiting the cluster stable before apply each step
+	balanceStepWaitStable = time.Minute
+)
+
+var (
+	ErrBalancePlanNotFound     = errors.New("no balance plan found")
+	ErrBalancePlanApplying     = errors.New("the balance plan is applying")
+	ErrBalancePlanChanged      = errors.New("the balance plan has been changed")
+	ErrBalancePlanStepNotFound = errors.New("the balance plan step is not found")
+)
+
+// a step in the balance plan will move the topic partition data from one node to another,
+// and it will be executed by moveTopicPartitionByManual.
+type BalancePlanStep struct {
+	ID         int    `json:"id"`
+	Topic      string `json:"topic"`
+	Partition  int    `json:"partition"`
+	MoveLeader bool   `json:"move_leader"`
+	FromNode   string `json:"from_node"`
+	ToNode     string `json:"to_node"`
+	Reason     string `json:"reason"`
+	// the estimated data need to be synced to the destination node
+	EstimatedBytes int64  `json:"estimated_bytes"`
+	State          string `json:"state"`
+	Err            string `json:"error,omitempty"`
+}
+
+type BalancePlan struct {
+	PlanID     int64             `json:"plan_id"`
+	CreateTime time.Time         `json:"create_time"`
+	Applying   bool              `json:"applying"`
+	Steps      []BalancePlanStep `json:"steps"`
+}
+
+func (self *BalancePlan) copy() *BalancePlan {
+	c := *self
+	c.Steps = make([]BalancePlanStep, len(self.Steps))
+	copy(c.Steps, self.Steps)
+	return &c
+}
+
+// balancePlanBuilder simulates the moves on the current topic stats to get the
+// full balance plan without changing anything in the cluster.
+type balancePlanBuilder struct {
+	dp           *DataPlacement
+	currentNodes map[string]NsqdNodeInfo
+	nodeStats    map[string]*NodeTopicStats
+	nodeLoads    map[string]float64
+	topicList    []*TopicPartitionMetaInfo
+	movedParts   map[string]struct{}
+	steps        []BalancePlanStep
+}
+
+func newBalancePlanBuilder(dp *DataPlacement) (*balancePlanBuilder, error) {
+	b := &balancePlanBuilder{
+		dp:           dp,
+		currentNodes: dp.lookupCoord.getCurrentNodes(),
+		nodeStats:    make(map[string]*NodeTopicStats),
+		nodeLoads:    make(map[string]float64),
+		movedParts:   make(map[string]struct{}),
+		steps:        make([]BalancePlanStep, 0),
+	}
+	for nodeID, nodeInfo := range b.currentNodes {
+		stat, err := dp.lookupCoord.getNsqdTopicStat(nodeInfo)
+		if err != nil {
+			coordLog.Infof("failed to get node topic status while generating balance plan: %v", nodeID)
+			return nil, err
+		}
+		b.nodeStats[nodeID] = stat
+		_, nodeLF := stat.GetNodeLoadFactor()
+		b.nodeLoads[nodeID] = nodeLF
+	}
+	topics, err := dp.lookupCoord.leadership.ScanTopics()
+	if err != nil {
+		coordLog.Infof("scan topics error: %v", err)
+		return nil, err
+	}
+	for i := range topics {
+		t := topics[i]
+		t.ISR = append([]string{}, t.ISR...)
+		t.CatchupList = append([]string{}, t.CatchupList...)
+		b.topicList = append(b.topicList, &t)
+	}
+	return b, nil
+}
+
+func (self *balancePlanBuilder) getTopicPartition(name string, partition int) *TopicPartitionMetaInfo {
+	for _, t := range self.topicList {
+		if t.Name == name && t.Partition == partition {
+			return t
+		}
+	}
+	return nil
+}
+
+// the node can not be used if any partition of the same topic is on it
+func (self *balancePlanBuilder) isExcluded(topicInfo *TopicPartitionMetaInfo, nodeID string) bool {
+	for _, t := range self.topicList {
+		if t.Name != topicInfo.Name {
+			continue
+		}
+		if t.Leader == nodeID || FindSlice(t.ISR, nodeID) != -1 || FindSlice(t.CatchupList, nodeID) != -1 {
+			return true
+		}
+	}
+	return false
+}
+
+// the partition which is not healthy or moved already in plan will be ignored
+func (self *balancePlanBuilder) isMovable(topicInfo *TopicPartitionMetaInfo) bool {
+	if topicInfo.OrderedMulti || len(topicInfo.ISR) < topicInfo.Replica {
+		return false
+	}
+	_, ok := self.movedParts[topicInfo.GetTopicDesp()]
+	return !ok
+}
+
+func (self *balancePlanBuilder) pickLeastLoadNode(topicInfo *TopicPartitionMetaInfo, newZoneOnly bool) string {
+	usedZones := getUsedZones(self.currentNodes, topicInfo.ISR, topicInfo.CatchupList)
+	chosen := ""
+	for nodeID, nodeInfo := range self.currentNodes {
+		if self.isExcluded(topicInfo, nodeID) {
+			continue
+		}
+		if newZoneOnly && isZoneUsed(usedZones, nodeInfo.Zone) {
+			continue
+		}
+		if chosen == "" || self.nodeLoads[nodeID] < self.nodeLoads[chosen] ||
+			(self.nodeLoads[nodeID] == self.nodeLoads[chosen] && nodeID < chosen) {
+			chosen = nodeID
+		}
+	}
+	return chosen
+}
+
+func (self *balancePlanBuilder) addStep(topicInfo *TopicPartitionMetaInfo, moveLeader bool,
+	fromNode string, toNode string, reason string) {
+	desp := topicInfo.GetTopicDesp()
+	step := BalancePlanStep{
+		ID:         len(self.steps) + 1,
+		Topic:      topicInfo.Name,
+		Partition:  topicInfo.Partition,
+		MoveLeader: moveLeader,
+		FromNode:   fromNode,
+		ToNode:     toNode,
+		Reason:     reason,
+		State:      BalanceStepPending,
+	}
+	fromStat := self.nodeStats[fromNode]
+	lf := 0.0
+	if FindSlice(topicInfo.ISR, toNode) != -1 {
+		// only the leader changed
+		if fromStat != nil {
+			lf = fromStat.GetTopicLeaderLoadFactor(desp)
+		}
+		topicInfo.Leader = toNode
+	} else {
+		if fromStat != nil {
+			lf = fromStat.GetTopicLoadFactor(desp)
+			step.EstimatedBytes = fromStat.TopicTotalDataSize[desp] * 1024 * 1024
+		}
+		topicInfo.ISR[FindSlice(topicInfo.ISR, fromNode)] = toNode
+		if topicInfo.Leader == fromNode {
+			topicInfo.Leader = toNode
+		}
+	}
+	self.nodeLoads[fromNode] -= lf
+	self.nodeLoads[toNode] += lf
+	self.movedParts[desp] = struct{}{}
+	self.steps = append(self.steps, step)
+	coordLog.Infof("balance plan step: %v", step)
+}
+
+func (self *balancePlanBuilder) planZoneSpread() {
+	for _, topicInfo := range self.topicList {
+		if !self.isMovable(topicInfo) {
+			continue
+		}
+		dupNodes := getDuplicatedZoneNodes(topicInfo, self.currentNodes)
+		if len(dupNodes) == 0 {
+			continue
+		}
+		toNode := self.pickLeastLoadNode(topicInfo, true)
+		if toNode == "" {
+			continue
+		}
+		self.addStep(topicInfo, false, dupNodes[0], toNode, "replicas in the same zone")
+	}
+}
+
+func (self *balancePlanBuilder) planPrimaryZoneLeader() {
+	primaryZone := self.dp.primaryZone
+	if primaryZone == "" {
+		return
+	}
+	for _, topicInfo := range self.topicList {
+		if !self.isMovable(topicInfo) || getNodeZone(self.currentNodes, topicInfo.Leader) == primaryZone {
+			continue
+		}
+		for _, nid := range topicInfo.ISR {
+			if getNodeZone(self.currentNodes, nid) == primaryZone {
+				self.addStep(topicInfo, true, topicInfo.Leader, nid, "leader not in primary zone")
+				break
+			}
+		}
+	}
+}
+
+// move the topic partition from the most busy node to the most idle node one by one
+// until the load of nodes is balanced.
+func (self *balancePlanBuilder) planLoadBalance() {
+	for len(self.steps) < maxBalancePlanSteps {
+		if len(self.nodeLoads) < 2 {
+			return
+		}
+		minNode, maxNode := "", ""
+		avgLoad := 0.0
+		for nodeID, load := range self.nodeLoads {
+			if minNode == "" || load < self.nodeLoads[minNode] {
+				minNode = nodeID
+			}
+			if maxNode == "" || load > self.nodeLoads[maxNode] {
+				maxNode = nodeID
+			}
+			avgLoad += load
+		}
+		avgLoad = avgLoad / float64(len(self.nodeLoads))
+		minLoad, maxLoad := self.nodeLoads[minNode], self.nodeLoads[maxNode]
+		if avgLoad < 5 && maxLoad < 10 {
+			// all nodes in the cluster are under low load, no need balance
+			return
+		}
+		if avgLoad*2 >= maxLoad && minLoad*4 >= avgLoad {
+			return
+		}
+		// try the most busy topic which will not make the destination busier than source.
+		stat := self.nodeStats[maxNode]
+		topicLFList := make(topicLFListT, 0, len(stat.TopicTotalDataSize))
+		for topicFullName := range stat.TopicTotalDataSize {
+			topicLFList = append(topicLFList, topicLoadFactorInfo{topicFullName, stat.GetTopicLoadFactor(topicFullName)})
+		}
+		sort.Sort(sort.Reverse(topicLFList))
+		moved := false
+		for _, t := range topicLFList {
+			if t.loadFactor*2 > maxLoad-minLoad {
+				continue
+			}
+			topicName, partitionID, err := splitTopicPartitionID(t.topic)
+			if err != nil {
+				continue
+			}
+			topicInfo := self.getTopicPartition(topicName, partitionID)
+			if topicInfo == nil || !self.isMovable(topicInfo) || FindSlice(topicInfo.ISR, maxNode) == -1 {
+				continue
+			}
+			if self.isExcluded(topicInfo, minNode) ||
+				!isZoneSpreadAfterMove(topicInfo.ISR, self.currentNodes, maxNode, minNode) {
+				continue
+			}
+			self.addStep(topicInfo, topicInfo.Leader == maxNode, maxNode, minNode, "node load unbalanced")
+			moved = true
+			break
+		}
+		if !moved {
+			return
+		}
+	}
+}
+
+func (self *DataPlacement) generateBalancePlan() (*BalancePlan, error) {
+	b, err := newBalancePlanBuilder(self)
+	if err != nil {
+		return nil, err
+	}
+	b.planZoneSpread()
+	b.planPrimaryZoneLeader()
+	b.planLoadBalance()
+	now := time.Now()
+	return &BalancePlan{
+		PlanID:     now.UnixNano(),
+		CreateTime: now,
+		Steps:      b.steps,
+	}, nil
+}
+
+// the steps are the same if all the moves are the same, the state of steps is ignored.
+func isSameBalanceSteps(a []BalancePlanStep, b []BalancePlanStep) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Topic != b[i].Topic || a[i].Partition != b[i].Partition ||
+			a[i].MoveLeader != b[i].MoveLeader || a[i].FromNode != b[i].FromNode ||
+			a[i].ToNode != b[i].ToNode {
+			return false
+		}
+	}
+	return true
+}
+
+// the current plan is kept if the new generated plan is not changed, so the plan id
+// will not change while the operator is checking the plan before applying.
+func (self *DataPlacement) updateBalancePlanNoLock(plan *BalancePlan) {
+	if self.balancePlan != nil && isSameBalanceSteps(self.balancePlan.Steps, plan.Steps) {
+		return
+	}
+	self.balancePlan = plan
+}
+
+// get the current balance plan, the plan will be generated if no plan or refresh is needed.
+func (self *DataPlacement) getBalancePlan(refresh bool) (*BalancePlan, error) {
+	self.planMutex.Lock()
+	defer self.planMutex.Unlock()
+	if self.balancePlan != nil && self.balancePlan.Applying {
+		if refresh {
+			return nil, ErrBalancePlanApplying
+		}
+		return self.balancePlan.copy(), nil
+	}
+	if self.balancePlan == nil || refresh {
+		plan, err := self.generateBalancePlan()
+		if err != nil {
+			return nil, err
+		}
+		self.updateBalancePlanNoLock(plan)
+	}
+	return self.balancePlan.copy(), nil
+}
+
+// apply the given steps of the plan, all the steps not done will be applied if no step is given.
+func (self *DataPlacement) applyBalancePlan(planID int64, stepIDs []int) error {
+	self.planMutex.Lock()
+	defer self.planMutex.Unlock()
+	plan := self.balancePlan
+	if plan == nil {
+		return ErrBalancePlanNotFound
+	}
+	if plan.PlanID != planID {
+		return ErrBalancePlanChanged
+	}
+	if plan.Applying {
+		return ErrBalancePlanApplying
+	}
+	stepIndexes := make([]int, 0, len(plan.Steps))
+	if len(stepIDs) == 0 {
+		for i, step := range plan.Steps {
+			if step.State != BalanceStepDone {
+				stepIndexes = append(stepIndexes, i)
+			}
+		}
+	} else {
+		for _, id := range stepIDs {
+			if id <= 0 || id > len(plan.Steps) {
+				return ErrBalancePlanStepNotFound
+			}
+			if plan.Steps[id-1].State != BalanceStepDone {
+				stepIndexes = append(stepIndexes, id-1)
+			}
+		}
+	}
+	for _, i := range stepIndexes {
+		plan.Steps[i].State = BalanceStepPending
+		plan.Steps[i].Err = ""
+	}
+	plan.Applying = true
+	self.planQuitChan = make(chan struct{})
+	go self.doApplyBalancePlan(plan, stepIndexes, self.planQuitChan)
+	return nil
+}
+
+func (self *DataPlacement) cancelBalancePlan() {
+	self.planMutex.Lock()
+	defer self.planMutex.Unlock()
+	if self.balancePlan == nil || !self.balancePlan.Applying {
+		return
+	}
+	select {
+	case <-self.planQuitChan:
+	default:
+		close(self.planQuitChan)
+	}
+}
+
+func (self *DataPlacement) doApplyBalancePlan(plan *BalancePlan, stepIndexes []int, quitChan chan struct{}) {
+	updateStep := func(i int, state string, err error) {
+		self.planMutex.Lock()
+		plan.Steps[i].State = state
+		if err != nil {
+			plan.Steps[i].Err = err.Error()
+		}
+		self.planMutex.Unlock()
+	}
+	defer func() {
+		self.planMutex.Lock()
+		for _, i := range stepIndexes {
+			if plan.Steps[i].State == BalanceStepPending {
+				plan.Steps[i].State = BalanceStepCancelled
+			}
+		}
+		plan.Applying = false
+		self.planMutex.Unlock()
+		coordLog.Infof("balance plan %v apply done", plan.PlanID)
+	}()
+	for _, i := range stepIndexes {
+		// wait the cluster stable since the previous step may cause the isr changing
+		waitStart := time.Now()
+		for !self.lookupCoord.IsClusterStable() && time.Since(waitStart) < balanceStepWaitStable {
+			select {
+			case <-quitChan:
+				return
+			case <-self.lookupCoord.stopChan:
+				return
+			case <-time.After(time.Second):
+			}
+		}
+		select {
+		case <-quitChan:
+			return
+		case <-self.lookupCoord.stopChan:
+			return
+		default:
+		}
+		if !self.lookupCoord.IsMineLeader() {
+			coordLog.Infof("not leader while applying balance plan")
+			return
+		}
+		updateStep(i, BalanceStepRunning, nil)
+		self.planMutex.Lock()
+		step := plan.Steps[i]
+		self.planMutex.Unlock()
+		coordLog.Infof("applying balance plan %v step: %v", plan.PlanID, step)
+		err := self.moveTopicPartitionByManual(step.Topic, step.Partition, step.MoveLeader,
+			step.FromNode, step.ToNode)
+		if err != nil {
+			coordLog.Infof("apply balance plan step %v failed: %v", step.ID, err)
+			updateStep(i, BalanceStepFailed, err)
+		} else {
+			updateStep(i, BalanceStepDone, nil)
+		}
+	}
+}
+
+// in dry run mode the balance will only generate the plan if no plan, the plan
+// can be regenerated by the operator using the refresh api.
+func (self *DataPlacement) checkBalancePlan() {
+	_, err := self.getBalancePlan(false)
+	if err != nil {
+		coordLog.Infof("generate balance plan failed: %v", err)
+	}
+}
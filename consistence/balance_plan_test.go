@@ -0,0 +1,107 @@
+package consistence
+
+import (
+	"testing"
+
+	"github.com/youzan/nsq/internal/test"
+)
+
+func TestBalancePlanBuilder(t *testing.T) {
+	currentNodes := map[string]NsqdNodeInfo{
+		"n1": {ID: "n1", Zone: "z1"},
+		"n2": {ID: "n2", Zone: "z1"},
+		"n3": {ID: "n3", Zone: "z2"},
+		"n4": {ID: "n4", Zone: "z3"},
+	}
+	b := &balancePlanBuilder{
+		dp:           &DataPlacement{primaryZone: "z2"},
+		currentNodes: currentNodes,
+		nodeStats:    make(map[string]*NodeTopicStats),
+		nodeLoads:    map[string]float64{"n1": 80, "n2": 12, "n3": 11, "n4": 10},
+		movedParts:   make(map[string]struct{}),
+	}
+	for nid := range currentNodes {
+		b.nodeStats[nid] = NewNodeTopicStats(nid, 1, 1)
+	}
+	b.nodeStats["n1"].TopicTotalDataSize["t3-0"] = 10
+	b.nodeStats["n1"].TopicLeaderDataSize["t3-0"] = 10
+	b.topicList = []*TopicPartitionMetaInfo{
+		{Name: "t1", Partition: 0},
+		{Name: "t2", Partition: 0},
+		{Name: "t3", Partition: 0},
+	}
+	b.topicList[0].Replica = 2
+	b.topicList[0].Leader = "n1"
+	b.topicList[0].ISR = []string{"n1", "n2"}
+	b.topicList[1].Replica = 2
+	b.topicList[1].Leader = "n4"
+	b.topicList[1].ISR = []string{"n4", "n3"}
+	b.topicList[2].Replica = 1
+	b.topicList[2].Leader = "n1"
+	b.topicList[2].ISR = []string{"n1"}
+
+	b.planZoneSpread()
+	b.planPrimaryZoneLeader()
+	b.planLoadBalance()
+	test.Equal(t, 3, len(b.steps))
+	// move the replica in the same zone to the idle node in new zone
+	test.Equal(t, "t1", b.steps[0].Topic)
+	test.Equal(t, false, b.steps[0].MoveLeader)
+	test.Equal(t, "n2", b.steps[0].FromNode)
+	test.Equal(t, "n4", b.steps[0].ToNode)
+	test.Equal(t, []string{"n1", "n4"}, b.topicList[0].ISR)
+	// move the leader to the primary zone, no data need to be synced
+	test.Equal(t, "t2", b.steps[1].Topic)
+	test.Equal(t, true, b.steps[1].MoveLeader)
+	test.Equal(t, "n4", b.steps[1].FromNode)
+	test.Equal(t, "n3", b.steps[1].ToNode)
+	test.Equal(t, int64(0), b.steps[1].EstimatedBytes)
+	// move the topic from the most busy node to the most idle node
+	test.Equal(t, "t3", b.steps[2].Topic)
+	test.Equal(t, true, b.steps[2].MoveLeader)
+	test.Equal(t, "n1", b.steps[2].FromNode)
+	test.Equal(t, "n4", b.steps[2].ToNode)
+	test.Equal(t, int64(10*1024*1024), b.steps[2].EstimatedBytes)
+	for i, s := range b.steps {
+		test.Equal(t, i+1, s.ID)
+		test.Equal(t, BalanceStepPending, s.State)
+	}
+}
+
+func TestBalancePlanApplyCheck(t *testing.T) {
+	dp := &DataPlacement{}
+	err := dp.applyBalancePlan(1, nil)
+	test.Equal(t, ErrBalancePlanNotFound, err)
+	dp.balancePlan = &BalancePlan{
+		PlanID: 1,
+		Steps:  []BalancePlanStep{{ID: 1, State: BalanceStepPending}},
+	}
+	err = dp.applyBalancePlan(2, nil)
+	test.Equal(t, ErrBalancePlanChanged, err)
+	err = dp.applyBalancePlan(1, []int{2})
+	test.Equal(t, ErrBalancePlanStepNotFound, err)
+	dp.balancePlan.Applying = true
+	err = dp.applyBalancePlan(1, []int{1})
+	test.Equal(t, ErrBalancePlanApplying, err)
+	_, err = dp.getBalancePlan(true)
+	test.Equal(t, ErrBalancePlanApplying, err)
+	plan, err := dp.getBalancePlan(false)
+	test.Nil(t, err)
+	test.Equal(t, int64(1), plan.PlanID)
+}
+
+func TestBalancePlanUpdateKeepID(t *testing.T) {
+	dp := &DataPlacement{}
+	steps := []BalancePlanStep{{ID: 1, Topic: "t1", FromNode: "n1", ToNode: "n2", State: BalanceStepPending}}
+	dp.updateBalancePlanNoLock(&BalancePlan{PlanID: 1, Steps: steps})
+	test.Equal(t, int64(1), dp.balancePlan.PlanID)
+	// the plan id should not change if the steps are the same
+	sameSteps := []BalancePlanStep{{ID: 1, Topic: "t1", FromNode: "n1", ToNode: "n2", State: BalanceStepPending}}
+	dp.updateBalancePlanNoLock(&BalancePlan{PlanID: 2, Steps: sameSteps})
+	test.Equal(t, int64(1), dp.balancePlan.PlanID)
+	newSteps := []BalancePlanStep{{ID: 1, Topic: "t1", FromNode: "n1", ToNode: "n3", State: BalanceStepPending}}
+	dp.updateBalancePlanNoLock(&BalancePlan{PlanID: 3, Steps: newSteps})
+	test.Equal(t, int64(3), dp.balancePlan.PlanID)
+	dp.updateBalancePlanNoLock(&BalancePlan{PlanID: 4})
+	test.Equal(t, int64(4), dp.balancePlan.PlanID)
+}
@@ -270,6 +270,7 @@ type TopicCommitLogMgr struct {
 	currentStart  int64
 	currentCount  int32
 	logStartInfo  LogStartInfo
+	dedup         *producerDedupWindow
 	sync.Mutex
 }
 
@@ -295,6 +296,7 @@ func InitTopicCommitLogMgr(t string, p int, basepath string, commitBufSize int)
 		bufSize:       commitBufSize,
 		committedLogs: make([]CommitLogData, 0, commitBufSize),
 		buffer:        make([]byte, 0, (commitBufSize+1)*GetLogDataSize()),
+		dedup:         newProducerDedupWindow(fullpath + ".dedup"),
 	}
 	// load check point index. read sizeof(CommitLogData) until EOF.
 	var err error
@@ -314,6 +316,11 @@ func InitTopicCommitLogMgr(t string, p int, basepath string, commitBufSize int)
 	if err != nil {
 		return nil, err
 	}
+	err = mgr.dedup.load()
+	if err != nil {
+		// the dedup window is not critical, just start with empty
+		coordLog.Warningf("load commit log dedup file %v error: %v", mgr.dedupFileName(), err)
+	}
 	//load meta
 	f, err := mgr.appender.Stat()
 	if err != nil {
@@ -370,6 +377,9 @@ func InitTopicCommitLogMgr(t string, p int, basepath string, commitBufSize int)
 			mgr.nLogID = l.LastMsgLogID + 1
 		}
 	}
+	// the buffered commit logs may be lost while crash, and the dedup records
+	// for them should be removed.
+	mgr.dedup.truncateAfter(mgr.nLogID - 1)
 	coordLog.Infof("%v commit log init with log start: %v, current: %v:%v, pid: %v", mgr.path,
 		mgr.logStartInfo, mgr.currentStart, mgr.currentCount, mgr.pLogID)
 	return mgr, nil
@@ -395,6 +405,7 @@ func (self *TopicCommitLogMgr) MoveTo(newBase string) error {
 		coordLog.Infof("rename the topic %v commit log current failed:%v", self.topic, err)
 	}
 	util.AtomicRename(self.path+".start", newPath+".start")
+	self.dedup.moveTo(newPath + ".dedup")
 	return nil
 }
 
@@ -497,6 +508,7 @@ func (self *TopicCommitLogMgr) ResetLogWithStart(newStart LogStartInfo) error {
 	}
 	os.Remove(self.path + ".current")
 	os.Remove(self.path + ".start")
+	self.dedup.reset()
 	self.logStartInfo = newStart
 	self.logStartInfo.SegmentStartOffset = 0
 	atomic.StoreInt64(&self.pLogID, 0)
@@ -547,6 +559,7 @@ func (self *TopicCommitLogMgr) Delete() {
 	}
 	os.Remove(self.path + ".current")
 	os.Remove(self.path + ".start")
+	self.dedup.remove()
 	self.Unlock()
 }
 
@@ -557,6 +570,7 @@ func (self *TopicCommitLogMgr) Close() {
 	self.appender.Close()
 	self.saveCurrentStart()
 	self.saveLogSegStartInfo()
+	self.dedup.close()
 	self.Unlock()
 }
 
@@ -577,6 +591,10 @@ func (self *TopicCommitLogMgr) Reopen() error {
 	if err != nil {
 		coordLog.Infof("open topic commit log error: %v", err)
 	}
+	err = self.dedup.load()
+	if err != nil {
+		coordLog.Infof("open topic commit log dedup error: %v", err)
+	}
 	//load meta
 	f, err := self.appender.Stat()
 	if err != nil {
@@ -633,6 +651,7 @@ func (self *TopicCommitLogMgr) Reopen() error {
 			self.nLogID = l.LastMsgLogID + 1
 		}
 	}
+	self.dedup.truncateAfter(self.nLogID - 1)
 	return nil
 
 }
@@ -813,6 +832,7 @@ func (self *TopicCommitLogMgr) truncateToOffset(startOffset int64, offset int64)
 		if err == ErrCommitLogEOF {
 			if self.currentStart <= self.logStartInfo.SegmentStartIndex {
 				atomic.StoreInt64(&self.pLogID, 0)
+				self.dedup.reset()
 				return nil, err
 			} else {
 				l, _, err = getLastCommitLogData(self.path, self.currentStart-1)
@@ -826,6 +846,7 @@ func (self *TopicCommitLogMgr) truncateToOffset(startOffset int64, offset int64)
 		}
 	}
 	atomic.StoreInt64(&self.pLogID, l.LogID)
+	self.dedup.truncateAfter(l.LastMsgLogID)
 	if l.LastMsgLogID+1 > atomic.LoadInt64(&self.nLogID) {
 		atomic.StoreInt64(&self.nLogID, l.LastMsgLogID+1)
 	}
@@ -1111,6 +1132,7 @@ func (self *TopicCommitLogMgr) flushCommitLogsNoLock() {
 func (self *TopicCommitLogMgr) FlushCommitLogs() {
 	self.Lock()
 	self.flushCommitLogsNoLock()
+	self.dedup.save()
 	self.Unlock()
 }
 
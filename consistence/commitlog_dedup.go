@@ -0,0 +1,393 @@
+package consistence
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/youzan/nsq/internal/util"
+	"github.com/youzan/nsq/nsqd"
+)
+
+var (
+	// the max producers kept in the dedup window of each partition, the least
+	// recently updated producer will be evicted if exceeded.
+	MAX_DEDUP_PRODUCERS = 1024
+	// the max sequences kept for each producer
+	MAX_DEDUP_SEQS_PER_PRODUCER = 128
+)
+
+// ProducerSeqRecord is the written message for the producer sequence, the
+// duplicated pub will return the message in the record.
+type ProducerSeqRecord struct {
+	Seq       uint64 `json:"seq"`
+	MsgID     int64  `json:"msg_id"`
+	MsgOffset int64  `json:"msg_offset"`
+	MsgSize   int32  `json:"msg_size"`
+}
+
+type producerSeqs struct {
+	LastUpdated int64               `json:"last_updated"`
+	Seqs        []ProducerSeqRecord `json:"seqs"`
+}
+
+type dedupLogEntry struct {
+	Producer string            `json:"producer"`
+	Record   ProducerSeqRecord `json:"record"`
+}
+
+// producerDedupWindow keeps the latest written sequences for each producer,
+// it is persisted alongside the commit log and updated both on leader and
+// replicas, so the new leader can still detect the duplicated retry from the
+// producer after the leader failover.
+// Each record is appended to the dedup log while the message is committed,
+// and the log is compacted into the snapshot file while flushing the commit
+// log. While loading, the log will be replayed after the snapshot.
+type producerDedupWindow struct {
+	sync.Mutex
+	Producers map[string]*producerSeqs
+	dirty     bool
+	fileName  string
+	appender  *os.File
+}
+
+func newProducerDedupWindow(fileName string) *producerDedupWindow {
+	return &producerDedupWindow{
+		Producers: make(map[string]*producerSeqs),
+		fileName:  fileName,
+	}
+}
+
+func (w *producerDedupWindow) logFileName() string {
+	return w.fileName + ".log"
+}
+
+func (w *producerDedupWindow) get(producer string, seq uint64) (ProducerSeqRecord, bool) {
+	w.Lock()
+	defer w.Unlock()
+	return w.getNoLock(producer, seq)
+}
+
+func (w *producerDedupWindow) getNoLock(producer string, seq uint64) (ProducerSeqRecord, bool) {
+	ps, ok := w.Producers[producer]
+	if !ok {
+		return ProducerSeqRecord{}, false
+	}
+	for i := len(ps.Seqs) - 1; i >= 0; i-- {
+		if ps.Seqs[i].Seq == seq {
+			return ps.Seqs[i], true
+		}
+	}
+	return ProducerSeqRecord{}, false
+}
+
+func (w *producerDedupWindow) put(producer string, r ProducerSeqRecord) {
+	w.Lock()
+	defer w.Unlock()
+	w.putNoLock(producer, r)
+	w.appendLogNoLock(producer, r)
+}
+
+func (w *producerDedupWindow) putNoLock(producer string, r ProducerSeqRecord) {
+	ps, ok := w.Producers[producer]
+	if !ok {
+		if len(w.Producers) >= MAX_DEDUP_PRODUCERS {
+			w.evictOldestNoLock()
+		}
+		ps = &producerSeqs{}
+		w.Producers[producer] = ps
+	}
+	ps.LastUpdated = time.Now().Unix()
+	ps.Seqs = append(ps.Seqs, r)
+	if len(ps.Seqs) > MAX_DEDUP_SEQS_PER_PRODUCER {
+		ps.Seqs = append(ps.Seqs[:0], ps.Seqs[len(ps.Seqs)-MAX_DEDUP_SEQS_PER_PRODUCER:]...)
+	}
+	w.dirty = true
+}
+
+func (w *producerDedupWindow) appendLogNoLock(producer string, r ProducerSeqRecord) {
+	if w.appender == nil {
+		var err error
+		w.appender, err = os.OpenFile(w.logFileName(), os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			coordLog.Errorf("open commit log dedup log %v error: %v", w.logFileName(), err)
+			w.appender = nil
+			return
+		}
+	}
+	data, _ := json.Marshal(dedupLogEntry{Producer: producer, Record: r})
+	data = append(data, '\n')
+	_, err := w.appender.Write(data)
+	if err != nil {
+		coordLog.Errorf("write commit log dedup log %v error: %v", w.logFileName(), err)
+	}
+}
+
+func (w *producerDedupWindow) evictOldestNoLock() {
+	oldest := ""
+	oldestTs := int64(0)
+	for k, ps := range w.Producers {
+		if oldest == "" || ps.LastUpdated < oldestTs {
+			oldest = k
+			oldestTs = ps.LastUpdated
+		}
+	}
+	delete(w.Producers, oldest)
+}
+
+// remove the records written after the log id since the commit log is
+// truncated, the snapshot is saved at once so the log will not bring them
+// back.
+func (w *producerDedupWindow) truncateAfter(logID int64) {
+	w.Lock()
+	defer w.Unlock()
+	changed := false
+	for k, ps := range w.Producers {
+		kept := ps.Seqs[:0]
+		for _, r := range ps.Seqs {
+			if r.MsgID <= logID {
+				kept = append(kept, r)
+			}
+		}
+		if len(kept) == len(ps.Seqs) {
+			continue
+		}
+		ps.Seqs = kept
+		if len(kept) == 0 {
+			delete(w.Producers, k)
+		}
+		changed = true
+	}
+	if changed {
+		w.dirty = true
+		w.saveNoLock()
+	}
+}
+
+func (w *producerDedupWindow) reset() {
+	w.Lock()
+	w.Producers = make(map[string]*producerSeqs)
+	w.dirty = true
+	w.saveNoLock()
+	w.Unlock()
+}
+
+func (w *producerDedupWindow) load() error {
+	w.Lock()
+	defer w.Unlock()
+	if w.appender != nil {
+		w.appender.Close()
+		w.appender = nil
+	}
+	producers := make(map[string]*producerSeqs)
+	data, err := ioutil.ReadFile(w.fileName)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &producers)
+		if err != nil {
+			return err
+		}
+	}
+	w.Producers = producers
+	w.dirty = false
+	data, err = ioutil.ReadFile(w.logFileName())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var e dedupLogEntry
+		// the last line may be partial written while crash
+		if json.Unmarshal(line, &e) != nil {
+			break
+		}
+		// the log may be replayed twice if crashed before the log compacted
+		if _, ok := w.getNoLock(e.Producer, e.Record.Seq); ok {
+			continue
+		}
+		w.putNoLock(e.Producer, e.Record)
+	}
+	return nil
+}
+
+func (w *producerDedupWindow) save() error {
+	w.Lock()
+	defer w.Unlock()
+	return w.saveNoLock()
+}
+
+// save the snapshot and compact the log
+func (w *producerDedupWindow) saveNoLock() error {
+	if !w.dirty {
+		return nil
+	}
+	data, err := json.Marshal(w.Producers)
+	if err != nil {
+		return err
+	}
+	tmpFileName := w.fileName + ".tmp"
+	file, err := os.OpenFile(tmpFileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err == nil {
+		_, err = file.Write(data)
+		if err == nil {
+			err = file.Sync()
+		}
+		file.Close()
+		if err == nil {
+			err = util.AtomicRename(tmpFileName, w.fileName)
+		}
+	}
+	if err != nil {
+		// save again next time
+		coordLog.Errorf("save commit log dedup file %v error: %v", w.fileName, err)
+		return err
+	}
+	w.dirty = false
+	if w.appender != nil {
+		err = w.appender.Truncate(0)
+	} else {
+		err = os.Truncate(w.logFileName(), 0)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err != nil {
+		coordLog.Errorf("truncate commit log dedup log %v error: %v", w.logFileName(), err)
+	}
+	return nil
+}
+
+func (w *producerDedupWindow) close() {
+	w.Lock()
+	defer w.Unlock()
+	w.saveNoLock()
+	if w.appender != nil {
+		w.appender.Close()
+		w.appender = nil
+	}
+}
+
+func (w *producerDedupWindow) moveTo(newFileName string) {
+	w.Lock()
+	defer w.Unlock()
+	w.dirty = true
+	w.saveNoLock()
+	if w.appender != nil {
+		w.appender.Close()
+		w.appender = nil
+	}
+	util.AtomicRename(w.fileName, newFileName)
+	os.Remove(w.logFileName())
+	w.fileName = newFileName
+}
+
+func (w *producerDedupWindow) remove() {
+	w.Lock()
+	defer w.Unlock()
+	if w.appender != nil {
+		w.appender.Close()
+		w.appender = nil
+	}
+	os.Remove(w.fileName)
+	os.Remove(w.logFileName())
+}
+
+func (self *TopicCommitLogMgr) dedupFileName() string {
+	return self.path + ".dedup"
+}
+
+// GetProducerSeq returns the written message for the producer sequence if
+// it is still in the dedup window.
+func (self *TopicCommitLogMgr) GetProducerSeq(producer string, seq uint64) (ProducerSeqRecord, bool) {
+	return self.dedup.get(producer, seq)
+}
+
+// RecordProducerSeq should be called after the message committed, the record
+// will be persisted to the dedup log at once.
+func (self *TopicCommitLogMgr) RecordProducerSeq(producer string, r ProducerSeqRecord) {
+	self.dedup.put(producer, r)
+}
+
+// record the producer sequences of the committed messages, the offset and
+// the size on disk of each message should be set.
+func (self *TopicCommitLogMgr) recordProducerSeqs(msgs []*nsqd.Message) {
+	for _, m := range msgs {
+		producerID, seq, ok := m.GetProducerSeq()
+		if !ok {
+			continue
+		}
+		self.RecordProducerSeq(producerID, ProducerSeqRecord{
+			Seq:       seq,
+			MsgID:     int64(m.ID),
+			MsgOffset: int64(m.Offset),
+			MsgSize:   int32(m.RawMoveSize),
+		})
+	}
+}
+
+// record the producer sequences of the committed raw data, only the ext
+// topic has the producer sequence.
+func (self *TopicCommitLogMgr) recordRawProducerSeqs(topic *nsqd.Topic, rawData []byte, l *CommitLogData) {
+	if !topic.IsExt() {
+		return
+	}
+	msgs, err := nsqd.DecodeRawMessages(rawData, true, nsqd.BackendOffset(l.MsgOffset))
+	if err != nil {
+		coordLog.Warningf("topic %v failed to decode raw data for dedup at %v: %v",
+			topic.GetFullName(), l, err)
+	}
+	self.recordProducerSeqs(msgs)
+}
+
+// remove the messages which have been written or repeated in the batch,
+// return the first duplicated record if all the messages are duplicated.
+func (self *TopicCommitLogMgr) filterDupProducerSeqs(topicName string, msgs []*nsqd.Message) ([]*nsqd.Message, ProducerSeqRecord, bool) {
+	var firstDup ProducerSeqRecord
+	var batchSeqs map[string]map[uint64]bool
+	hasDup := false
+	newMsgs := msgs[:0:0]
+	for i, m := range msgs {
+		producerID, seq, ok := m.GetProducerSeq()
+		if ok {
+			r, written := self.GetProducerSeq(producerID, seq)
+			if !written && batchSeqs[producerID][seq] {
+				written = true
+			}
+			if written {
+				coordLog.Infof("topic %v duplicated pub from producer %v seq %v, written message: %v",
+					topicName, producerID, seq, r)
+				if !hasDup {
+					// copy the messages before the first duplicated
+					newMsgs = append(newMsgs, msgs[:i]...)
+					firstDup = r
+					hasDup = true
+				}
+				continue
+			}
+			if batchSeqs == nil {
+				batchSeqs = make(map[string]map[uint64]bool)
+			}
+			if batchSeqs[producerID] == nil {
+				batchSeqs[producerID] = make(map[uint64]bool)
+			}
+			batchSeqs[producerID][seq] = true
+		}
+		if hasDup {
+			newMsgs = append(newMsgs, m)
+		}
+	}
+	if !hasDup {
+		return msgs, firstDup, false
+	}
+	return newMsgs, firstDup, len(newMsgs) == 0
+}
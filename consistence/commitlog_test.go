@@ -2,11 +2,14 @@ package consistence
 
 import (
 	"fmt"
+	"github.com/youzan/nsq/internal/ext"
 	"github.com/youzan/nsq/internal/levellogger"
 	"github.com/youzan/nsq/internal/test"
+	"github.com/youzan/nsq/nsqd"
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"path"
 	"strconv"
 	"testing"
 	"time"
@@ -1544,3 +1547,139 @@ func TestCommitLogMoveToAndDelete(t *testing.T) {
 	test.Nil(t, err)
 
 }
+
+func TestCommitLogProducerDedup(t *testing.T) {
+	oldSeqs := MAX_DEDUP_SEQS_PER_PRODUCER
+	oldProducers := MAX_DEDUP_PRODUCERS
+	MAX_DEDUP_SEQS_PER_PRODUCER = 10
+	MAX_DEDUP_PRODUCERS = 2
+	defer func() {
+		MAX_DEDUP_SEQS_PER_PRODUCER = oldSeqs
+		MAX_DEDUP_PRODUCERS = oldProducers
+	}()
+	logName := "test_log_dedup" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	coordLog.Logger = newTestLogger(t)
+	logMgr, err := InitTopicCommitLogMgr(logName, 0, tmpDir, 4)
+	test.Nil(t, err)
+
+	num := 20
+	msgRawSize := 10
+	var logs []CommitLogData
+	for i := 0; i < num; i++ {
+		var logData CommitLogData
+		logData.LogID = int64(logMgr.NextID())
+		logData.LastMsgLogID = logData.LogID
+		logData.Epoch = 1
+		logData.MsgOffset = int64(i * msgRawSize)
+		logData.MsgSize = int32(msgRawSize)
+		logData.MsgCnt = int64(i + 1)
+		logData.MsgNum = 1
+		err = logMgr.AppendCommitLog(&logData, false)
+		test.Nil(t, err)
+		logMgr.RecordProducerSeq("p1", ProducerSeqRecord{
+			Seq:       uint64(i),
+			MsgID:     logData.LogID,
+			MsgOffset: logData.MsgOffset,
+			MsgSize:   logData.MsgSize,
+		})
+		logs = append(logs, logData)
+	}
+	// only the latest sequences are kept
+	_, ok := logMgr.GetProducerSeq("p1", 0)
+	test.Equal(t, false, ok)
+	r, ok := logMgr.GetProducerSeq("p1", uint64(num-1))
+	test.Equal(t, true, ok)
+	test.Equal(t, logs[num-1].LogID, r.MsgID)
+	test.Equal(t, logs[num-1].MsgOffset, r.MsgOffset)
+	_, ok = logMgr.GetProducerSeq("p2", uint64(num-1))
+	test.Equal(t, false, ok)
+
+	// should be reloaded after reopen
+	logMgr.Close()
+	logMgr, err = InitTopicCommitLogMgr(logName, 0, tmpDir, 4)
+	test.Nil(t, err)
+	r, ok = logMgr.GetProducerSeq("p1", uint64(num-2))
+	test.Equal(t, true, ok)
+	test.Equal(t, logs[num-2].LogID, r.MsgID)
+
+	// should be persisted at once without flush or close
+	logMgr.RecordProducerSeq("p1", ProducerSeqRecord{Seq: uint64(num), MsgID: logs[num-1].LogID})
+	crashedLogMgr, err := InitTopicCommitLogMgr(logName, 0, tmpDir, 4)
+	test.Nil(t, err)
+	r, ok = crashedLogMgr.GetProducerSeq("p1", uint64(num))
+	test.Equal(t, true, ok)
+	test.Equal(t, logs[num-1].LogID, r.MsgID)
+	_, ok = crashedLogMgr.GetProducerSeq("p1", uint64(num-2))
+	test.Equal(t, true, ok)
+
+	// the truncated messages should be removed from the window
+	_, err = logMgr.TruncateToOffsetV2(0, int64((num-1)*GetLogDataSize()))
+	test.Nil(t, err)
+	_, ok = logMgr.GetProducerSeq("p1", uint64(num-1))
+	test.Equal(t, false, ok)
+	_, ok = logMgr.GetProducerSeq("p1", uint64(num-2))
+	test.Equal(t, true, ok)
+
+	// the least recently updated producer will be evicted
+	logMgr.RecordProducerSeq("p2", ProducerSeqRecord{Seq: 1, MsgID: logs[0].LogID})
+	time.Sleep(time.Second)
+	logMgr.RecordProducerSeq("p2", ProducerSeqRecord{Seq: 2, MsgID: logs[0].LogID})
+	logMgr.RecordProducerSeq("p3", ProducerSeqRecord{Seq: 1, MsgID: logs[0].LogID})
+	_, ok = logMgr.GetProducerSeq("p1", uint64(num-2))
+	test.Equal(t, false, ok)
+	_, ok = logMgr.GetProducerSeq("p2", 1)
+	test.Equal(t, true, ok)
+	_, ok = logMgr.GetProducerSeq("p3", 1)
+	test.Equal(t, true, ok)
+
+	// should move with the commit log
+	newDir := path.Join(tmpDir, "moved")
+	os.MkdirAll(newDir, 0755)
+	logMgr.MoveTo(newDir)
+	logMgr, err = InitTopicCommitLogMgr(logName, 0, newDir, 4)
+	test.Nil(t, err)
+	_, ok = logMgr.GetProducerSeq("p3", 1)
+	test.Equal(t, true, ok)
+	logMgr.Delete()
+	_, err = os.Stat(logMgr.dedupFileName())
+	test.Equal(t, true, os.IsNotExist(err))
+}
+
+func TestCommitLogFilterDupProducerSeqs(t *testing.T) {
+	logName := "test_log_dedup_filter" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	coordLog.Logger = newTestLogger(t)
+	logMgr, err := InitTopicCommitLogMgr(logName, 0, tmpDir, 4)
+	test.Nil(t, err)
+	defer logMgr.Close()
+
+	newMsg := func(seq int) *nsqd.Message {
+		header := `{"##producer_id":"p1","##producer_seq":"` + strconv.Itoa(seq) + `"}`
+		return nsqd.NewMessageWithExt(0, []byte(strconv.Itoa(seq)), ext.JSON_HEADER_EXT_VER, []byte(header))
+	}
+	logMgr.RecordProducerSeq("p1", ProducerSeqRecord{Seq: 1, MsgID: 10, MsgOffset: 100, MsgSize: 20})
+	noSeqMsg := nsqd.NewMessageWithExt(0, []byte("noseq"), ext.JSON_HEADER_EXT_VER, []byte(`{"k":"v"}`))
+	msgs := []*nsqd.Message{newMsg(0), newMsg(1), noSeqMsg, newMsg(2), newMsg(2)}
+	left, dup, allDup := logMgr.filterDupProducerSeqs("test", msgs)
+	test.Equal(t, false, allDup)
+	test.Equal(t, int64(10), dup.MsgID)
+	test.Equal(t, []*nsqd.Message{msgs[0], msgs[2], msgs[3]}, left)
+
+	msgs = []*nsqd.Message{newMsg(3), noSeqMsg}
+	left, _, allDup = logMgr.filterDupProducerSeqs("test", msgs)
+	test.Equal(t, false, allDup)
+	test.Equal(t, msgs, left)
+
+	left, dup, allDup = logMgr.filterDupProducerSeqs("test", []*nsqd.Message{newMsg(1)})
+	test.Equal(t, true, allDup)
+	test.Equal(t, 0, len(left))
+	test.Equal(t, int64(100), dup.MsgOffset)
+	test.Equal(t, int32(20), dup.MsgSize)
+}
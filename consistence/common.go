@@ -183,6 +183,7 @@ var (
 	ErrLocalForwardThanLeader              = NewCoordErr("local data is more than leader", CoordElectionErr)
 	ErrLocalSetChannelOffsetNotFirstClient = NewCoordErr("failed to set channel offset since not first client", CoordLocalErr)
 	ErrLocalMissingTopic                   = NewCoordErr("local topic missing", CoordLocalErr)
+	ErrLocalMissingChannel                 = NewCoordErr("local channel missing", CoordLocalErr)
 	ErrLocalNotReadyForWrite               = NewCoordErr("local topic is not ready for write.", CoordLocalErr)
 	ErrLocalInitTopicFailed                = NewCoordErr("local topic init failed", CoordLocalErr)
 	ErrLocalInitTopicCoordFailed           = NewCoordErr("topic coordinator init failed", CoordLocalErr)
@@ -534,6 +534,72 @@ func (self *NsqdCoordRpcServer) DeleteNsqdTopic(rpcTopicReq *RpcAdminTopicInfo)
 	return &ret
 }
 
+// pause, reset or resume the channel consume on the topic partition leader,
+// used by lookupd to reset the channel for all the partitions at once.
+func (self *NsqdCoordRpcServer) ResetChannel(req *RpcResetChannelReq) *RpcResetChannelRsp {
+	var ret RpcResetChannelRsp
+	defer coordErrStats.incCoordErr(&ret.ErrInfo)
+	if err := self.checkLookupForWrite(req.LookupdEpoch); err != nil {
+		ret.ErrInfo = *err
+		return &ret
+	}
+	tcData, err := self.nsqdCoord.getTopicCoordData(req.Name, req.Partition)
+	if err != nil {
+		ret.ErrInfo = *err
+		return &ret
+	}
+	if !tcData.IsMineLeaderSessionReady(self.nsqdCoord.myNode.GetID()) {
+		coordLog.Infof("not leader while reset channel for topic: %v, leader: %v", tcData.topicInfo.GetTopicDesp(), tcData.GetLeader())
+		ret.ErrInfo = *ErrNotTopicLeader
+		return &ret
+	}
+	localTopic, localErr := self.nsqdCoord.localNsqd.GetExistingTopic(req.Name, req.Partition)
+	if localErr != nil {
+		coordLog.Infof("no topic on local: %v, %v", tcData.topicInfo.GetTopicDesp(), localErr)
+		ret.ErrInfo = *ErrLocalMissingTopic
+		return &ret
+	}
+	ch, localErr := localTopic.GetExistingChannel(req.Channel)
+	if localErr != nil {
+		coordLog.Infof("no channel %v on local topic: %v, %v", req.Channel, tcData.topicInfo.GetTopicDesp(), localErr)
+		ret.ErrInfo = *ErrLocalMissingChannel
+		return &ret
+	}
+
+	coordLog.Infof("got reset channel %v request for topic %v: action %v, ts %v", req.Channel,
+		tcData.topicInfo.GetTopicDesp(), req.Action, req.Timestamp)
+	switch req.Action {
+	case ResetChannelPause:
+		ret.WasPaused = ch.IsPaused()
+		if !ret.WasPaused {
+			localErr = self.nsqdCoord.UpdateChannelStateToCluster(ch, 1, -1)
+		}
+	case ResetChannelResume:
+		localErr = self.nsqdCoord.UpdateChannelStateToCluster(ch, 0, -1)
+	case ResetChannelToTimestamp:
+		_, queueOffset, cnt, searchErr := self.nsqdCoord.SearchLogByMsgTimestamp(req.Name, req.Partition, req.Timestamp)
+		if searchErr != nil {
+			coordLog.Infof("search timestamp %v for topic %v failed: %v", req.Timestamp, tcData.topicInfo.GetTopicDesp(), searchErr)
+			ret.ErrInfo = CoordErr{searchErr.Error(), RpcNoErr, CoordLocalErr}
+			return &ret
+		}
+		localErr = self.nsqdCoord.SetChannelConsumeOffsetToCluster(ch, queueOffset, cnt, true)
+		ret.QueueOffset = queueOffset
+		ret.MsgCnt = cnt
+	default:
+		ret.ErrInfo = *ErrTopicArgError
+		return &ret
+	}
+	if localErr != nil {
+		coordLog.Infof("reset channel %v action %v for topic %v failed: %v", req.Channel, req.Action,
+			tcData.topicInfo.GetTopicDesp(), localErr)
+		ret.ErrInfo = CoordErr{localErr.Error(), RpcNoErr, CoordLocalErr}
+		return &ret
+	}
+	localTopic.SaveChannelMeta()
+	return &ret
+}
+
 func (self *NsqdCoordRpcServer) GetTopicStats(topic string) *NodeTopicStats {
 	s := time.Now().Unix()
 	defer func() {
@@ -604,6 +670,10 @@ type RpcChannelState struct {
 	Channel string
 	Paused  int
 	Skipped int
+	// nil means no change
+	DeadLetter    *nsqd.DeadLetterConf
+	ExtFilter     *nsqd.ExtFilterData
+	PriorityLanes *int
 }
 
 type RpcChannelOffsetArg struct {
@@ -697,6 +767,27 @@ type RpcConfirmedDelayedCursor struct {
 	OtherCntList   map[int]uint64
 }
 
+const (
+	ResetChannelPause = iota
+	ResetChannelToTimestamp
+	ResetChannelResume
+)
+
+type RpcResetChannelReq struct {
+	RpcAdminTopicInfo
+	Channel string
+	Action  int
+	// the timestamp in seconds to reset the channel consume to
+	Timestamp int64
+}
+
+type RpcResetChannelRsp struct {
+	WasPaused   bool
+	QueueOffset int64
+	MsgCnt      int64
+	ErrInfo     CoordErr
+}
+
 type RpcNodeInfoReq struct {
 	NodeID string
 }
@@ -743,7 +834,7 @@ func (self *NsqdCoordRpcServer) UpdateChannelState(state *RpcChannelState) *Coor
 		return &ret
 	}
 	// update local channel offset
-	err = self.nsqdCoord.updateChannelStateOnSlave(tc.GetData(), state.Channel, state.Paused, state.Skipped)
+	err = self.nsqdCoord.updateChannelStateOnSlave(tc.GetData(), state)
 	if err != nil {
 		ret = *err
 		return &ret
@@ -928,6 +1019,22 @@ func (self *NsqdCoordRpcServer) GetLastCommitLogID(req *RpcCommitLogReq) (int64,
 	return ret, nil
 }
 
+// return the end offset of the topic data committed on local
+func (self *NsqdCoordRpcServer) GetCommitLogEndOffset(req *RpcCommitLogReq) (int64, error) {
+	tc, err := self.nsqdCoord.getTopicCoordData(req.TopicName, req.TopicPartition)
+	if err != nil {
+		return 0, err.ToErrorType()
+	}
+	_, _, logData, localErr := tc.logMgr.GetLastCommitLogOffsetV2()
+	if localErr != nil {
+		if localErr == ErrCommitLogEOF {
+			return 0, nil
+		}
+		return 0, localErr
+	}
+	return logData.MsgOffset + int64(logData.MsgSize), nil
+}
+
 func (self *NsqdCoordRpcServer) GetLastDelayedQueueCommitLogID(req *RpcCommitLogReq) (int64, error) {
 	var ret int64
 	tc, err := self.nsqdCoord.getTopicCoordData(req.TopicName, req.TopicPartition)
@@ -1164,6 +1271,11 @@ func (self *NsqdCoordRpcServer) TriggerLookupChanged() error {
 	return nil
 }
 
+func (self *NsqdCoordRpcServer) SetCatchupRateLimit(rate int64) error {
+	self.nsqdCoord.setClusterCatchupRateLimit(rate)
+	return nil
+}
+
 func (self *NsqdCoordRpcServer) GetNodeInfo(req *RpcNodeInfoReq) (*RpcNodeInfoRsp, error) {
 	var ret RpcNodeInfoRsp
 
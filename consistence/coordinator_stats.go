@@ -4,6 +4,7 @@ import (
 	"github.com/absolute8511/gorpc"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 const maxNumCounters = 1024
@@ -122,6 +123,30 @@ func (self *CoordErrStats) incCoordErr(e *CoordErr) {
 
 var coordErrStats = newCoordErrStats()
 
+type catchupThrottleStats struct {
+	pulledBytes   int64
+	throttledCnt  int64
+	throttledTime int64
+}
+
+func (self *catchupThrottleStats) pulled(n int64) {
+	atomic.AddInt64(&self.pulledBytes, n)
+}
+
+func (self *catchupThrottleStats) throttled(d time.Duration) {
+	atomic.AddInt64(&self.throttledCnt, 1)
+	atomic.AddInt64(&self.throttledTime, int64(d))
+}
+
+type CatchupThrottleStat struct {
+	NodeRateLimit    int64 `json:"node_rate_limit"`
+	TopicRateLimit   int64 `json:"topic_rate_limit"`
+	ClusterRateLimit int64 `json:"cluster_rate_limit"`
+	PulledBytes      int64 `json:"pulled_bytes"`
+	ThrottledCnt     int64 `json:"throttled_cnt"`
+	ThrottledTimeMs  int64 `json:"throttled_time_ms"`
+}
+
 type ISRStat struct {
 	HostName string `json:"hostname"`
 	NodeID   string `json:"node_id"`
@@ -139,10 +164,13 @@ type TopicCoordStat struct {
 	Partition    int           `json:"partition"`
 	ISRStats     []ISRStat     `json:"isr_stats"`
 	CatchupStats []CatchupStat `json:"catchup_stats"`
+	// the time waited by the catchup rate limit on this node
+	CatchupThrottledTimeMs int64 `json:"catchup_throttled_time_ms"`
 }
 
 type CoordStats struct {
 	RpcStats        *gorpc.ConnStats `json:"rpc_stats"`
 	ErrStats        CoordErrStatsData
-	TopicCoordStats []TopicCoordStat `json:"topic_coord_stats"`
+	TopicCoordStats []TopicCoordStat    `json:"topic_coord_stats"`
+	CatchupStats    CatchupThrottleStat `json:"catchup_stats"`
 }
@@ -8,6 +8,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -466,7 +467,13 @@ func (s *StatsSorter) Less(i, j int) bool {
 
 type DataPlacement struct {
 	balanceInterval [2]int
-	lookupCoord     *NsqLookupCoordinator
+	primaryZone     string
+	// only generate the balance plan and wait the plan to be applied by manual
+	balanceDryRun bool
+	lookupCoord   *NsqLookupCoordinator
+	planMutex     sync.Mutex
+	balancePlan   *BalancePlan
+	planQuitChan  chan struct{}
 }
 
 func NewDataPlacement(coord *NsqLookupCoordinator) *DataPlacement {
@@ -484,6 +491,83 @@ func (self *DataPlacement) SetBalanceInterval(start int, end int) {
 	self.balanceInterval[1] = end
 }
 
+func (self *DataPlacement) SetPrimaryZone(zone string) {
+	self.primaryZone = zone
+}
+
+func (self *DataPlacement) SetBalanceDryRun(dryRun bool) {
+	self.balanceDryRun = dryRun
+}
+
+func getNodeZone(currentNodes map[string]NsqdNodeInfo, nodeID string) string {
+	if n, ok := currentNodes[nodeID]; ok {
+		return n.Zone
+	}
+	return ""
+}
+
+// the node without zone label is a failure domain by itself, so it is never
+// treated as the same zone with others.
+func getUsedZones(currentNodes map[string]NsqdNodeInfo, nodeLists ...[]string) map[string]struct{} {
+	usedZones := make(map[string]struct{})
+	for _, nodes := range nodeLists {
+		for _, nid := range nodes {
+			zone := getNodeZone(currentNodes, nid)
+			if zone != "" {
+				usedZones[zone] = struct{}{}
+			}
+		}
+	}
+	return usedZones
+}
+
+func isZoneUsed(usedZones map[string]struct{}, zone string) bool {
+	if zone == "" {
+		return false
+	}
+	_, ok := usedZones[zone]
+	return ok
+}
+
+// get the isr nodes (exclude the leader) which are in the same zone with other isr nodes
+func getDuplicatedZoneNodes(topicInfo *TopicPartitionMetaInfo, currentNodes map[string]NsqdNodeInfo) []string {
+	zoneCnt := make(map[string]int)
+	for _, nid := range topicInfo.ISR {
+		zone := getNodeZone(currentNodes, nid)
+		if zone != "" {
+			zoneCnt[zone]++
+		}
+	}
+	dupNodes := make([]string, 0)
+	for _, nid := range topicInfo.ISR {
+		if nid == topicInfo.Leader {
+			continue
+		}
+		if zoneCnt[getNodeZone(currentNodes, nid)] > 1 {
+			dupNodes = append(dupNodes, nid)
+		}
+	}
+	return dupNodes
+}
+
+// check if the replicas of the topic will still be spread across the different zones
+// after the data moved from one node to another.
+func isZoneSpreadAfterMove(isr []string, currentNodes map[string]NsqdNodeInfo, fromNode string, toNode string) bool {
+	toZone := getNodeZone(currentNodes, toNode)
+	if toZone == "" {
+		return true
+	}
+	for _, nid := range isr {
+		if nid == fromNode || nid == toNode {
+			continue
+		}
+		if getNodeZone(currentNodes, nid) == toZone {
+			return false
+		}
+	}
+	return true
+}
+
 func (self *DataPlacement) DoBalance(monitorChan chan struct{}) {
 	//check period for the data balance.
 	ticker := time.NewTicker(time.Minute * 10)
@@ -510,6 +594,10 @@ func (self *DataPlacement) DoBalance(monitorChan chan struct{}) {
 				coordLog.Infof("no balance since cluster is not stable while checking balance")
 				continue
 			}
+			if self.balanceDryRun {
+				self.checkBalancePlan()
+				continue
+			}
 			avgLeaderLoad := 0.0
 			minLeaderLoad := float64(math.MaxInt32)
 			maxLeaderLoad := 0.0
@@ -569,6 +657,9 @@ func (self *DataPlacement) DoBalance(monitorChan chan struct{}) {
 			if moved {
 				continue
 			}
+			if self.rebalanceTopicZone(monitorChan, currentNodes, nodeTopicStats) {
+				continue
+			}
 
 			leaderSort := func(l, r *NodeTopicStats) bool {
 				return l.LeaderLessLoader(r)
@@ -838,7 +929,11 @@ func (self *DataPlacement) checkAndPrepareMove(monitorChan chan struct{}, topicN
 			}
 		}
 		if !checkMoveOK {
-			if leaderNodeLF < sortedNodeTopicStats[len(sortedNodeTopicStats)/2].GetNodeLeaderLoadFactor() {
+			if !isZoneSpreadAfterMove(topicInfo.ISR, self.lookupCoord.getCurrentNodes(),
+				statsMinMax[1].NodeID, statsMinMax[0].NodeID) {
+				coordLog.Infof("the min load node %v is in the same zone with other isr nodes: %v",
+					statsMinMax[0].NodeID, topicInfo.ISR)
+			} else if leaderNodeLF < sortedNodeTopicStats[len(sortedNodeTopicStats)/2].GetNodeLeaderLoadFactor() {
 				err := self.addToCatchupAndWaitISRReady(monitorChan, topicName, partitionID,
 					statsMinMax[0].NodeID,
 					sortedNodeTopicStats, false)
@@ -1008,20 +1103,7 @@ func (self *DataPlacement) addToCatchupAndWaitISRReady(monitorChan chan struct{}
 			filteredNodes = append(filteredNodes, addNode)
 		}
 	} else {
-		for index, s := range sortedNodeTopicStats {
-			if !tryAllNodes {
-				if index >= len(sortedNodeTopicStats)-2 ||
-					index > len(sortedNodeTopicStats)/2 {
-					// never move to the busy nodes
-					break
-				}
-			}
-			if FindSlice(topicInfo.ISR, s.NodeID) != -1 {
-				// filter
-			} else {
-				filteredNodes = append(filteredNodes, s.NodeID)
-			}
-		}
+		filteredNodes = self.getCatchupCandidateNodes(topicInfo, sortedNodeTopicStats, tryAllNodes)
 	}
 	for {
 		if currentSelect >= len(filteredNodes) {
@@ -1072,6 +1154,41 @@ func (self *DataPlacement) addToCatchupAndWaitISRReady(monitorChan chan struct{}
 	return nil
 }
 
+// the nodes not in isr ordered by the load, and the nodes in the zones not used by the isr are tried first.
+func (self *DataPlacement) getCatchupCandidateNodes(topicInfo *TopicPartitionMetaInfo,
+	sortedNodeTopicStats []NodeTopicStats, tryAllNodes bool) []string {
+	filteredNodes := make([]string, 0)
+	for index, s := range sortedNodeTopicStats {
+		if !tryAllNodes {
+			if index >= len(sortedNodeTopicStats)-2 ||
+				index > len(sortedNodeTopicStats)/2 {
+				// never move to the busy nodes
+				break
+			}
+		}
+		if FindSlice(topicInfo.ISR, s.NodeID) != -1 {
+			// filter
+		} else {
+			filteredNodes = append(filteredNodes, s.NodeID)
+		}
+	}
+	// try the nodes in the zones not used by the isr first
+	currentNodes := self.lookupCoord.getCurrentNodes()
+	usedZones := getUsedZones(currentNodes, topicInfo.ISR)
+	zoneSortedNodes := make([]string, 0, len(filteredNodes))
+	for _, nid := range filteredNodes {
+		if !isZoneUsed(usedZones, getNodeZone(currentNodes, nid)) {
+			zoneSortedNodes = append(zoneSortedNodes, nid)
+		}
+	}
+	for _, nid := range filteredNodes {
+		if isZoneUsed(usedZones, getNodeZone(currentNodes, nid)) {
+			zoneSortedNodes = append(zoneSortedNodes, nid)
+		}
+	}
+	return zoneSortedNodes
+}
+
 func (self *DataPlacement) addToCatchupAndWaitISRReadyForOrderedTopic(monitorChan chan struct{}, topicInfo *TopicPartitionMetaInfo,
 	nodeNameList []string) error {
 	retry := 0
@@ -1189,11 +1306,14 @@ func (self *DataPlacement) allocNodeForTopic(topicInfo *TopicPartitionMetaInfo,
 	// collect the nsqd data, check if any node has the topic data already.
 	var chosenNode NsqdNodeInfo
 	var chosenStat *NodeTopicStats
+	chosenInNewZone := false
 
 	excludeNodes, commonErr := self.getExcludeNodesForTopic(topicInfo, false)
 	if commonErr != nil {
 		return nil, ErrLeadershipServerUnstable
 	}
+	// the node in the zone not used by this topic partition is preferred.
+	usedZones := getUsedZones(currentNodes, topicInfo.ISR, topicInfo.CatchupList)
 
 	for nodeID, nodeInfo := range currentNodes {
 		if _, ok := excludeNodes[nodeID]; ok {
@@ -1204,12 +1324,14 @@ func (self *DataPlacement) allocNodeForTopic(topicInfo *TopicPartitionMetaInfo,
 			coordLog.Infof("failed to get topic status for this node: %v", nodeInfo)
 			continue
 		}
-		if chosenNode.ID == "" {
+		inNewZone := !isZoneUsed(usedZones, nodeInfo.Zone)
+		if chosenNode.ID == "" || (inNewZone && !chosenInNewZone) {
 			chosenNode = nodeInfo
 			chosenStat = topicStat
+			chosenInNewZone = inNewZone
 			continue
 		}
-		if topicStat.SlaveLessLoader(chosenStat) {
+		if inNewZone == chosenInNewZone && topicStat.SlaveLessLoader(chosenStat) {
 			chosenNode = nodeInfo
 			chosenStat = topicStat
 		}
@@ -1340,37 +1462,37 @@ func (self *DataPlacement) allocTopicLeaderAndISR(orderedMulti bool, currentNode
 	By(leaderSort).Sort(nodeTopicStats)
 	leaders := make([]string, partitionNum)
 	p := 0
-	currentSelect := 0
 	coordLog.Infof("alloc current exist status: %v, \n %v", existLeaders, existSlaves)
 	for p < partitionNum {
 		if elem, ok := existPart[p]; ok {
 			leaders[p] = elem.Leader
 		} else {
-			for {
-				if currentSelect >= len(nodeTopicStats) {
+			// the nodes in the primary zone are tried first for the leader
+			for tryPrimary := self.primaryZone != ""; leaders[p] == ""; tryPrimary = false {
+				for _, nodeInfo := range nodeTopicStats {
+					if tryPrimary && getNodeZone(currentNodes, nodeInfo.NodeID) != self.primaryZone {
+						continue
+					}
+					if _, ok := existLeaders[nodeInfo.NodeID]; ok {
+						continue
+					}
+					// TODO: should slave can be used for other leader?
+					if _, ok := existSlaves[nodeInfo.NodeID]; ok {
+						continue
+					}
+					leaders[p] = nodeInfo.NodeID
+					existLeaders[nodeInfo.NodeID] = struct{}{}
+					break
+				}
+				if !tryPrimary && leaders[p] == "" {
 					coordLog.Infof("not enough nodes for leaders")
 					return nil, nil, ErrNodeUnavailable
 				}
-				nodeInfo := nodeTopicStats[currentSelect]
-				currentSelect++
-				if _, ok := existLeaders[nodeInfo.NodeID]; ok {
-					coordLog.Infof("ignore for exist other leader(different partition) node: %v", nodeInfo)
-					continue
-				}
-				// TODO: should slave can be used for other leader?
-				if _, ok := existSlaves[nodeInfo.NodeID]; ok {
-					coordLog.Infof("ignore for exist other slave (different partition) node: %v", nodeInfo)
-					continue
-				}
-				leaders[p] = nodeInfo.NodeID
-				existLeaders[nodeInfo.NodeID] = struct{}{}
-				break
 			}
 		}
 		p++
 	}
 	p = 0
-	currentSelect = 0
 	slaveSort := func(l, r *NodeTopicStats) bool {
 		return l.SlaveLessLoader(r)
 	}
@@ -1385,32 +1507,39 @@ func (self *DataPlacement) allocTopicLeaderAndISR(orderedMulti bool, currentNode
 		} else if elem, ok := existPart[p]; ok {
 			isr = elem.ISR
 		} else {
-			for {
-				if currentSelect >= len(nodeTopicStats) {
-					coordLog.Infof("not enough nodes for slaves")
-					return nil, nil, ErrNodeUnavailable
-				}
-				nodeInfo := nodeTopicStats[currentSelect]
-				currentSelect++
-				if nodeInfo.NodeID == leaders[p] {
-					coordLog.Infof("ignore for leader node: %v", nodeInfo.NodeID)
-					continue
-				}
-				if _, ok := existSlaves[nodeInfo.NodeID]; ok {
-					coordLog.Infof("ignore for exist slave node: %v", nodeInfo.NodeID)
-					continue
-				}
-				// TODO: should slave can be used for other leader?
-				if _, ok := existLeaders[nodeInfo.NodeID]; ok {
-					coordLog.Infof("ignore for exist other leader(different partition) node: %v", nodeInfo.NodeID)
-					continue
-				}
-				existSlaves[nodeInfo.NodeID] = struct{}{}
-				isr = append(isr, nodeInfo.NodeID)
-				if len(isr) >= replica {
-					break
+			// spread the isr across the different zones first, and allow the
+			// used zones if no more zones available.
+			usedZones := getUsedZones(currentNodes, isr)
+			for _, allowUsedZone := range []bool{false, true} {
+				for _, nodeInfo := range nodeTopicStats {
+					if len(isr) >= replica {
+						break
+					}
+					if nodeInfo.NodeID == leaders[p] {
+						continue
+					}
+					if _, ok := existSlaves[nodeInfo.NodeID]; ok {
+						continue
+					}
+					// TODO: should slave can be used for other leader?
+					if _, ok := existLeaders[nodeInfo.NodeID]; ok {
+						continue
+					}
+					zone := getNodeZone(currentNodes, nodeInfo.NodeID)
+					if !allowUsedZone && isZoneUsed(usedZones, zone) {
+						continue
+					}
+					existSlaves[nodeInfo.NodeID] = struct{}{}
+					isr = append(isr, nodeInfo.NodeID)
+					if zone != "" {
+						usedZones[zone] = struct{}{}
+					}
 				}
 			}
+			if len(isr) < replica {
+				coordLog.Infof("not enough nodes for slaves")
+				return nil, nil, ErrNodeUnavailable
+			}
 		}
 		isrlist[p] = isr
 		p++
@@ -1473,6 +1602,18 @@ func (self *DataPlacement) chooseNewLeaderFromISR(topicInfo *TopicPartitionMetaI
 			newestReplicas = append(newestReplicas, replica)
 		}
 	}
+	// prefer the replicas in the primary zone
+	if self.primaryZone != "" {
+		primaryReplicas := make([]string, 0, len(newestReplicas))
+		for _, replica := range newestReplicas {
+			if getNodeZone(currentNodes, replica) == self.primaryZone {
+				primaryReplicas = append(primaryReplicas, replica)
+			}
+		}
+		if len(primaryReplicas) > 0 {
+			newestReplicas = primaryReplicas
+		}
+	}
 	// select the least load factor node
 	newLeader := ""
 	if len(newestReplicas) == 1 {
@@ -1667,6 +1808,72 @@ func (self *DataPlacement) rebalanceOrderedTopic(monitorChan chan struct{}) (boo
 	return moved, isAllBalanced
 }
 
+// try spread the replicas of the topic partition across the different zones and move
+// the leader to the primary zone. Only one topic partition will be moved at once.
+func (self *DataPlacement) rebalanceTopicZone(monitorChan chan struct{}, currentNodes map[string]NsqdNodeInfo,
+	sortedNodeTopicStats []NodeTopicStats) bool {
+	if !atomic.CompareAndSwapInt32(&self.lookupCoord.balanceWaiting, 0, 1) {
+		coordLog.Infof("another balance is running, should wait")
+		return false
+	}
+	defer atomic.StoreInt32(&self.lookupCoord.balanceWaiting, 0)
+
+	topicList, err := self.lookupCoord.leadership.ScanTopics()
+	if err != nil {
+		coordLog.Infof("scan topics error: %v", err)
+		return false
+	}
+	for _, topicInfo := range topicList {
+		if topicInfo.OrderedMulti {
+			continue
+		}
+		select {
+		case <-monitorChan:
+			return false
+		default:
+		}
+		if !self.lookupCoord.IsClusterStable() || !self.lookupCoord.IsMineLeader() {
+			return false
+		}
+		if len(topicInfo.ISR) < topicInfo.Replica {
+			continue
+		}
+		dupNodes := getDuplicatedZoneNodes(&topicInfo, currentNodes)
+		if len(dupNodes) > 0 {
+			n, coordErr := self.allocNodeForTopic(&topicInfo, currentNodes)
+			if coordErr != nil {
+				continue
+			}
+			if isZoneUsed(getUsedZones(currentNodes, topicInfo.ISR, topicInfo.CatchupList), n.Zone) {
+				// no more zone available for this topic
+				continue
+			}
+			coordLog.Infof("topic %v isr %v has replicas in the same zone, try move %v to node %v",
+				topicInfo.GetTopicDesp(), topicInfo.ISR, dupNodes[0], n.GetID())
+			err := self.addToCatchupAndWaitISRReady(monitorChan, topicInfo.Name, topicInfo.Partition,
+				n.GetID(), sortedNodeTopicStats, false)
+			if err != nil {
+				coordLog.Infof("topic %v add new zone node %v failed: %v", topicInfo.GetTopicDesp(), n.GetID(), err)
+				continue
+			}
+			self.lookupCoord.handleMoveTopic(false, topicInfo.Name, topicInfo.Partition, dupNodes[0])
+			return true
+		}
+		if self.primaryZone == "" || getNodeZone(currentNodes, topicInfo.Leader) == self.primaryZone {
+			continue
+		}
+		for _, nid := range topicInfo.ISR {
+			if getNodeZone(currentNodes, nid) == self.primaryZone {
+				coordLog.Infof("topic %v leader %v is not in primary zone, try move leader to the isr %v",
+					topicInfo.GetTopicDesp(), topicInfo.Leader, topicInfo.ISR)
+				self.lookupCoord.handleMoveTopic(true, topicInfo.Name, topicInfo.Partition, topicInfo.Leader)
+				return true
+			}
+		}
+	}
+	return false
+}
+
 type SortableStrings []string
 
 func (s SortableStrings) Less(l, r int) bool {
@@ -1751,6 +1958,8 @@ func (self *DataPlacement) decideUnwantedISRNode(topicInfo *TopicPartitionMetaIn
 	//remove the unwanted node in isr
 	if !topicInfo.OrderedMulti {
 		maxLF := 0.0
+		// the nodes in the duplicated zone should be removed first
+		dupNodes := getDuplicatedZoneNodes(topicInfo, currentNodes)
 		for _, nodeID := range topicInfo.ISR {
 			if nodeID == topicInfo.Leader {
 				continue
@@ -1760,6 +1969,9 @@ func (self *DataPlacement) decideUnwantedISRNode(topicInfo *TopicPartitionMetaIn
 				// the isr maybe lost, we should exit without any remove
 				return unwantedNode
 			}
+			if len(dupNodes) > 0 && FindSlice(dupNodes, nodeID) == -1 {
+				continue
+			}
 			stat, err := self.lookupCoord.getNsqdTopicStat(n)
 			if err != nil {
 				continue
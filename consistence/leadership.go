@@ -20,6 +20,10 @@ type NsqdNodeInfo struct {
 	TcpPort  string
 	RpcPort  string
 	HttpPort string
+	// the zone (or rack) label of the node, the replicas of a topic partition
+	// will be spread across the different zones. Empty means the node is
+	// a failure domain by itself.
+	Zone string
 }
 
 func (self *NsqdNodeInfo) GetID() string {
@@ -59,6 +63,14 @@ type TopicMetaInfo struct {
 	OrderedMulti bool
 	//used for message ext
 	Ext bool
+	// the compression for the topic disk queue data, all the replicas
+	// should use the same compression to keep the data the same
+	Compression string
+	// the default ttl in seconds for the message, 0 means never expire
+	MsgTTL int64
+	// the json ext header key indexed for searching the message, empty
+	// means no index
+	IndexKey string
 }
 
 type TopicPartitionReplicaInfo struct {
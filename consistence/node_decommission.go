@@ -0,0 +1,372 @@
+package consistence
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrNodeNotDecommissioning = errors.New("node is not in decommission")
+)
+
+const (
+	defaultDecommissionConcurrent = 1
+)
+
+type DecommissionPartitionProgress struct {
+	Topic     string `json:"topic"`
+	Partition int    `json:"partition"`
+	// the removing node is the leader while the decommission started
+	WasLeader    bool     `json:"was_leader"`
+	CatchupNodes []string `json:"catchup_nodes"`
+	// the data left to be synced by the catchup nodes, -1 if unknown
+	CatchupLeftBytes int64 `json:"catchup_left_bytes"`
+	// any new replica has been joined into isr
+	ISRJoined   bool `json:"isr_joined"`
+	LeaderMoved bool `json:"leader_moved"`
+	// the removing node has left the isr
+	Done bool `json:"done"`
+}
+
+type NodeDecommissionStatus struct {
+	NodeID          string                          `json:"node_id"`
+	State           string                          `json:"state"`
+	Paused          bool                            `json:"paused"`
+	MaxConcurrent   int                             `json:"max_concurrent"`
+	CatchupRate     int64                           `json:"catchup_rate"`
+	StartTime       time.Time                       `json:"start_time"`
+	TotalPartitions int                             `json:"total_partitions"`
+	DonePartitions  int                             `json:"done_partitions"`
+	Partitions      []DecommissionPartitionProgress `json:"partitions"`
+}
+
+type nodeDecommission struct {
+	paused        bool
+	maxConcurrent int
+	// the catchup bytes per second for all the nsqd nodes while decommission, 0 means no limit.
+	catchupRate int64
+	startTime   time.Time
+	// the isr of the partitions on the removing node while first seen
+	origISR   map[string][]string
+	wasLeader map[string]bool
+}
+
+func newNodeDecommission() *nodeDecommission {
+	return &nodeDecommission{
+		maxConcurrent: defaultDecommissionConcurrent,
+		startTime:     time.Now(),
+		origISR:       make(map[string][]string),
+		wasLeader:     make(map[string]bool),
+	}
+}
+
+// mark the node as removing and set the limit for the data movement,
+// the limit can be changed by calling this again while the node is removing.
+func (self *NsqLookupCoordinator) StartNodeDecommission(nid string, maxConcurrent int, catchupRate int64) error {
+	if err := self.MarkNodeAsRemoving(nid); err != nil {
+		return err
+	}
+	if maxConcurrent <= 0 {
+		maxConcurrent = defaultDecommissionConcurrent
+	}
+	if catchupRate < 0 {
+		catchupRate = 0
+	}
+	self.decommissionMutex.Lock()
+	d, ok := self.decommissions[nid]
+	if !ok {
+		d = newNodeDecommission()
+		self.decommissions[nid] = d
+	}
+	d.maxConcurrent = maxConcurrent
+	d.catchupRate = catchupRate
+	self.decommissionMutex.Unlock()
+	coordLog.Infof("node %v decommission started, concurrent: %v, catchup rate: %v", nid, maxConcurrent, catchupRate)
+	self.syncCatchupRateLimit()
+	return nil
+}
+
+// pause will stop moving more partitions out of the removing node, the movement already started will go on.
+func (self *NsqLookupCoordinator) PauseNodeDecommission(nid string, pause bool) error {
+	if self.leaderNode.GetID() != self.myNode.GetID() {
+		coordLog.Infof("not leader while pause node decommission")
+		return ErrNotNsqLookupLeader
+	}
+	self.decommissionMutex.Lock()
+	d, ok := self.decommissions[nid]
+	if ok {
+		d.paused = pause
+	}
+	self.decommissionMutex.Unlock()
+	if !ok {
+		return ErrNodeNotDecommissioning
+	}
+	coordLog.Infof("node %v decommission paused: %v", nid, pause)
+	self.syncCatchupRateLimit()
+	return nil
+}
+
+func (self *NsqLookupCoordinator) GetNodeDecommissionStatus(nid string) (*NodeDecommissionStatus, error) {
+	if self.leaderNode.GetID() != self.myNode.GetID() {
+		return nil, ErrNotNsqLookupLeader
+	}
+	self.nodesMutex.RLock()
+	state, ok := self.removingNodes[nid]
+	self.nodesMutex.RUnlock()
+	if !ok {
+		return nil, ErrNodeNotDecommissioning
+	}
+	allTopics, err := self.leadership.ScanTopics()
+	if err != nil {
+		return nil, err
+	}
+	self.recordDecommissionPartitions(nid, allTopics)
+
+	status := &NodeDecommissionStatus{
+		NodeID: nid,
+		State:  state,
+	}
+	self.decommissionMutex.Lock()
+	d, ok := self.decommissions[nid]
+	if !ok {
+		self.decommissionMutex.Unlock()
+		return nil, ErrNodeNotDecommissioning
+	}
+	status.Paused = d.paused
+	status.MaxConcurrent = d.maxConcurrent
+	status.CatchupRate = d.catchupRate
+	status.StartTime = d.startTime
+	origISR := make(map[string][]string, len(d.origISR))
+	wasLeader := make(map[string]bool, len(d.wasLeader))
+	for desp, isr := range d.origISR {
+		origISR[desp] = isr
+		wasLeader[desp] = d.wasLeader[desp]
+	}
+	self.decommissionMutex.Unlock()
+
+	for _, topicInfo := range allTopics {
+		desp := topicInfo.GetTopicDesp()
+		isr, ok := origISR[desp]
+		if !ok {
+			continue
+		}
+		p := getDecommissionPartitionProgress(nid, &topicInfo, isr, wasLeader[desp])
+		if len(p.CatchupNodes) > 0 {
+			p.CatchupLeftBytes = self.getCatchupLeftBytes(&topicInfo, p.CatchupNodes)
+		}
+		status.Partitions = append(status.Partitions, p)
+	}
+	status.TotalPartitions = len(status.Partitions)
+	for _, p := range status.Partitions {
+		if p.Done {
+			status.DonePartitions++
+		}
+	}
+	return status, nil
+}
+
+func getDecommissionPartitionProgress(nid string, topicInfo *TopicPartitionMetaInfo,
+	origISR []string, wasLeader bool) DecommissionPartitionProgress {
+	p := DecommissionPartitionProgress{
+		Topic:     topicInfo.Name,
+		Partition: topicInfo.Partition,
+		WasLeader: wasLeader,
+	}
+	for _, catchup := range topicInfo.CatchupList {
+		if catchup != nid {
+			p.CatchupNodes = append(p.CatchupNodes, catchup)
+		}
+	}
+	for _, n := range topicInfo.ISR {
+		if FindSlice(origISR, n) == -1 {
+			p.ISRJoined = true
+			break
+		}
+	}
+	p.LeaderMoved = wasLeader && topicInfo.Leader != nid
+	p.Done = FindSlice(topicInfo.ISR, nid) == -1 && FindSlice(topicInfo.CatchupList, nid) == -1
+	return p
+}
+
+// the max data left to be synced for all the catchup nodes
+func (self *NsqLookupCoordinator) getCatchupLeftBytes(topicInfo *TopicPartitionMetaInfo, catchupNodes []string) int64 {
+	leaderEnd, coordErr := self.getNsqdCommitLogEndOffset(topicInfo.Leader, topicInfo)
+	if coordErr != nil {
+		coordLog.Infof("failed to get topic %v data end on leader: %v", topicInfo.GetTopicDesp(), coordErr)
+		return -1
+	}
+	left := int64(0)
+	for _, nid := range catchupNodes {
+		end, coordErr := self.getNsqdCommitLogEndOffset(nid, topicInfo)
+		if coordErr != nil {
+			coordLog.Infof("failed to get topic %v data end on node %v: %v", topicInfo.GetTopicDesp(), nid, coordErr)
+			return -1
+		}
+		if leaderEnd-end > left {
+			left = leaderEnd - end
+		}
+	}
+	return left
+}
+
+// remember the isr for the partitions on the removing node, so we can tell the progress
+// after the node left the isr.
+func (self *NsqLookupCoordinator) recordDecommissionPartitions(nid string, allTopics []TopicPartitionMetaInfo) {
+	self.decommissionMutex.Lock()
+	defer self.decommissionMutex.Unlock()
+	d, ok := self.decommissions[nid]
+	if !ok {
+		return
+	}
+	for _, topicInfo := range allTopics {
+		if FindSlice(topicInfo.ISR, nid) == -1 {
+			continue
+		}
+		desp := topicInfo.GetTopicDesp()
+		if _, ok := d.origISR[desp]; ok {
+			continue
+		}
+		isr := make([]string, len(topicInfo.ISR))
+		copy(isr, topicInfo.ISR)
+		d.origISR[desp] = isr
+		d.wasLeader[desp] = topicInfo.Leader == nid
+	}
+}
+
+func (self *NsqLookupCoordinator) getDecommission(nid string) (paused bool, maxConcurrent int) {
+	self.decommissionMutex.Lock()
+	defer self.decommissionMutex.Unlock()
+	d, ok := self.decommissions[nid]
+	if !ok {
+		return false, defaultDecommissionConcurrent
+	}
+	return d.paused, d.maxConcurrent
+}
+
+func (self *NsqLookupCoordinator) removeDecommission(nid string) {
+	self.decommissionMutex.Lock()
+	delete(self.decommissions, nid)
+	self.decommissionMutex.Unlock()
+}
+
+// the catchup rate used by the nsqd nodes is the min limit of all
+// the decommissions, the paused decommission is also included since the
+// moves started before paused are still syncing data.
+func (self *NsqLookupCoordinator) getDecommissionCatchupRate() int64 {
+	self.decommissionMutex.Lock()
+	defer self.decommissionMutex.Unlock()
+	rate := int64(0)
+	for _, d := range self.decommissions {
+		if d.catchupRate <= 0 {
+			continue
+		}
+		if rate == 0 || d.catchupRate < rate {
+			rate = d.catchupRate
+		}
+	}
+	return rate
+}
+
+func (self *NsqLookupCoordinator) syncCatchupRateLimit() {
+	rate := self.getDecommissionCatchupRate()
+	lastRate := atomic.LoadInt64(&self.lastCatchupRate)
+	if rate == 0 && lastRate == 0 {
+		return
+	}
+	allSuccess := true
+	for nid := range self.getCurrentNodes() {
+		c, coordErr := self.acquireRpcClient(nid)
+		if coordErr != nil {
+			allSuccess = false
+			continue
+		}
+		err := c.SetCatchupRateLimit(rate)
+		if err != nil {
+			coordLog.Infof("failed to set catchup rate limit on node %v: %v", nid, err)
+			allSuccess = false
+		}
+	}
+	if allSuccess {
+		atomic.StoreInt64(&self.lastCatchupRate, rate)
+	}
+}
+
+// count the topic moved from the removing node in the stats of the chosen node, so the
+// next choosing will see the load before the stats refreshed from the nsqd nodes.
+func addMovingTopicStat(to *NodeTopicStats, from *NodeTopicStats, topicFullName string, asLeader bool) {
+	if to.TopicTotalDataSize == nil {
+		to.TopicTotalDataSize = make(map[string]int64)
+	}
+	if to.TopicLeaderDataSize == nil {
+		to.TopicLeaderDataSize = make(map[string]int64)
+	}
+	if to.ChannelDepthData == nil {
+		to.ChannelDepthData = make(map[string]int64)
+	}
+	if to.TopicHourlyPubDataList == nil {
+		to.TopicHourlyPubDataList = make(map[string][24]int64)
+	}
+	if from == nil {
+		from = NewNodeTopicStats("", 0, 0)
+	}
+	to.TopicTotalDataSize[topicFullName] += from.TopicTotalDataSize[topicFullName]
+	if !asLeader {
+		return
+	}
+	to.TopicLeaderDataSize[topicFullName] += from.TopicLeaderDataSize[topicFullName]
+	to.ChannelDepthData[topicFullName] += from.ChannelDepthData[topicFullName]
+	if pubList, ok := from.TopicHourlyPubDataList[topicFullName]; ok {
+		to.TopicHourlyPubDataList[topicFullName] = pubList
+	}
+}
+
+// choose the catchup node for each topic moved out of the removing node one by one
+// before the concurrent moving started, the stats is updated after each choosing so
+// the topics in the same batch will not all be moved to the same idle node. The empty
+// node is returned if no need to add catchup or no node can be chosen.
+func (self *NsqLookupCoordinator) chooseCatchupNodesForRemoving(nid string, topics []TopicPartitionMetaInfo,
+	sortedNodeTopicStats []NodeTopicStats, sortBy By) []string {
+	var removingStat *NodeTopicStats
+	for i := range sortedNodeTopicStats {
+		if sortedNodeTopicStats[i].NodeID == nid {
+			stat := sortedNodeTopicStats[i]
+			removingStat = &stat
+			break
+		}
+	}
+	// the nodes chosen for the other partitions of the same topic
+	chosenNodes := make(map[string][]string)
+	targets := make([]string, len(topics))
+	for i := range topics {
+		topicInfo := &topics[i]
+		if len(topicInfo.ISR) > topicInfo.Replica {
+			continue
+		}
+		excludeNodes, err := self.dpm.getExcludeNodesForTopic(topicInfo, false)
+		if err != nil {
+			continue
+		}
+		for _, n := range chosenNodes[topicInfo.Name] {
+			excludeNodes[n] = struct{}{}
+		}
+		for _, n := range self.dpm.getCatchupCandidateNodes(topicInfo, sortedNodeTopicStats, true) {
+			if _, ok := excludeNodes[n]; !ok {
+				targets[i] = n
+				break
+			}
+		}
+		if targets[i] == "" {
+			continue
+		}
+		chosenNodes[topicInfo.Name] = append(chosenNodes[topicInfo.Name], targets[i])
+		for j := range sortedNodeTopicStats {
+			if sortedNodeTopicStats[j].NodeID == targets[i] {
+				addMovingTopicStat(&sortedNodeTopicStats[j], removingStat, topicInfo.GetTopicDesp(), topicInfo.Leader == nid)
+				break
+			}
+		}
+		sortBy.Sort(sortedNodeTopicStats)
+	}
+	return targets
+}
@@ -0,0 +1,96 @@
+package consistence
+
+import (
+	"testing"
+
+	"github.com/youzan/nsq/internal/test"
+)
+
+func TestNodeDecommissionPartitionProgress(t *testing.T) {
+	topicInfo := &TopicPartitionMetaInfo{Name: "t1", Partition: 0}
+	topicInfo.Leader = "n1"
+	topicInfo.ISR = []string{"n1", "n2"}
+	topicInfo.CatchupList = []string{"n3"}
+	origISR := []string{"n1", "n2"}
+	p := getDecommissionPartitionProgress("n1", topicInfo, origISR, true)
+	test.Equal(t, []string{"n3"}, p.CatchupNodes)
+	test.Equal(t, false, p.ISRJoined)
+	test.Equal(t, false, p.LeaderMoved)
+	test.Equal(t, false, p.Done)
+
+	topicInfo.ISR = []string{"n1", "n2", "n3"}
+	topicInfo.CatchupList = nil
+	p = getDecommissionPartitionProgress("n1", topicInfo, origISR, true)
+	test.Equal(t, 0, len(p.CatchupNodes))
+	test.Equal(t, true, p.ISRJoined)
+	test.Equal(t, false, p.LeaderMoved)
+	test.Equal(t, false, p.Done)
+
+	topicInfo.Leader = "n2"
+	topicInfo.ISR = []string{"n2", "n3"}
+	p = getDecommissionPartitionProgress("n1", topicInfo, origISR, true)
+	test.Equal(t, true, p.ISRJoined)
+	test.Equal(t, true, p.LeaderMoved)
+	test.Equal(t, true, p.Done)
+}
+
+func TestNodeDecommissionCatchupRate(t *testing.T) {
+	coord := NewNsqLookupCoordinator("test-cluster", &NsqLookupdNodeInfo{ID: "l1"}, nil)
+	test.Equal(t, int64(0), coord.getDecommissionCatchupRate())
+	coord.decommissions["n1"] = newNodeDecommission()
+	coord.decommissions["n2"] = newNodeDecommission()
+	coord.decommissions["n1"].catchupRate = 2000
+	coord.decommissions["n2"].catchupRate = 1000
+	test.Equal(t, int64(1000), coord.getDecommissionCatchupRate())
+	// the paused decommission still limits the moves already started
+	coord.decommissions["n2"].paused = true
+	test.Equal(t, int64(1000), coord.getDecommissionCatchupRate())
+	paused, concurrent := coord.getDecommission("n2")
+	test.Equal(t, true, paused)
+	test.Equal(t, defaultDecommissionConcurrent, concurrent)
+	coord.removeDecommission("n1")
+	test.Equal(t, int64(1000), coord.getDecommissionCatchupRate())
+	coord.decommissions["n2"].catchupRate = 0
+	test.Equal(t, int64(0), coord.getDecommissionCatchupRate())
+
+	topics := []TopicPartitionMetaInfo{{Name: "t1", Partition: 0}, {Name: "t2", Partition: 0}}
+	topics[0].Leader = "n2"
+	topics[0].ISR = []string{"n2", "n3"}
+	topics[1].Leader = "n3"
+	topics[1].ISR = []string{"n3", "n4"}
+	coord.recordDecommissionPartitions("n2", topics)
+	test.Equal(t, 1, len(coord.decommissions["n2"].origISR))
+	test.Equal(t, true, coord.decommissions["n2"].wasLeader[topics[0].GetTopicDesp()])
+	// the isr recorded first should not be changed
+	topics[0].ISR = []string{"n2", "n4"}
+	coord.recordDecommissionPartitions("n2", topics)
+	test.Equal(t, []string{"n2", "n3"}, coord.decommissions["n2"].origISR[topics[0].GetTopicDesp()])
+}
+
+func TestNodeDecommissionAddMovingTopicStat(t *testing.T) {
+	from := NewNodeTopicStats("n1", 1, 1)
+	from.TopicTotalDataSize["t1-0"] = 100
+	from.TopicLeaderDataSize["t1-0"] = 100
+	from.ChannelDepthData["t1-0"] = 50
+	stats := []NodeTopicStats{*NewNodeTopicStats("n2", 1, 1), *NewNodeTopicStats("n3", 1, 1)}
+	leaderSort := func(l, r *NodeTopicStats) bool {
+		return l.LeaderLessLoader(r)
+	}
+	By(leaderSort).Sort(stats)
+	chosen := stats[0].NodeID
+	addMovingTopicStat(&stats[0], from, "t1-0", true)
+	test.Equal(t, int64(100), stats[0].TopicTotalDataSize["t1-0"])
+	test.Equal(t, int64(100), stats[0].TopicLeaderDataSize["t1-0"])
+	test.Equal(t, int64(50), stats[0].ChannelDepthData["t1-0"])
+	// the chosen node should not be the most idle node after the topic counted
+	By(leaderSort).Sort(stats)
+	test.NotEqual(t, chosen, stats[0].NodeID)
+
+	// only the data is counted for the replica not leader
+	nilStat := NodeTopicStats{NodeID: "n4"}
+	addMovingTopicStat(&nilStat, from, "t1-0", false)
+	test.Equal(t, int64(100), nilStat.TopicTotalDataSize["t1-0"])
+	test.Equal(t, 0, len(nilStat.TopicLeaderDataSize))
+	addMovingTopicStat(&nilStat, nil, "t2-0", true)
+	test.Equal(t, 2, len(nilStat.TopicTotalDataSize))
+}
@@ -148,6 +148,12 @@ type NsqdCoordinator struct {
 	enableBenchCost        bool
 	stopping               int32
 	catchupRunning         int32
+	catchupLimiter         *byteRateLimiter
+	// the catchup limits configured on local and the limit from lookupd while removing node
+	nodeCatchupRate    int64
+	topicCatchupRate   int64
+	clusterCatchupRate int64
+	catchupStats       catchupThrottleStats
 }
 
 func NewNsqdCoordinator(cluster, ip, tcpport, rpcport, httpport, extraID string, rootPath string, nsqd *nsqd.NSQD) *NsqdCoordinator {
@@ -171,6 +177,7 @@ func NewNsqdCoordinator(cluster, ip, tcpport, rpcport, httpport, extraID string,
 		tryCheckUnsynced:       make(chan bool, 1),
 		lookupRemoteCreateFunc: NewNsqLookupRpcClient,
 		lookupRemoteClients:    make(map[string]INsqlookupRemoteProxy),
+		catchupLimiter:         newByteRateLimiter(0),
 	}
 
 	if nsqdCoord.leadership != nil {
@@ -185,6 +192,62 @@ func (self *NsqdCoordinator) GetMyID() string {
 	return self.myNode.GetID()
 }
 
+// should be set before start, the zone will be registered with the node info
+func (self *NsqdCoordinator) SetNodeZone(zone string) {
+	self.myNode.Zone = zone
+}
+
+// limit the bytes per second pulled from the leaders while catching up for
+// all the topics and each topic partition, 0 means no limit.
+func (self *NsqdCoordinator) SetCatchupRateLimit(nodeRate int64, topicRate int64) {
+	old := atomic.SwapInt64(&self.nodeCatchupRate, nodeRate)
+	oldTopic := atomic.SwapInt64(&self.topicCatchupRate, topicRate)
+	if old != nodeRate || oldTopic != topicRate {
+		coordLog.Infof("catchup rate limit changed to %v bytes/s, topic limit: %v bytes/s", nodeRate, topicRate)
+	}
+	self.updateCatchupLimiter()
+}
+
+// the limit set by lookupd while removing nodes from cluster, 0 means no limit.
+func (self *NsqdCoordinator) setClusterCatchupRateLimit(rate int64) {
+	old := atomic.SwapInt64(&self.clusterCatchupRate, rate)
+	if old != rate {
+		coordLog.Infof("cluster catchup rate limit changed to %v bytes/s", rate)
+	}
+	self.updateCatchupLimiter()
+}
+
+func (self *NsqdCoordinator) updateCatchupLimiter() {
+	rate := atomic.LoadInt64(&self.nodeCatchupRate)
+	clusterRate := atomic.LoadInt64(&self.clusterCatchupRate)
+	if clusterRate > 0 && (rate <= 0 || clusterRate < rate) {
+		rate = clusterRate
+	}
+	self.catchupLimiter.SetRate(rate)
+}
+
+// wait if the data pulled exceed the limit for node or topic.
+func (self *NsqdCoordinator) throttleCatchup(tc *TopicCoordinator, pulledBytes int64) *CoordErr {
+	tc.catchupLimiter.SetRate(atomic.LoadInt64(&self.topicCatchupRate))
+	now := time.Now()
+	wait := self.catchupLimiter.reserve(pulledBytes, now)
+	if topicWait := tc.catchupLimiter.reserve(pulledBytes, now); topicWait > wait {
+		wait = topicWait
+	}
+	self.catchupStats.pulled(pulledBytes)
+	if wait <= 0 {
+		return nil
+	}
+	self.catchupStats.throttled(wait)
+	atomic.AddInt64(&tc.catchupThrottled, int64(wait))
+	select {
+	case <-self.stopChan:
+		return ErrTopicExitingOnSlave
+	case <-time.After(wait):
+	}
+	return nil
+}
+
 func (self *NsqdCoordinator) SetLeadershipMgr(l NSQDLeadership) {
 	self.leadership = l
 	if self.leadership != nil {
@@ -718,6 +781,9 @@ func (self *NsqdCoordinator) loadLocalTopicData() error {
 				RetentionDay: topicInfo.RetentionDay,
 				OrderedMulti: topicInfo.OrderedMulti,
 				Ext:          topicInfo.Ext,
+				Compression:  topicInfo.Compression,
+				MsgTTL:       topicInfo.MsgTTL,
+				IndexKey:     topicInfo.IndexKey,
 			}
 			tc.GetData().updateBufferSize(int(dyConf.SyncEvery - 1))
 			maybeInitDelayedQ(tc.GetData(), topic)
@@ -1287,6 +1353,25 @@ func (self *NsqdCoordinator) SearchLogByMsgTimestamp(topic string, part int, ts_
 	return l, realOffset, curCount, nil
 }
 
+// get the total message count committed in the commit log
+func (self *NsqdCoordinator) GetCommitLogMsgCnt(topic string, part int) (int64, error) {
+	tcData, err := self.getTopicCoordData(topic, part)
+	if err != nil {
+		return 0, err.ToErrorType()
+	}
+	if tcData.logMgr == nil {
+		return 0, ErrMissingTopicLog.ToErrorType()
+	}
+	_, _, l, localErr := tcData.logMgr.GetLastCommitLogOffsetV2()
+	if localErr == ErrCommitLogEOF {
+		return 0, nil
+	}
+	if localErr != nil {
+		return 0, localErr
+	}
+	return l.MsgCnt + int64(l.MsgNum) - 1, nil
+}
+
 // for isr node to check with leader
 // The lookup will wait all isr sync to new leader during the leader switch
 func (self *NsqdCoordinator) syncToNewLeader(topicCoord *coordData, joinSession string, mustSynced bool) *CoordErr {
@@ -1668,6 +1753,9 @@ func (self *NsqdCoordinator) pullCatchupDataFromLeader(tc *TopicCoordinator,
 				hasErr = true
 				break
 			}
+			if !fromDelayedQueue {
+				logMgr.recordRawProducerSeqs(localTopic, d, &l)
+			}
 		}
 		if !hasErr {
 			logMgr.FlushCommitLogs()
@@ -1685,6 +1773,13 @@ func (self *NsqdCoordinator) pullCatchupDataFromLeader(tc *TopicCoordinator,
 		if synced {
 			break
 		}
+		pulledBytes := int64(0)
+		for _, d := range dataList {
+			pulledBytes += int64(len(d))
+		}
+		if coordErr := self.throttleCatchup(tc, pulledBytes); coordErr != nil {
+			return coordErr
+		}
 	}
 	return nil
 }
@@ -1787,6 +1882,9 @@ func (self *NsqdCoordinator) catchupFromLeader(topicInfo TopicPartitionMetaInfo,
 		RetentionDay: topicInfo.RetentionDay,
 		OrderedMulti: topicInfo.OrderedMulti,
 		Ext:          topicInfo.Ext,
+		Compression:  topicInfo.Compression,
+		MsgTTL:       topicInfo.MsgTTL,
+		IndexKey:     topicInfo.IndexKey,
 	}
 	tc.GetData().updateBufferSize(int(dyConf.SyncEvery - 1))
 	localTopic.SetDynamicInfo(*dyConf, tc.GetData().logMgr)
@@ -1868,6 +1966,13 @@ func (self *NsqdCoordinator) catchupFromLeader(topicInfo TopicPartitionMetaInfo,
 						if meta.Skipped {
 							ch.Skip()
 						}
+						if meta.DeadLetter != nil {
+							ch.SetDeadLetterConf(*meta.DeadLetter)
+						}
+						if meta.ExtFilter != nil {
+							ch.SetExtFilter(*meta.ExtFilter)
+						}
+						ch.SetPriorityLanes(meta.PriorityLanes)
 					}
 					delete(oldChList, chName)
 				}
@@ -2197,6 +2302,9 @@ func (self *NsqdCoordinator) updateTopicLeaderSession(topicCoord *TopicCoordinat
 		RetentionDay: tcData.topicInfo.RetentionDay,
 		OrderedMulti: tcData.topicInfo.OrderedMulti,
 		Ext:          tcData.topicInfo.Ext,
+		Compression:  tcData.topicInfo.Compression,
+		MsgTTL:       tcData.topicInfo.MsgTTL,
+		IndexKey:     tcData.topicInfo.IndexKey,
 	}
 	tcData.updateBufferSize(int(dyConf.SyncEvery - 1))
 	localTopic.SetDynamicInfo(*dyConf, tcData.logMgr)
@@ -2464,6 +2572,9 @@ func (self *NsqdCoordinator) updateLocalTopic(topicInfo *TopicPartitionMetaInfo,
 		RetentionDay: topicInfo.RetentionDay,
 		OrderedMulti: topicInfo.OrderedMulti,
 		Ext:          topicInfo.Ext,
+		Compression:  topicInfo.Compression,
+		MsgTTL:       topicInfo.MsgTTL,
+		IndexKey:     topicInfo.IndexKey,
 	}
 	tcData.updateBufferSize(int(dyConf.SyncEvery - 1))
 	localErr = maybeInitDelayedQ(tcData, t)
@@ -2561,15 +2672,25 @@ func (self *NsqdCoordinator) Stats(topic string, part int) *CoordStats {
 		s.RpcStats = self.rpcServer.rpcServer.Stats.Snapshot()
 	}
 	s.ErrStats = *coordErrStats.GetCopy()
+	s.CatchupStats = CatchupThrottleStat{
+		NodeRateLimit:    atomic.LoadInt64(&self.nodeCatchupRate),
+		TopicRateLimit:   atomic.LoadInt64(&self.topicCatchupRate),
+		ClusterRateLimit: atomic.LoadInt64(&self.clusterCatchupRate),
+		PulledBytes:      atomic.LoadInt64(&self.catchupStats.pulledBytes),
+		ThrottledCnt:     atomic.LoadInt64(&self.catchupStats.throttledCnt),
+		ThrottledTimeMs:  atomic.LoadInt64(&self.catchupStats.throttledTime) / int64(time.Millisecond),
+	}
 	s.TopicCoordStats = make([]TopicCoordStat, 0)
 	if len(topic) > 0 {
 		if part >= 0 {
-			tcData, err := self.getTopicCoordData(topic, part)
+			tc, err := self.getTopicCoord(topic, part)
 			if err != nil {
 			} else {
+				tcData := tc.GetData()
 				var stat TopicCoordStat
 				stat.Name = topic
 				stat.Partition = part
+				stat.CatchupThrottledTimeMs = atomic.LoadInt64(&tc.catchupThrottled) / int64(time.Millisecond)
 				for _, nid := range tcData.topicInfo.ISR {
 					stat.ISRStats = append(stat.ISRStats, ISRStat{HostName: "", NodeID: nid})
 				}
@@ -2587,6 +2708,7 @@ func (self *NsqdCoordinator) Stats(topic string, part int) *CoordStats {
 					var stat TopicCoordStat
 					stat.Name = topic
 					stat.Partition = tc.topicInfo.Partition
+					stat.CatchupThrottledTimeMs = atomic.LoadInt64(&tc.catchupThrottled) / int64(time.Millisecond)
 					for _, nid := range tc.topicInfo.ISR {
 						stat.ISRStats = append(stat.ISRStats, ISRStat{HostName: "", NodeID: nid})
 					}
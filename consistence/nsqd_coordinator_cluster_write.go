@@ -60,6 +60,14 @@ func (self *NsqdCoordinator) internalPutMessageToCluster(topic *nsqd.Topic,
 
 	var logMgr *TopicCommitLogMgr
 	var delayQ *nsqd.DelayQueue
+	// the retried pub from the producer with the same sequence will return
+	// the message written before, and nothing will be written.
+	producerID, producerSeq, hasProducerSeq := msg.GetProducerSeq()
+	if putDelayed {
+		hasProducerSeq = false
+	}
+	var dupRecord ProducerSeqRecord
+	var isDup bool
 	doLocalWrite := func(d *coordData) *CoordErr {
 		logMgr = d.logMgr
 		if putDelayed {
@@ -69,6 +77,14 @@ func (self *NsqdCoordinator) internalPutMessageToCluster(topic *nsqd.Topic,
 				return &CoordErr{err.Error(), RpcNoErr, CoordLocalErr}
 			}
 		}
+		if hasProducerSeq {
+			dupRecord, isDup = logMgr.GetProducerSeq(producerID, producerSeq)
+			if isDup {
+				coordLog.Infof("topic %v duplicated pub from producer %v seq %v, written message: %v",
+					topic.GetFullName(), producerID, producerSeq, dupRecord)
+				return nil
+			}
+		}
 		var id nsqd.MessageID
 		var offset nsqd.BackendOffset
 		var writeBytes int32
@@ -112,6 +128,9 @@ func (self *NsqdCoordinator) internalPutMessageToCluster(topic *nsqd.Topic,
 		}
 	}
 	doLocalCommit := func() error {
+		if isDup {
+			return nil
+		}
 		localErr := logMgr.AppendCommitLog(&commitLog, false)
 		if localErr != nil {
 			coordLog.Errorf("topic : %v failed write commit log : %v, logmgr: %v, %v",
@@ -122,9 +141,20 @@ func (self *NsqdCoordinator) internalPutMessageToCluster(topic *nsqd.Topic,
 			topic.UpdateCommittedOffset(queueEnd)
 			topic.Unlock()
 		}
+		if localErr == nil && hasProducerSeq {
+			logMgr.RecordProducerSeq(producerID, ProducerSeqRecord{
+				Seq:       producerSeq,
+				MsgID:     commitLog.LogID,
+				MsgOffset: commitLog.MsgOffset,
+				MsgSize:   commitLog.MsgSize,
+			})
+		}
 		return localErr
 	}
 	doLocalRollback := func() {
+		if isDup {
+			return
+		}
 		coordLog.Warningf("failed write begin rollback : %v, %v", topic.GetFullName(), commitLog)
 		topic.Lock()
 		if !putDelayed {
@@ -152,6 +182,9 @@ func (self *NsqdCoordinator) internalPutMessageToCluster(topic *nsqd.Topic,
 		return nil
 	}
 	doSlaveSync := func(c *NsqdRpcClient, nodeID string, tcData *coordData) *CoordErr {
+		if isDup {
+			return nil
+		}
 		// should retry if failed, and the slave should keep the last success write to avoid the duplicated
 		if putDelayed {
 			putErr := c.PutDelayedMessage(&tcData.topicLeaderSession, &tcData.topicInfo, commitLog, msg)
@@ -188,6 +221,9 @@ func (self *NsqdCoordinator) internalPutMessageToCluster(topic *nsqd.Topic,
 	var err error
 	if clusterErr != nil {
 		err = clusterErr.ToErrorType()
+	} else if isDup {
+		return nsqd.MessageID(dupRecord.MsgID), nsqd.BackendOffset(dupRecord.MsgOffset), dupRecord.MsgSize,
+			topic.GetCommitted(), nil
 	} else if coordLog.Level() >= levellogger.LOG_DETAIL {
 		coordLog.Infof("sync write success put offset: %v, logmgr: %v, %v",
 			commitLog, logMgr.pLogID, logMgr.nLogID)
@@ -208,10 +244,18 @@ func (self *NsqdCoordinator) PutMessagesToCluster(topic *nsqd.Topic,
 
 	var queueEnd nsqd.BackendQueueEnd
 	var logMgr *TopicCommitLogMgr
+	// the retried messages from the producer with the same sequence will be
+	// removed from the batch, and nothing will be written if all duplicated.
+	var dupRecord ProducerSeqRecord
+	var isDup bool
 
 	doLocalWrite := func(d *coordData) *CoordErr {
-		topic.Lock()
 		logMgr = d.logMgr
+		msgs, dupRecord, isDup = logMgr.filterDupProducerSeqs(topic.GetFullName(), msgs)
+		if isDup {
+			return nil
+		}
+		topic.Lock()
 		id, offset, writeBytes, totalCnt, qe, localErr := topic.PutMessagesNoLock(msgs)
 		queueEnd = qe
 		topic.Unlock()
@@ -242,6 +286,9 @@ func (self *NsqdCoordinator) PutMessagesToCluster(topic *nsqd.Topic,
 		}
 	}
 	doLocalCommit := func() error {
+		if isDup {
+			return nil
+		}
 		localErr := logMgr.AppendCommitLog(&commitLog, false)
 		if localErr != nil {
 			coordLog.Errorf("topic : %v failed write commit log : %v, logMgr: %v, %v",
@@ -250,9 +297,15 @@ func (self *NsqdCoordinator) PutMessagesToCluster(topic *nsqd.Topic,
 		topic.Lock()
 		topic.UpdateCommittedOffset(queueEnd)
 		topic.Unlock()
+		if localErr == nil {
+			logMgr.recordProducerSeqs(msgs)
+		}
 		return localErr
 	}
 	doLocalRollback := func() {
+		if isDup {
+			return
+		}
 		coordLog.Warningf("failed write begin rollback : %v, %v", topic.GetFullName(), commitLog)
 		topic.Lock()
 		topic.ResetBackendEndNoLock(nsqd.BackendOffset(commitLog.MsgOffset), commitLog.MsgCnt-1)
@@ -268,6 +321,9 @@ func (self *NsqdCoordinator) PutMessagesToCluster(topic *nsqd.Topic,
 		return nil
 	}
 	doSlaveSync := func(c *NsqdRpcClient, nodeID string, tcData *coordData) *CoordErr {
+		if isDup {
+			return nil
+		}
 		// should retry if failed, and the slave should keep the last success write to avoid the duplicated
 		putErr := c.PutMessages(&tcData.topicLeaderSession, &tcData.topicInfo, commitLog, msgs)
 		if putErr != nil {
@@ -294,6 +350,8 @@ func (self *NsqdCoordinator) PutMessagesToCluster(topic *nsqd.Topic,
 	var err error
 	if clusterErr != nil {
 		err = clusterErr.ToErrorType()
+	} else if isDup {
+		return nsqd.MessageID(dupRecord.MsgID), nsqd.BackendOffset(dupRecord.MsgOffset), dupRecord.MsgSize, nil
 	} else if coordLog.Level() >= levellogger.LOG_DETAIL {
 		coordLog.Infof("sync write success put offset: %v, logmgr: %v, %v",
 			commitLog, logMgr.pLogID, logMgr.nLogID)
@@ -596,6 +654,8 @@ func (self *NsqdCoordinator) putRawDataOnSlave(coord *TopicCoordinator, logData
 			topic.Lock()
 			topic.UpdateCommittedOffset(queueEnd)
 			topic.Unlock()
+			// keep the same dedup window with the leader for the leader failover
+			logMgr.recordRawProducerSeqs(topic, rawData, &logData)
 		}
 		return nil
 	}
@@ -685,6 +745,15 @@ func (self *NsqdCoordinator) putMessageOnSlave(coord *TopicCoordinator, logData
 			topic.Lock()
 			topic.UpdateCommittedOffset(queueEnd)
 			topic.Unlock()
+			// keep the same dedup window with the leader for the leader failover
+			if producerID, seq, ok := msg.GetProducerSeq(); ok {
+				logMgr.RecordProducerSeq(producerID, ProducerSeqRecord{
+					Seq:       seq,
+					MsgID:     logData.LogID,
+					MsgOffset: logData.MsgOffset,
+					MsgSize:   logData.MsgSize,
+				})
+			}
 		}
 		return nil
 	}
@@ -786,6 +855,7 @@ func (self *NsqdCoordinator) putMessagesOnSlave(coord *TopicCoordinator, logData
 		topic.Lock()
 		topic.UpdateCommittedOffset(queueEnd)
 		topic.Unlock()
+		logMgr.recordProducerSeqs(msgs)
 		return nil
 	}
 
@@ -1008,6 +1078,74 @@ func (self *NsqdCoordinator) UpdateChannelStateToCluster(channel *nsqd.Channel,
 	return nil
 }
 
+func (self *NsqdCoordinator) UpdateChannelDeadLetterToCluster(channel *nsqd.Channel, conf nsqd.DeadLetterConf) error {
+	return self.updateChannelConfToCluster(channel, "dead letter", conf, func() error {
+		channel.SetDeadLetterConf(conf)
+		return nil
+	}, RpcChannelState{Paused: -1, Skipped: -1, DeadLetter: &conf})
+}
+
+func (self *NsqdCoordinator) UpdateChannelExtFilterToCluster(channel *nsqd.Channel, filter nsqd.ExtFilterData) error {
+	return self.updateChannelConfToCluster(channel, "ext filter", filter, func() error {
+		return channel.SetExtFilter(filter)
+	}, RpcChannelState{Paused: -1, Skipped: -1, ExtFilter: &filter})
+}
+
+func (self *NsqdCoordinator) UpdateChannelPriorityLanesToCluster(channel *nsqd.Channel, lanes int) error {
+	return self.updateChannelConfToCluster(channel, "priority lanes", lanes, func() error {
+		return channel.SetPriorityLanes(lanes)
+	}, RpcChannelState{Paused: -1, Skipped: -1, PriorityLanes: &lanes})
+}
+
+// apply the channel config locally and sync the partly filled state to the replicas,
+// the channel and topic fields of the state will be filled before sync.
+func (self *NsqdCoordinator) updateChannelConfToCluster(channel *nsqd.Channel, desc string, conf interface{},
+	localApply func() error, state RpcChannelState) error {
+	topicName := channel.GetTopicName()
+	partition := channel.GetTopicPart()
+	coord, checkErr := self.getTopicCoord(topicName, partition)
+	if checkErr != nil {
+		return checkErr.ToErrorType()
+	}
+	state.Channel = channel.GetName()
+
+	doLocalWrite := func(d *coordData) *CoordErr {
+		err := localApply()
+		if err != nil {
+			coordLog.Infof("set channel(%v) %v %v failed: %v", channel.GetName(), desc, conf, err)
+			return &CoordErr{err.Error(), RpcCommonErr, CoordLocalErr}
+		}
+		return nil
+	}
+	doLocalExit := func(err *CoordErr) {}
+	doLocalCommit := func() error {
+		return nil
+	}
+	doLocalRollback := func() {
+	}
+	doRefresh := func(d *coordData) *CoordErr {
+		return nil
+	}
+	doSlaveSync := func(c *NsqdRpcClient, nodeID string, tcData *coordData) *CoordErr {
+		// the rpc client fills the topic fields, so each replica needs its own copy
+		syncState := state
+		rpcErr := c.updateChannelState(&tcData.topicLeaderSession, &tcData.topicInfo, &syncState)
+		if rpcErr != nil {
+			coordLog.Infof("sync channel(%v) %v %v to replica %v failed: %v, topic %v,%v", channel.GetName(), desc, conf, nodeID, rpcErr, topicName, partition)
+		}
+		return rpcErr
+	}
+	handleSyncResult := func(successNum int, tcData *coordData) bool {
+		return true
+	}
+	clusterErr := self.doSyncOpToCluster(false, coord, doLocalWrite, doLocalExit, doLocalCommit, doLocalRollback,
+		doRefresh, doSlaveSync, handleSyncResult)
+	if clusterErr != nil {
+		return clusterErr.ToErrorType()
+	}
+	return nil
+}
+
 func (self *NsqdCoordinator) FinishMessageToCluster(channel *nsqd.Channel, clientID int64, clientAddr string, msgID nsqd.MessageID) error {
 	topicName := channel.GetTopicName()
 	partition := channel.GetTopicPart()
@@ -1103,7 +1241,10 @@ func (self *NsqdCoordinator) FinishMessageToCluster(channel *nsqd.Channel, clien
 	return nil
 }
 
-func (self *NsqdCoordinator) updateChannelStateOnSlave(tc *coordData, channelName string, paused int, skipped int) *CoordErr {
+func (self *NsqdCoordinator) updateChannelStateOnSlave(tc *coordData, state *RpcChannelState) *CoordErr {
+	channelName := state.Channel
+	paused := state.Paused
+	skipped := state.Skipped
 	topicName := tc.topicInfo.Name
 	partition := tc.topicInfo.Partition
 
@@ -1161,6 +1302,21 @@ func (self *NsqdCoordinator) updateChannelStateOnSlave(tc *coordData, channelNam
 		coordLog.Errorf("fail to skip/unskip %v, channel: %v, %v", skipped, topic.GetTopicName(), channelName)
 		return ErrLocalChannelSkipFailed
 	}
+	if state.DeadLetter != nil {
+		ch.SetDeadLetterConf(*state.DeadLetter)
+	}
+	if state.ExtFilter != nil {
+		if err := ch.SetExtFilter(*state.ExtFilter); err != nil {
+			coordLog.Errorf("fail to set ext filter %v, channel: %v, %v", state.ExtFilter, topic.GetTopicName(), channelName)
+			return &CoordErr{err.Error(), RpcCommonErr, CoordSlaveErr}
+		}
+	}
+	if state.PriorityLanes != nil {
+		if err := ch.SetPriorityLanes(*state.PriorityLanes); err != nil {
+			coordLog.Errorf("fail to set priority lanes %v, channel: %v, %v", *state.PriorityLanes, topic.GetTopicName(), channelName)
+			return &CoordErr{err.Error(), RpcCommonErr, CoordSlaveErr}
+		}
+	}
 	topic.SaveChannelMeta()
 	return nil
 }
@@ -1385,6 +1541,69 @@ func (self *NsqdCoordinator) EmptyChannelDelayedStateToCluster(channel *nsqd.Cha
 	return nil
 }
 
+// confirm the delayed messages (which are not channel delayed) that have been
+// moved to the topic queue, and sync the delayed queue state to replicas.
+func (self *NsqdCoordinator) ConfirmDelayedMessagesToCluster(topic *nsqd.Topic, msgs []*nsqd.Message) error {
+	if topic.IsOrdered() {
+		return nil
+	}
+
+	topicName := topic.GetTopicName()
+	partition := topic.GetTopicPart()
+	coord, checkErr := self.getTopicCoord(topicName, partition)
+	if checkErr != nil {
+		return checkErr.ToErrorType()
+	}
+	changed := false
+	doLocalWrite := func(d *coordData) *CoordErr {
+		dq := topic.GetDelayedQueue()
+		if dq == nil {
+			return ErrLocalDelayedQueueMissing
+		}
+		for _, msg := range msgs {
+			// the caller should know the message is not confirmed, so it will not be published again
+			localErr := dq.ConfirmedMessage(msg)
+			if localErr != nil {
+				coordLog.Infof("topic %v confirm delayed message %v error: %v", topic.GetFullName(), msg.ID, localErr)
+				return &CoordErr{localErr.Error(), RpcNoErr, CoordLocalErr}
+			}
+			changed = true
+		}
+		return nil
+	}
+	doLocalExit := func(err *CoordErr) {}
+	doLocalCommit := func() error {
+		return nil
+	}
+	doLocalRollback := func() {}
+	doRefresh := func(d *coordData) *CoordErr {
+		return nil
+	}
+	doSlaveSync := func(c *NsqdRpcClient, nodeID string, tcData *coordData) *CoordErr {
+		if !changed {
+			return nil
+		}
+		cursorList, cntList, channelCntList := topic.GetDelayedQueueConsumedState()
+		rpcErr := c.UpdateDelayedQueueState(&tcData.topicLeaderSession, &tcData.topicInfo,
+			"", cursorList, cntList, channelCntList, false)
+		if rpcErr != nil {
+			coordLog.Infof("sync topic(%v) delayed queue state to replica %v failed: %v", topic.GetFullName(),
+				nodeID, rpcErr)
+		}
+		return rpcErr
+	}
+	handleSyncResult := func(successNum int, tcData *coordData) bool {
+		// the delayed state will be synced next time, so we can ignore the error here
+		return true
+	}
+	clusterErr := self.doSyncOpToCluster(false, coord, doLocalWrite, doLocalExit, doLocalCommit, doLocalRollback,
+		doRefresh, doSlaveSync, handleSyncResult)
+	if clusterErr != nil {
+		return clusterErr.ToErrorType()
+	}
+	return nil
+}
+
 func (self *NsqdCoordinator) updateDelayedQueueStateOnSlave(tc *coordData, channelName string,
 	keyList [][]byte, cntList map[int]uint64, channelCntList map[string]uint64) *CoordErr {
 	topicName := tc.topicInfo.Name
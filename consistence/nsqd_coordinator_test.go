@@ -1896,3 +1896,115 @@ func BenchmarkNsqdCoordPub2Replicator1024(b *testing.B) {
 func BenchmarkNsqdCoordPub3Replicator1024(b *testing.B) {
 	benchmarkNsqdCoordPubWithArg(b, 3, 1024)
 }
+
+func TestNsqdCoordConfirmDelayedMessagesFailed(t *testing.T) {
+	topic := "coordTestTopicConfirmDelayed"
+	partition := 1
+	SetCoordLogger(newTestLogger(t), levellogger.LOG_DEBUG)
+
+	nsqd1, randPort1, nodeInfo1, data1 := newNsqdNode(t, "id1")
+	defer os.RemoveAll(data1)
+	defer nsqd1.Exit()
+	nsqdCoord1 := startNsqdCoord(t, strconv.Itoa(randPort1), data1, "id1", nsqd1, true)
+	nsqdCoord1.Start()
+	defer nsqdCoord1.Stop()
+
+	var topicInitInfo RpcAdminTopicInfo
+	topicInitInfo.Name = topic
+	topicInitInfo.Partition = partition
+	topicInitInfo.Epoch = 1
+	topicInitInfo.EpochForWrite = 1
+	topicInitInfo.ISR = append(topicInitInfo.ISR, nsqdCoord1.myNode.GetID())
+	topicInitInfo.Leader = nsqdCoord1.myNode.GetID()
+	topicInitInfo.Replica = 1
+	ensureTopicOnNsqdCoord(nsqdCoord1, topicInitInfo)
+	leaderSession := &TopicLeaderSession{
+		LeaderNode:  nodeInfo1,
+		LeaderEpoch: 1,
+		Session:     "fake123",
+	}
+	ensureTopicLeaderSession(nsqdCoord1, topic, partition, leaderSession)
+	ensureTopicDisableWrite(nsqdCoord1, topic, partition, false)
+	topicData1 := nsqd1.GetTopic(topic, partition)
+
+	msg := nsqdNs.NewMessage(0, []byte("delayed"))
+	msg.DelayedType = nsqdNs.PubDelayed
+	msg.DelayedTs = time.Now().Add(-time.Second).UnixNano()
+	_, _, _, _, err := nsqdCoord1.PutDelayedMessageToCluster(topicData1, msg)
+	test.Nil(t, err)
+	dq := topicData1.GetDelayedQueue()
+	test.NotNil(t, dq)
+	ret := make([]nsqdNs.Message, 10)
+	n, err := dq.PeekRecentDelayedPub(time.Now().UnixNano(), ret)
+	test.Nil(t, err)
+	test.Equal(t, 1, n)
+
+	// the message not in the delayed queue can not be confirmed, the error
+	// should be returned and the messages after it are not confirmed.
+	missing := ret[0]
+	missing.DelayedTs++
+	err = nsqdCoord1.ConfirmDelayedMessagesToCluster(topicData1, []*nsqdNs.Message{&missing, &ret[0]})
+	test.NotNil(t, err)
+	n, err = dq.PeekRecentDelayedPub(time.Now().UnixNano(), ret)
+	test.Nil(t, err)
+	test.Equal(t, 1, n)
+
+	err = nsqdCoord1.ConfirmDelayedMessagesToCluster(topicData1, []*nsqdNs.Message{&ret[0]})
+	test.Nil(t, err)
+	n, err = dq.PeekRecentDelayedPub(time.Now().UnixNano(), ret)
+	test.Nil(t, err)
+	test.Equal(t, 0, n)
+}
+
+func TestNsqdCoordUpdateChannelConf(t *testing.T) {
+	topic := "coordTestTopicChannelConf"
+	partition := 1
+	SetCoordLogger(newTestLogger(t), levellogger.LOG_DEBUG)
+
+	nsqd1, randPort1, nodeInfo1, data1 := newNsqdNode(t, "id1")
+	defer os.RemoveAll(data1)
+	defer nsqd1.Exit()
+	nsqdCoord1 := startNsqdCoord(t, strconv.Itoa(randPort1), data1, "id1", nsqd1, true)
+	nsqdCoord1.Start()
+	defer nsqdCoord1.Stop()
+
+	var topicInitInfo RpcAdminTopicInfo
+	topicInitInfo.Name = topic
+	topicInitInfo.Partition = partition
+	topicInitInfo.Epoch = 1
+	topicInitInfo.EpochForWrite = 1
+	topicInitInfo.ISR = append(topicInitInfo.ISR, nsqdCoord1.myNode.GetID())
+	topicInitInfo.Leader = nsqdCoord1.myNode.GetID()
+	topicInitInfo.Replica = 1
+	ensureTopicOnNsqdCoord(nsqdCoord1, topicInitInfo)
+	leaderSession := &TopicLeaderSession{
+		LeaderNode:  nodeInfo1,
+		LeaderEpoch: 1,
+		Session:     "fake123",
+	}
+	ensureTopicLeaderSession(nsqdCoord1, topic, partition, leaderSession)
+	ensureTopicDisableWrite(nsqdCoord1, topic, partition, false)
+	topicData1 := nsqd1.GetTopic(topic, partition)
+	ch := topicData1.GetChannel("ch")
+
+	conf := nsqdNs.DeadLetterConf{MaxAttempts: 3, Topic: "dlq_topic"}
+	err := nsqdCoord1.UpdateChannelDeadLetterToCluster(ch, conf)
+	test.Nil(t, err)
+	test.Equal(t, conf, ch.GetDeadLetterConf())
+
+	filter := nsqdNs.ExtFilterData{Type: 1, FilterExtKey: "k1", FilterData: "v1"}
+	err = nsqdCoord1.UpdateChannelExtFilterToCluster(ch, filter)
+	test.Nil(t, err)
+	test.Equal(t, filter, ch.GetExtFilter())
+	// the invalid filter should fail locally and keep the old one
+	err = nsqdCoord1.UpdateChannelExtFilterToCluster(ch, nsqdNs.ExtFilterData{Type: 1})
+	test.NotNil(t, err)
+	test.Equal(t, filter, ch.GetExtFilter())
+
+	err = nsqdCoord1.UpdateChannelPriorityLanesToCluster(ch, 3)
+	test.Nil(t, err)
+	test.Equal(t, 3, ch.GetPriorityLanes())
+	err = nsqdCoord1.UpdateChannelPriorityLanesToCluster(ch, nsqdNs.MaxPriorityLanes+1)
+	test.NotNil(t, err)
+	test.Equal(t, 3, ch.GetPriorityLanes())
+}
@@ -255,6 +255,22 @@ func (self *NsqdRpcClient) DeleteNsqdTopic(epoch EpochType, topicInfo *TopicPart
 	return convertRpcError(err, retErr)
 }
 
+func (self *NsqdRpcClient) ResetChannel(epoch EpochType, topicInfo *TopicPartitionMetaInfo, channel string,
+	action int, ts int64) (*RpcResetChannelRsp, *CoordErr) {
+	var req RpcResetChannelReq
+	req.LookupdEpoch = epoch
+	req.TopicPartitionMetaInfo = *topicInfo
+	req.Channel = channel
+	req.Action = action
+	req.Timestamp = ts
+	rspVar, err := self.CallWithRetry("ResetChannel", &req)
+	if err != nil {
+		return nil, convertRpcError(err, nil)
+	}
+	rsp := rspVar.(*RpcResetChannelRsp)
+	return rsp, convertRpcError(err, &rsp.ErrInfo)
+}
+
 func (self *NsqdRpcClient) IsTopicWriteDisabled(topicInfo *TopicPartitionMetaInfo) bool {
 	var rpcInfo RpcAdminTopicInfo
 	rpcInfo.TopicPartitionMetaInfo = *topicInfo
@@ -278,6 +294,11 @@ func (self *NsqdRpcClient) TriggerLookupChanged() error {
 	return err
 }
 
+func (self *NsqdRpcClient) SetCatchupRateLimit(rate int64) error {
+	_, err := self.CallFast("SetCatchupRateLimit", rate)
+	return err
+}
+
 func (self *NsqdRpcClient) NotifyUpdateChannelOffset(leaderSession *TopicLeaderSession, info *TopicPartitionMetaInfo, channel string, offset ChannelConsumerOffset) *CoordErr {
 	var updateInfo RpcChannelOffsetArg
 	updateInfo.TopicName = info.Name
@@ -319,18 +340,18 @@ func (self *NsqdRpcClient) DeleteChannel(leaderSession *TopicLeaderSession, info
 }
 
 func (self *NsqdRpcClient) UpdateChannelState(leaderSession *TopicLeaderSession, info *TopicPartitionMetaInfo, channel string, paused int, skipped int) *CoordErr {
-	var channelState RpcChannelState
+	return self.updateChannelState(leaderSession, info, &RpcChannelState{Channel: channel, Paused: paused, Skipped: skipped})
+}
+
+func (self *NsqdRpcClient) updateChannelState(leaderSession *TopicLeaderSession, info *TopicPartitionMetaInfo, channelState *RpcChannelState) *CoordErr {
 	channelState.TopicName = info.Name
 	channelState.TopicPartition = info.Partition
 	channelState.TopicWriteEpoch = info.EpochForWrite
 	channelState.Epoch = info.Epoch
 	channelState.TopicLeaderSessionEpoch = leaderSession.LeaderEpoch
 	channelState.TopicLeaderSession = leaderSession.Session
-	channelState.Channel = channel
-	channelState.Paused = paused
-	channelState.Skipped = skipped
 
-	retErr, err := self.CallWithRetry("UpdateChannelState", &channelState)
+	retErr, err := self.CallWithRetry("UpdateChannelState", channelState)
 	return convertRpcError(err, retErr)
 }
 
@@ -528,6 +549,18 @@ func (self *NsqdRpcClient) GetLastCommitLogID(topicInfo *TopicPartitionMetaInfo)
 	return ret.(int64), convertRpcError(err, &retErr)
 }
 
+func (self *NsqdRpcClient) GetCommitLogEndOffset(topicInfo *TopicPartitionMetaInfo) (int64, *CoordErr) {
+	var req RpcCommitLogReq
+	req.TopicName = topicInfo.Name
+	req.TopicPartition = topicInfo.Partition
+	var retErr CoordErr
+	ret, err := self.CallFast("GetCommitLogEndOffset", &req)
+	if err != nil || ret == nil {
+		return 0, convertRpcError(err, &retErr)
+	}
+	return ret.(int64), convertRpcError(err, &retErr)
+}
+
 func (self *NsqdRpcClient) GetLastDelayedQueueCommitLogID(topicInfo *TopicPartitionMetaInfo) (int64, *CoordErr) {
 	var req RpcCommitLogReq
 	req.TopicName = topicInfo.Name
@@ -7,12 +7,16 @@ import (
 	"time"
 
 	"github.com/youzan/nsq/internal/protocol"
+	"github.com/youzan/nsq/nsqd"
 )
 
 const (
 	MAX_PARTITION_NUM  = 255
 	MAX_SYNC_EVERY     = 4000
 	MAX_RETENTION_DAYS = 60
+	// the message ttl should not exceed the max retention
+	MAX_MSG_TTL_SECONDS = MAX_RETENTION_DAYS * 24 * 3600
+	MAX_INDEX_KEY_LEN   = 255
 )
 
 func (self *NsqLookupCoordinator) GetAllLookupdNodes() ([]NsqLookupdNodeInfo, error) {
@@ -118,6 +122,38 @@ func (self *NsqLookupCoordinator) MoveTopicPartitionDataByManual(topicName strin
 	return err
 }
 
+func (self *NsqLookupCoordinator) GetBalancePlan() (*BalancePlan, error) {
+	if !self.IsMineLeader() {
+		return nil, ErrNotNsqLookupLeader
+	}
+	return self.dpm.getBalancePlan(false)
+}
+
+func (self *NsqLookupCoordinator) RefreshBalancePlan() (*BalancePlan, error) {
+	if !self.IsMineLeader() {
+		return nil, ErrNotNsqLookupLeader
+	}
+	coordLog.Infof("refresh the balance plan")
+	return self.dpm.getBalancePlan(true)
+}
+
+func (self *NsqLookupCoordinator) ApplyBalancePlan(planID int64, stepIDs []int) error {
+	if !self.IsMineLeader() {
+		return ErrNotNsqLookupLeader
+	}
+	coordLog.Infof("try apply balance plan %v steps: %v", planID, stepIDs)
+	return self.dpm.applyBalancePlan(planID, stepIDs)
+}
+
+func (self *NsqLookupCoordinator) CancelBalancePlan() error {
+	if !self.IsMineLeader() {
+		return ErrNotNsqLookupLeader
+	}
+	coordLog.Infof("cancel the applying balance plan")
+	self.dpm.cancelBalancePlan()
+	return nil
+}
+
 func (self *NsqLookupCoordinator) GetClusterNodeLoadFactor() (map[string]float64, map[string]float64) {
 	currentNodes := self.getCurrentNodes()
 	leaderFactors := make(map[string]float64, len(currentNodes))
@@ -162,6 +198,11 @@ func (self *NsqLookupCoordinator) MarkNodeAsRemoving(nid string) error {
 		self.removingNodes = newRemovingNodes
 	}
 	self.nodesMutex.Unlock()
+	self.decommissionMutex.Lock()
+	if _, ok := self.decommissions[nid]; !ok {
+		self.decommissions[nid] = newNodeDecommission()
+	}
+	self.decommissionMutex.Unlock()
 	return nil
 }
 
@@ -347,8 +388,38 @@ func (self *NsqLookupCoordinator) deleteTopicPartition(topic string, pid int) er
 	return nil
 }
 
-func (self *NsqLookupCoordinator) ChangeTopicMetaParam(topic string,
-	newSyncEvery int, newRetentionDay int, newReplicator int, upgradeExt string) error {
+// the topic meta params to change, the negative number and the empty string
+// means no change.
+type TopicMetaParamChange struct {
+	SyncEvery    int
+	RetentionDay int
+	Replica      int
+	// change the topic to ext topic, can not change ext to non-ext
+	UpgradeExt bool
+	// use none to disable the compression
+	Compression string
+	MsgTTL      int64
+	// use none to disable the index
+	IndexKey string
+}
+
+// NewTopicMetaParamChange returns the change with nothing changed
+func NewTopicMetaParamChange() TopicMetaParamChange {
+	return TopicMetaParamChange{
+		SyncEvery:    -1,
+		RetentionDay: -1,
+		Replica:      -1,
+		MsgTTL:       -1,
+	}
+}
+
+func (self *NsqLookupCoordinator) ChangeTopicMetaParam(topic string, change TopicMetaParamChange) error {
+	newSyncEvery := change.SyncEvery
+	newRetentionDay := change.RetentionDay
+	newReplicator := change.Replica
+	newCompression := change.Compression
+	newMsgTTL := change.MsgTTL
+	newIndexKey := change.IndexKey
 	if self.leaderNode.GetID() != self.myNode.GetID() {
 		coordLog.Infof("not leader while create topic")
 		return ErrNotNsqLookupLeader
@@ -367,6 +438,25 @@ func (self *NsqLookupCoordinator) ChangeTopicMetaParam(topic string,
 	if newReplicator > 5 {
 		return errors.New("max replicator allowed exceed")
 	}
+	// empty means no change, and use none to disable the compression
+	changeCompression := newCompression != ""
+	if newCompression == "none" {
+		newCompression = nsqd.CompressNone
+	}
+	if changeCompression && !nsqd.IsValidCompression(newCompression) {
+		return errors.New("invalid compression")
+	}
+	if newMsgTTL > MAX_MSG_TTL_SECONDS {
+		return errors.New("max message ttl allowed exceed")
+	}
+	// empty means no change, and use none to disable the index
+	changeIndexKey := newIndexKey != ""
+	if newIndexKey == "none" {
+		newIndexKey = ""
+	}
+	if len(newIndexKey) > MAX_INDEX_KEY_LEN {
+		return errors.New("index key too long")
+	}
 
 	self.joinStateMutex.Lock()
 	state, ok := self.joinISRState[topic]
@@ -402,12 +492,26 @@ func (self *NsqLookupCoordinator) ChangeTopicMetaParam(topic string,
 		if newReplicator > 0 {
 			meta.Replica = newReplicator
 		}
+		if newMsgTTL >= 0 {
+			meta.MsgTTL = newMsgTTL
+		}
+		if changeIndexKey {
+			if !meta.Ext && newIndexKey != "" {
+				return errors.New("index key only supported for the ext topic")
+			}
+			meta.IndexKey = newIndexKey
+		}
 		// change to ext only, can not change ext to non-ext
 		needDisableWrite := false
-		if upgradeExt == "true" && !meta.Ext {
+		if change.UpgradeExt && !meta.Ext {
 			meta.Ext = true
 			needDisableWrite = true
 		}
+		// the replicas should change the compression at the same time
+		if changeCompression && newCompression != meta.Compression {
+			meta.Compression = newCompression
+			needDisableWrite = true
+		}
 		if needDisableWrite {
 			if !atomic.CompareAndSwapInt32(&self.isUpgrading, 0, 1) {
 				coordLog.Infof("the cluster state is already upgrading")
@@ -550,6 +654,15 @@ func (self *NsqLookupCoordinator) CreateTopic(topic string, meta TopicMetaInfo)
 	if meta.PartitionNum >= MAX_PARTITION_NUM {
 		return errors.New("max partition allowed exceed")
 	}
+	if !nsqd.IsValidCompression(meta.Compression) {
+		return errors.New("invalid compression")
+	}
+	if meta.MsgTTL < 0 || meta.MsgTTL > MAX_MSG_TTL_SECONDS {
+		return errors.New("invalid message ttl")
+	}
+	if len(meta.IndexKey) > MAX_INDEX_KEY_LEN || (meta.IndexKey != "" && !meta.Ext) {
+		return errors.New("invalid index key")
+	}
 
 	currentNodes := self.getCurrentNodes()
 	if len(currentNodes) < meta.Replica {
@@ -656,3 +769,95 @@ func (self *NsqLookupCoordinator) checkAndUpdateTopicPartitions(currentNodes map
 	self.triggerCheckTopics("", 0, time.Millisecond*500)
 	return nil
 }
+
+type ChannelResetResult struct {
+	Partition   int    `json:"partition"`
+	Node        string `json:"node"`
+	QueueOffset int64  `json:"queue_offset"`
+	MsgCnt      int64  `json:"msg_cnt"`
+	Err         string `json:"error,omitempty"`
+}
+
+// reset the channel consume position to the timestamp for all the partitions
+// of the topic. The channel is paused on all the partition leaders before
+// reset and resumed after all reset done (unless it was paused before), so
+// the consumers will not see the partial reset.
+func (self *NsqLookupCoordinator) ResetChannelByTimestamp(topic string, channel string, ts int64) ([]ChannelResetResult, error) {
+	if self.leaderNode.GetID() != self.myNode.GetID() {
+		coordLog.Infof("not leader while reset channel")
+		return nil, ErrNotNsqLookupLeader
+	}
+	if !protocol.IsValidTopicName(topic) {
+		return nil, errors.New("invalid topic name")
+	}
+	if !protocol.IsValidChannelName(channel) {
+		return nil, errors.New("invalid channel name")
+	}
+	meta, _, err := self.leadership.GetTopicMetaInfo(topic)
+	if err != nil {
+		coordLog.Infof("get topic key %v failed :%v", topic, err)
+		return nil, err
+	}
+	topicInfoList := make([]*TopicPartitionMetaInfo, 0, meta.PartitionNum)
+	clients := make([]*NsqdRpcClient, 0, meta.PartitionNum)
+	for pid := 0; pid < meta.PartitionNum; pid++ {
+		topicInfo, err := self.leadership.GetTopicInfo(topic, pid)
+		if err != nil {
+			coordLog.Infof("failed to get the topic info %v-%v: %v", topic, pid, err)
+			return nil, err
+		}
+		c, rpcErr := self.acquireRpcClient(topicInfo.Leader)
+		if rpcErr != nil {
+			coordLog.Infof("failed to get rpc client: %v, %v", topicInfo.Leader, rpcErr)
+			return nil, rpcErr.ToErrorType()
+		}
+		topicInfoList = append(topicInfoList, topicInfo)
+		clients = append(clients, c)
+	}
+
+	coordLog.Infof("reset topic %v channel %v to timestamp %v", topic, channel, ts)
+	epoch := self.leaderNode.Epoch
+	needResume := make([]bool, len(clients))
+	defer func() {
+		for i, c := range clients {
+			if !needResume[i] {
+				continue
+			}
+			_, rpcErr := c.ResetChannel(epoch, topicInfoList[i], channel, ResetChannelResume, 0)
+			if rpcErr != nil {
+				coordLog.Warningf("failed to resume channel %v for topic %v: %v", channel,
+					topicInfoList[i].GetTopicDesp(), rpcErr)
+			}
+		}
+	}()
+	for i, c := range clients {
+		rsp, rpcErr := c.ResetChannel(epoch, topicInfoList[i], channel, ResetChannelPause, 0)
+		if rpcErr != nil {
+			coordLog.Infof("failed to pause channel %v for topic %v: %v", channel,
+				topicInfoList[i].GetTopicDesp(), rpcErr)
+			return nil, rpcErr.ToErrorType()
+		}
+		needResume[i] = !rsp.WasPaused
+	}
+
+	results := make([]ChannelResetResult, 0, len(clients))
+	var anyErr error
+	for i, c := range clients {
+		r := ChannelResetResult{
+			Partition: topicInfoList[i].Partition,
+			Node:      topicInfoList[i].Leader,
+		}
+		rsp, rpcErr := c.ResetChannel(epoch, topicInfoList[i], channel, ResetChannelToTimestamp, ts)
+		if rpcErr != nil {
+			coordLog.Infof("failed to reset channel %v for topic %v: %v", channel,
+				topicInfoList[i].GetTopicDesp(), rpcErr)
+			r.Err = rpcErr.String()
+			anyErr = rpcErr.ToErrorType()
+		} else {
+			r.QueueOffset = rsp.QueueOffset
+			r.MsgCnt = rsp.MsgCnt
+		}
+		results = append(results, r)
+	}
+	return results, anyErr
+}
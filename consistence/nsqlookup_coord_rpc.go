@@ -48,6 +48,25 @@ type RpcReqLeaveFromISRByLeader struct {
 	LeaderSession TopicLeaderSession
 }
 
+type RpcRaftMessage struct {
+	Msgs [][]byte
+}
+
+// the read or write request to the raft kv store on nsqlookupd
+type RpcRaftKVReq struct {
+	Get       bool
+	Recursive bool
+	Key       string
+	Op        RaftKVOp
+}
+
+type RpcRaftKVRsp struct {
+	CoordErr
+	Node *RaftKVNode
+}
+
+var ErrRaftKVNotEnabled = NewCoordErr("raft kv store is not enabled", CoordCommonErr)
+
 type NsqLookupCoordRpcServer struct {
 	nsqLookupCoord *NsqLookupCoordinator
 	rpcDispatcher  *gorpc.Dispatcher
@@ -185,3 +204,50 @@ func (self *NsqLookupCoordRpcServer) RequestCheckTopicConsistence(req *RpcReqChe
 	self.nsqLookupCoord.handleRequestCheckTopicConsistence(req.TopicName, req.TopicPartition)
 	return &coordErr
 }
+
+func (self *NsqLookupCoordRpcServer) getRaftKVStore() *RaftKVStore {
+	if self.nsqLookupCoord == nil {
+		return nil
+	}
+	mgr, ok := self.nsqLookupCoord.leadership.(*NsqLookupdRaftMgr)
+	if !ok {
+		return nil
+	}
+	return mgr.store
+}
+
+func (self *NsqLookupCoordRpcServer) RaftMessage(req *RpcRaftMessage) *CoordErr {
+	var coordErr CoordErr
+	store := self.getRaftKVStore()
+	if store == nil {
+		return ErrRaftKVNotEnabled
+	}
+	err := store.Step(req.Msgs)
+	if err != nil {
+		coordErr.ErrMsg = err.Error()
+		coordErr.ErrType = CoordCommonErr
+		coordErr.ErrCode = RpcCommonErr
+	}
+	return &coordErr
+}
+
+func (self *NsqLookupCoordRpcServer) RaftKV(req *RpcRaftKVReq) *RpcRaftKVRsp {
+	var rsp RpcRaftKVRsp
+	store := self.getRaftKVStore()
+	if store == nil {
+		rsp.CoordErr = *ErrRaftKVNotEnabled
+		return &rsp
+	}
+	var err error
+	if req.Get {
+		rsp.Node, err = store.Get(req.Key, req.Recursive)
+	} else {
+		rsp.Node, err = store.Do(&req.Op)
+	}
+	if err != nil {
+		rsp.ErrMsg = err.Error()
+		rsp.ErrType = CoordCommonErr
+		rsp.ErrCode = RpcCommonErr
+	}
+	return &rsp
+}
@@ -366,6 +366,14 @@ func (self *NsqLookupCoordinator) getNsqdLastCommitLogID(nid string, topicInfo *
 	return c.GetLastCommitLogID(topicInfo)
 }
 
+func (self *NsqLookupCoordinator) getNsqdCommitLogEndOffset(nid string, topicInfo *TopicPartitionMetaInfo) (int64, *CoordErr) {
+	c, err := self.acquireRpcClient(nid)
+	if err != nil {
+		return 0, err
+	}
+	return c.GetCommitLogEndOffset(topicInfo)
+}
+
 func (self *NsqLookupCoordinator) acquireRpcClient(nid string) (*NsqdRpcClient, *CoordErr) {
 	currentNodes, _ := self.getCurrentNodesWithRemoving()
 
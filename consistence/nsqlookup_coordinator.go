@@ -76,6 +76,10 @@ type TopicNameInfo struct {
 type Options struct {
 	BalanceStart int
 	BalanceEnd   int
+	// the leaders of topic partitions will prefer the nsqd nodes in this zone
+	PrimaryZone string
+	// the balance will only generate the plan which should be applied by manual
+	BalanceDryRun bool
 }
 
 // nsqlookup coordinator is used for the topic leader and isr coordinator, all the changes for leader or isr
@@ -106,6 +110,9 @@ type NsqLookupCoordinator struct {
 	dpm                *DataPlacement
 	balanceWaiting     int32
 	doChecking         int32
+	decommissionMutex  sync.Mutex
+	decommissions      map[string]*nodeDecommission
+	lastCatchupRate    int64
 }
 
 func NewNsqLookupCoordinator(cluster string, n *NsqLookupdNodeInfo, opts *Options) *NsqLookupCoordinator {
@@ -121,6 +128,7 @@ func NewNsqLookupCoordinator(cluster string, n *NsqLookupdNodeInfo, opts *Option
 		joinISRState:       make(map[string]*JoinISRState),
 		failedRpcList:      make([]RpcFailedInfo, 0),
 		nsqdMonitorChan:    make(chan struct{}),
+		decommissions:      make(map[string]*nodeDecommission),
 	}
 	if coord.leadership != nil {
 		coord.leadership.InitClusterID(coord.clusterKey)
@@ -129,6 +137,8 @@ func NewNsqLookupCoordinator(cluster string, n *NsqLookupdNodeInfo, opts *Option
 	coord.dpm = NewDataPlacement(coord)
 	if opts != nil {
 		coord.dpm.SetBalanceInterval(opts.BalanceStart, opts.BalanceEnd)
+		coord.dpm.SetPrimaryZone(opts.PrimaryZone)
+		coord.dpm.SetBalanceDryRun(opts.BalanceDryRun)
 	}
 	return coord
 }
@@ -149,6 +159,9 @@ func RetryWithTimeout(fn func() error) error {
 
 // init and register to leader server
 func (self *NsqLookupCoordinator) Start() error {
+	// the rpc server should be started before register since the embedded
+	// raft leadership need communicate with other lookupd nodes by rpc.
+	go self.nsqlookupRpcServer.start(self.myNode.NodeIP, self.myNode.RpcPort)
 	if self.leadership != nil {
 		err := self.leadership.Register(&self.myNode)
 		if err != nil {
@@ -158,7 +171,6 @@ func (self *NsqLookupCoordinator) Start() error {
 	}
 	self.wg.Add(1)
 	go self.handleLeadership()
-	go self.nsqlookupRpcServer.start(self.myNode.NodeIP, self.myNode.RpcPort)
 	self.notifyNodesLookup()
 	return nil
 }
@@ -251,6 +263,10 @@ func (self *NsqLookupCoordinator) notifyLeaderChanged(monitorChan chan struct{})
 		self.nodesMutex.Lock()
 		self.removingNodes = make(map[string]string)
 		self.nodesMutex.Unlock()
+		self.decommissionMutex.Lock()
+		self.decommissions = make(map[string]*nodeDecommission)
+		self.decommissionMutex.Unlock()
+		atomic.StoreInt64(&self.lastCatchupRate, 0)
 		self.rpcMutex.Lock()
 		for nid, c := range self.nsqdRpcClients {
 			c.Close()
@@ -471,6 +487,9 @@ func (self *NsqLookupCoordinator) handleRemovingNodes(monitorChan chan struct{})
 				removingNodes[nid] = removeState
 			}
 			self.nodesMutex.RUnlock()
+			// the nsqd nodes restarted or joined need the limit, and
+			// the limit should be reset after all the nodes removed.
+			self.syncCatchupRateLimit()
 			// remove state: marked -> pending -> data_transferred -> done
 			if len(removingNodes) == 0 {
 				continue
@@ -495,12 +514,18 @@ func (self *NsqLookupCoordinator) handleRemovingNodes(monitorChan chan struct{})
 			By(leaderSort).Sort(nodeTopicStats)
 
 			for nid := range removingNodes {
+				paused, maxConcurrent := self.getDecommission(nid)
+				if paused {
+					coordLog.Infof("the removing node %v is paused", nid)
+					continue
+				}
 				anyPending := false
 				coordLog.Infof("handle the removing node %v ", nid)
+				self.recordDecommissionPartitions(nid, allTopics)
 				// only check the topic with one replica left
 				// because the doCheckTopics will check the others
 				// we add a new replica for the removing node
-				moved := 0
+				movingTopics := make([]TopicPartitionMetaInfo, 0)
 				for _, topicInfo := range allTopics {
 					if FindSlice(topicInfo.ISR, nid) == -1 {
 						if FindSlice(topicInfo.CatchupList, nid) != -1 {
@@ -516,26 +541,57 @@ func (self *NsqLookupCoordinator) handleRemovingNodes(monitorChan chan struct{})
 						}
 						continue
 					}
-					if len(topicInfo.ISR) <= topicInfo.Replica {
-						anyPending = true
-						// find new catchup and wait isr ready
-						removingNodes[nid] = "pending"
-						err := self.dpm.addToCatchupAndWaitISRReady(monitorChan, topicInfo.Name, topicInfo.Partition,
-							"", nodeTopicStats, true)
-						if err != nil {
-							coordLog.Infof("topic %v data on node %v transferred failed, waiting next time", topicInfo.GetTopicDesp(), nid)
-							continue
-						}
-						coordLog.Infof("topic %v data on node %v transferred success", topicInfo.GetTopicDesp(), nid)
-						anyStateChanged = true
+					movingTopics = append(movingTopics, topicInfo)
+				}
+				// the ordered topic partitions are placed by the node list, so
+				// they can not be moved concurrently.
+				orderedTopics := make([]TopicPartitionMetaInfo, 0)
+				normalTopics := make([]TopicPartitionMetaInfo, 0, len(movingTopics))
+				for _, topicInfo := range movingTopics {
+					if topicInfo.OrderedMulti {
+						orderedTopics = append(orderedTopics, topicInfo)
+					} else {
+						normalTopics = append(normalTopics, topicInfo)
+					}
+				}
+				movingTopics = append(orderedTopics, normalTopics...)
+				moved := 0
+				for len(movingTopics) > 0 {
+					batch := movingTopics
+					if movingTopics[0].OrderedMulti {
+						batch = batch[:1]
+					} else if len(batch) > maxConcurrent {
+						batch = batch[:maxConcurrent]
 					}
-					if topicInfo.Leader == nid {
-						self.handleMoveTopic(true, topicInfo.Name, topicInfo.Partition, nid)
+					movingTopics = movingTopics[len(batch):]
+					var targets []string
+					if !batch[0].OrderedMulti {
+						targets = self.chooseCatchupNodesForRemoving(nid, batch, nodeTopicStats, By(leaderSort))
 					} else {
-						self.handleMoveTopic(false, topicInfo.Name, topicInfo.Partition, nid)
+						targets = make([]string, len(batch))
+					}
+					var wg sync.WaitGroup
+					var resultMutex sync.Mutex
+					for i, topicInfo := range batch {
+						if len(topicInfo.ISR) <= topicInfo.Replica {
+							anyPending = true
+							removingNodes[nid] = "pending"
+						}
+						wg.Add(1)
+						go func(topicInfo TopicPartitionMetaInfo, addNode string) {
+							defer wg.Done()
+							transferred := self.moveTopicFromRemovingNode(monitorChan, nid, &topicInfo, addNode, nodeTopicStats)
+							if transferred {
+								resultMutex.Lock()
+								anyStateChanged = true
+								resultMutex.Unlock()
+							}
+						}(topicInfo, targets[i])
 					}
-					moved++
-					if moved%16 == 0 {
+					wg.Wait()
+					moved += len(batch)
+					if moved >= 16 {
+						moved = 0
 						// recompute the load factor after moved some topics
 						nodeTopicStats = nodeTopicStats[:0]
 						for nodeID, nodeInfo := range currentNodes {
@@ -548,6 +604,20 @@ func (self *NsqLookupCoordinator) handleRemovingNodes(monitorChan chan struct{})
 						}
 						By(leaderSort).Sort(nodeTopicStats)
 					}
+					if len(movingTopics) == 0 {
+						break
+					}
+					paused, maxConcurrent = self.getDecommission(nid)
+					if paused {
+						coordLog.Infof("the removing node %v is paused, %v topics left", nid, len(movingTopics))
+						anyPending = true
+						break
+					}
+					select {
+					case <-monitorChan:
+						return
+					default:
+					}
 				}
 				if !anyPending {
 					anyStateChanged = true
@@ -562,6 +632,7 @@ func (self *NsqLookupCoordinator) handleRemovingNodes(monitorChan chan struct{})
 							_, ok := self.nsqdNodes[nid]
 							if !ok {
 								delete(removingNodes, nid)
+								self.removeDecommission(nid)
 								coordLog.Infof("the node %v is removed finally since not alive in cluster", nid)
 							}
 							self.nodesMutex.Unlock()
@@ -579,6 +650,31 @@ func (self *NsqLookupCoordinator) handleRemovingNodes(monitorChan chan struct{})
 	}
 }
 
+// move the topic replica out of the removing node to the given node, the node will be
+// chosen by the stats if not given. Return true if the data has been transferred to the
+// new replica.
+func (self *NsqLookupCoordinator) moveTopicFromRemovingNode(monitorChan chan struct{}, nid string,
+	topicInfo *TopicPartitionMetaInfo, addNode string, nodeTopicStats []NodeTopicStats) bool {
+	transferred := false
+	if len(topicInfo.ISR) <= topicInfo.Replica {
+		// find new catchup and wait isr ready
+		err := self.dpm.addToCatchupAndWaitISRReady(monitorChan, topicInfo.Name, topicInfo.Partition,
+			addNode, nodeTopicStats, true)
+		if err != nil {
+			coordLog.Infof("topic %v data on node %v transferred failed, waiting next time", topicInfo.GetTopicDesp(), nid)
+			return false
+		}
+		coordLog.Infof("topic %v data on node %v transferred success", topicInfo.GetTopicDesp(), nid)
+		transferred = true
+	}
+	if topicInfo.Leader == nid {
+		self.handleMoveTopic(true, topicInfo.Name, topicInfo.Partition, nid)
+	} else {
+		self.handleMoveTopic(false, topicInfo.Name, topicInfo.Partition, nid)
+	}
+	return transferred
+}
+
 func (self *NsqLookupCoordinator) triggerCheckTopics(topic string, part int, delay time.Duration) {
 	time.Sleep(delay)
 
@@ -514,7 +514,34 @@ func startNsqLookupCoord(t *testing.T, useFakeLeadership bool) (*NsqLookupCoordi
 	return coord, int(randPort), &n
 }
 
+func startNsqLookupCoordWithLeadership(t *testing.T, l NSQLookupdLeadership) (*NsqLookupCoordinator, int, *NsqLookupdNodeInfo) {
+	var n NsqLookupdNodeInfo
+	n.NodeIP = "127.0.0.1"
+	randPort := rand.Int31n(20000) + 30000
+	n.RpcPort = strconv.Itoa(int(randPort))
+	n.TcpPort = "0"
+	n.Epoch = 1
+	n.ID = GenNsqLookupNodeID(&n, "")
+	opts := &Options{
+		BalanceStart: 1,
+		BalanceEnd:   23,
+	}
+	coord := NewNsqLookupCoordinator(TEST_NSQ_CLUSTER_NAME, &n, opts)
+	coord.SetLeadershipMgr(l)
+	err := coord.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return coord, int(randPort), &n
+}
+
 func prepareCluster(t *testing.T, nodeList []string, useFakeLeadership bool) (*NsqLookupCoordinator, map[string]*testClusterNodeInfo) {
+	return prepareClusterWithZones(t, nodeList, nil, useFakeLeadership)
+}
+
+// the zone of each nsqd node is set by the same index of node list
+func prepareClusterWithZones(t *testing.T, nodeList []string, zones []string,
+	useFakeLeadership bool) (*NsqLookupCoordinator, map[string]*testClusterNodeInfo) {
 	rand.Seed(time.Now().Unix())
 	nsqdNodeInfoList := make(map[string]*testClusterNodeInfo)
 	serverAddrList := strings.Split(testEtcdServers, ",")
@@ -534,10 +561,13 @@ func prepareCluster(t *testing.T, nodeList []string, useFakeLeadership bool) (*N
 		rsp.Body.Close()
 	}
 
-	for _, id := range nodeList {
+	for i, id := range nodeList {
 		var n testClusterNodeInfo
 		n.localNsqd, n.randPort, n.nodeInfo, n.dataPath = newNsqdNode(t, id)
 		n.nsqdCoord = startNsqdCoord(t, strconv.Itoa(int(n.randPort)), n.dataPath, id, n.localNsqd, useFakeLeadership)
+		if i < len(zones) {
+			n.nsqdCoord.SetNodeZone(zones[i])
+		}
 		n.id = id
 		time.Sleep(time.Second)
 		nsqdNodeInfoList[n.nodeInfo.GetID()] = &n
@@ -653,7 +683,7 @@ func testNsqLookupNsqdNodesChange(t *testing.T, useFakeLeadership bool) {
 	}()
 
 	// test new topic create
-	err := lookupCoord1.CreateTopic(topic, TopicMetaInfo{2, 2, 0, 0, 0, 0, false, false})
+	err := lookupCoord1.CreateTopic(topic, TopicMetaInfo{PartitionNum: 2, Replica: 2})
 	test.Nil(t, err)
 
 	waitClusterStable(lookupCoord1, time.Second*3)
@@ -838,7 +868,7 @@ func testNsqLookupNsqdNodesChange(t *testing.T, useFakeLeadership bool) {
 	waitClusterStable(lookupCoord1, time.Second*5)
 	// test new topic create
 	coordLog.Warningf("============= begin test 3 replicas ====")
-	err = lookupCoord1.CreateTopic(topic3, TopicMetaInfo{1, 3, 0, 0, 0, 0, false, false})
+	err = lookupCoord1.CreateTopic(topic3, TopicMetaInfo{PartitionNum: 1, Replica: 3})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord1, time.Second*5)
 	// with 3 replica, the isr join timeout will change the isr list if the isr has the quorum nodes
@@ -969,7 +999,7 @@ func TestNsqLookupNsqdCreateTopic(t *testing.T) {
 	}()
 
 	// test new topic create
-	err := lookupCoord1.CreateTopic(topic_p1_r1, TopicMetaInfo{1, 1, 0, 0, 0, 0, false, false})
+	err := lookupCoord1.CreateTopic(topic_p1_r1, TopicMetaInfo{PartitionNum: 1, Replica: 1})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord1, time.Second*3)
 	pmeta, _, err := lookupLeadership.GetTopicMetaInfo(topic_p1_r1)
@@ -991,7 +1021,7 @@ func TestNsqLookupNsqdCreateTopic(t *testing.T) {
 	test.Equal(t, tc0.topicInfo.Leader, t0.Leader)
 	test.Equal(t, len(tc0.topicInfo.ISR), 1)
 
-	err = lookupCoord1.CreateTopic(topic_p1_r3, TopicMetaInfo{1, 3, 0, 0, 0, 0, false, false})
+	err = lookupCoord1.CreateTopic(topic_p1_r3, TopicMetaInfo{PartitionNum: 1, Replica: 3})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord1, time.Second*5)
 	lookupCoord1.triggerCheckTopics("", 0, 0)
@@ -1016,7 +1046,7 @@ func TestNsqLookupNsqdCreateTopic(t *testing.T) {
 	test.Equal(t, tc0.topicInfo.Leader, t0.Leader)
 	test.Equal(t, len(tc0.topicInfo.ISR), 3)
 
-	err = lookupCoord1.CreateTopic(topic_p3_r1, TopicMetaInfo{3, 1, 0, 0, 0, 0, false, false})
+	err = lookupCoord1.CreateTopic(topic_p3_r1, TopicMetaInfo{PartitionNum: 3, Replica: 1})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord1, time.Second*2)
 	waitClusterStable(lookupCoord1, time.Second*5)
@@ -1048,7 +1078,7 @@ func TestNsqLookupNsqdCreateTopic(t *testing.T) {
 	test.Equal(t, tc1.topicInfo.Leader, t1.Leader)
 	test.Equal(t, len(tc1.topicInfo.ISR), 1)
 
-	err = lookupCoord1.CreateTopic(topic_p2_r2, TopicMetaInfo{2, 2, 0, 0, 0, 0, false, false})
+	err = lookupCoord1.CreateTopic(topic_p2_r2, TopicMetaInfo{PartitionNum: 2, Replica: 2})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord1, time.Second*3)
 	waitClusterStable(lookupCoord1, time.Second*5)
@@ -1083,7 +1113,7 @@ func TestNsqLookupNsqdCreateTopic(t *testing.T) {
 	// test create on exist topic, create on partial partition
 	oldMeta, _, err := lookupCoord1.leadership.GetTopicMetaInfo(topic_p2_r2)
 	test.Nil(t, err)
-	err = lookupCoord1.CreateTopic(topic_p2_r2, TopicMetaInfo{2, 2, 0, 0, 1, 1, false, false})
+	err = lookupCoord1.CreateTopic(topic_p2_r2, TopicMetaInfo{PartitionNum: 2, Replica: 2, MagicCode: 1, RetentionDay: 1})
 	test.NotNil(t, err)
 	waitClusterStable(lookupCoord1, time.Second)
 	waitClusterStable(lookupCoord1, time.Second*5)
@@ -1093,6 +1123,96 @@ func TestNsqLookupNsqdCreateTopic(t *testing.T) {
 	SetCoordLogger(newTestLogger(t), levellogger.LOG_ERR)
 }
 
+func TestDataPlacementZoneCheck(t *testing.T) {
+	currentNodes := map[string]NsqdNodeInfo{
+		"n1": {ID: "n1", Zone: "z1"},
+		"n2": {ID: "n2", Zone: "z1"},
+		"n3": {ID: "n3", Zone: "z2"},
+		"n4": {ID: "n4"},
+		"n5": {ID: "n5"},
+	}
+	usedZones := getUsedZones(currentNodes, []string{"n1", "n4"}, []string{"n5"})
+	test.Equal(t, 1, len(usedZones))
+	test.Equal(t, true, isZoneUsed(usedZones, "z1"))
+	test.Equal(t, false, isZoneUsed(usedZones, "z2"))
+	// the node without zone is never in the used zone
+	test.Equal(t, false, isZoneUsed(usedZones, ""))
+
+	var topicInfo TopicPartitionMetaInfo
+	topicInfo.Leader = "n1"
+	topicInfo.ISR = []string{"n1", "n3", "n4", "n5"}
+	test.Equal(t, 0, len(getDuplicatedZoneNodes(&topicInfo, currentNodes)))
+	topicInfo.ISR = []string{"n1", "n2", "n3"}
+	dupNodes := getDuplicatedZoneNodes(&topicInfo, currentNodes)
+	test.Equal(t, []string{"n2"}, dupNodes)
+
+	test.Equal(t, false, isZoneSpreadAfterMove([]string{"n1", "n3"}, currentNodes, "n3", "n2"))
+	test.Equal(t, true, isZoneSpreadAfterMove([]string{"n1", "n3"}, currentNodes, "n1", "n2"))
+	test.Equal(t, true, isZoneSpreadAfterMove([]string{"n1", "n3"}, currentNodes, "n3", "n4"))
+}
+
+func TestNsqLookupNsqdCreateTopicWithZone(t *testing.T) {
+	if testing.Verbose() {
+		SetCoordLogger(levellogger.NewSimpleLog(), levellogger.LOG_INFO)
+		glog.SetFlags(0, "", "", true, true, 1)
+		glog.StartWorker(time.Second)
+	} else {
+		SetCoordLogger(newTestLogger(t), levellogger.LOG_WARN)
+	}
+	idList := []string{"id1", "id2", "id3", "id4"}
+	zoneList := []string{"zone1", "zone1", "zone2", "zone3"}
+	lookupCoord1, nodeInfoList := prepareClusterWithZones(t, idList, zoneList, false)
+	for _, n := range nodeInfoList {
+		defer os.RemoveAll(n.dataPath)
+		defer n.localNsqd.Exit()
+		defer n.nsqdCoord.Stop()
+	}
+	test.Equal(t, 4, len(nodeInfoList))
+	lookupCoord1.dpm.SetPrimaryZone("zone2")
+
+	topic_p1_r3 := "test-nsqlookup-topic-unit-testcreate-zone-p1-r3"
+	lookupLeadership := lookupCoord1.leadership
+
+	time.Sleep(time.Second)
+	checkDeleteErr(t, lookupCoord1.DeleteTopic(topic_p1_r3, "**"))
+	time.Sleep(time.Second * 3)
+	defer func() {
+		waitClusterStable(lookupCoord1, time.Second*3)
+		checkDeleteErr(t, lookupCoord1.DeleteTopic(topic_p1_r3, "**"))
+		time.Sleep(time.Second * 3)
+
+		lookupCoord1.Stop()
+	}()
+
+	err := lookupCoord1.CreateTopic(topic_p1_r3, TopicMetaInfo{1, 3, 0, 0, 0, 0, false, false, "", 0, ""})
+	test.Nil(t, err)
+	waitClusterStable(lookupCoord1, time.Second*5)
+	t0, err := lookupLeadership.GetTopicInfo(topic_p1_r3, 0)
+	test.Nil(t, err)
+	test.Equal(t, 3, len(t0.ISR))
+	currentNodes := lookupCoord1.getCurrentNodes()
+	// the leader should be in the primary zone and the isr should be in different zones
+	test.Equal(t, "zone2", currentNodes[t0.Leader].Zone)
+	test.Equal(t, 3, len(getUsedZones(currentNodes, t0.ISR)))
+
+	// the new leader should be in the primary zone if possible
+	oldLeader := t0.Leader
+	lookupCoord1.handleMoveTopic(true, topic_p1_r3, 0, oldLeader)
+	waitClusterStable(lookupCoord1, time.Second*5)
+	t0, err = lookupLeadership.GetTopicInfo(topic_p1_r3, 0)
+	test.Nil(t, err)
+	test.NotEqual(t, oldLeader, t0.Leader)
+	// the primary zone has only one node, so leader will be moved back while balance
+	monitorChan := make(chan struct{})
+	moved := lookupCoord1.dpm.rebalanceTopicZone(monitorChan, currentNodes, nil)
+	test.Equal(t, true, moved)
+	waitClusterStable(lookupCoord1, time.Second*5)
+	t0, err = lookupLeadership.GetTopicInfo(topic_p1_r3, 0)
+	test.Nil(t, err)
+	test.Equal(t, oldLeader, t0.Leader)
+	SetCoordLogger(newTestLogger(t), levellogger.LOG_ERR)
+}
+
 func TestNsqLookupUpdateTopicMeta(t *testing.T) {
 	if testing.Verbose() {
 		SetCoordLogger(levellogger.NewSimpleLog(), levellogger.LOG_INFO)
@@ -1125,16 +1245,21 @@ func TestNsqLookupUpdateTopicMeta(t *testing.T) {
 		lookupCoord.Stop()
 	}()
 
-	err := lookupCoord.CreateTopic(topic_p1_r1, TopicMetaInfo{1, 1, 0, 0, 0, 0, false, false})
+	err := lookupCoord.CreateTopic(topic_p1_r1, TopicMetaInfo{PartitionNum: 1, Replica: 1})
 	test.Nil(t, err)
 	time.Sleep(time.Second)
 
-	err = lookupCoord.CreateTopic(topic_p2_r1, TopicMetaInfo{2, 1, 0, 0, 0, 0, false, false})
+	err = lookupCoord.CreateTopic(topic_p2_r1, TopicMetaInfo{PartitionNum: 2, Replica: 1})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord, time.Second*5)
 
+	replicaChange := func(replica int) TopicMetaParamChange {
+		change := NewTopicMetaParamChange()
+		change.Replica = replica
+		return change
+	}
 	// test increase replicator and decrease the replicator
-	err = lookupCoord.ChangeTopicMetaParam(topic_p1_r1, -1, -1, 3, "")
+	err = lookupCoord.ChangeTopicMetaParam(topic_p1_r1, replicaChange(3))
 	lookupCoord.triggerCheckTopics("", 0, 0)
 	waitClusterStable(lookupCoord, time.Second*15)
 	tmeta, _, _ := lookupLeadership.GetTopicMetaInfo(topic_p1_r1)
@@ -1146,7 +1271,7 @@ func TestNsqLookupUpdateTopicMeta(t *testing.T) {
 		test.Equal(t, tmeta.Replica, len(info.ISR))
 	}
 
-	err = lookupCoord.ChangeTopicMetaParam(topic_p1_r1, -1, -1, 2, "")
+	err = lookupCoord.ChangeTopicMetaParam(topic_p1_r1, replicaChange(2))
 	lookupCoord.triggerCheckTopics("", 0, 0)
 	waitClusterStable(lookupCoord, time.Second*5)
 	time.Sleep(time.Second * 3)
@@ -1158,7 +1283,7 @@ func TestNsqLookupUpdateTopicMeta(t *testing.T) {
 		test.Equal(t, tmeta.Replica, len(info.ISR))
 	}
 
-	err = lookupCoord.ChangeTopicMetaParam(topic_p2_r1, -1, -1, 2, "")
+	err = lookupCoord.ChangeTopicMetaParam(topic_p2_r1, replicaChange(2))
 	lookupCoord.triggerCheckTopics("", 0, 0)
 	waitClusterStable(lookupCoord, time.Second*5)
 	time.Sleep(time.Second * 5)
@@ -1171,10 +1296,10 @@ func TestNsqLookupUpdateTopicMeta(t *testing.T) {
 	}
 
 	// should fail
-	err = lookupCoord.ChangeTopicMetaParam(topic_p2_r1, -1, -1, 3, "")
+	err = lookupCoord.ChangeTopicMetaParam(topic_p2_r1, replicaChange(3))
 	test.NotNil(t, err)
 
-	err = lookupCoord.ChangeTopicMetaParam(topic_p2_r1, -1, -1, 1, "")
+	err = lookupCoord.ChangeTopicMetaParam(topic_p2_r1, replicaChange(1))
 	waitClusterStable(lookupCoord, time.Second*5)
 	lookupCoord.triggerCheckTopics("", 0, 0)
 	time.Sleep(time.Second * 3)
@@ -1187,7 +1312,10 @@ func TestNsqLookupUpdateTopicMeta(t *testing.T) {
 	}
 
 	// test update the sync and retention , all partition and replica should be updated
-	err = lookupCoord.ChangeTopicMetaParam(topic_p1_r1, 1234, 3, -1, "")
+	change := NewTopicMetaParamChange()
+	change.SyncEvery = 1234
+	change.RetentionDay = 3
+	err = lookupCoord.ChangeTopicMetaParam(topic_p1_r1, change)
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord, time.Second*5)
 	time.Sleep(time.Second)
@@ -1244,15 +1372,15 @@ func TestNsqLookupMarkNodeRemove(t *testing.T) {
 		lookupCoord.Stop()
 	}()
 
-	err := lookupCoord.CreateTopic(topic_p4_r1, TopicMetaInfo{4, 1, 0, 0, 0, 0, false, false})
+	err := lookupCoord.CreateTopic(topic_p4_r1, TopicMetaInfo{PartitionNum: 4, Replica: 1})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord, time.Second)
 
-	err = lookupCoord.CreateTopic(topic_p2_r2, TopicMetaInfo{2, 2, 0, 0, 0, 0, false, false})
+	err = lookupCoord.CreateTopic(topic_p2_r2, TopicMetaInfo{PartitionNum: 2, Replica: 2})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord, time.Second)
 
-	err = lookupCoord.CreateTopic(topic_p1_r3, TopicMetaInfo{1, 3, 0, 0, 0, 0, false, false})
+	err = lookupCoord.CreateTopic(topic_p1_r3, TopicMetaInfo{PartitionNum: 1, Replica: 3})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord, time.Second)
 
@@ -1359,15 +1487,15 @@ func TestNsqLookupExpandPartition(t *testing.T) {
 		lookupCoord.Stop()
 	}()
 
-	err := lookupCoord.CreateTopic(topic_p1_r1, TopicMetaInfo{1, 1, 0, 0, 0, 0, false, false})
+	err := lookupCoord.CreateTopic(topic_p1_r1, TopicMetaInfo{PartitionNum: 1, Replica: 1})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord, time.Second)
 
-	err = lookupCoord.CreateTopic(topic_p1_r2, TopicMetaInfo{1, 2, 0, 0, 0, 0, false, false})
+	err = lookupCoord.CreateTopic(topic_p1_r2, TopicMetaInfo{PartitionNum: 1, Replica: 2})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord, time.Second)
 
-	err = lookupCoord.CreateTopic(topic_p1_r3, TopicMetaInfo{1, 3, 0, 0, 0, 0, false, false})
+	err = lookupCoord.CreateTopic(topic_p1_r3, TopicMetaInfo{PartitionNum: 1, Replica: 3})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord, time.Second)
 	waitClusterStable(lookupCoord, time.Second)
@@ -1471,13 +1599,13 @@ func TestNsqLookupMovePartition(t *testing.T) {
 	}()
 
 	// test new topic create
-	err := lookupCoord.CreateTopic(topic_p1_r1, TopicMetaInfo{1, 1, 0, 0, 0, 0, false, false})
+	err := lookupCoord.CreateTopic(topic_p1_r1, TopicMetaInfo{PartitionNum: 1, Replica: 1})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord, time.Second*3)
 
-	err = lookupCoord.CreateTopic(topic_p2_r2, TopicMetaInfo{2, 2, 0, 0, 0, 0, false, false})
+	err = lookupCoord.CreateTopic(topic_p2_r2, TopicMetaInfo{PartitionNum: 2, Replica: 2})
 	test.Nil(t, err)
-	err = lookupCoord.CreateTopic(topic_ordered_p4_r3, TopicMetaInfo{4, 3, 0, 0, 0, 0, true, false})
+	err = lookupCoord.CreateTopic(topic_ordered_p4_r3, TopicMetaInfo{PartitionNum: 4, Replica: 3, OrderedMulti: true})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord, time.Second*5)
 
@@ -1753,14 +1881,14 @@ func TestNsqLookupOrderedTopicCreate(t *testing.T) {
 	}()
 
 	// test new topic create
-	err := lookupCoord1.CreateTopic(topic_p8_r3, TopicMetaInfo{8, 3, 0, 0, 0, 0, true, false})
+	err := lookupCoord1.CreateTopic(topic_p8_r3, TopicMetaInfo{PartitionNum: 8, Replica: 3, OrderedMulti: true})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord1, time.Second*3)
 
 	checkOrderedMultiTopic(t, topic_p8_r3, 8, len(nodeInfoList),
 		nodeInfoList, lookupLeadership, true)
 
-	err = lookupCoord1.CreateTopic(topic_p13_r1, TopicMetaInfo{13, 1, 0, 0, 0, 0, true, false})
+	err = lookupCoord1.CreateTopic(topic_p13_r1, TopicMetaInfo{PartitionNum: 13, Replica: 1, OrderedMulti: true})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord1, time.Second*5)
 	lookupCoord1.triggerCheckTopics("", 0, 0)
@@ -1769,7 +1897,7 @@ func TestNsqLookupOrderedTopicCreate(t *testing.T) {
 	checkOrderedMultiTopic(t, topic_p13_r1, 13, len(nodeInfoList),
 		nodeInfoList, lookupLeadership, true)
 
-	err = lookupCoord1.CreateTopic(topic_p25_r3, TopicMetaInfo{25, 3, 0, 0, 0, 0, true, false})
+	err = lookupCoord1.CreateTopic(topic_p25_r3, TopicMetaInfo{PartitionNum: 25, Replica: 3, OrderedMulti: true})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord1, time.Second*2)
 	waitClusterStable(lookupCoord1, time.Second*5)
@@ -1780,7 +1908,7 @@ func TestNsqLookupOrderedTopicCreate(t *testing.T) {
 	// test create on exist topic, create on partial partition
 	oldMeta, _, err := lookupCoord1.leadership.GetTopicMetaInfo(topic_p25_r3)
 	test.Nil(t, err)
-	err = lookupCoord1.CreateTopic(topic_p25_r3, TopicMetaInfo{25, 3, 0, 0, 1, 1, true, false})
+	err = lookupCoord1.CreateTopic(topic_p25_r3, TopicMetaInfo{PartitionNum: 25, Replica: 3, MagicCode: 1, RetentionDay: 1, OrderedMulti: true})
 	test.NotNil(t, err)
 	waitClusterStable(lookupCoord1, time.Second)
 	waitClusterStable(lookupCoord1, time.Second*5)
@@ -1904,7 +2032,7 @@ func TestNsqLookupOrderedTopicBalance(t *testing.T) {
 		lookupCoord1.Stop()
 	}()
 
-	err := lookupCoord1.CreateTopic(topic_p13_r2, TopicMetaInfo{13, 2, 0, 0, 0, 0, true, false})
+	err := lookupCoord1.CreateTopic(topic_p13_r2, TopicMetaInfo{PartitionNum: 13, Replica: 2, OrderedMulti: true})
 	test.Nil(t, err)
 	waitClusterStable(lookupCoord1, time.Second*10)
 	time.Sleep(time.Second * 3)
@@ -190,3 +190,32 @@ func (self *NsqLookupRpcClient) RequestCheckTopicConsistence(topic string, parti
 	req.TopicPartition = partition
 	self.CallWithRetry("RequestCheckTopicConsistence", &req)
 }
+
+func (self *NsqLookupRpcClient) RaftMessage(msgs [][]byte) error {
+	var req RpcRaftMessage
+	req.Msgs = msgs
+	ret, err := self.CallFast("RaftMessage", &req)
+	if err != nil && self.ShouldRemoved() {
+		self.Reconnect()
+	}
+	coordErr := convertRpcError(err, ret)
+	if coordErr != nil {
+		return coordErr.ToErrorType()
+	}
+	return nil
+}
+
+func (self *NsqLookupRpcClient) RaftKV(req *RpcRaftKVReq) (*RaftKVNode, error) {
+	ret, err := self.CallWithRetry("RaftKV", req)
+	if err != nil {
+		return nil, err
+	}
+	rsp, ok := ret.(*RpcRaftKVRsp)
+	if !ok || rsp == nil {
+		return nil, ErrRpcMethodUnknown.ToErrorType()
+	}
+	if rsp.HasError() {
+		return nil, convertRaftKVError(rsp.ErrMsg)
+	}
+	return rsp.Node, nil
+}
@@ -0,0 +1,1033 @@
+package consistence
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/absolute8511/bolt"
+	"github.com/coreos/etcd/raft"
+	"github.com/coreos/etcd/raft/raftpb"
+	"golang.org/x/net/context"
+)
+
+// The raft kv store is the embedded metadata store replicated by the raft
+// between the nsqlookupd nodes, it is a small subset of the etcd v2 keys api
+// (directory, ttl, compare and swap, watch) which is enough for the cluster
+// leadership. All the data is kept in memory and the raft log and snapshot
+// are persisted in the local bolt db.
+
+const (
+	RaftKVOpSet = iota + 1
+	RaftKVOpDelete
+	RaftKVOpRefresh
+	RaftKVOpExpire
+)
+
+const (
+	RaftKVPrevIgnore = iota
+	RaftKVPrevExist
+	RaftKVPrevNoExist
+)
+
+const (
+	raftKVTickInterval   = time.Millisecond * 100
+	raftKVElectionTick   = 10
+	raftKVHeartbeatTick  = 1
+	raftKVRequestTimeout = time.Second * 5
+	raftKVExpireInterval = time.Second
+	raftKVSnapCount      = 10000
+	// the log entries kept after snapshot for the slow followers
+	raftKVSnapCatchupEntries = 1000
+	raftKVWatchBuffer        = 4096
+)
+
+var (
+	ErrRaftKVCompareFailed = errors.New("raft kv compare failed")
+	ErrRaftKVNotFile       = errors.New("raft kv key is a directory")
+	ErrRaftKVNotDir        = errors.New("raft kv key is not a directory")
+	ErrRaftKVStopped       = errors.New("raft kv store stopped")
+	ErrRaftKVTimeout       = errors.New("raft kv request timeout")
+	ErrRaftKVInvalidPeers  = errors.New("raft kv peers should contain the local node")
+
+	raftKVErrList = []error{ErrKeyNotFound, ErrKeyAlreadyExist, ErrRaftKVCompareFailed,
+		ErrRaftKVNotFile, ErrRaftKVNotDir, ErrRaftKVStopped, ErrRaftKVTimeout}
+
+	bucketRaftEntries = []byte("raft_entries")
+	bucketRaftMeta    = []byte("raft_meta")
+	raftHardStateKey  = []byte("hardstate")
+	raftSnapshotKey   = []byte("snapshot")
+)
+
+// RaftKVNode is the key or the directory in the store, the children are only
+// filled for the directory while reading.
+type RaftKVNode struct {
+	Key           string
+	Value         string
+	Dir           bool
+	CreatedIndex  uint64
+	ModifiedIndex uint64
+	// the unix nano time to expire, 0 means never expire
+	ExpireAt int64
+	Nodes    []*RaftKVNode `json:",omitempty"`
+}
+
+func (self *RaftKVNode) copyNode() *RaftKVNode {
+	n := *self
+	n.Nodes = nil
+	return &n
+}
+
+// RaftKVOp is the write operation proposed to the raft, the expire time is
+// decided by the proposer to make the apply deterministic.
+type RaftKVOp struct {
+	Type      int
+	NodeID    uint64
+	ReqID     uint64
+	Key       string
+	Value     string
+	Dir       bool
+	Recursive bool
+	// ttl in seconds
+	TTL       int64
+	ExpireAt  int64
+	PrevExist int
+	// 0 means no check for the modified index
+	PrevIndex uint64
+	PrevValue string
+	// used by the expire operation
+	Keys []string
+	Now  int64
+}
+
+type RaftKVEvent struct {
+	// create, set, delete or expire
+	Action   string
+	Node     *RaftKVNode
+	PrevNode *RaftKVNode
+}
+
+type raftKVResult struct {
+	node *RaftKVNode
+	err  error
+}
+
+type raftKVWatcher struct {
+	prefix string
+	ch     chan *RaftKVEvent
+}
+
+func (self *raftKVWatcher) match(key string) bool {
+	if self.prefix == "/" || key == self.prefix || strings.HasPrefix(key, self.prefix+"/") {
+		return true
+	}
+	// the parent directory is removed
+	return strings.HasPrefix(self.prefix, key+"/")
+}
+
+// the transport used to send the raft messages to the peers
+type raftKVTransport interface {
+	setStore(s *RaftKVStore)
+	send(msgs []raftpb.Message)
+	stop()
+}
+
+// GetRaftKVNodeID returns the raft id of the node, the id is decided by the
+// rpc address of the nsqlookupd.
+func GetRaftKVNodeID(addr string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(addr))
+	id := h.Sum64()
+	if id == 0 {
+		id = 1
+	}
+	return id
+}
+
+func convertRaftKVError(msg string) error {
+	for _, e := range raftKVErrList {
+		if e.Error() == msg {
+			return e
+		}
+	}
+	return errors.New(msg)
+}
+
+type raftLogger struct{}
+
+func (l *raftLogger) Debug(v ...interface{})                   { coordLog.Debugf("%v", v) }
+func (l *raftLogger) Debugf(format string, v ...interface{})   { coordLog.Debugf(format, v...) }
+func (l *raftLogger) Info(v ...interface{})                    { coordLog.Infof("%v", v) }
+func (l *raftLogger) Infof(format string, v ...interface{})    { coordLog.Infof(format, v...) }
+func (l *raftLogger) Warning(v ...interface{})                 { coordLog.Warningf("%v", v) }
+func (l *raftLogger) Warningf(format string, v ...interface{}) { coordLog.Warningf(format, v...) }
+func (l *raftLogger) Error(v ...interface{})                   { coordLog.Errorf("%v", v) }
+func (l *raftLogger) Errorf(format string, v ...interface{})   { coordLog.Errorf(format, v...) }
+func (l *raftLogger) Fatal(v ...interface{}) {
+	coordLog.Errorf("%v", v)
+	os.Exit(1)
+}
+func (l *raftLogger) Fatalf(format string, v ...interface{}) {
+	coordLog.Errorf(format, v...)
+	os.Exit(1)
+}
+func (l *raftLogger) Panic(v ...interface{}) {
+	coordLog.Errorf("%v", v)
+	panic(fmt.Sprint(v...))
+}
+func (l *raftLogger) Panicf(format string, v ...interface{}) {
+	coordLog.Errorf(format, v...)
+	panic(fmt.Sprintf(format, v...))
+}
+
+type RaftKVStore struct {
+	id        uint64
+	node      raft.Node
+	storage   *raft.MemoryStorage
+	db        *bolt.DB
+	transport raftKVTransport
+
+	dataLock      sync.RWMutex
+	data          map[string]*RaftKVNode
+	appliedIndex  uint64
+	snapshotIndex uint64
+	confState     raftpb.ConfState
+
+	waitLock sync.Mutex
+	waits    map[uint64]chan raftKVResult
+	reqID    uint64
+
+	watchLock sync.Mutex
+	watchers  map[*raftKVWatcher]struct{}
+
+	leader   uint64
+	stopOnce sync.Once
+	stopC    chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewRaftKVStore starts the raft kv store with the rpc transport, the peers
+// are the rpc addresses of all the nsqlookupd nodes (include the local node)
+// separated by comma.
+func NewRaftKVStore(localAddr string, peers string, dataPath string) (*RaftKVStore, error) {
+	peerMap := make(map[uint64]string)
+	for _, addr := range strings.Split(peers, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		peerMap[GetRaftKVNodeID(addr)] = addr
+	}
+	id := GetRaftKVNodeID(localAddr)
+	if _, ok := peerMap[id]; !ok {
+		return nil, ErrRaftKVInvalidPeers
+	}
+	trans := newRaftRpcTransport(id, peerMap)
+	s, err := newRaftKVStore(id, peerMap, dataPath, trans)
+	if err != nil {
+		trans.stop()
+		return nil, err
+	}
+	return s, nil
+}
+
+func newRaftKVStore(id uint64, peers map[uint64]string, dataPath string, trans raftKVTransport) (*RaftKVStore, error) {
+	err := os.MkdirAll(dataPath, 0755)
+	if err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path.Join(dataPath, "raft_kv.db"), 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	s := &RaftKVStore{
+		id:        id,
+		storage:   raft.NewMemoryStorage(),
+		db:        db,
+		transport: trans,
+		data:      make(map[string]*RaftKVNode),
+		waits:     make(map[uint64]chan raftKVResult),
+		reqID:     uint64(time.Now().UnixNano()),
+		watchers:  make(map[*raftKVWatcher]struct{}),
+		stopC:     make(chan struct{}),
+	}
+	hasState, err := s.loadRaftState()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	c := &raft.Config{
+		ID:              id,
+		ElectionTick:    raftKVElectionTick,
+		HeartbeatTick:   raftKVHeartbeatTick,
+		Storage:         s.storage,
+		Applied:         s.appliedIndex,
+		MaxSizePerMsg:   1024 * 1024,
+		MaxInflightMsgs: 256,
+		CheckQuorum:     true,
+		PreVote:         true,
+		// set the logger for this node only to avoid changing the global raft logger
+		Logger: &raftLogger{},
+	}
+	if hasState {
+		s.node = raft.RestartNode(c)
+	} else {
+		rpeers := make([]raft.Peer, 0, len(peers))
+		for pid, addr := range peers {
+			rpeers = append(rpeers, raft.Peer{ID: pid, Context: []byte(addr)})
+		}
+		s.node = raft.StartNode(c, rpeers)
+	}
+	// the messages will be sent after run, so the transport can deliver the
+	// messages to the store from now on.
+	trans.setStore(s)
+	coordLog.Infof("raft kv store %v started at %v, peers: %v, restart: %v", id, dataPath, peers, hasState)
+	s.wg.Add(2)
+	go s.run()
+	go s.expireLoop()
+	return s, nil
+}
+
+// load the persisted raft log and restore the data from the snapshot
+func (self *RaftKVStore) loadRaftState() (bool, error) {
+	hasState := false
+	err := self.db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(bucketRaftMeta)
+		if err != nil {
+			return err
+		}
+		entries, err := tx.CreateBucketIfNotExists(bucketRaftEntries)
+		if err != nil {
+			return err
+		}
+		if v := meta.Get(raftSnapshotKey); v != nil {
+			var snap raftpb.Snapshot
+			if err := snap.Unmarshal(v); err != nil {
+				return err
+			}
+			if err := self.storage.ApplySnapshot(snap); err != nil {
+				return err
+			}
+			if err := self.restoreData(snap); err != nil {
+				return err
+			}
+			hasState = true
+		}
+		if v := meta.Get(raftHardStateKey); v != nil {
+			var hs raftpb.HardState
+			if err := hs.Unmarshal(v); err != nil {
+				return err
+			}
+			if err := self.storage.SetHardState(hs); err != nil {
+				return err
+			}
+			hasState = true
+		}
+		ents := make([]raftpb.Entry, 0)
+		err = entries.ForEach(func(k, v []byte) error {
+			var e raftpb.Entry
+			if err := e.Unmarshal(v); err != nil {
+				return err
+			}
+			if e.Index > self.snapshotIndex {
+				ents = append(ents, e)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if len(ents) > 0 {
+			hasState = true
+			return self.storage.Append(ents)
+		}
+		return nil
+	})
+	return hasState, err
+}
+
+func (self *RaftKVStore) restoreData(snap raftpb.Snapshot) error {
+	data := make(map[string]*RaftKVNode)
+	if len(snap.Data) > 0 {
+		if err := json.Unmarshal(snap.Data, &data); err != nil {
+			return err
+		}
+	}
+	self.dataLock.Lock()
+	self.data = data
+	self.appliedIndex = snap.Metadata.Index
+	self.snapshotIndex = snap.Metadata.Index
+	self.confState = snap.Metadata.ConfState
+	self.dataLock.Unlock()
+	return nil
+}
+
+func raftIndexKey(index uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, index)
+	return k
+}
+
+func (self *RaftKVStore) saveRaftState(hs raftpb.HardState, ents []raftpb.Entry, snap raftpb.Snapshot) error {
+	if raft.IsEmptyHardState(hs) && len(ents) == 0 && raft.IsEmptySnap(snap) {
+		return nil
+	}
+	return self.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(bucketRaftMeta)
+		entries := tx.Bucket(bucketRaftEntries)
+		if !raft.IsEmptySnap(snap) {
+			v, err := snap.Marshal()
+			if err != nil {
+				return err
+			}
+			if err := meta.Put(raftSnapshotKey, v); err != nil {
+				return err
+			}
+			if err := deleteRaftEntries(entries, 0, snap.Metadata.Index); err != nil {
+				return err
+			}
+		}
+		if len(ents) > 0 {
+			// the entries after the first new entry are conflicted
+			if err := deleteRaftEntries(entries, ents[0].Index, 0); err != nil {
+				return err
+			}
+			for i := range ents {
+				v, err := ents[i].Marshal()
+				if err != nil {
+					return err
+				}
+				if err := entries.Put(raftIndexKey(ents[i].Index), v); err != nil {
+					return err
+				}
+			}
+		}
+		if !raft.IsEmptyHardState(hs) {
+			v, err := hs.Marshal()
+			if err != nil {
+				return err
+			}
+			if err := meta.Put(raftHardStateKey, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// delete the entries in [from, to], 0 for to means no limit
+func deleteRaftEntries(b *bolt.Bucket, from uint64, to uint64) error {
+	c := b.Cursor()
+	for k, _ := c.Seek(raftIndexKey(from)); k != nil; k, _ = c.Next() {
+		if to > 0 && binary.BigEndian.Uint64(k) > to {
+			break
+		}
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *RaftKVStore) run() {
+	defer self.wg.Done()
+	ticker := time.NewTicker(raftKVTickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			self.node.Tick()
+		case rd := <-self.node.Ready():
+			err := self.saveRaftState(rd.HardState, rd.Entries, rd.Snapshot)
+			if err != nil {
+				coordLog.Errorf("raft kv store save raft state failed: %v", err)
+				go self.Stop()
+				return
+			}
+			if !raft.IsEmptySnap(rd.Snapshot) {
+				self.storage.ApplySnapshot(rd.Snapshot)
+				err = self.restoreData(rd.Snapshot)
+				if err != nil {
+					coordLog.Errorf("raft kv store restore snapshot failed: %v", err)
+					go self.Stop()
+					return
+				}
+				coordLog.Infof("raft kv store restored from snapshot at %v", rd.Snapshot.Metadata.Index)
+			}
+			if !raft.IsEmptyHardState(rd.HardState) {
+				self.storage.SetHardState(rd.HardState)
+			}
+			self.storage.Append(rd.Entries)
+			self.transport.send(rd.Messages)
+			if rd.SoftState != nil {
+				old := atomic.SwapUint64(&self.leader, rd.SoftState.Lead)
+				if old != rd.SoftState.Lead {
+					coordLog.Infof("raft kv store %v leader changed from %v to %v", self.id, old, rd.SoftState.Lead)
+				}
+			}
+			self.applyEntries(rd.CommittedEntries)
+			self.maybeSnapshot()
+			self.node.Advance()
+		case <-self.stopC:
+			return
+		}
+	}
+}
+
+func (self *RaftKVStore) applyEntries(ents []raftpb.Entry) {
+	for _, e := range ents {
+		if e.Index <= self.getAppliedIndex() {
+			continue
+		}
+		switch e.Type {
+		case raftpb.EntryNormal:
+			if len(e.Data) > 0 {
+				var op RaftKVOp
+				err := json.Unmarshal(e.Data, &op)
+				if err != nil {
+					coordLog.Errorf("raft kv store invalid entry at %v: %v", e.Index, err)
+				} else {
+					self.applyOp(&op, e.Index)
+				}
+			}
+		case raftpb.EntryConfChange:
+			var cc raftpb.ConfChange
+			cc.Unmarshal(e.Data)
+			cs := self.node.ApplyConfChange(cc)
+			self.dataLock.Lock()
+			self.confState = *cs
+			self.dataLock.Unlock()
+		}
+		self.dataLock.Lock()
+		self.appliedIndex = e.Index
+		self.dataLock.Unlock()
+	}
+}
+
+func (self *RaftKVStore) applyOp(op *RaftKVOp, index uint64) {
+	self.dataLock.Lock()
+	var events []*RaftKVEvent
+	var ret raftKVResult
+	switch op.Type {
+	case RaftKVOpSet:
+		ret.node, events, ret.err = self.applySet(op, index)
+	case RaftKVOpDelete:
+		ret.node, events, ret.err = self.applyDelete(op)
+	case RaftKVOpRefresh:
+		n := self.data[op.Key]
+		if n == nil {
+			ret.err = ErrKeyNotFound
+		} else if ret.err = checkRaftKVPrev(op, n); ret.err == nil {
+			n.ExpireAt = op.ExpireAt
+			ret.node = n.copyNode()
+		}
+	case RaftKVOpExpire:
+		for _, k := range op.Keys {
+			n, ok := self.data[k]
+			if !ok || n.ExpireAt == 0 || n.ExpireAt > op.Now {
+				continue
+			}
+			self.removeNoLock(k)
+			events = append(events, &RaftKVEvent{Action: "expire", Node: n.copyNode(), PrevNode: n.copyNode()})
+		}
+	}
+	self.dataLock.Unlock()
+
+	for _, e := range events {
+		self.notifyWatchers(e)
+	}
+	if op.NodeID != self.id {
+		return
+	}
+	self.waitLock.Lock()
+	ch, ok := self.waits[op.ReqID]
+	if ok {
+		delete(self.waits, op.ReqID)
+	}
+	self.waitLock.Unlock()
+	if ok {
+		ch <- ret
+	}
+}
+
+func checkRaftKVPrev(op *RaftKVOp, old *RaftKVNode) error {
+	switch op.PrevExist {
+	case RaftKVPrevExist:
+		if old == nil {
+			return ErrKeyNotFound
+		}
+	case RaftKVPrevNoExist:
+		if old != nil {
+			return ErrKeyAlreadyExist
+		}
+	}
+	if op.PrevIndex == 0 && op.PrevValue == "" {
+		return nil
+	}
+	if old == nil {
+		return ErrKeyNotFound
+	}
+	if op.PrevIndex != 0 && old.ModifiedIndex != op.PrevIndex {
+		return ErrRaftKVCompareFailed
+	}
+	if op.PrevValue != "" && old.Value != op.PrevValue {
+		return ErrRaftKVCompareFailed
+	}
+	return nil
+}
+
+func (self *RaftKVStore) applySet(op *RaftKVOp, index uint64) (*RaftKVNode, []*RaftKVEvent, error) {
+	old := self.data[op.Key]
+	if err := checkRaftKVPrev(op, old); err != nil {
+		return nil, nil, err
+	}
+	if old != nil && old.Dir {
+		return nil, nil, ErrRaftKVNotFile
+	}
+	if old != nil && op.Dir {
+		return nil, nil, ErrRaftKVNotDir
+	}
+	// the parent directories are created if not exist
+	var parents []string
+	for p := path.Dir(op.Key); p != "/" && p != "."; p = path.Dir(p) {
+		pn, ok := self.data[p]
+		if !ok {
+			parents = append(parents, p)
+		} else if !pn.Dir {
+			return nil, nil, ErrRaftKVNotDir
+		}
+	}
+	for _, p := range parents {
+		self.data[p] = &RaftKVNode{Key: p, Dir: true, CreatedIndex: index, ModifiedIndex: index}
+	}
+	n := &RaftKVNode{
+		Key:           op.Key,
+		Value:         op.Value,
+		Dir:           op.Dir,
+		CreatedIndex:  index,
+		ModifiedIndex: index,
+		ExpireAt:      op.ExpireAt,
+	}
+	e := &RaftKVEvent{Action: "create", Node: n.copyNode()}
+	if old != nil {
+		n.CreatedIndex = old.CreatedIndex
+		e.Action = "set"
+		e.PrevNode = old.copyNode()
+		e.Node.CreatedIndex = old.CreatedIndex
+	}
+	self.data[op.Key] = n
+	return n.copyNode(), []*RaftKVEvent{e}, nil
+}
+
+func (self *RaftKVStore) applyDelete(op *RaftKVOp) (*RaftKVNode, []*RaftKVEvent, error) {
+	old := self.data[op.Key]
+	if old == nil {
+		return nil, nil, ErrKeyNotFound
+	}
+	if err := checkRaftKVPrev(op, old); err != nil {
+		return nil, nil, err
+	}
+	if old.Dir && !op.Recursive {
+		return nil, nil, ErrRaftKVNotFile
+	}
+	self.removeNoLock(op.Key)
+	return old.copyNode(), []*RaftKVEvent{{Action: "delete", Node: old.copyNode(), PrevNode: old.copyNode()}}, nil
+}
+
+func (self *RaftKVStore) removeNoLock(key string) {
+	delete(self.data, key)
+	prefix := key + "/"
+	for k := range self.data {
+		if strings.HasPrefix(k, prefix) {
+			delete(self.data, k)
+		}
+	}
+}
+
+func (self *RaftKVStore) notifyWatchers(e *RaftKVEvent) {
+	self.watchLock.Lock()
+	defer self.watchLock.Unlock()
+	for w := range self.watchers {
+		if !w.match(e.Node.Key) {
+			continue
+		}
+		select {
+		case w.ch <- e:
+		default:
+			// the slow watcher is closed and should get the newest data and watch again
+			coordLog.Warningf("raft kv watcher %v is too slow, closed", w.prefix)
+			delete(self.watchers, w)
+			close(w.ch)
+		}
+	}
+}
+
+func (self *RaftKVStore) getAppliedIndex() uint64 {
+	self.dataLock.RLock()
+	defer self.dataLock.RUnlock()
+	return self.appliedIndex
+}
+
+func (self *RaftKVStore) maybeSnapshot() {
+	self.dataLock.RLock()
+	applied := self.appliedIndex
+	if applied-self.snapshotIndex < raftKVSnapCount {
+		self.dataLock.RUnlock()
+		return
+	}
+	data, err := json.Marshal(self.data)
+	cs := self.confState
+	self.dataLock.RUnlock()
+	if err != nil {
+		coordLog.Errorf("raft kv store snapshot failed: %v", err)
+		return
+	}
+	snap, err := self.storage.CreateSnapshot(applied, &cs, data)
+	if err != nil {
+		coordLog.Errorf("raft kv store snapshot failed: %v", err)
+		return
+	}
+	err = self.saveRaftState(raftpb.HardState{}, nil, snap)
+	if err != nil {
+		coordLog.Errorf("raft kv store save snapshot failed: %v", err)
+		return
+	}
+	if applied > raftKVSnapCatchupEntries {
+		self.storage.Compact(applied - raftKVSnapCatchupEntries)
+	}
+	self.dataLock.Lock()
+	self.snapshotIndex = applied
+	self.dataLock.Unlock()
+	coordLog.Infof("raft kv store snapshot at %v", applied)
+}
+
+// only the raft leader expires the keys to make all the nodes expire at the
+// same index.
+func (self *RaftKVStore) expireLoop() {
+	defer self.wg.Done()
+	ticker := time.NewTicker(raftKVExpireInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-self.stopC:
+			return
+		}
+		if !self.IsLeader() {
+			continue
+		}
+		now := time.Now().UnixNano()
+		var keys []string
+		self.dataLock.RLock()
+		for k, n := range self.data {
+			if n.ExpireAt > 0 && n.ExpireAt <= now {
+				keys = append(keys, k)
+			}
+		}
+		self.dataLock.RUnlock()
+		if len(keys) == 0 {
+			continue
+		}
+		_, err := self.Do(&RaftKVOp{Type: RaftKVOpExpire, Keys: keys, Now: now})
+		if err != nil {
+			coordLog.Infof("raft kv store expire keys failed: %v", err)
+		}
+	}
+}
+
+func (self *RaftKVStore) IsLeader() bool {
+	return atomic.LoadUint64(&self.leader) == self.id
+}
+
+func (self *RaftKVStore) GetLeader() uint64 {
+	return atomic.LoadUint64(&self.leader)
+}
+
+// Step handles the raft messages from the peers
+func (self *RaftKVStore) Step(msgs [][]byte) error {
+	for _, data := range msgs {
+		var m raftpb.Message
+		err := m.Unmarshal(data)
+		if err != nil {
+			return err
+		}
+		err = self.node.Step(context.Background(), m)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *RaftKVStore) reportUnreachable(id uint64) {
+	self.node.ReportUnreachable(id)
+}
+
+func (self *RaftKVStore) reportSnapshot(id uint64, failed bool) {
+	if failed {
+		self.node.ReportSnapshot(id, raft.SnapshotFailure)
+	} else {
+		self.node.ReportSnapshot(id, raft.SnapshotFinish)
+	}
+}
+
+// Get reads the key from the local data, the children will be returned for
+// the directory. The local data may be stale (the follower may lag behind
+// the leader), so the leadership should not be decided by Get only, use
+// the compare in Do which is checked while applying the raft log.
+func (self *RaftKVStore) Get(key string, recursive bool) (*RaftKVNode, error) {
+	key = path.Clean("/" + key)
+	self.dataLock.RLock()
+	defer self.dataLock.RUnlock()
+	var n *RaftKVNode
+	if key == "/" {
+		n = &RaftKVNode{Key: key, Dir: true}
+	} else {
+		old, ok := self.data[key]
+		if !ok {
+			return nil, ErrKeyNotFound
+		}
+		n = old.copyNode()
+	}
+	if !n.Dir {
+		return n, nil
+	}
+	dirs := map[string]*RaftKVNode{key: n}
+	prefix := strings.TrimSuffix(key, "/") + "/"
+	children := make([]*RaftKVNode, 0)
+	for k, v := range self.data {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		if !recursive && strings.Contains(k[len(prefix):], "/") {
+			continue
+		}
+		c := v.copyNode()
+		children = append(children, c)
+		if c.Dir {
+			dirs[k] = c
+		}
+	}
+	for _, c := range children {
+		if p, ok := dirs[path.Dir(c.Key)]; ok {
+			p.Nodes = append(p.Nodes, c)
+		}
+	}
+	return n, nil
+}
+
+// Do proposes the write operation and waits the result applied on the local node
+func (self *RaftKVStore) Do(op *RaftKVOp) (*RaftKVNode, error) {
+	select {
+	case <-self.stopC:
+		return nil, ErrRaftKVStopped
+	default:
+	}
+	op.Key = path.Clean("/" + op.Key)
+	op.NodeID = self.id
+	op.ReqID = atomic.AddUint64(&self.reqID, 1)
+	if op.TTL > 0 {
+		op.ExpireAt = time.Now().Add(time.Duration(op.TTL) * time.Second).UnixNano()
+	}
+	data, err := json.Marshal(op)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan raftKVResult, 1)
+	self.waitLock.Lock()
+	self.waits[op.ReqID] = ch
+	self.waitLock.Unlock()
+	defer func() {
+		self.waitLock.Lock()
+		delete(self.waits, op.ReqID)
+		self.waitLock.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), raftKVRequestTimeout)
+	defer cancel()
+	err = self.node.Propose(ctx, data)
+	if err != nil {
+		coordLog.Infof("raft kv store propose %v failed: %v", op.Key, err)
+		return nil, ErrRaftKVTimeout
+	}
+	select {
+	case r := <-ch:
+		return r.node, r.err
+	case <-ctx.Done():
+		return nil, ErrRaftKVTimeout
+	case <-self.stopC:
+		return nil, ErrRaftKVStopped
+	}
+}
+
+// Watch watches the changes of the key and all the children, the returned
+// channel will be closed if the watcher is too slow or stopped.
+func (self *RaftKVStore) Watch(key string) (<-chan *RaftKVEvent, func()) {
+	w := &raftKVWatcher{
+		prefix: path.Clean("/" + key),
+		ch:     make(chan *RaftKVEvent, raftKVWatchBuffer),
+	}
+	self.watchLock.Lock()
+	self.watchers[w] = struct{}{}
+	self.watchLock.Unlock()
+	return w.ch, func() {
+		self.watchLock.Lock()
+		if _, ok := self.watchers[w]; ok {
+			delete(self.watchers, w)
+			close(w.ch)
+		}
+		self.watchLock.Unlock()
+	}
+}
+
+func (self *RaftKVStore) Stop() {
+	self.stopOnce.Do(func() {
+		close(self.stopC)
+		self.wg.Wait()
+		self.node.Stop()
+		self.transport.stop()
+		self.watchLock.Lock()
+		for w := range self.watchers {
+			delete(self.watchers, w)
+			close(w.ch)
+		}
+		self.watchLock.Unlock()
+		self.db.Close()
+		coordLog.Infof("raft kv store %v stopped", self.id)
+	})
+}
+
+// the raft messages are sent by the rpc of nsqlookupd, each peer has a
+// separate queue to avoid blocking the raft.
+type raftRpcPeer struct {
+	id     uint64
+	addr   string
+	msgC   chan raftpb.Message
+	client *NsqLookupRpcClient
+}
+
+type raftRpcTransport struct {
+	id    uint64
+	store *RaftKVStore
+	peers map[uint64]*raftRpcPeer
+	stopC chan struct{}
+	wg    sync.WaitGroup
+}
+
+func newRaftRpcTransport(id uint64, peers map[uint64]string) *raftRpcTransport {
+	t := &raftRpcTransport{
+		id:    id,
+		peers: make(map[uint64]*raftRpcPeer),
+		stopC: make(chan struct{}),
+	}
+	for pid, addr := range peers {
+		if pid == id {
+			continue
+		}
+		p := &raftRpcPeer{
+			id:   pid,
+			addr: addr,
+			msgC: make(chan raftpb.Message, 1024),
+		}
+		t.peers[pid] = p
+		t.wg.Add(1)
+		go t.sendLoop(p)
+	}
+	return t
+}
+
+func (self *raftRpcTransport) setStore(s *RaftKVStore) {
+	self.store = s
+}
+
+func (self *raftRpcTransport) send(msgs []raftpb.Message) {
+	for _, m := range msgs {
+		p, ok := self.peers[m.To]
+		if !ok {
+			continue
+		}
+		select {
+		case p.msgC <- m:
+		default:
+			// the raft will retry the dropped message
+			self.report(m, true)
+		}
+	}
+}
+
+func (self *raftRpcTransport) report(m raftpb.Message, failed bool) {
+	if self.store == nil {
+		return
+	}
+	if failed {
+		self.store.reportUnreachable(m.To)
+	}
+	if m.Type == raftpb.MsgSnap {
+		self.store.reportSnapshot(m.To, failed)
+	}
+}
+
+func (self *raftRpcTransport) sendLoop(p *raftRpcPeer) {
+	defer self.wg.Done()
+	for {
+		var m raftpb.Message
+		select {
+		case m = <-p.msgC:
+		case <-self.stopC:
+			if p.client != nil {
+				p.client.Close()
+			}
+			return
+		}
+		batch := []raftpb.Message{m}
+	BATCH:
+		for len(batch) < 64 {
+			select {
+			case m = <-p.msgC:
+				batch = append(batch, m)
+			default:
+				break BATCH
+			}
+		}
+		datas := make([][]byte, 0, len(batch))
+		for i := range batch {
+			d, err := batch[i].Marshal()
+			if err != nil {
+				continue
+			}
+			datas = append(datas, d)
+		}
+		if p.client == nil {
+			c, err := NewNsqLookupRpcClient(p.addr, RPC_TIMEOUT_SHORT)
+			if err != nil {
+				for _, bm := range batch {
+					self.report(bm, true)
+				}
+				continue
+			}
+			p.client = c.(*NsqLookupRpcClient)
+		}
+		err := p.client.RaftMessage(datas)
+		if err != nil {
+			coordLog.Debugf("send raft message to %v failed: %v", p.addr, err)
+		}
+		for _, bm := range batch {
+			if err != nil || bm.Type == raftpb.MsgSnap {
+				self.report(bm, err != nil)
+			}
+		}
+	}
+}
+
+func (self *raftRpcTransport) stop() {
+	close(self.stopC)
+	self.wg.Wait()
+}
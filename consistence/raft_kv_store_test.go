@@ -0,0 +1,411 @@
+package consistence
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/youzan/nsq/internal/levellogger"
+	"github.com/youzan/nsq/internal/test"
+)
+
+// the in-process network for the raft kv stores, the messages to the down
+// node are dropped.
+type testRaftKVNetwork struct {
+	sync.Mutex
+	stores map[uint64]*RaftKVStore
+	down   map[uint64]bool
+}
+
+func newTestRaftKVNetwork() *testRaftKVNetwork {
+	return &testRaftKVNetwork{
+		stores: make(map[uint64]*RaftKVStore),
+		down:   make(map[uint64]bool),
+	}
+}
+
+func (self *testRaftKVNetwork) getStore(id uint64) *RaftKVStore {
+	self.Lock()
+	defer self.Unlock()
+	if self.down[id] {
+		return nil
+	}
+	return self.stores[id]
+}
+
+func (self *testRaftKVNetwork) setDown(id uint64, down bool) {
+	self.Lock()
+	self.down[id] = down
+	self.Unlock()
+}
+
+type testRaftKVTransport struct {
+	id    uint64
+	nw    *testRaftKVNetwork
+	store *RaftKVStore
+	msgC  chan raftpb.Message
+	stopC chan struct{}
+	wg    sync.WaitGroup
+}
+
+func newTestRaftKVTransport(id uint64, nw *testRaftKVNetwork) *testRaftKVTransport {
+	t := &testRaftKVTransport{
+		id:    id,
+		nw:    nw,
+		msgC:  make(chan raftpb.Message, 1024),
+		stopC: make(chan struct{}),
+	}
+	t.wg.Add(1)
+	go t.sendLoop()
+	return t
+}
+
+func (self *testRaftKVTransport) setStore(s *RaftKVStore) {
+	self.store = s
+	self.nw.Lock()
+	self.nw.stores[self.id] = s
+	self.nw.down[self.id] = false
+	self.nw.Unlock()
+}
+
+func (self *testRaftKVTransport) send(msgs []raftpb.Message) {
+	for _, m := range msgs {
+		select {
+		case self.msgC <- m:
+		default:
+			self.store.reportUnreachable(m.To)
+		}
+	}
+}
+
+func (self *testRaftKVTransport) sendLoop() {
+	defer self.wg.Done()
+	for {
+		select {
+		case m := <-self.msgC:
+			if self.nw.getStore(self.id) == nil {
+				continue
+			}
+			to := self.nw.getStore(m.To)
+			if to == nil {
+				self.store.reportUnreachable(m.To)
+				if m.Type == raftpb.MsgSnap {
+					self.store.reportSnapshot(m.To, true)
+				}
+				continue
+			}
+			d, _ := m.Marshal()
+			to.Step([][]byte{d})
+			if m.Type == raftpb.MsgSnap {
+				self.store.reportSnapshot(m.To, false)
+			}
+		case <-self.stopC:
+			return
+		}
+	}
+}
+
+func (self *testRaftKVTransport) stop() {
+	close(self.stopC)
+	self.wg.Wait()
+}
+
+type testRaftKVCluster struct {
+	nw     *testRaftKVNetwork
+	peers  map[uint64]string
+	dirs   map[uint64]string
+	stores map[uint64]*RaftKVStore
+}
+
+func newTestRaftKVCluster(t *testing.T, num int) *testRaftKVCluster {
+	c := &testRaftKVCluster{
+		nw:     newTestRaftKVNetwork(),
+		peers:  make(map[uint64]string),
+		dirs:   make(map[uint64]string),
+		stores: make(map[uint64]*RaftKVStore),
+	}
+	for i := 1; i <= num; i++ {
+		c.peers[uint64(i)] = "raft-node-" + strconv.Itoa(i)
+	}
+	for id := range c.peers {
+		tmpDir, err := ioutil.TempDir("", "raft-kv-"+strconv.Itoa(int(id)))
+		test.Nil(t, err)
+		c.dirs[id] = tmpDir
+		c.startNode(t, id)
+	}
+	return c
+}
+
+func (self *testRaftKVCluster) startNode(t *testing.T, id uint64) *RaftKVStore {
+	s, err := newRaftKVStore(id, self.peers, self.dirs[id], newTestRaftKVTransport(id, self.nw))
+	test.Nil(t, err)
+	self.stores[id] = s
+	return s
+}
+
+func (self *testRaftKVCluster) stopNode(id uint64) {
+	self.nw.setDown(id, true)
+	self.stores[id].Stop()
+	delete(self.stores, id)
+}
+
+func (self *testRaftKVCluster) waitLeader(t *testing.T) *RaftKVStore {
+	start := time.Now()
+	for time.Since(start) < time.Second*10 {
+		var leader uint64
+		agreed := true
+		for _, s := range self.stores {
+			l := s.GetLeader()
+			if l == 0 || (leader != 0 && l != leader) {
+				agreed = false
+				break
+			}
+			leader = l
+		}
+		if agreed {
+			if s, ok := self.stores[leader]; ok {
+				return s
+			}
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	t.Fatal("raft kv leader not elected")
+	return nil
+}
+
+func (self *testRaftKVCluster) getFollower() *RaftKVStore {
+	for _, s := range self.stores {
+		if !s.IsLeader() {
+			return s
+		}
+	}
+	return nil
+}
+
+func (self *testRaftKVCluster) waitKey(t *testing.T, key string, value string) {
+	start := time.Now()
+	for _, s := range self.stores {
+		for {
+			n, err := s.Get(key, false)
+			if err == nil && n.Value == value {
+				break
+			}
+			if time.Since(start) > time.Second*5 {
+				t.Fatalf("key %v on node %v not replicated: %v, %v", key, s.id, n, err)
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+}
+
+func (self *testRaftKVCluster) waitKeyDeleted(t *testing.T, key string) {
+	start := time.Now()
+	for _, s := range self.stores {
+		for {
+			_, err := s.Get(key, false)
+			if err == ErrKeyNotFound {
+				break
+			}
+			if time.Since(start) > time.Second*5 {
+				t.Fatalf("key %v on node %v not deleted: %v", key, s.id, err)
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+}
+
+func (self *testRaftKVCluster) close() {
+	for id := range self.stores {
+		self.stopNode(id)
+	}
+	for _, dir := range self.dirs {
+		os.RemoveAll(dir)
+	}
+}
+
+func TestRaftKVStoreReplicate(t *testing.T) {
+	SetCoordLogger(newTestLogger(t), levellogger.LOG_WARN)
+	c := newTestRaftKVCluster(t, 3)
+	defer c.close()
+	c.waitLeader(t)
+	follower := c.getFollower()
+	// write to the follower should be forwarded to the leader
+	n, err := follower.Do(&RaftKVOp{Type: RaftKVOpSet, Key: "/test/dir/key1", Value: "v1"})
+	test.Nil(t, err)
+	test.Equal(t, "/test/dir/key1", n.Key)
+	test.Equal(t, n.CreatedIndex, n.ModifiedIndex)
+	c.waitKey(t, "/test/dir/key1", "v1")
+
+	_, err = follower.Do(&RaftKVOp{Type: RaftKVOpSet, Key: "/test/dir/key2", Value: "v2"})
+	test.Nil(t, err)
+	_, err = follower.Do(&RaftKVOp{Type: RaftKVOpSet, Key: "/test/dir/sub/key3", Value: "v3"})
+	test.Nil(t, err)
+	dir, err := follower.Get("/test/dir", false)
+	test.Nil(t, err)
+	test.Equal(t, true, dir.Dir)
+	test.Equal(t, 3, len(dir.Nodes))
+	for _, sub := range dir.Nodes {
+		test.Equal(t, 0, len(sub.Nodes))
+	}
+	dir, err = follower.Get("/test", true)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(dir.Nodes))
+	test.Equal(t, 3, len(dir.Nodes[0].Nodes))
+
+	n2, err := follower.Do(&RaftKVOp{Type: RaftKVOpSet, Key: "/test/dir/key1", Value: "v1-new"})
+	test.Nil(t, err)
+	test.Equal(t, n.CreatedIndex, n2.CreatedIndex)
+	test.Equal(t, true, n2.ModifiedIndex > n.ModifiedIndex)
+	c.waitKey(t, "/test/dir/key1", "v1-new")
+}
+
+func TestRaftKVStoreCompareAndSwap(t *testing.T) {
+	SetCoordLogger(newTestLogger(t), levellogger.LOG_WARN)
+	c := newTestRaftKVCluster(t, 3)
+	defer c.close()
+	s := c.waitLeader(t)
+
+	n, err := s.Do(&RaftKVOp{Type: RaftKVOpSet, Key: "/cas/key", Value: "v1", PrevExist: RaftKVPrevNoExist})
+	test.Nil(t, err)
+	_, err = s.Do(&RaftKVOp{Type: RaftKVOpSet, Key: "/cas/key", Value: "v2", PrevExist: RaftKVPrevNoExist})
+	test.Equal(t, ErrKeyAlreadyExist, err)
+	_, err = s.Do(&RaftKVOp{Type: RaftKVOpSet, Key: "/cas/notexist", Value: "v2", PrevExist: RaftKVPrevExist})
+	test.Equal(t, ErrKeyNotFound, err)
+	_, err = s.Do(&RaftKVOp{Type: RaftKVOpSet, Key: "/cas/key", Value: "v2", PrevIndex: n.ModifiedIndex + 1})
+	test.Equal(t, ErrRaftKVCompareFailed, err)
+	n, err = s.Do(&RaftKVOp{Type: RaftKVOpSet, Key: "/cas/key", Value: "v2", PrevIndex: n.ModifiedIndex})
+	test.Nil(t, err)
+	test.Equal(t, "v2", n.Value)
+	// the refresh should fail if the value is changed by others
+	_, err = s.Do(&RaftKVOp{Type: RaftKVOpRefresh, Key: "/cas/key", TTL: 2, PrevValue: "v1"})
+	test.Equal(t, ErrRaftKVCompareFailed, err)
+	n, err = s.Get("/cas/key", false)
+	test.Nil(t, err)
+	test.Equal(t, int64(0), n.ExpireAt)
+	_, err = s.Do(&RaftKVOp{Type: RaftKVOpRefresh, Key: "/cas/key", TTL: 10, PrevValue: "v2"})
+	test.Nil(t, err)
+
+	_, err = s.Do(&RaftKVOp{Type: RaftKVOpDelete, Key: "/cas/key", PrevValue: "v1"})
+	test.Equal(t, ErrRaftKVCompareFailed, err)
+	_, err = s.Do(&RaftKVOp{Type: RaftKVOpDelete, Key: "/cas/key", PrevValue: "v2"})
+	test.Nil(t, err)
+	_, err = s.Get("/cas/key", false)
+	test.Equal(t, ErrKeyNotFound, err)
+
+	// the key can not be created under a file
+	_, err = s.Do(&RaftKVOp{Type: RaftKVOpSet, Key: "/cas/file", Value: "v"})
+	test.Nil(t, err)
+	_, err = s.Do(&RaftKVOp{Type: RaftKVOpSet, Key: "/cas/file/key", Value: "v"})
+	test.Equal(t, ErrRaftKVNotDir, err)
+	// the directory can not be deleted without recursive
+	_, err = s.Do(&RaftKVOp{Type: RaftKVOpSet, Key: "/cas/dir", Dir: true, PrevExist: RaftKVPrevNoExist})
+	test.Nil(t, err)
+	_, err = s.Do(&RaftKVOp{Type: RaftKVOpSet, Key: "/cas/dir", Value: "v"})
+	test.Equal(t, ErrRaftKVNotFile, err)
+	_, err = s.Do(&RaftKVOp{Type: RaftKVOpSet, Key: "/cas/dir/key", Value: "v"})
+	test.Nil(t, err)
+	_, err = s.Do(&RaftKVOp{Type: RaftKVOpDelete, Key: "/cas/dir"})
+	test.Equal(t, ErrRaftKVNotFile, err)
+	_, err = s.Do(&RaftKVOp{Type: RaftKVOpDelete, Key: "/cas/dir", Recursive: true})
+	test.Nil(t, err)
+	_, err = s.Get("/cas/dir/key", false)
+	test.Equal(t, ErrKeyNotFound, err)
+	_, err = s.Do(&RaftKVOp{Type: RaftKVOpDelete, Key: "/cas/dir", Recursive: true})
+	test.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestRaftKVStoreTTLAndWatch(t *testing.T) {
+	SetCoordLogger(newTestLogger(t), levellogger.LOG_WARN)
+	c := newTestRaftKVCluster(t, 3)
+	defer c.close()
+	c.waitLeader(t)
+	follower := c.getFollower()
+	watchC, cancel := follower.Watch("/ttl")
+	defer cancel()
+
+	_, err := follower.Do(&RaftKVOp{Type: RaftKVOpSet, Key: "/ttl/key", Value: "v", TTL: 2})
+	test.Nil(t, err)
+	_, err = follower.Do(&RaftKVOp{Type: RaftKVOpSet, Key: "/ttl/keep", Value: "v"})
+	test.Nil(t, err)
+	e := <-watchC
+	test.Equal(t, "create", e.Action)
+	test.Equal(t, "/ttl/key", e.Node.Key)
+	e = <-watchC
+	test.Equal(t, "/ttl/keep", e.Node.Key)
+
+	// the refreshed key should not expire
+	time.Sleep(time.Second)
+	_, err = follower.Do(&RaftKVOp{Type: RaftKVOpRefresh, Key: "/ttl/key", TTL: 2})
+	test.Nil(t, err)
+	time.Sleep(time.Second * 1)
+	_, err = follower.Get("/ttl/key", false)
+	test.Nil(t, err)
+
+	select {
+	case e = <-watchC:
+		test.Equal(t, "expire", e.Action)
+		test.Equal(t, "/ttl/key", e.Node.Key)
+	case <-time.After(time.Second * 5):
+		t.Fatal("the key should be expired")
+	}
+	c.waitKeyDeleted(t, "/ttl/key")
+	c.waitKey(t, "/ttl/keep", "v")
+	_, err = follower.Do(&RaftKVOp{Type: RaftKVOpRefresh, Key: "/ttl/key", TTL: 2})
+	test.Equal(t, ErrKeyNotFound, err)
+
+	// delete the parent should notify the watcher of the children
+	keyWatchC, keyCancel := follower.Watch("/ttl/keep")
+	defer keyCancel()
+	_, err = follower.Do(&RaftKVOp{Type: RaftKVOpDelete, Key: "/ttl", Recursive: true})
+	test.Nil(t, err)
+	e = <-keyWatchC
+	test.Equal(t, "delete", e.Action)
+	test.Equal(t, "/ttl", e.Node.Key)
+}
+
+func TestRaftKVStoreRestartAndFailover(t *testing.T) {
+	SetCoordLogger(newTestLogger(t), levellogger.LOG_WARN)
+	c := newTestRaftKVCluster(t, 3)
+	defer c.close()
+	leader := c.waitLeader(t)
+	_, err := leader.Do(&RaftKVOp{Type: RaftKVOpSet, Key: "/restart/key1", Value: "v1"})
+	test.Nil(t, err)
+	c.waitKey(t, "/restart/key1", "v1")
+
+	// the stopped follower should catch up after restart
+	follower := c.getFollower()
+	c.stopNode(follower.id)
+	_, err = leader.Do(&RaftKVOp{Type: RaftKVOpSet, Key: "/restart/key2", Value: "v2"})
+	test.Nil(t, err)
+	c.startNode(t, follower.id)
+	c.waitKey(t, "/restart/key1", "v1")
+	c.waitKey(t, "/restart/key2", "v2")
+
+	// the new leader should be elected after the leader is down
+	c.stopNode(leader.id)
+	newLeader := c.waitLeader(t)
+	test.NotEqual(t, leader.id, newLeader.id)
+	_, err = newLeader.Do(&RaftKVOp{Type: RaftKVOpSet, Key: "/restart/key3", Value: "v3"})
+	test.Nil(t, err)
+
+	// all the data should be recovered from the disk after the whole cluster restarted
+	c.startNode(t, leader.id)
+	c.waitKey(t, "/restart/key3", "v3")
+	for id := range c.peers {
+		c.stopNode(id)
+	}
+	for id := range c.peers {
+		c.startNode(t, id)
+	}
+	c.waitLeader(t)
+	c.waitKey(t, "/restart/key1", "v1")
+	c.waitKey(t, "/restart/key2", "v2")
+	c.waitKey(t, "/restart/key3", "v3")
+	_, err = os.Stat(path.Join(c.dirs[leader.id], "raft_kv.db"))
+	test.Nil(t, err)
+}
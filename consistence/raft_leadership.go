@@ -0,0 +1,827 @@
+package consistence
+
+import (
+	"encoding/json"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the raft kv store can be accessed locally on nsqlookupd or by the rpc of
+// nsqlookupd from nsqd.
+type raftKVClient interface {
+	Get(key string, recursive bool) (*RaftKVNode, error)
+	Do(op *RaftKVOp) (*RaftKVNode, error)
+}
+
+// the rpc client to access the raft kv store on any of the nsqlookupd nodes
+type raftKVRemoteClient struct {
+	sync.Mutex
+	addrs   []string
+	index   int
+	clients map[string]*NsqLookupRpcClient
+}
+
+func newRaftKVRemoteClient(addrs string) *raftKVRemoteClient {
+	c := &raftKVRemoteClient{
+		clients: make(map[string]*NsqLookupRpcClient),
+	}
+	for _, addr := range strings.Split(addrs, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr != "" {
+			c.addrs = append(c.addrs, addr)
+		}
+	}
+	return c
+}
+
+func (self *raftKVRemoteClient) call(req *RpcRaftKVReq) (*RaftKVNode, error) {
+	var lastErr error
+	for i := 0; i < len(self.addrs); i++ {
+		self.Lock()
+		addr := self.addrs[self.index%len(self.addrs)]
+		c, ok := self.clients[addr]
+		if !ok {
+			rc, err := NewNsqLookupRpcClient(addr, RPC_TIMEOUT)
+			if err != nil {
+				self.index++
+				self.Unlock()
+				lastErr = err
+				continue
+			}
+			c = rc.(*NsqLookupRpcClient)
+			self.clients[addr] = c
+		}
+		self.Unlock()
+		n, err := c.RaftKV(req)
+		if err == nil {
+			return n, nil
+		}
+		for _, e := range raftKVErrList {
+			// the store returned the result, no need to try the others
+			if err == e && err != ErrRaftKVStopped && err != ErrRaftKVTimeout {
+				return nil, err
+			}
+		}
+		coordLog.Infof("raft kv request to %v failed: %v", addr, err)
+		lastErr = err
+		self.Lock()
+		self.index++
+		self.Unlock()
+	}
+	if lastErr == nil {
+		lastErr = ErrRaftKVInvalidPeers
+	}
+	return nil, lastErr
+}
+
+func (self *raftKVRemoteClient) Get(key string, recursive bool) (*RaftKVNode, error) {
+	return self.call(&RpcRaftKVReq{Get: true, Key: key, Recursive: recursive})
+}
+
+func (self *raftKVRemoteClient) Do(op *RaftKVOp) (*RaftKVNode, error) {
+	return self.call(&RpcRaftKVReq{Op: *op})
+}
+
+func (self *raftKVRemoteClient) close() {
+	self.Lock()
+	for addr, c := range self.clients {
+		c.Close()
+		delete(self.clients, addr)
+	}
+	self.Unlock()
+}
+
+// keep the ttl of the key refreshed until stopped
+func refreshRaftKVKey(c raftKVClient, key string, value string, stopC chan bool) {
+	for {
+		select {
+		case <-stopC:
+			return
+		case <-time.After(time.Second * time.Duration(ETCD_TTL/10)):
+			_, err := c.Do(&RaftKVOp{Type: RaftKVOpRefresh, Key: key, TTL: ETCD_TTL, PrevValue: value})
+			if err != nil {
+				coordLog.Errorf("update error: %s", err.Error())
+				_, err = c.Do(&RaftKVOp{Type: RaftKVOpSet, Key: key, Value: value, TTL: ETCD_TTL})
+				if err != nil {
+					coordLog.Errorf("set key error: %s", err.Error())
+				}
+			}
+		}
+	}
+}
+
+func releaseRaftKVTopicLeader(c raftKVClient, topicKey string, session *TopicLeaderSession) error {
+	valueB, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	_, err = c.Do(&RaftKVOp{Type: RaftKVOpDelete, Key: topicKey, PrevValue: string(valueB)})
+	if err == ErrRaftKVCompareFailed {
+		// the session value may be marshaled by the old version
+		n, innErr := c.Get(topicKey, false)
+		if innErr == nil {
+			var old TopicLeaderSession
+			json.Unmarshal([]byte(n.Value), &old)
+			if old.IsSame(session) {
+				_, err = c.Do(&RaftKVOp{Type: RaftKVOpDelete, Key: topicKey, PrevIndex: n.ModifiedIndex})
+			} else {
+				coordLog.Warningf("topic leader session [%s] mismatch: %v, orig: %v", topicKey, session, old)
+			}
+		}
+	}
+	if err == nil {
+		coordLog.Infof("try release topic leader session [%s] success: %v", topicKey, session)
+	} else {
+		coordLog.Infof("try release topic leader session [%s] error: %v, orig: %v", topicKey, err, session)
+	}
+	return err
+}
+
+func getRaftKVTopicInfo(c raftKVClient, topicRoot string, topic string, partition int) (*TopicPartitionMetaInfo, error) {
+	n, err := c.Get(path.Join(topicRoot, topic, NSQ_TOPIC_META), false)
+	if err != nil {
+		return nil, err
+	}
+	var topicInfo TopicPartitionMetaInfo
+	err = json.Unmarshal([]byte(n.Value), &topicInfo.TopicMetaInfo)
+	if err != nil {
+		return nil, err
+	}
+	n, err = c.Get(path.Join(topicRoot, topic, strconv.Itoa(partition), NSQ_TOPIC_REPLICA_INFO), false)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(n.Value), &topicInfo.TopicPartitionReplicaInfo)
+	if err != nil {
+		return nil, err
+	}
+	topicInfo.Epoch = EpochType(n.ModifiedIndex)
+	topicInfo.Name = topic
+	topicInfo.Partition = partition
+	return &topicInfo, nil
+}
+
+func getRaftKVTopicLeaderSession(c raftKVClient, key string) (*TopicLeaderSession, error) {
+	n, err := c.Get(key, false)
+	if err != nil {
+		if err == ErrKeyNotFound {
+			return nil, ErrLeaderSessionNotExist
+		}
+		return nil, err
+	}
+	var topicLeaderSession TopicLeaderSession
+	if err = json.Unmarshal([]byte(n.Value), &topicLeaderSession); err != nil {
+		return nil, err
+	}
+	return &topicLeaderSession, nil
+}
+
+func getRaftKVLookupdNodes(c raftKVClient, key string) ([]NsqLookupdNodeInfo, error) {
+	n, err := c.Get(key, false)
+	if err != nil {
+		return nil, err
+	}
+	lookupdNodeList := make([]NsqLookupdNodeInfo, 0)
+	for _, node := range n.Nodes {
+		var nodeInfo NsqLookupdNodeInfo
+		if err = json.Unmarshal([]byte(node.Value), &nodeInfo); err != nil {
+			continue
+		}
+		lookupdNodeList = append(lookupdNodeList, nodeInfo)
+	}
+	return lookupdNodeList, nil
+}
+
+// NsqLookupdRaftMgr is the leadership of nsqlookupd based on the embedded
+// raft kv store, the store is replicated between all the nsqlookupd nodes.
+type NsqLookupdRaftMgr struct {
+	sync.Mutex
+	store             *RaftKVStore
+	clusterID         string
+	topicRoot         string
+	clusterPath       string
+	leaderSessionPath string
+	leaderStr         string
+	lookupdRootPath   string
+	nodeKey           string
+	nodeValue         string
+
+	refreshStopCh chan bool
+	stopCh        chan struct{}
+	stopOnce      sync.Once
+}
+
+func NewNsqLookupdRaftMgr(store *RaftKVStore) *NsqLookupdRaftMgr {
+	return &NsqLookupdRaftMgr{
+		store:  store,
+		stopCh: make(chan struct{}),
+	}
+}
+
+func (self *NsqLookupdRaftMgr) InitClusterID(id string) {
+	self.clusterID = id
+	self.clusterPath = path.Join("/", NSQ_ROOT_DIR, id)
+	self.topicRoot = path.Join(self.clusterPath, NSQ_TOPIC_DIR)
+	self.leaderSessionPath = path.Join(self.clusterPath, NSQ_LOOKUPD_DIR, NSQ_LOOKUPD_LEADER_SESSION)
+	self.lookupdRootPath = path.Join(self.clusterPath, NSQ_LOOKUPD_DIR, NSQ_LOOKUPD_NODE_DIR)
+}
+
+func (self *NsqLookupdRaftMgr) Register(value *NsqLookupdNodeInfo) error {
+	valueB, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	self.Lock()
+	defer self.Unlock()
+	if self.refreshStopCh != nil {
+		close(self.refreshStopCh)
+		self.refreshStopCh = nil
+	}
+	self.leaderStr = string(valueB)
+	self.nodeKey = path.Join(self.lookupdRootPath, "Node-"+value.ID)
+	self.nodeValue = string(valueB)
+	// the store may be not ready until the raft leader elected
+	for i := 0; i < 6; i++ {
+		_, err = self.store.Do(&RaftKVOp{Type: RaftKVOpSet, Key: self.nodeKey, Value: self.nodeValue, TTL: ETCD_TTL})
+		if err != ErrRaftKVTimeout {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	self.refreshStopCh = make(chan bool, 1)
+	go refreshRaftKVKey(self.store, self.nodeKey, self.nodeValue, self.refreshStopCh)
+	return nil
+}
+
+func (self *NsqLookupdRaftMgr) Unregister(value *NsqLookupdNodeInfo) error {
+	self.Lock()
+	if self.refreshStopCh != nil {
+		close(self.refreshStopCh)
+		self.refreshStopCh = nil
+	}
+	self.Unlock()
+	_, err := self.store.Do(&RaftKVOp{Type: RaftKVOpDelete, Key: path.Join(self.lookupdRootPath, "Node-"+value.ID)})
+	if err != nil {
+		coordLog.Warningf("cluser[%v] node[%v] unregister failed: %v", self.clusterID, value, err)
+		return err
+	}
+	return nil
+}
+
+// Stop stops all the watchers and the raft kv store
+func (self *NsqLookupdRaftMgr) Stop() {
+	self.stopOnce.Do(func() {
+		close(self.stopCh)
+		self.store.Stop()
+	})
+}
+
+func (self *NsqLookupdRaftMgr) GetClusterEpoch() (EpochType, error) {
+	n, err := self.store.Get(self.clusterPath, false)
+	if err != nil {
+		return 0, err
+	}
+	return EpochType(n.ModifiedIndex), nil
+}
+
+func (self *NsqLookupdRaftMgr) GetAllLookupdNodes() ([]NsqLookupdNodeInfo, error) {
+	return getRaftKVLookupdNodes(self.store, self.lookupdRootPath)
+}
+
+// the leader session is a key with ttl, the node which created the key is
+// the leader until the key expired or deleted.
+func (self *NsqLookupdRaftMgr) AcquireAndWatchLeader(leader chan *NsqLookupdNodeInfo, stop chan struct{}) {
+	watchC, cancel := self.store.Watch(self.leaderSessionPath)
+	defer func() {
+		cancel()
+		close(leader)
+	}()
+	ticker := time.NewTicker(time.Second * time.Duration(ETCD_TTL/10))
+	defer ticker.Stop()
+	lastLeader := ""
+	for {
+		n, err := self.store.Get(self.leaderSessionPath, false)
+		if err == ErrKeyNotFound {
+			n, err = self.store.Do(&RaftKVOp{Type: RaftKVOpSet, Key: self.leaderSessionPath, Value: self.leaderStr,
+				TTL: ETCD_TTL, PrevExist: RaftKVPrevNoExist})
+			if err == nil {
+				coordLog.Infof("lookupd leader acquired: %v", self.leaderStr)
+			}
+		} else if err == nil && n.Value == self.leaderStr {
+			// the local read may be stale, the refresh only succeeds if we
+			// still hold the session while applying the raft log
+			_, err = self.store.Do(&RaftKVOp{Type: RaftKVOpRefresh, Key: self.leaderSessionPath, TTL: ETCD_TTL,
+				PrevValue: self.leaderStr})
+			if err == ErrRaftKVCompareFailed || err == ErrKeyNotFound {
+				// the local data has been applied to the failed refresh, read again
+				coordLog.Infof("lookupd leader session lost: %v", err)
+				n, err = self.store.Get(self.leaderSessionPath, false)
+			}
+		}
+		if err != nil && err != ErrKeyAlreadyExist {
+			coordLog.Infof("acquire lookupd leader failed: %v", err)
+		}
+		current := ""
+		if n != nil {
+			current = n.Value
+		} else if err != ErrKeyNotFound {
+			current = lastLeader
+		}
+		if current != lastLeader {
+			var lookupdNode NsqLookupdNodeInfo
+			if current != "" {
+				json.Unmarshal([]byte(current), &lookupdNode)
+			}
+			coordLog.Infof("lookupd leader changed from %v to: %v", lastLeader, current)
+			select {
+			case leader <- &lookupdNode:
+				lastLeader = current
+			case <-stop:
+			case <-self.stopCh:
+			}
+		}
+		select {
+		case <-ticker.C:
+		case _, ok := <-watchC:
+			if !ok {
+				watchC, cancel = self.store.Watch(self.leaderSessionPath)
+			}
+		case <-stop:
+			self.releaseLeader()
+			return
+		case <-self.stopCh:
+			self.releaseLeader()
+			return
+		}
+	}
+}
+
+func (self *NsqLookupdRaftMgr) releaseLeader() {
+	_, err := self.store.Do(&RaftKVOp{Type: RaftKVOpDelete, Key: self.leaderSessionPath, PrevValue: self.leaderStr})
+	if err == nil {
+		coordLog.Infof("lookupd leader released: %v", self.leaderStr)
+	}
+}
+
+// CheckIfLeader reads the local data which may be stale, it should only be
+// used as a hint and the leadership is confirmed by refreshing the session.
+func (self *NsqLookupdRaftMgr) CheckIfLeader(session string) bool {
+	n, err := self.store.Get(self.leaderSessionPath, false)
+	if err != nil {
+		return false
+	}
+	return n.Value == session
+}
+
+func (self *NsqLookupdRaftMgr) UpdateLookupEpoch(oldGen EpochType) (EpochType, error) {
+	return 0, nil
+}
+
+func (self *NsqLookupdRaftMgr) GetNsqdNodes() ([]NsqdNodeInfo, error) {
+	n, err := self.store.Get(path.Join(self.clusterPath, NSQ_NODE_DIR), false)
+	if err != nil {
+		return nil, err
+	}
+	nsqdNodes := make([]NsqdNodeInfo, 0)
+	for _, node := range n.Nodes {
+		if node.Dir {
+			continue
+		}
+		var nodeInfo NsqdNodeInfo
+		err := json.Unmarshal([]byte(node.Value), &nodeInfo)
+		if err != nil {
+			continue
+		}
+		nsqdNodes = append(nsqdNodes, nodeInfo)
+	}
+	return nsqdNodes, nil
+}
+
+func (self *NsqLookupdRaftMgr) WatchNsqdNodes(nsqds chan []NsqdNodeInfo, stop chan struct{}) {
+	key := path.Join(self.clusterPath, NSQ_NODE_DIR)
+	watchC, cancel := self.store.Watch(key)
+	defer func() {
+		cancel()
+		close(nsqds)
+	}()
+	for {
+		nsqdNodes, err := self.GetNsqdNodes()
+		if err == nil {
+			select {
+			case nsqds <- nsqdNodes:
+			case <-stop:
+				return
+			case <-self.stopCh:
+				return
+			}
+		} else if err != ErrKeyNotFound {
+			coordLog.Errorf("key[%s] getNsqdNodes error: %s", key, err.Error())
+		}
+		select {
+		case _, ok := <-watchC:
+			if !ok {
+				watchC, cancel = self.store.Watch(key)
+			}
+		case <-stop:
+			return
+		case <-self.stopCh:
+			return
+		}
+	}
+}
+
+func (self *NsqLookupdRaftMgr) ScanTopics() ([]TopicPartitionMetaInfo, error) {
+	n, err := self.store.Get(self.topicRoot, true)
+	if err != nil {
+		return nil, err
+	}
+	topicMetaInfos := make([]TopicPartitionMetaInfo, 0)
+	for _, topicNode := range n.Nodes {
+		topicName := path.Base(topicNode.Key)
+		var metaNode *RaftKVNode
+		for _, c := range topicNode.Nodes {
+			if !c.Dir && path.Base(c.Key) == NSQ_TOPIC_META {
+				metaNode = c
+				break
+			}
+		}
+		if metaNode == nil {
+			continue
+		}
+		var mInfo TopicMetaInfo
+		if err := json.Unmarshal([]byte(metaNode.Value), &mInfo); err != nil {
+			continue
+		}
+		for _, partNode := range topicNode.Nodes {
+			if !partNode.Dir {
+				continue
+			}
+			partition, err := strconv.Atoi(path.Base(partNode.Key))
+			if err != nil {
+				continue
+			}
+			for _, c := range partNode.Nodes {
+				if c.Dir || path.Base(c.Key) != NSQ_TOPIC_REPLICA_INFO {
+					continue
+				}
+				var topicInfo TopicPartitionMetaInfo
+				if err := json.Unmarshal([]byte(c.Value), &topicInfo.TopicPartitionReplicaInfo); err != nil {
+					continue
+				}
+				topicInfo.Epoch = EpochType(c.ModifiedIndex)
+				topicInfo.Name = topicName
+				topicInfo.Partition = partition
+				topicInfo.TopicMetaInfo = mInfo
+				topicMetaInfos = append(topicMetaInfos, topicInfo)
+			}
+		}
+	}
+	return topicMetaInfos, nil
+}
+
+func (self *NsqLookupdRaftMgr) GetTopicInfo(topic string, partition int) (*TopicPartitionMetaInfo, error) {
+	return getRaftKVTopicInfo(self.store, self.topicRoot, topic, partition)
+}
+
+func (self *NsqLookupdRaftMgr) CreateTopic(topic string, meta *TopicMetaInfo) error {
+	metaValue, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	_, err = self.store.Do(&RaftKVOp{Type: RaftKVOpSet, Key: path.Join(self.topicRoot, topic, NSQ_TOPIC_META),
+		Value: string(metaValue), PrevExist: RaftKVPrevNoExist})
+	return err
+}
+
+func (self *NsqLookupdRaftMgr) CreateTopicPartition(topic string, partition int) error {
+	_, err := self.store.Do(&RaftKVOp{Type: RaftKVOpSet, Key: path.Join(self.topicRoot, topic, strconv.Itoa(partition)),
+		Dir: true, PrevExist: RaftKVPrevNoExist})
+	return err
+}
+
+func (self *NsqLookupdRaftMgr) isExist(key string) (bool, error) {
+	_, err := self.store.Get(key, false)
+	if err != nil {
+		if err == ErrKeyNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (self *NsqLookupdRaftMgr) IsExistTopic(topic string) (bool, error) {
+	return self.isExist(path.Join(self.topicRoot, topic))
+}
+
+func (self *NsqLookupdRaftMgr) IsExistTopicPartition(topic string, partition int) (bool, error) {
+	return self.isExist(path.Join(self.topicRoot, topic, strconv.Itoa(partition)))
+}
+
+func (self *NsqLookupdRaftMgr) GetTopicMetaInfo(topic string) (TopicMetaInfo, EpochType, error) {
+	var metaInfo TopicMetaInfo
+	n, err := self.store.Get(path.Join(self.topicRoot, topic, NSQ_TOPIC_META), false)
+	if err != nil {
+		return metaInfo, 0, err
+	}
+	err = json.Unmarshal([]byte(n.Value), &metaInfo)
+	if err != nil {
+		return metaInfo, 0, err
+	}
+	return metaInfo, EpochType(n.ModifiedIndex), nil
+}
+
+func (self *NsqLookupdRaftMgr) UpdateTopicMetaInfo(topic string, meta *TopicMetaInfo, oldGen EpochType) error {
+	value, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	coordLog.Infof("Update_topic meta info: %s %s %d", topic, string(value), oldGen)
+	_, err = self.store.Do(&RaftKVOp{Type: RaftKVOpSet, Key: path.Join(self.topicRoot, topic, NSQ_TOPIC_META),
+		Value: string(value), PrevExist: RaftKVPrevExist, PrevIndex: uint64(oldGen)})
+	return err
+}
+
+func (self *NsqLookupdRaftMgr) DeleteTopic(topic string, partition int) error {
+	_, err := self.store.Do(&RaftKVOp{Type: RaftKVOpDelete, Key: path.Join(self.topicRoot, topic, strconv.Itoa(partition)),
+		Recursive: true})
+	if err != nil && err != ErrKeyNotFound {
+		return err
+	}
+	return nil
+}
+
+func (self *NsqLookupdRaftMgr) DeleteWholeTopic(topic string) error {
+	_, err := self.store.Do(&RaftKVOp{Type: RaftKVOpDelete, Key: path.Join(self.topicRoot, topic), Recursive: true})
+	coordLog.Infof("delete whole topic: %v, %v", topic, err)
+	return err
+}
+
+func (self *NsqLookupdRaftMgr) UpdateTopicNodeInfo(topic string, partition int, topicInfo *TopicPartitionReplicaInfo, oldGen EpochType) error {
+	value, err := json.Marshal(topicInfo)
+	if err != nil {
+		return err
+	}
+	coordLog.Infof("Update_topic info: %s %d %s %d", topic, partition, string(value), oldGen)
+	op := &RaftKVOp{Type: RaftKVOpSet, Key: path.Join(self.topicRoot, topic, strconv.Itoa(partition), NSQ_TOPIC_REPLICA_INFO),
+		Value: string(value)}
+	if oldGen == 0 {
+		op.PrevExist = RaftKVPrevNoExist
+	} else {
+		op.PrevExist = RaftKVPrevExist
+		op.PrevIndex = uint64(oldGen)
+	}
+	n, err := self.store.Do(op)
+	if err != nil {
+		return err
+	}
+	topicInfo.Epoch = EpochType(n.ModifiedIndex)
+	return nil
+}
+
+func (self *NsqLookupdRaftMgr) GetTopicLeaderSession(topic string, partition int) (*TopicLeaderSession, error) {
+	return getRaftKVTopicLeaderSession(self.store, path.Join(self.topicRoot, topic, strconv.Itoa(partition), NSQ_TOPIC_LEADER_SESSION))
+}
+
+// watch the leader session changes of all the topic partitions
+func (self *NsqLookupdRaftMgr) WatchTopicLeader(leader chan *TopicLeaderSession, stop chan struct{}) error {
+	watchC, cancel := self.store.Watch(self.topicRoot)
+	defer func() {
+		cancel()
+		close(leader)
+	}()
+	for {
+		select {
+		case e, ok := <-watchC:
+			if !ok {
+				coordLog.Warningf("watch key[%s] lost, rewatch", self.topicRoot)
+				watchC, cancel = self.store.Watch(self.topicRoot)
+				continue
+			}
+			if e.Node.Dir || path.Base(e.Node.Key) != NSQ_TOPIC_LEADER_SESSION {
+				continue
+			}
+			var topicLeaderSession TopicLeaderSession
+			if e.Action == "delete" || e.Action == "expire" {
+				keys := strings.Split(e.Node.Key, "/")
+				keyLen := len(keys)
+				if keyLen < 3 {
+					continue
+				}
+				partition, err := strconv.Atoi(keys[keyLen-2])
+				if err != nil {
+					continue
+				}
+				coordLog.Infof("topic[%s] partition[%d] action[%s] leader deleted.", keys[keyLen-3], partition, e.Action)
+				topicLeaderSession.Topic = keys[keyLen-3]
+				topicLeaderSession.Partition = partition
+			} else if e.Action == "create" {
+				if err := json.Unmarshal([]byte(e.Node.Value), &topicLeaderSession); err != nil {
+					continue
+				}
+				coordLog.Infof("topicLeaderSession[%v] create.", topicLeaderSession)
+			} else {
+				continue
+			}
+			select {
+			case leader <- &topicLeaderSession:
+			case <-stop:
+				return nil
+			case <-self.stopCh:
+				return nil
+			}
+		case <-stop:
+			return nil
+		case <-self.stopCh:
+			return nil
+		}
+	}
+}
+
+func (self *NsqLookupdRaftMgr) ReleaseTopicLeader(topic string, partition int, session *TopicLeaderSession) error {
+	return releaseRaftKVTopicLeader(self.store,
+		path.Join(self.topicRoot, topic, strconv.Itoa(partition), NSQ_TOPIC_LEADER_SESSION), session)
+}
+
+func (self *NsqLookupdRaftMgr) GetTopicsMetaInfoMap(topics []string) (map[string]*TopicMetaInfo, error) {
+	topicMetaInfoCache := make(map[string]*TopicMetaInfo)
+	for _, topic := range topics {
+		topicMeta, _, err := self.GetTopicMetaInfo(topic)
+		if err != nil && err != ErrKeyNotFound {
+			return nil, err
+		}
+		topicMetaInfoCache[topic] = &topicMeta
+	}
+	return topicMetaInfoCache, nil
+}
+
+// NsqdRaftMgr is the leadership of nsqd which accesses the raft kv store on
+// the nsqlookupd nodes by rpc.
+type NsqdRaftMgr struct {
+	sync.Mutex
+	client      raftKVClient
+	clusterID   string
+	topicRoot   string
+	lookupdRoot string
+	nodeKey     string
+	nodeValue   string
+
+	refreshStopCh chan bool
+}
+
+// NewNsqdRaftMgr creates the nsqd leadership by the rpc addresses of the
+// nsqlookupd nodes, separated by comma.
+func NewNsqdRaftMgr(addrs string) *NsqdRaftMgr {
+	return newNsqdRaftMgr(newRaftKVRemoteClient(addrs))
+}
+
+func newNsqdRaftMgr(c raftKVClient) *NsqdRaftMgr {
+	return &NsqdRaftMgr{
+		client: c,
+	}
+}
+
+func (self *NsqdRaftMgr) InitClusterID(id string) {
+	self.clusterID = id
+	self.topicRoot = path.Join("/", NSQ_ROOT_DIR, id, NSQ_TOPIC_DIR)
+	self.lookupdRoot = path.Join("/", NSQ_ROOT_DIR, id, NSQ_LOOKUPD_DIR)
+}
+
+func (self *NsqdRaftMgr) RegisterNsqd(nodeData *NsqdNodeInfo) error {
+	value, err := json.Marshal(nodeData)
+	if err != nil {
+		return err
+	}
+	self.Lock()
+	defer self.Unlock()
+	if self.refreshStopCh != nil {
+		close(self.refreshStopCh)
+		self.refreshStopCh = nil
+	}
+	self.nodeKey = path.Join("/", NSQ_ROOT_DIR, self.clusterID, NSQ_NODE_DIR, "Node-"+nodeData.ID)
+	self.nodeValue = string(value)
+	_, err = self.client.Do(&RaftKVOp{Type: RaftKVOpSet, Key: self.nodeKey, Value: self.nodeValue, TTL: ETCD_TTL})
+	if err != nil {
+		return err
+	}
+	coordLog.Infof("registered new node: %v", nodeData)
+	self.refreshStopCh = make(chan bool, 1)
+	go refreshRaftKVKey(self.client, self.nodeKey, self.nodeValue, self.refreshStopCh)
+	return nil
+}
+
+func (self *NsqdRaftMgr) UnregisterNsqd(nodeData *NsqdNodeInfo) error {
+	self.Lock()
+	defer self.Unlock()
+	if self.refreshStopCh != nil {
+		close(self.refreshStopCh)
+		self.refreshStopCh = nil
+	}
+	_, err := self.client.Do(&RaftKVOp{Type: RaftKVOpDelete,
+		Key: path.Join("/", NSQ_ROOT_DIR, self.clusterID, NSQ_NODE_DIR, "Node-"+nodeData.ID)})
+	if err != nil {
+		coordLog.Warningf("cluser[%v] node[%v] unregister failed: %v", self.clusterID, nodeData, err)
+		return err
+	}
+	coordLog.Infof("cluser[%v] node[%v] unregistered", self.clusterID, nodeData)
+	return nil
+}
+
+func (self *NsqdRaftMgr) AcquireTopicLeader(topic string, partition int, nodeData *NsqdNodeInfo, epoch EpochType) error {
+	topicLeaderSession := &TopicLeaderSession{
+		Topic:       topic,
+		Partition:   partition,
+		LeaderNode:  nodeData,
+		Session:     hostname + strconv.FormatInt(time.Now().Unix(), 10),
+		LeaderEpoch: epoch,
+	}
+	valueB, err := json.Marshal(topicLeaderSession)
+	if err != nil {
+		return err
+	}
+	topicKey := path.Join(self.topicRoot, topic, strconv.Itoa(partition), NSQ_TOPIC_LEADER_SESSION)
+	n, err := self.client.Get(topicKey, false)
+	if err == ErrKeyNotFound {
+		coordLog.Infof("try to acquire topic leader session [%s]", topicKey)
+		_, err = self.client.Do(&RaftKVOp{Type: RaftKVOpSet, Key: topicKey, Value: string(valueB),
+			PrevExist: RaftKVPrevNoExist})
+		if err != nil {
+			coordLog.Infof("acquire topic leader session [%s] failed: %v", topicKey, err)
+			return err
+		}
+		coordLog.Infof("acquire topic leader [%s] success: %v", topicKey, string(valueB))
+		return nil
+	} else if err != nil {
+		coordLog.Warningf("try to acquire topic %v leader session failed: %v", topicKey, err)
+		return err
+	}
+	if n.Value == string(valueB) {
+		coordLog.Infof("get topic leader with the same [%s] ", topicKey)
+		return nil
+	}
+	coordLog.Infof("get topic leader [%s] failed, lock exist value[%s]", topicKey, n.Value)
+	return ErrKeyAlreadyExist
+}
+
+func (self *NsqdRaftMgr) ReleaseTopicLeader(topic string, partition int, session *TopicLeaderSession) error {
+	self.Lock()
+	defer self.Unlock()
+	return releaseRaftKVTopicLeader(self.client,
+		path.Join(self.topicRoot, topic, strconv.Itoa(partition), NSQ_TOPIC_LEADER_SESSION), session)
+}
+
+func (self *NsqdRaftMgr) GetAllLookupdNodes() ([]NsqLookupdNodeInfo, error) {
+	return getRaftKVLookupdNodes(self.client, path.Join(self.lookupdRoot, NSQ_LOOKUPD_NODE_DIR))
+}
+
+// the lookupd leader is polled from the nsqlookupd since the rpc can not
+// watch the changes.
+func (self *NsqdRaftMgr) WatchLookupdLeader(leader chan *NsqLookupdNodeInfo, stop chan struct{}) error {
+	key := path.Join(self.lookupdRoot, NSQ_LOOKUPD_LEADER_SESSION)
+	defer close(leader)
+	lastLeader := ""
+	isFirst := true
+	for {
+		n, err := self.client.Get(key, false)
+		current := lastLeader
+		if err == nil {
+			current = n.Value
+		} else if err == ErrKeyNotFound {
+			current = ""
+		} else {
+			coordLog.Errorf("get error: %s", err.Error())
+		}
+		if current != lastLeader || (isFirst && current != "") {
+			var lookupdInfo NsqLookupdNodeInfo
+			if current != "" {
+				json.Unmarshal([]byte(current), &lookupdInfo)
+			}
+			coordLog.Infof("key: %s value: %s", key, current)
+			select {
+			case leader <- &lookupdInfo:
+				lastLeader = current
+				isFirst = false
+			case <-stop:
+				return nil
+			}
+		}
+		select {
+		case <-time.After(time.Second):
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+func (self *NsqdRaftMgr) GetTopicInfo(topic string, partition int) (*TopicPartitionMetaInfo, error) {
+	return getRaftKVTopicInfo(self.client, self.topicRoot, topic, partition)
+}
+
+func (self *NsqdRaftMgr) GetTopicLeaderSession(topic string, partition int) (*TopicLeaderSession, error) {
+	return getRaftKVTopicLeaderSession(self.client, path.Join(self.topicRoot, topic, strconv.Itoa(partition), NSQ_TOPIC_LEADER_SESSION))
+}
@@ -0,0 +1,223 @@
+package consistence
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/youzan/nsq/internal/levellogger"
+	"github.com/youzan/nsq/internal/test"
+)
+
+func TestRaftLeadershipLookupd(t *testing.T) {
+	SetCoordLogger(newTestLogger(t), levellogger.LOG_WARN)
+	ClusterID := "test-nsq-cluster-unit-test-raft-leadership"
+	c := newTestRaftKVCluster(t, 3)
+	defer c.close()
+	leader := c.waitLeader(t)
+	follower := c.getFollower()
+
+	lookupdMgr := NewNsqLookupdRaftMgr(follower)
+	lookupdMgr.InitClusterID(ClusterID)
+	lookupdInfo := &NsqLookupdNodeInfo{
+		ID:       "l-1",
+		NodeIP:   "127.0.0.1",
+		HttpPort: "8090",
+	}
+	err := lookupdMgr.Register(lookupdInfo)
+	test.Nil(t, err)
+	lookupdMgr2 := NewNsqLookupdRaftMgr(leader)
+	lookupdMgr2.InitClusterID(ClusterID)
+	lookupdInfo2 := &NsqLookupdNodeInfo{
+		ID:       "l-2",
+		NodeIP:   "127.0.0.1",
+		HttpPort: "8091",
+	}
+	err = lookupdMgr2.Register(lookupdInfo2)
+	test.Nil(t, err)
+
+	// nsqd access the store by the client of any lookupd
+	nodeMgr := newNsqdRaftMgr(leader)
+	nodeMgr.InitClusterID(ClusterID)
+	nodeInfo := &NsqdNodeInfo{
+		ID:      "n-1",
+		NodeIP:  "127.0.0.1",
+		TcpPort: "2222",
+		RpcPort: "2223",
+	}
+	err = nodeMgr.RegisterNsqd(nodeInfo)
+	test.Nil(t, err)
+	lookupList, err := nodeMgr.GetAllLookupdNodes()
+	test.Nil(t, err)
+	test.Equal(t, 2, len(lookupList))
+
+	stop := make(chan struct{})
+	nsqdsCh := make(chan []NsqdNodeInfo, 10)
+	go lookupdMgr.WatchNsqdNodes(nsqdsCh, stop)
+	nsqds := <-nsqdsCh
+	test.Equal(t, 1, len(nsqds))
+	test.Equal(t, nodeInfo.ID, nsqds[0].ID)
+
+	// only one lookupd can be the leader
+	luLeader1 := make(chan *NsqLookupdNodeInfo, 10)
+	go lookupdMgr.AcquireAndWatchLeader(luLeader1, stop)
+	l := <-luLeader1
+	test.Equal(t, lookupdInfo.ID, l.ID)
+	luLeader2 := make(chan *NsqLookupdNodeInfo, 10)
+	go lookupdMgr2.AcquireAndWatchLeader(luLeader2, stop)
+	l = <-luLeader2
+	test.Equal(t, lookupdInfo.ID, l.ID)
+	test.Equal(t, true, lookupdMgr2.CheckIfLeader(lookupdMgr.leaderStr))
+	nsqdLookupLeader := make(chan *NsqLookupdNodeInfo, 10)
+	go nodeMgr.WatchLookupdLeader(nsqdLookupLeader, stop)
+	l = <-nsqdLookupLeader
+	test.Equal(t, lookupdInfo.ID, l.ID)
+
+	topicLeaders := make(chan *TopicLeaderSession, 10)
+	go lookupdMgr2.WatchTopicLeader(topicLeaders, stop)
+
+	topicName := "raft-topic"
+	partition := 0
+	exist, err := lookupdMgr.IsExistTopic(topicName)
+	test.Nil(t, err)
+	test.Equal(t, false, exist)
+	err = lookupdMgr.CreateTopic(topicName, &TopicMetaInfo{PartitionNum: 1, Replica: 2})
+	test.Nil(t, err)
+	err = lookupdMgr.CreateTopic(topicName, &TopicMetaInfo{PartitionNum: 1, Replica: 2})
+	test.Equal(t, ErrKeyAlreadyExist, err)
+	err = lookupdMgr.CreateTopicPartition(topicName, partition)
+	test.Nil(t, err)
+	exist, err = lookupdMgr.IsExistTopicPartition(topicName, partition)
+	test.Nil(t, err)
+	test.Equal(t, true, exist)
+
+	meta, metaGen, err := lookupdMgr.GetTopicMetaInfo(topicName)
+	test.Nil(t, err)
+	test.Equal(t, 2, meta.Replica)
+	meta.Replica = 3
+	err = lookupdMgr.UpdateTopicMetaInfo(topicName, &meta, metaGen+1)
+	test.Equal(t, ErrRaftKVCompareFailed, err)
+	err = lookupdMgr.UpdateTopicMetaInfo(topicName, &meta, metaGen)
+	test.Nil(t, err)
+
+	replicaInfo := &TopicPartitionReplicaInfo{
+		Leader: nodeInfo.GetID(),
+		ISR:    []string{nodeInfo.GetID()},
+	}
+	err = lookupdMgr.UpdateTopicNodeInfo(topicName, partition, replicaInfo, 0)
+	test.Nil(t, err)
+	test.NotEqual(t, EpochType(0), replicaInfo.Epoch)
+	err = lookupdMgr.UpdateTopicNodeInfo(topicName, partition, replicaInfo, 0)
+	test.Equal(t, ErrKeyAlreadyExist, err)
+	oldEpoch := replicaInfo.Epoch
+	err = lookupdMgr.UpdateTopicNodeInfo(topicName, partition, replicaInfo, replicaInfo.Epoch)
+	test.Nil(t, err)
+	test.Equal(t, true, replicaInfo.Epoch > oldEpoch)
+
+	topicInfo, err := nodeMgr.GetTopicInfo(topicName, partition)
+	test.Nil(t, err)
+	test.Equal(t, 3, topicInfo.Replica)
+	test.Equal(t, replicaInfo.Epoch, topicInfo.Epoch)
+	test.Equal(t, nodeInfo.GetID(), topicInfo.Leader)
+	topics, err := lookupdMgr.ScanTopics()
+	test.Nil(t, err)
+	test.Equal(t, 1, len(topics))
+	test.Equal(t, topicName, topics[0].Name)
+	test.Equal(t, replicaInfo.Epoch, topics[0].Epoch)
+	metaMap, err := lookupdMgr.GetTopicsMetaInfoMap([]string{topicName, "not-exist-topic"})
+	test.Nil(t, err)
+	test.Equal(t, 3, metaMap[topicName].Replica)
+	test.Equal(t, 0, metaMap["not-exist-topic"].Replica)
+
+	// the topic leader session
+	_, err = lookupdMgr.GetTopicLeaderSession(topicName, partition)
+	test.Equal(t, ErrLeaderSessionNotExist, err)
+	err = nodeMgr.AcquireTopicLeader(topicName, partition, nodeInfo, topicInfo.EpochForWrite)
+	test.Nil(t, err)
+	s := <-topicLeaders
+	test.Equal(t, nodeInfo.GetID(), s.LeaderNode.GetID())
+	// the follower may apply the change a little later
+	session, err := lookupdMgr.GetTopicLeaderSession(topicName, partition)
+	for i := 0; i < 100 && err == ErrLeaderSessionNotExist; i++ {
+		time.Sleep(time.Millisecond * 10)
+		session, err = lookupdMgr.GetTopicLeaderSession(topicName, partition)
+	}
+	test.Nil(t, err)
+	test.Equal(t, s.Session, session.Session)
+	err = nodeMgr.AcquireTopicLeader(topicName, partition, &NsqdNodeInfo{ID: "n-2"}, topicInfo.EpochForWrite)
+	test.Equal(t, ErrKeyAlreadyExist, err)
+	err = lookupdMgr.ReleaseTopicLeader(topicName, partition, session)
+	test.Nil(t, err)
+	s = <-topicLeaders
+	test.Equal(t, topicName, s.Topic)
+	test.Equal(t, partition, s.Partition)
+	test.Nil(t, s.LeaderNode)
+
+	err = lookupdMgr.DeleteTopic(topicName, partition)
+	test.Nil(t, err)
+	err = lookupdMgr.DeleteWholeTopic(topicName)
+	test.Nil(t, err)
+	exist, err = lookupdMgr.IsExistTopic(topicName)
+	test.Nil(t, err)
+	test.Equal(t, false, exist)
+
+	err = nodeMgr.UnregisterNsqd(nodeInfo)
+	test.Nil(t, err)
+	select {
+	case nsqds = <-nsqdsCh:
+		test.Equal(t, 0, len(nsqds))
+	case <-time.After(time.Second * 5):
+		t.Fatal("nsqd node remove should be notified")
+	}
+	close(stop)
+	// wait all the watchers stopped
+	for _, ch := range []chan *NsqLookupdNodeInfo{luLeader1, luLeader2, nsqdLookupLeader} {
+		for range ch {
+		}
+	}
+	for range topicLeaders {
+	}
+	for range nsqdsCh {
+	}
+	// the leader should be released after stopped
+	_, err = leader.Get(lookupdMgr.leaderSessionPath, false)
+	test.Equal(t, ErrKeyNotFound, err)
+	err = lookupdMgr.Unregister(lookupdInfo)
+	test.Nil(t, err)
+	err = lookupdMgr2.Unregister(lookupdInfo2)
+	test.Nil(t, err)
+}
+
+// the coordinators of nsqlookupd run with the real raft kv store in process
+func TestNsqLookupLeadershipChangeWithRaft(t *testing.T) {
+	SetCoordLogger(newTestLogger(t), levellogger.LOG_WARN)
+	c := newTestRaftKVCluster(t, 3)
+	defer c.close()
+	c.waitLeader(t)
+	coords := make([]*NsqLookupCoordinator, 0, len(c.stores))
+	for _, s := range c.stores {
+		coord, _, _ := startNsqLookupCoordWithLeadership(t, NewNsqLookupdRaftMgr(s))
+		coords = append(coords, coord)
+	}
+	time.Sleep(time.Second * 2)
+	leaderCnt := 0
+	leader := coords[0].GetLookupLeader()
+	test.NotEqual(t, "", leader.GetID())
+	for _, coord := range coords {
+		l := coord.GetLookupLeader()
+		test.Equal(t, leader.GetID(), l.GetID())
+		if coord.IsMineLeader() {
+			leaderCnt++
+		}
+	}
+	test.Equal(t, 1, leaderCnt)
+	var wg sync.WaitGroup
+	for _, coord := range coords {
+		wg.Add(1)
+		go func(coord *NsqLookupCoordinator) {
+			defer wg.Done()
+			coord.Stop()
+		}(coord)
+	}
+	wg.Wait()
+}
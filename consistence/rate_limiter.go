@@ -0,0 +1,66 @@
+package consistence
+
+import (
+	"sync"
+	"time"
+)
+
+// byteRateLimiter is a token bucket limiting the bytes transferred per second,
+// the bucket can hold at most one second of data. The rate 0 means no limit.
+// The bytes can be borrowed from the future, so a large batch will make the
+// following callers wait longer instead of being rejected.
+type byteRateLimiter struct {
+	sync.Mutex
+	rate      int64
+	available float64
+	last      time.Time
+}
+
+func newByteRateLimiter(rate int64) *byteRateLimiter {
+	return &byteRateLimiter{
+		rate:      rate,
+		available: float64(rate),
+		last:      time.Now(),
+	}
+}
+
+func (self *byteRateLimiter) SetRate(rate int64) {
+	if rate < 0 {
+		rate = 0
+	}
+	self.Lock()
+	if self.rate != rate {
+		self.rate = rate
+		self.available = float64(rate)
+		self.last = time.Now()
+	}
+	self.Unlock()
+}
+
+func (self *byteRateLimiter) GetRate() int64 {
+	self.Lock()
+	defer self.Unlock()
+	return self.rate
+}
+
+// reserve the n bytes and return the duration the caller should wait before
+// the bytes can be transferred.
+func (self *byteRateLimiter) reserve(n int64, now time.Time) time.Duration {
+	self.Lock()
+	defer self.Unlock()
+	if self.rate <= 0 || n <= 0 {
+		return 0
+	}
+	if now.After(self.last) {
+		self.available += now.Sub(self.last).Seconds() * float64(self.rate)
+		if self.available > float64(self.rate) {
+			self.available = float64(self.rate)
+		}
+		self.last = now
+	}
+	self.available -= float64(n)
+	if self.available >= 0 {
+		return 0
+	}
+	return time.Duration(-self.available / float64(self.rate) * float64(time.Second))
+}
@@ -0,0 +1,59 @@
+package consistence
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/youzan/nsq/internal/test"
+)
+
+func TestByteRateLimiter(t *testing.T) {
+	l := newByteRateLimiter(0)
+	now := time.Now()
+	test.Equal(t, time.Duration(0), l.reserve(1024*1024, now))
+
+	l.SetRate(1000)
+	test.Equal(t, int64(1000), l.GetRate())
+	now = l.last
+	// the burst for one second is allowed
+	test.Equal(t, time.Duration(0), l.reserve(1000, now))
+	test.Equal(t, time.Second/2, l.reserve(500, now))
+	// the bytes borrowed should be paid back first
+	test.Equal(t, time.Second/2, l.reserve(500, now.Add(time.Second/2)))
+	test.Equal(t, time.Duration(0), l.reserve(500, now.Add(time.Second*3)))
+	// never refill more than the burst
+	test.Equal(t, time.Second, l.reserve(2000, now.Add(time.Second*10)))
+
+	l.SetRate(0)
+	test.Equal(t, time.Duration(0), l.reserve(1024*1024, now))
+}
+
+func TestNsqdCoordCatchupRateLimit(t *testing.T) {
+	coord := NewNsqdCoordinator("test-cluster", "127.0.0.1", "0", "0", "0", "", "", nil)
+	coord.SetCatchupRateLimit(1000, 0)
+	test.Equal(t, int64(1000), coord.catchupLimiter.GetRate())
+	// use the smaller one of the local and lookupd limit
+	coord.setClusterCatchupRateLimit(500)
+	test.Equal(t, int64(500), coord.catchupLimiter.GetRate())
+	coord.setClusterCatchupRateLimit(2000)
+	test.Equal(t, int64(1000), coord.catchupLimiter.GetRate())
+	coord.SetCatchupRateLimit(0, 0)
+	test.Equal(t, int64(2000), coord.catchupLimiter.GetRate())
+	coord.setClusterCatchupRateLimit(0)
+	test.Equal(t, int64(0), coord.catchupLimiter.GetRate())
+
+	tc := &TopicCoordinator{catchupLimiter: newByteRateLimiter(0)}
+	tc.coordData = &coordData{}
+	coordErr := coord.throttleCatchup(tc, 10000)
+	test.Nil(t, coordErr)
+	coord.SetCatchupRateLimit(0, 1000)
+	coordErr = coord.throttleCatchup(tc, 1100)
+	test.Nil(t, coordErr)
+	stats := coord.Stats("", -1)
+	test.Equal(t, int64(1000), stats.CatchupStats.TopicRateLimit)
+	test.Equal(t, int64(11100), stats.CatchupStats.PulledBytes)
+	test.Equal(t, int64(1), stats.CatchupStats.ThrottledCnt)
+	test.Equal(t, true, stats.CatchupStats.ThrottledTimeMs >= 90)
+	test.Equal(t, true, atomic.LoadInt64(&tc.catchupThrottled) >= int64(90*time.Millisecond))
+}
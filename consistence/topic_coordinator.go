@@ -77,6 +77,9 @@ type TopicCoordinator struct {
 	disableWrite   int32
 	exiting        int32
 	basePath       string
+	catchupLimiter *byteRateLimiter
+	// the nanoseconds waited by the catchup limit
+	catchupThrottled int64
 }
 
 func NewTopicCoordinator(name string, partition int, basepath string,
@@ -88,6 +91,7 @@ func NewTopicCoordinator(name string, partition int, basepath string,
 	tc.topicInfo.Partition = partition
 	tc.disableWrite = 1
 	tc.basePath = basepath
+	tc.catchupLimiter = newByteRateLimiter(0)
 	var err error
 	err = os.MkdirAll(basepath, 0755)
 	if err != nil {
@@ -246,6 +246,29 @@ func (c *ClusterInfo) GetLookupdTopicChannels(topic string, lookupdHTTPAddrs []s
 	return channels, nil
 }
 
+// GetLookupdTopicLag returns the channel lag of all the partitions for the given topic,
+// the lookupd will be tried one by one until success since each lookupd will query
+// all the partition leaders.
+func (c *ClusterInfo) GetLookupdTopicLag(topic string, channel string, lookupdHTTPAddrs []string) (*TopicLag, error) {
+	var errs []error
+	for _, addr := range lookupdHTTPAddrs {
+		endpoint := fmt.Sprintf("http://%s/topic/lag?topic=%s", addr, url.QueryEscape(topic))
+		if channel != "" {
+			endpoint += "&channel=" + url.QueryEscape(channel)
+		}
+		c.logf("CI: querying nsqlookupd %s", endpoint)
+
+		var resp TopicLag
+		err := c.client.NegotiateV1(endpoint, &resp)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		return &resp, nil
+	}
+	return nil, fmt.Errorf("Failed to query any nsqlookupd: %s", ErrList(errs))
+}
+
 // GetLookupdProducers returns Producers of all the nsqd connected to the given lookupds
 func (c *ClusterInfo) GetLookupdProducers(lookupdHTTPAddrs []string) (Producers, error) {
 	var producers []*Producer
@@ -1251,6 +1274,16 @@ func (c *ClusterInfo) EmptyChannel(topicName string, channelName string, lookupd
 	return c.actionHelper(topicName, lookupdHTTPAddrs, nsqdHTTPAddrs, "empty_channel", "channel/empty", qs)
 }
 
+func (c *ClusterInfo) ReplayChannelDLQ(topicName string, channelName string, lookupdHTTPAddrs []string, nsqdHTTPAddrs []string) error {
+	qs := fmt.Sprintf("topic=%s&channel=%s", url.QueryEscape(topicName), url.QueryEscape(channelName))
+	return c.actionHelper(topicName, lookupdHTTPAddrs, nsqdHTTPAddrs, "channel/dlq/replay", "channel/dlq/replay", qs)
+}
+
+func (c *ClusterInfo) PurgeChannelDLQ(topicName string, channelName string, lookupdHTTPAddrs []string, nsqdHTTPAddrs []string) error {
+	qs := fmt.Sprintf("topic=%s&channel=%s", url.QueryEscape(topicName), url.QueryEscape(channelName))
+	return c.actionHelper(topicName, lookupdHTTPAddrs, nsqdHTTPAddrs, "channel/dlq/purge", "channel/dlq/purge", qs)
+}
+
 func (c *ClusterInfo) ResetChannel(topicName string, channelName string, lookupdHTTPAddrs []string, resetBy string) error {
 	qs := fmt.Sprintf("topic=%s&channel=%s", url.QueryEscape(topicName), url.QueryEscape(channelName))
 	return c.actionHelperWithContent(topicName, lookupdHTTPAddrs, nil, "", "channel/setoffset", qs, resetBy)
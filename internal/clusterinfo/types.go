@@ -210,6 +210,7 @@ type ChannelStats struct {
 	DeferredCount           int64                                   `json:"deferred_count"`
 	RequeueCount            int64                                   `json:"requeue_count"`
 	TimeoutCount            int64                                   `json:"timeout_count"`
+	ExpiredCount            int64                                   `json:"expired_count"`
 	MessageCount            int64                                   `json:"message_count"`
 	DelayedQueueCount       uint64                                  `json:"delayed_queue_count"`
 	DelayedQueueRecent      string                                  `json:"delayed_queue_recent"`
@@ -248,6 +249,7 @@ func (c *ChannelStats) Add(a *ChannelStats) {
 	c.DeferredCount += a.DeferredCount
 	c.RequeueCount += a.RequeueCount
 	c.TimeoutCount += a.TimeoutCount
+	c.ExpiredCount += a.ExpiredCount
 	c.MessageCount += a.MessageCount
 	c.DelayedQueueCount += a.DelayedQueueCount
 	if c.DelayedQueueRecent == "" {
@@ -506,3 +508,77 @@ type NodeHourlyPubsize struct {
 	TopicPartition string `json:"topic_partition"`
 	HourlyPubSize  int64  `json:"hourly_pub_size"`
 }
+
+// the consume lag of a channel on one topic partition, the confirmed and end offsets
+// are the virtual disk queue offsets and the depth timestamp is the publish time
+// (in nanoseconds) of the oldest message waiting to be consumed.
+type ChannelPartitionLag struct {
+	TopicName       string `json:"topic_name"`
+	TopicPartition  string `json:"topic_partition"`
+	ChannelName     string `json:"channel_name"`
+	Node            string `json:"node"`
+	ConfirmedOffset int64  `json:"confirmed_offset"`
+	ConfirmedCount  int64  `json:"confirmed_count"`
+	EndOffset       int64  `json:"end_offset"`
+	EndCount        int64  `json:"end_count"`
+	CommitLogCount  int64  `json:"commit_log_count"`
+	LagCount        int64  `json:"lag_count"`
+	LagBytes        int64  `json:"lag_bytes"`
+	DepthTimestamp  int64  `json:"depth_ts"`
+	LagTimeMs       int64  `json:"lag_time_ms"`
+}
+
+type ChannelPartitionLags []*ChannelPartitionLag
+
+func (c ChannelPartitionLags) Len() int      { return len(c) }
+func (c ChannelPartitionLags) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c ChannelPartitionLags) Less(i, j int) bool {
+	pi, _ := strconv.Atoi(c[i].TopicPartition)
+	pj, _ := strconv.Atoi(c[j].TopicPartition)
+	return pi < pj
+}
+
+type ChannelLag struct {
+	ChannelName string               `json:"channel_name"`
+	LagCount    int64                `json:"lag_count"`
+	LagBytes    int64                `json:"lag_bytes"`
+	MaxLagTime  int64                `json:"max_lag_time_ms"`
+	Partitions  ChannelPartitionLags `json:"partitions"`
+}
+
+type ChannelLags []*ChannelLag
+
+func (c ChannelLags) Len() int           { return len(c) }
+func (c ChannelLags) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c ChannelLags) Less(i, j int) bool { return c[i].ChannelName < c[j].ChannelName }
+
+type TopicLag struct {
+	TopicName string      `json:"topic_name"`
+	Channels  ChannelLags `json:"channels"`
+	Errors    []string    `json:"errors,omitempty"`
+}
+
+// merge the partition lags to the channel lags sorted by the channel name and partition
+func NewTopicLag(topicName string, partLags []*ChannelPartitionLag) *TopicLag {
+	channels := make(map[string]*ChannelLag)
+	for _, pl := range partLags {
+		ch, ok := channels[pl.ChannelName]
+		if !ok {
+			ch = &ChannelLag{ChannelName: pl.ChannelName}
+			channels[pl.ChannelName] = ch
+		}
+		ch.LagCount += pl.LagCount
+		ch.LagBytes += pl.LagBytes
+		if pl.LagTimeMs > ch.MaxLagTime {
+			ch.MaxLagTime = pl.LagTimeMs
+		}
+		ch.Partitions = append(ch.Partitions, pl)
+	}
+	tl := &TopicLag{TopicName: topicName}
+	for _, ch := range channels {
+		sort.Sort(ch.Partitions)
+		tl.Channels = append(tl.Channels, ch)
+	}
+	sort.Sort(tl.Channels)
+	return tl
+}
@@ -13,6 +13,31 @@ const (
 	CLIENT_DISPATCH_TAG_KEY = "##client_dispatch_tag"
 	TRACE_ID_KEY            = "##trace_id"
 	MaxExtLen               = 65535
+
+	// headers for the message moved to the dead letter topic
+	DLQ_ORIG_TOPIC_KEY     = "##dlq_orig_topic"
+	DLQ_ORIG_PARTITION_KEY = "##dlq_orig_partition"
+	DLQ_ORIG_CHANNEL_KEY   = "##dlq_orig_channel"
+	DLQ_ORIG_ID_KEY        = "##dlq_orig_id"
+	DLQ_ATTEMPTS_KEY       = "##dlq_attempts"
+	DLQ_REASON_KEY         = "##dlq_reason"
+	DLQ_KEY_PREFIX         = "##dlq_"
+
+	// the unix timestamp in seconds, the message will be auto confirmed
+	// without delivery after expired
+	MSG_EXPIRE_AT_KEY = "##expire_at"
+	// the priority lane of the message, the higher will be dispatched first
+	MSG_PRIORITY_KEY = "##priority"
+	// the messages with the same sharding key will not be in flight
+	// concurrently in a channel
+	MSG_SHARDING_KEY = "##sharding_key"
+	// the producer id and the increasing sequence (in string) of the producer,
+	// the retried pub with the same sequence will not be written again
+	MSG_PRODUCER_ID_KEY  = "##producer_id"
+	MSG_PRODUCER_SEQ_KEY = "##producer_seq"
+	// the original timestamp (unix nano in string) of the message imported
+	// from the exported data
+	MSG_ORIG_TIMESTAMP_KEY = "##orig_timestamp"
 )
 
 var MAX_TAG_LEN = 100
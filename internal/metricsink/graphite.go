@@ -0,0 +1,57 @@
+package metricsink
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"time"
+)
+
+// write the metrics in the graphite plaintext protocol: "<path> <value> <timestamp>",
+// all the metrics of one push use the same timestamp and are sent while closing.
+type graphiteSink struct {
+	addr   string
+	prefix string
+	conn   net.Conn
+	ts     int64
+	buf    bytes.Buffer
+}
+
+func newGraphiteSink(addr string, protocol string, prefix string) (*graphiteSink, error) {
+	conn, err := dial(protocol, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &graphiteSink{
+		addr:   addr,
+		prefix: prefix,
+		conn:   conn,
+		ts:     time.Now().Unix(),
+	}, nil
+}
+
+func (s *graphiteSink) String() string {
+	return s.addr
+}
+
+func (s *graphiteSink) Incr(stat string, count int64) error {
+	return s.write(stat, count)
+}
+
+func (s *graphiteSink) Gauge(stat string, value int64) error {
+	return s.write(stat, value)
+}
+
+func (s *graphiteSink) write(stat string, value int64) error {
+	_, err := fmt.Fprintf(&s.buf, "%s%s %d %d\n", s.prefix, stat, value, s.ts)
+	return err
+}
+
+func (s *graphiteSink) Close() error {
+	err := writeLines(s.conn, s.buf.Bytes())
+	closeErr := s.conn.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
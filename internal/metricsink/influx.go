@@ -0,0 +1,91 @@
+package metricsink
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const influxHTTPTimeout = time.Second * 5
+
+var influxMeasurementReplacer = strings.NewReplacer(",", `\,`, " ", `\ `)
+
+// write the metrics in the influxdb line protocol:
+// "<measurement>,type=<counter|gauge> value=<value>i <timestamp>",
+// the addr can be the http write url (http://host:8086/write?db=nsq) or
+// the udp/tcp listener address.
+type influxSink struct {
+	addr   string
+	prefix string
+	conn   net.Conn
+	ts     int64
+	buf    bytes.Buffer
+}
+
+func newInfluxSink(addr string, protocol string, prefix string) (*influxSink, error) {
+	s := &influxSink{
+		addr:   addr,
+		prefix: prefix,
+		ts:     time.Now().UnixNano(),
+	}
+	if !isHTTPAddr(addr) {
+		conn, err := dial(protocol, addr)
+		if err != nil {
+			return nil, err
+		}
+		s.conn = conn
+	}
+	return s, nil
+}
+
+func isHTTPAddr(addr string) bool {
+	return strings.HasPrefix(addr, "http://") || strings.HasPrefix(addr, "https://")
+}
+
+func (s *influxSink) String() string {
+	return s.addr
+}
+
+func (s *influxSink) Incr(stat string, count int64) error {
+	return s.write(stat, "counter", count)
+}
+
+func (s *influxSink) Gauge(stat string, value int64) error {
+	return s.write(stat, "gauge", value)
+}
+
+func (s *influxSink) write(stat string, typ string, value int64) error {
+	_, err := fmt.Fprintf(&s.buf, "%s,type=%s value=%di %d\n",
+		influxMeasurementReplacer.Replace(s.prefix+stat), typ, value, s.ts)
+	return err
+}
+
+func (s *influxSink) Close() error {
+	if s.conn != nil {
+		err := writeLines(s.conn, s.buf.Bytes())
+		closeErr := s.conn.Close()
+		if err != nil {
+			return err
+		}
+		return closeErr
+	}
+	if s.buf.Len() == 0 {
+		return nil
+	}
+	client := &http.Client{Timeout: influxHTTPTimeout}
+	rsp, err := client.Post(s.addr, "text/plain; charset=utf-8", &s.buf)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	io.Copy(ioutil.Discard, rsp.Body)
+	if rsp.StatusCode/100 != 2 {
+		return fmt.Errorf("write to influxdb %v failed: %v", s.addr, rsp.Status)
+	}
+	return nil
+}
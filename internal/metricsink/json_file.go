@@ -0,0 +1,69 @@
+package metricsink
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+type jsonMetric struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Value int64  `json:"value"`
+}
+
+type jsonMetrics struct {
+	Timestamp int64        `json:"timestamp"`
+	Metrics   []jsonMetric `json:"metrics"`
+}
+
+// append all the metrics of one push as one json line to the file
+type jsonFileSink struct {
+	path    string
+	prefix  string
+	metrics jsonMetrics
+}
+
+func newJSONFileSink(path string, prefix string) (*jsonFileSink, error) {
+	return &jsonFileSink{
+		path:   path,
+		prefix: prefix,
+		metrics: jsonMetrics{
+			Timestamp: time.Now().Unix(),
+		},
+	}, nil
+}
+
+func (s *jsonFileSink) String() string {
+	return s.path
+}
+
+func (s *jsonFileSink) Incr(stat string, count int64) error {
+	s.metrics.Metrics = append(s.metrics.Metrics, jsonMetric{Name: s.prefix + stat, Type: "counter", Value: count})
+	return nil
+}
+
+func (s *jsonFileSink) Gauge(stat string, value int64) error {
+	s.metrics.Metrics = append(s.metrics.Metrics, jsonMetric{Name: s.prefix + stat, Type: "gauge", Value: value})
+	return nil
+}
+
+func (s *jsonFileSink) Close() error {
+	if len(s.metrics.Metrics) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(s.metrics)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	closeErr := f.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
@@ -0,0 +1,97 @@
+package metricsink
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/youzan/nsq/internal/statsd"
+)
+
+const (
+	TypeStatsd   = "statsd"
+	TypeGraphite = "graphite"
+	TypeInflux   = "influx"
+	TypeJSONFile = "json-file"
+)
+
+const dialTimeout = time.Second
+
+// the max payload of one udp packet to avoid the ip fragmentation
+const maxUDPPacketSize = 1400
+
+// Sink receives the metrics of one push, the counter is the increment since
+// the last push. The buffered sinks may send all the metrics while closing,
+// so the error of Close should be checked.
+type Sink interface {
+	String() string
+	Incr(stat string, count int64) error
+	Gauge(stat string, value int64) error
+	Close() error
+}
+
+// New create the sink for one push, the addr is the remote address for statsd,
+// graphite and influx (the http url is also supported by influx),
+// and it is the file path for the json file sink.
+func New(sinkType string, addr string, protocol string, prefix string) (Sink, error) {
+	switch sinkType {
+	case "", TypeStatsd:
+		client := statsd.NewClient(addr, prefix)
+		err := client.CreateSocket(protocol)
+		if err != nil {
+			return nil, err
+		}
+		return client, nil
+	case TypeGraphite:
+		return newGraphiteSink(addr, protocol, prefix)
+	case TypeInflux:
+		return newInfluxSink(addr, protocol, prefix)
+	case TypeJSONFile:
+		return newJSONFileSink(addr, prefix)
+	}
+	return nil, fmt.Errorf("unknown metrics sink type: %v", sinkType)
+}
+
+func IsValidType(sinkType string) bool {
+	switch sinkType {
+	case "", TypeStatsd, TypeGraphite, TypeInflux, TypeJSONFile:
+		return true
+	}
+	return false
+}
+
+func dial(protocol string, addr string) (net.Conn, error) {
+	if protocol == "" {
+		protocol = "tcp"
+	}
+	return net.DialTimeout(protocol, addr, dialTimeout)
+}
+
+// write the metric lines to the conn, the lines will be split into packets
+// not larger than maxUDPPacketSize for the udp conn, and each packet only
+// contains the complete lines.
+func writeLines(conn net.Conn, data []byte) error {
+	if _, ok := conn.(*net.UDPConn); !ok {
+		_, err := conn.Write(data)
+		return err
+	}
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxUDPPacketSize {
+			n = bytes.LastIndexByte(data[:maxUDPPacketSize], '\n') + 1
+			if n == 0 {
+				// the single line is too large, send it in one packet anyway
+				n = bytes.IndexByte(data, '\n') + 1
+				if n == 0 {
+					n = len(data)
+				}
+			}
+		}
+		if _, err := conn.Write(data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package metricsink
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func pushTestMetrics(t *testing.T, s Sink) {
+	if err := s.Incr("topic.t1.message_count", 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Gauge("topic.t1.channel.c 1.depth", 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGraphiteSink(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	recv := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			recv <- ""
+			return
+		}
+		data, _ := ioutil.ReadAll(conn)
+		conn.Close()
+		recv <- string(data)
+	}()
+
+	s, err := New(TypeGraphite, l.Addr().String(), "tcp", "nsq.host.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushTestMetrics(t, s)
+	lines := strings.Split(strings.TrimSpace(<-recv), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("unexpected lines: %v", lines)
+	}
+	fields := strings.Fields(lines[0])
+	if len(fields) != 3 || fields[0] != "nsq.host.topic.t1.message_count" || fields[1] != "10" {
+		t.Fatalf("unexpected line: %v", lines[0])
+	}
+}
+
+func TestGraphiteUDPSinkSplitPackets(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	s, err := New(TypeGraphite, pc.LocalAddr().String(), "udp", "nsq.host.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := 100
+	for i := 0; i < total; i++ {
+		if err := s.Gauge("topic.t1.channel.c1.depth_"+strconv.Itoa(i), int64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 65536)
+	lines := 0
+	for lines < total {
+		pc.SetReadDeadline(time.Now().Add(time.Second * 3))
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("read packets failed after %v lines: %v", lines, err)
+		}
+		if n > maxUDPPacketSize {
+			t.Fatalf("packet too large: %v", n)
+		}
+		if buf[n-1] != '\n' {
+			t.Fatalf("packet should end with the complete line: %v", string(buf[:n]))
+		}
+		lines += strings.Count(string(buf[:n]), "\n")
+	}
+	if lines != total {
+		t.Fatalf("unexpected lines: %v", lines)
+	}
+}
+
+func TestInfluxHTTPSink(t *testing.T) {
+	recv := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		data, _ := ioutil.ReadAll(req.Body)
+		recv <- string(data)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	s, err := New(TypeInflux, ts.URL+"/write?db=nsq", "", "nsq.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushTestMetrics(t, s)
+	lines := strings.Split(strings.TrimSpace(<-recv), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("unexpected lines: %v", lines)
+	}
+	if !strings.HasPrefix(lines[0], "nsq.topic.t1.message_count,type=counter value=10i ") {
+		t.Fatalf("unexpected line: %v", lines[0])
+	}
+	if !strings.HasPrefix(lines[1], `nsq.topic.t1.channel.c\ 1.depth,type=gauge value=5i `) {
+		t.Fatalf("unexpected line: %v", lines[1])
+	}
+}
+
+func TestJSONFileSink(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "nsq-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	fileName := path.Join(tmpDir, "metrics.json")
+	for i := 0; i < 2; i++ {
+		s, err := New(TypeJSONFile, fileName, "", "nsq.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pushTestMetrics(t, s)
+	}
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("unexpected lines: %v", lines)
+	}
+	var m jsonMetrics
+	if err := json.Unmarshal([]byte(lines[1]), &m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Metrics) != 2 || m.Metrics[0] != (jsonMetric{"nsq.topic.t1.message_count", "counter", 10}) {
+		t.Fatalf("unexpected metrics: %v", m)
+	}
+}
+
+func TestUnknownSink(t *testing.T) {
+	if IsValidType("unknown") {
+		t.Fatal("should be invalid")
+	}
+	_, err := New("unknown", "127.0.0.1:1", "tcp", "")
+	if err == nil {
+		t.Fatal("should fail for unknown sink")
+	}
+}
@@ -0,0 +1,174 @@
+package prom
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// the content type of the prometheus text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+type Labels map[string]string
+
+type family struct {
+	name    string
+	help    string
+	typ     string
+	samples []string
+}
+
+// Exposition collects the metrics and writes them in the prometheus text format.
+// The samples of the same metric will be grouped together since prometheus
+// requires all the samples of one metric family to be contiguous.
+type Exposition struct {
+	prefix   string
+	families []*family
+	index    map[string]*family
+}
+
+func NewExposition(prefix string) *Exposition {
+	return &Exposition{
+		prefix: prefix,
+		index:  make(map[string]*family),
+	}
+}
+
+func (e *Exposition) getFamily(name string, typ string, help string) *family {
+	name = e.prefix + name
+	f, ok := e.index[name]
+	if !ok {
+		f = &family{name: name, help: help, typ: typ}
+		e.index[name] = f
+		e.families = append(e.families, f)
+	}
+	return f
+}
+
+func (e *Exposition) Counter(name string, help string, v float64, labels Labels) {
+	f := e.getFamily(name, typeCounter, help)
+	f.samples = append(f.samples, formatSample(f.name, labels, "", "", v))
+}
+
+func (e *Exposition) Gauge(name string, help string, v float64, labels Labels) {
+	f := e.getFamily(name, typeGauge, help)
+	f.samples = append(f.samples, formatSample(f.name, labels, "", "", v))
+}
+
+// Histogram converts the bucket counts to the cumulative prometheus buckets,
+// the upperBounds should be one less than the counts since the last count is
+// for the values above all the bounds. The sum is the sum of all the observed values.
+func (e *Exposition) Histogram(name string, help string, upperBounds []float64, counts []int64, sum float64, labels Labels) {
+	if len(counts) == 0 || len(upperBounds) != len(counts)-1 {
+		return
+	}
+	f := e.getFamily(name, typeHistogram, help)
+	var total int64
+	for i, c := range counts {
+		total += c
+		bound := math.Inf(1)
+		if i < len(upperBounds) {
+			bound = upperBounds[i]
+		}
+		f.samples = append(f.samples, formatSample(f.name+"_bucket", labels, "le", formatValue(bound), float64(total)))
+	}
+	f.samples = append(f.samples, formatSample(f.name+"_sum", labels, "", "", sum))
+	f.samples = append(f.samples, formatSample(f.name+"_count", labels, "", "", float64(total)))
+}
+
+func (e *Exposition) Bytes() []byte {
+	var buf bytes.Buffer
+	for _, f := range e.families {
+		buf.WriteString("# HELP ")
+		buf.WriteString(f.name)
+		buf.WriteString(" ")
+		buf.WriteString(escapeHelp(f.help))
+		buf.WriteString("\n# TYPE ")
+		buf.WriteString(f.name)
+		buf.WriteString(" ")
+		buf.WriteString(f.typ)
+		buf.WriteString("\n")
+		for _, s := range f.samples {
+			buf.WriteString(s)
+			buf.WriteString("\n")
+		}
+	}
+	return buf.Bytes()
+}
+
+func formatSample(name string, labels Labels, extraKey string, extraValue string, v float64) string {
+	var buf bytes.Buffer
+	buf.WriteString(name)
+	if len(labels) > 0 || extraKey != "" {
+		keys := make([]string, 0, len(labels))
+		for k := range labels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf.WriteString("{")
+		for i, k := range keys {
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			buf.WriteString(k)
+			buf.WriteString("=\"")
+			buf.WriteString(escapeLabelValue(labels[k]))
+			buf.WriteString("\"")
+		}
+		if extraKey != "" {
+			if len(keys) > 0 {
+				buf.WriteString(",")
+			}
+			buf.WriteString(extraKey)
+			buf.WriteString("=\"")
+			buf.WriteString(escapeLabelValue(extraValue))
+			buf.WriteString("\"")
+		}
+		buf.WriteString("}")
+	}
+	buf.WriteString(" ")
+	buf.WriteString(formatValue(v))
+	return buf.String()
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+var helpReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeLabelValue(v string) string {
+	return labelValueReplacer.Replace(v)
+}
+
+func escapeHelp(v string) string {
+	return helpReplacer.Replace(v)
+}
+
+// ExponentialBounds returns count upper bounds starting from start and
+// multiplied by factor each time.
+func ExponentialBounds(start float64, factor float64, count int) []float64 {
+	bounds := make([]float64, 0, count)
+	for i := 0; i < count; i++ {
+		bounds = append(bounds, start)
+		start *= factor
+	}
+	return bounds
+}
@@ -0,0 +1,34 @@
+package prom
+
+import (
+	"testing"
+
+	"github.com/youzan/nsq/internal/test"
+)
+
+func TestExpositionFormat(t *testing.T) {
+	e := NewExposition("nsq_")
+	e.Gauge("depth", "the depth", 10, Labels{"topic": "t1", "channel": "c\"1"})
+	e.Counter("count", "the count", 3, nil)
+	e.Gauge("depth", "the depth", 1.5, Labels{"topic": "t2", "channel": "c2"})
+	e.Histogram("latency_seconds", "the latency", []float64{0.1, 1}, []int64{1, 2, 3}, 12.5, Labels{"topic": "t1"})
+	// mismatch bounds should be ignored
+	e.Histogram("bad", "bad", []float64{0.1}, []int64{1, 2, 3}, 0, nil)
+
+	expected := `# HELP nsq_depth the depth
+# TYPE nsq_depth gauge
+nsq_depth{channel="c\"1",topic="t1"} 10
+nsq_depth{channel="c2",topic="t2"} 1.5
+# HELP nsq_count the count
+# TYPE nsq_count counter
+nsq_count 3
+# HELP nsq_latency_seconds the latency
+# TYPE nsq_latency_seconds histogram
+nsq_latency_seconds_bucket{topic="t1",le="0.1"} 1
+nsq_latency_seconds_bucket{topic="t1",le="1"} 3
+nsq_latency_seconds_bucket{topic="t1",le="+Inf"} 6
+nsq_latency_seconds_sum{topic="t1"} 12.5
+nsq_latency_seconds_count{topic="t1"} 6
+`
+	test.Equal(t, expected, string(e.Bytes()))
+}
@@ -113,6 +113,7 @@ func NewHTTPServer(ctx *Context) *httpServer {
 	router.Handle("GET", "/api/statistics", http_api.Decorate(s.statisticsHandler, log, http_api.V1))
 	router.Handle("GET", "/api/statistics/:sortBy", http_api.Decorate(s.statisticsHandler, log, http_api.V1))
 	router.Handle("GET", "/api/cluster/stats", http_api.Decorate(s.clusterStatsHandler, log, http_api.V1))
+	router.Handle("GET", "/metrics", http_api.Decorate(s.metricsHandler, http_api.PlainText))
 	router.Handle("GET", "/api/oauth/cas/callback", http_api.Decorate(s.casAuthCallbackHandler, log, http_api.V1))
 	router.Handle("GET", "/api/oauth/cas/callback/logout", http_api.Decorate(s.casAuthCallbackLogoutHandler, log, http_api.V1))
 	return s
@@ -1132,6 +1133,22 @@ func (s *httpServer) topicChannelAction(req *http.Request, topicName string, cha
 
 			s.notifyAdminActionWithUser("create_channel", topicName, channelName, "", req)
 		}
+	case "dlq_replay":
+		if channelName != "" {
+			err = s.ci.ReplayChannelDLQ(topicName, channelName,
+				s.ctx.nsqadmin.opts.NSQLookupdHTTPAddresses,
+				s.ctx.nsqadmin.opts.NSQDHTTPAddresses)
+
+			s.notifyAdminActionWithUser("dlq_replay_channel", topicName, channelName, "", req)
+		}
+	case "dlq_purge":
+		if channelName != "" {
+			err = s.ci.PurgeChannelDLQ(topicName, channelName,
+				s.ctx.nsqadmin.opts.NSQLookupdHTTPAddresses,
+				s.ctx.nsqadmin.opts.NSQDHTTPAddresses)
+
+			s.notifyAdminActionWithUser("dlq_purge_channel", topicName, channelName, "", req)
+		}
 	case "reset":
 		if channelName != "" {
 			//parse timestamp
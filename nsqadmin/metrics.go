@@ -0,0 +1,56 @@
+package nsqadmin
+
+import (
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/youzan/nsq/internal/clusterinfo"
+	"github.com/youzan/nsq/internal/prom"
+)
+
+const metricsPrefix = "nsqadmin_"
+
+// the cluster wide metrics collected from the leaders of all the topic partitions,
+// so the prometheus only need scrape the nsqadmin to get the cluster view.
+func (s *httpServer) metricsHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	e := prom.NewExposition(metricsPrefix)
+	scrapeErrors := 0
+	producers, err := s.ci.GetProducers(s.ctx.nsqadmin.opts.NSQLookupdHTTPAddresses, s.ctx.nsqadmin.opts.NSQDHTTPAddresses)
+	if err != nil {
+		if _, ok := err.(clusterinfo.PartialErr); !ok {
+			s.ctx.nsqadmin.logf("ERROR: failed to get producers - %s", err)
+			producers = nil
+		}
+		scrapeErrors++
+	}
+	e.Gauge("nsqd_nodes", "the number of nsqd nodes in the cluster", float64(len(producers)), nil)
+	var topicStats []*clusterinfo.TopicStats
+	if len(producers) > 0 {
+		topicStats, _, err = s.ci.GetNSQDStats(producers, "", "partition", true)
+		if err != nil {
+			s.ctx.nsqadmin.logf("WARNING: failed to get nsqd stats - %s", err)
+			scrapeErrors++
+		}
+	}
+	for _, t := range topicStats {
+		tl := prom.Labels{"topic": t.TopicName, "partition": t.TopicPartition, "node": t.Node}
+		e.Counter("topic_message_count", "total messages published to the topic partition", float64(t.MessageCount), tl)
+		e.Gauge("topic_depth_bytes", "the data size of the topic partition", float64(t.Depth), tl)
+		e.Gauge("topic_hourly_pub_bytes", "the data size published in current hour", float64(t.HourlyPubSize), tl)
+		for _, ch := range t.Channels {
+			cl := prom.Labels{"topic": t.TopicName, "partition": t.TopicPartition, "node": t.Node, "channel": ch.ChannelName}
+			e.Gauge("channel_depth", "the message count waiting to be consumed", float64(ch.Depth), cl)
+			e.Gauge("channel_depth_bytes", "the message size waiting to be consumed", float64(ch.DepthSize), cl)
+			e.Gauge("channel_in_flight_count", "the in flight message count", float64(ch.InFlightCount), cl)
+			e.Gauge("channel_deferred_count", "the deferred message count", float64(ch.DeferredCount), cl)
+			e.Gauge("channel_delayed_queue_count", "the message count in the delayed queue", float64(ch.DelayedQueueCount), cl)
+			e.Counter("channel_message_count", "total messages of the channel", float64(ch.MessageCount), cl)
+			e.Counter("channel_requeue_count", "total requeued messages of the channel", float64(ch.RequeueCount), cl)
+			e.Counter("channel_timeout_count", "total timeout messages of the channel", float64(ch.TimeoutCount), cl)
+			e.Counter("channel_expired_count", "total expired messages of the channel", float64(ch.ExpiredCount), cl)
+		}
+	}
+	e.Gauge("scrape_errors", "the errors while collecting the cluster metrics", float64(scrapeErrors), nil)
+	w.Header().Set("Content-Type", prom.ContentType)
+	return e.Bytes(), nil
+}
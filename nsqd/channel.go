@@ -13,6 +13,7 @@ import (
 	"github.com/youzan/nsq/internal/protocol"
 
 	simpleJson "github.com/bitly/go-simplejson"
+	"github.com/tidwall/gjson"
 	"github.com/youzan/nsq/internal/ext"
 	"github.com/youzan/nsq/internal/levellogger"
 	"github.com/youzan/nsq/internal/quantile"
@@ -64,6 +65,22 @@ type delayedMessage struct {
 	deliveryTs time.Time
 }
 
+// the message will be moved to the dead letter topic while the
+// attempts exceed the max attempts, 0 means disabled.
+// The dead letter topic should be an ext topic with the same partition number
+// as the channel topic, and the dead letter partition leader should be the same
+// node as the channel topic partition leader, since the message is moved to
+// the dead letter partition with the same partition id by the channel leader.
+type DeadLetterConf struct {
+	MaxAttempts uint32 `json:"max_attempts"`
+	// default to <topic>_<channel>_DLQ if empty
+	Topic string `json:"topic,omitempty"`
+}
+
+func GetDefaultDeadLetterTopic(topicName string, channelName string) string {
+	return topicName + "_" + channelName + "_DLQ"
+}
+
 // Channel represents the concrete type for a NSQ channel (and also
 // implements the Queue interface)
 //
@@ -78,6 +95,12 @@ type Channel struct {
 	timeoutCount      uint64
 	deferredCount     int64
 	deferredFromDelay int64
+	expiredCount      uint64
+	deadLetterCount   uint64
+	// the messages should be moved to the dead letter topic but failed
+	deadLetterFailedCount uint64
+	// the default ttl in seconds for the message without the expire ext header
+	msgTTL int64
 
 	sync.RWMutex
 
@@ -108,6 +131,9 @@ type Channel struct {
 	clients          map[int64]Consumer
 	paused           int32
 	skipped          int32
+	deadLetter       atomic.Value
+	extFilter        atomic.Value
+	priorityLanes    atomic.Value
 	ephemeral        bool
 	deleteCallback   func(*Channel)
 	deleter          sync.Once
@@ -119,6 +145,8 @@ type Channel struct {
 	inFlightMessages map[MessageID]*Message
 	inFlightPQ       inFlightPqueue
 	inFlightMutex    sync.Mutex
+	keyLocks         keyOrderLocks
+	keyWaitingCount  int64
 
 	confirmedMsgs   *IntervalSkipList
 	confirmMutex    sync.Mutex
@@ -358,6 +386,31 @@ func (c *Channel) IsExt() bool {
 	return atomic.LoadInt32(&c.Ext) == 1
 }
 
+func (c *Channel) SetMsgTTL(ttlSec int64) {
+	atomic.StoreInt64(&c.msgTTL, ttlSec)
+}
+
+func (c *Channel) GetMsgTTL() int64 {
+	return atomic.LoadInt64(&c.msgTTL)
+}
+
+// IsMsgExpired check the expire time in the json ext header first, and use the
+// default ttl of the topic if the message has no expire header.
+func (c *Channel) IsMsgExpired(msg *Message, now time.Time) bool {
+	if msg.ExtVer == ext.JSON_HEADER_EXT_VER {
+		expireAt := gjson.GetBytes(msg.ExtBytes, ext.MSG_EXPIRE_AT_KEY)
+		if expireAt.Exists() {
+			ts := expireAt.Int()
+			return ts > 0 && now.Unix() >= ts
+		}
+	}
+	ttl := c.GetMsgTTL()
+	if ttl <= 0 || msg.Timestamp <= 0 {
+		return false
+	}
+	return now.UnixNano()-msg.Timestamp >= ttl*int64(time.Second)
+}
+
 func (c *Channel) SetSlowTrace(enable bool) {
 	if enable {
 		atomic.StoreInt32(&c.EnableSlowTrace, 1)
@@ -442,6 +495,7 @@ func (c *Channel) initPQ() {
 	}
 	c.inFlightMessages = make(map[MessageID]*Message, pqSize)
 	c.inFlightPQ = newInFlightPqueue(pqSize)
+	c.resetKeyLocks()
 	atomic.StoreInt64(&c.deferredCount, 0)
 	c.inFlightMutex.Unlock()
 }
@@ -615,6 +669,118 @@ func (c *Channel) IsSkipped() bool {
 	return atomic.LoadInt32(&c.skipped) == 1
 }
 
+func (c *Channel) GetDeadLetterConf() DeadLetterConf {
+	conf, ok := c.deadLetter.Load().(DeadLetterConf)
+	if !ok {
+		return DeadLetterConf{}
+	}
+	return conf
+}
+
+func (c *Channel) SetDeadLetterConf(conf DeadLetterConf) {
+	c.deadLetter.Store(conf)
+}
+
+func (c *Channel) GetDeadLetterTopic() string {
+	conf := c.GetDeadLetterConf()
+	if conf.Topic != "" {
+		return conf.Topic
+	}
+	return GetDefaultDeadLetterTopic(c.GetTopicName(), c.GetName())
+}
+
+// check if the delivery attempts exceed the max attempts of the dead letter
+func (c *Channel) isAttemptsExceeded(attempts uint32) bool {
+	maxAttempts := c.GetDeadLetterConf().MaxAttempts
+	return maxAttempts > 0 && attempts > maxAttempts
+}
+
+// check if the message attempts exceed the max attempts, should be called after
+// the message is started in flight since the attempts is increased while delivering.
+func (c *Channel) IsExceedMaxAttempts(msg *Message) bool {
+	if c.IsOrdered() {
+		return false
+	}
+	return c.isAttemptsExceeded(uint32(msg.Attempts))
+}
+
+// return the copy of the in flight message if it should be moved to the dead letter
+// topic instead of requeue by the client
+func (c *Channel) ShouldMoveToDeadLetter(clientID int64, id MessageID) (*Message, bool) {
+	if c.IsOrdered() {
+		return nil, false
+	}
+	if c.GetDeadLetterConf().MaxAttempts == 0 {
+		return nil, false
+	}
+	c.inFlightMutex.Lock()
+	defer c.inFlightMutex.Unlock()
+	msg, ok := c.inFlightMessages[id]
+	if !ok {
+		return nil, false
+	}
+	if msg.GetClientID() != clientID || msg.IsDeferred() {
+		return nil, false
+	}
+	// the requeued message will be delivered with one more attempt
+	if !c.isAttemptsExceeded(uint32(msg.Attempts) + 1) {
+		return nil, false
+	}
+	return msg.GetCopy(), true
+}
+
+// update the stats of the messages moved to the dead letter topic
+func (c *Channel) UpdateDeadLetterStats(moved bool) {
+	if moved {
+		atomic.AddUint64(&c.deadLetterCount, 1)
+	} else {
+		atomic.AddUint64(&c.deadLetterFailedCount, 1)
+	}
+}
+
+type channelExtFilter struct {
+	data   ExtFilterData
+	filter IExtFilter
+}
+
+func (c *Channel) GetExtFilter() ExtFilterData {
+	f, ok := c.extFilter.Load().(*channelExtFilter)
+	if !ok || f == nil {
+		return ExtFilterData{}
+	}
+	return f.data
+}
+
+// set the channel level ext filter, the message not matched will be confirmed
+// without delivery to any client. The filter type 0 means no filter.
+func (c *Channel) SetExtFilter(filter ExtFilterData) error {
+	if filter.Type == 0 {
+		c.extFilter.Store(&channelExtFilter{})
+		return nil
+	}
+	f, err := NewExtFilter(filter)
+	if err != nil {
+		return err
+	}
+	c.extFilter.Store(&channelExtFilter{data: filter, filter: f})
+	return nil
+}
+
+func (c *Channel) IsFilteredOut(msg *Message) bool {
+	if !c.IsExt() {
+		return false
+	}
+	f, ok := c.extFilter.Load().(*channelExtFilter)
+	if !ok || f == nil || f.filter == nil {
+		return false
+	}
+	matched := f.filter.Match(msg)
+	if f.data.Inverse {
+		matched = !matched
+	}
+	return !matched
+}
+
 func (c *Channel) doSkip(skipped bool) error {
 	if skipped {
 		atomic.StoreInt32(&c.skipped, 1)
@@ -643,6 +809,9 @@ func (c *Channel) UpdateQueueEnd(end BackendQueueEnd, forceReload bool) error {
 		case c.endUpdatedChan <- true:
 		default:
 		}
+		if pl := c.getPriorityLanes(); pl != nil {
+			pl.notifyEnd()
+		}
 	}
 	return err
 }
@@ -899,6 +1068,7 @@ func (c *Channel) internalFinishMessage(clientID int64, clientAddr string,
 			clientID)
 		return 0, 0, false, nil, err
 	}
+	c.unlockMsgKey(msg)
 	now := time.Now()
 	ackCost := now.UnixNano() - msg.deliveryTS.UnixNano()
 	isOldDeferred := msg.IsDeferred()
@@ -1485,6 +1655,9 @@ func (c *Channel) drainChannelWaiting(clearConfirmed bool, lastDataNeedRead *boo
 	}
 	c.confirmMutex.Unlock()
 	atomic.StoreInt64(&c.waitingProcessMsgTs, 0)
+	if pl := c.getPriorityLanes(); pl != nil {
+		pl.reset()
+	}
 
 	if c.Exiting() {
 		return nil
@@ -1635,6 +1808,7 @@ LOOP:
 					inflightCnt := len(c.inFlightMessages)
 					inflightCnt += len(c.waitingRequeueMsgs)
 					inflightCnt += len(c.waitingRequeueChanMsgs)
+					inflightCnt += int(c.GetKeyWaitingCount())
 					c.inFlightMutex.Unlock()
 					if inflightCnt <= 0 {
 						nsqLog.Warningf("reset need clear confirmed since no inflight: %v, %v",
@@ -1670,11 +1844,22 @@ LOOP:
 			inflightCnt := len(c.inFlightMessages)
 			inflightCnt += len(c.waitingRequeueMsgs)
 			inflightCnt += len(c.waitingRequeueChanMsgs)
+			inflightCnt += int(c.GetKeyWaitingCount())
 			c.inFlightMutex.Unlock()
 			if inflightCnt <= 0 {
 				nsqLog.Warningf("many confirmed but no inflight: %v, %v, %v",
 					c.GetTopicName(), c.GetName(), atomic.LoadInt32(&c.waitingConfirm))
 			}
+		} else if c.isKeyWaitingFull() {
+			// too many messages waiting on the same key, hold reading until
+			// the waiting messages dispatched
+			if nsqLog.Level() >= levellogger.LOG_DEBUG {
+				nsqLog.LogDebugf("channel %v reader is holding by key waiting: %v",
+					c.GetName(), c.GetKeyWaitingCount())
+			}
+			atomic.StoreInt32(&c.needNotifyRead, 1)
+			readChan = nil
+			needReadBackend = false
 		} else {
 			readChan = origReadChan
 			needReadBackend = true
@@ -1714,6 +1899,15 @@ LOOP:
 		}
 
 		atomic.StoreInt32(&c.waitingDeliveryState, 0)
+		var laneReadyChan chan bool
+		if pl := c.getPriorityLanes(); pl != nil && !c.IsConsumeDisabled() {
+			// the higher priority lane is dispatched before the default reader
+			msg = pl.poll()
+			if msg != nil {
+				goto laneMsgReady
+			}
+			laneReadyChan = pl.readyChan
+		}
 		select {
 		case <-c.exitChan:
 			goto exit
@@ -1726,7 +1920,7 @@ LOOP:
 			lastDataNeedRead = false
 			if data.Err != nil {
 				nsqLog.LogErrorf("channel (%v): failed to read message - %s", c.GetName(), data.Err)
-				if data.Err == ErrReadQueueCountMissing {
+				if data.Err == ErrReadQueueCountMissing || data.Err == ErrArchivedSegmentRestoring {
 					time.Sleep(time.Second)
 				} else {
 					// TODO: fix corrupt file from other replica.
@@ -1792,6 +1986,12 @@ LOOP:
 			}
 			lastMsg = *msg
 			isSkipped = false
+			if pl := c.getPriorityLanes(); pl != nil && pl.isHigherLaneMsg(msg) {
+				// will be dispatched by the priority lane reader
+				continue LOOP
+			}
+		case <-laneReadyChan:
+			continue LOOP
 		case <-c.tryReadBackend:
 			atomic.StoreInt32(&c.needNotifyRead, 0)
 			readBackendWait = false
@@ -1805,6 +2005,7 @@ LOOP:
 			continue LOOP
 		}
 
+	laneMsgReady:
 		if msg == nil {
 			continue
 		}
@@ -1821,8 +2022,15 @@ LOOP:
 			}
 		}
 
+		expired := c.IsMsgExpired(msg, time.Now())
+		if expired {
+			atomic.AddUint64(&c.expiredCount, 1)
+			if msg.TraceID != 0 || c.IsTraced() || nsqLog.Level() >= levellogger.LOG_DETAIL {
+				nsqMsgTracer.TraceSub(c.GetTopicName(), c.GetName(), "EXPIRED", msg.TraceID, msg, "0", 0)
+			}
+		}
 		//let timer sync to update backend in replicas' channels
-		if c.IsSkipped() {
+		if expired || c.IsSkipped() || c.IsFilteredOut(msg) {
 			if msg.DelayedType == ChannelDelayed {
 				c.ConfirmDelayedMessage(msg)
 			} else {
@@ -1831,6 +2039,10 @@ LOOP:
 			c.CleanWaitingRequeueChan(msg)
 			continue LOOP
 		}
+		if !c.tryLockMsgKey(msg) {
+			// will be dispatched after the previous message with the same key finished
+			continue LOOP
+		}
 
 		atomic.StoreInt32(&c.waitingDeliveryState, 1)
 		//atomic.StoreInt32(&msg.deferredCnt, 0)
@@ -2177,7 +2389,8 @@ exit:
 				nsqLog.LogDebugf("channel %v delayed waiting : %v", c.GetName(), waitingDelayCnt)
 			}
 			c.inFlightMutex.Lock()
-			allWaiting := len(c.inFlightMessages) + len(c.waitingRequeueChanMsgs) + len(c.waitingRequeueMsgs)
+			allWaiting := len(c.inFlightMessages) + len(c.waitingRequeueChanMsgs) + len(c.waitingRequeueMsgs) +
+				int(c.GetKeyWaitingCount())
 			c.inFlightMutex.Unlock()
 			if waitingDelayCnt > int64(allWaiting) {
 				nsqLog.Logf("channel %v delayed waiting : %v, more than all waiting delivery: %v", c.GetName(), waitingDelayCnt, allWaiting)
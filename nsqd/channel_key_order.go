@@ -0,0 +1,140 @@
+package nsqd
+
+import (
+	"sync/atomic"
+
+	"github.com/tidwall/gjson"
+	"github.com/youzan/nsq/internal/ext"
+)
+
+// the max messages waiting on the same sharding key, the channel reader will
+// hold reading while any key has too many waiting messages.
+const maxKeyWaitingMsgs = 1000
+
+// keyOrderLocks is the sharding key lock table of the channel, the message
+// with the sharding key in the json ext header will lock the key until it is
+// finished, the later messages with the same key will wait in the table and
+// be dispatched one by one after the previous finished. The messages without
+// the key can be dispatched in parallel as usual.
+// All of these should be protected by the inflight lock.
+type keyOrderLocks struct {
+	owners  map[string]MessageID
+	waiting map[string][]*Message
+	// the number of keys with too many waiting messages
+	fullKeys int
+}
+
+func newKeyOrderLocks() keyOrderLocks {
+	return keyOrderLocks{
+		owners:  make(map[string]MessageID),
+		waiting: make(map[string][]*Message),
+	}
+}
+
+// get the sharding key of the message, the delayed message from delayed queue
+// has been out of order, so it will not be locked.
+func getMsgShardingKey(msg *Message) string {
+	if msg.ExtVer != ext.JSON_HEADER_EXT_VER || msg.DelayedType == ChannelDelayed {
+		return ""
+	}
+	v := gjson.GetBytes(msg.ExtBytes, ext.MSG_SHARDING_KEY)
+	if v.Type != gjson.String {
+		return ""
+	}
+	return v.Str
+}
+
+// try lock the sharding key before dispatching the message, return false if
+// the key is locked by others and the message will be dispatched after the
+// key unlocked.
+func (c *Channel) tryLockMsgKey(msg *Message) bool {
+	if c.IsOrdered() {
+		return true
+	}
+	key := getMsgShardingKey(msg)
+	if key == "" {
+		return true
+	}
+	c.inFlightMutex.Lock()
+	defer c.inFlightMutex.Unlock()
+	owner, ok := c.keyLocks.owners[key]
+	if !ok {
+		c.keyLocks.owners[key] = msg.ID
+		return true
+	}
+	if owner == msg.ID {
+		// the requeued message which owns the key
+		return true
+	}
+	c.keyLocks.waiting[key] = append(c.keyLocks.waiting[key], msg)
+	if len(c.keyLocks.waiting[key]) == maxKeyWaitingMsgs {
+		c.keyLocks.fullKeys++
+		nsqLog.Logf("channel %v too many messages waiting on key %v", c.GetName(), key)
+	}
+	atomic.AddInt64(&c.keyWaitingCount, 1)
+	if msg.TraceID != 0 || c.IsTraced() {
+		nsqMsgTracer.TraceSub(c.GetTopicName(), c.GetName(), "KEY_WAITING", msg.TraceID, msg, "0", 0)
+	}
+	return false
+}
+
+// unlock the key while the message is finished and requeue the next waiting
+// message with the same key, should be protected by the inflight lock
+func (c *Channel) unlockMsgKey(msg *Message) {
+	key := getMsgShardingKey(msg)
+	if key == "" {
+		return
+	}
+	if owner, ok := c.keyLocks.owners[key]; !ok || owner != msg.ID {
+		return
+	}
+	waitingList := c.keyLocks.waiting[key]
+	if len(waitingList) == 0 {
+		delete(c.keyLocks.owners, key)
+		return
+	}
+	if len(waitingList) == maxKeyWaitingMsgs {
+		c.keyLocks.fullKeys--
+		if c.keyLocks.fullKeys == 0 && atomic.LoadInt32(&c.needNotifyRead) == 1 {
+			select {
+			case c.tryReadBackend <- true:
+			default:
+			}
+		}
+	}
+	next := waitingList[0]
+	waitingList[0] = nil
+	if len(waitingList) == 1 {
+		delete(c.keyLocks.waiting, key)
+	} else {
+		c.keyLocks.waiting[key] = waitingList[1:]
+	}
+	atomic.AddInt64(&c.keyWaitingCount, -1)
+	c.keyLocks.owners[key] = next.ID
+	if c.Exiting() {
+		return
+	}
+	select {
+	case c.requeuedMsgChan <- next:
+		c.waitingRequeueChanMsgs[next.ID] = next
+	default:
+		c.waitingRequeueMsgs[next.ID] = next
+	}
+}
+
+// the waiting messages will be read again from the confirmed after reset,
+// should be protected by the inflight lock
+func (c *Channel) resetKeyLocks() {
+	c.keyLocks = newKeyOrderLocks()
+	atomic.StoreInt64(&c.keyWaitingCount, 0)
+}
+
+func (c *Channel) isKeyWaitingFull() bool {
+	c.inFlightMutex.Lock()
+	defer c.inFlightMutex.Unlock()
+	return c.keyLocks.fullKeys > 0
+}
+
+func (c *Channel) GetKeyWaitingCount() int64 {
+	return atomic.LoadInt64(&c.keyWaitingCount)
+}
@@ -0,0 +1,359 @@
+package nsqd
+
+import (
+	"errors"
+	"io"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/youzan/nsq/internal/ext"
+)
+
+// MaxPriorityLanes is the max lanes of the channel, the message with the
+// priority larger than the lanes will be dispatched in the highest lane.
+const MaxPriorityLanes = 8
+
+// the messages read ahead for each higher lane, so the higher lane messages
+// can be dispatched continuously before the default lane.
+const priorityLaneBufferSize = 16
+
+var ErrInvalidPriorityLanes = errors.New("invalid priority lanes")
+
+type PriorityLaneStats struct {
+	Priority   int    `json:"priority"`
+	ReadCount  uint64 `json:"read_count"`
+	ReadOffset int64  `json:"read_offset"`
+}
+
+type laneMessage struct {
+	msg *Message
+	gen int64
+}
+
+type priorityLane struct {
+	readCount  uint64
+	readOffset int64
+	priority   int
+	msgChan    chan laneMessage
+	endUpdated chan bool
+}
+
+// priorityLanes keeps a read cursor for each priority lane above 0, each
+// cursor reads the whole queue from the confirmed position and only dispatch
+// the messages in its own lane, the lane 0 is the default channel reader which
+// skips the messages belong to the higher lanes. The messagePump will always
+// dispatch the higher lane first. All the lanes share the same confirmed
+// interval, so the confirmed position is moved only if all the lanes
+// confirmed.
+type priorityLanes struct {
+	gen       int64
+	ch        *Channel
+	lanes     []*priorityLane
+	readyChan chan bool
+	exitChan  chan struct{}
+	wg        sync.WaitGroup
+}
+
+func newPriorityLanes(c *Channel, num int) *priorityLanes {
+	pl := &priorityLanes{
+		ch:        c,
+		lanes:     make([]*priorityLane, num),
+		readyChan: make(chan bool, 1),
+		exitChan:  make(chan struct{}),
+	}
+	for i := range pl.lanes {
+		pl.lanes[i] = &priorityLane{
+			priority:   i,
+			msgChan:    make(chan laneMessage, priorityLaneBufferSize),
+			endUpdated: make(chan bool, 1),
+		}
+	}
+	return pl
+}
+
+func (pl *priorityLanes) start() {
+	for _, lane := range pl.lanes[1:] {
+		pl.wg.Add(1)
+		go pl.readLoop(lane)
+	}
+}
+
+func (pl *priorityLanes) stop() {
+	close(pl.exitChan)
+	pl.wg.Wait()
+}
+
+// reset all the lane readers to the confirmed, and the messages read before
+// will be ignored. The waiting readers will be waked up to read again.
+func (pl *priorityLanes) reset() {
+	atomic.AddInt64(&pl.gen, 1)
+	for _, lane := range pl.lanes {
+	DRAIN:
+		for {
+			select {
+			case <-lane.msgChan:
+			default:
+				break DRAIN
+			}
+		}
+	}
+	pl.notifyEnd()
+}
+
+func (pl *priorityLanes) notifyEnd() {
+	for _, lane := range pl.lanes {
+		select {
+		case lane.endUpdated <- true:
+		default:
+		}
+	}
+}
+
+// poll the waiting message from the highest lane
+func (pl *priorityLanes) poll() *Message {
+	gen := atomic.LoadInt64(&pl.gen)
+	for i := len(pl.lanes) - 1; i > 0; {
+		select {
+		case lm := <-pl.lanes[i].msgChan:
+			if lm.gen == gen {
+				return lm.msg
+			}
+			// read before reset, try the same lane again
+		default:
+			i--
+		}
+	}
+	return nil
+}
+
+// check if the message read by the default reader should be dispatched by
+// the higher lane.
+func (pl *priorityLanes) isHigherLaneMsg(msg *Message) bool {
+	p := getMsgPriority(msg, len(pl.lanes))
+	if p > 0 {
+		return true
+	}
+	atomic.AddUint64(&pl.lanes[0].readCount, 1)
+	atomic.StoreInt64(&pl.lanes[0].readOffset, int64(msg.Offset))
+	return false
+}
+
+func (pl *priorityLanes) stats() []PriorityLaneStats {
+	stats := make([]PriorityLaneStats, 0, len(pl.lanes))
+	for _, lane := range pl.lanes {
+		stats = append(stats, PriorityLaneStats{
+			Priority:   lane.priority,
+			ReadCount:  atomic.LoadUint64(&lane.readCount),
+			ReadOffset: atomic.LoadInt64(&lane.readOffset),
+		})
+	}
+	return stats
+}
+
+// wait more data or timeout, return false if exiting
+func (pl *priorityLanes) wait(lane *priorityLane, d time.Duration) bool {
+	select {
+	case <-lane.endUpdated:
+	case <-time.After(d):
+	case <-pl.exitChan:
+		return false
+	case <-pl.ch.exitChan:
+		return false
+	}
+	return true
+}
+
+func (pl *priorityLanes) readLoop(lane *priorityLane) {
+	defer pl.wg.Done()
+	c := pl.ch
+	var snap *DiskQueueSnapshot
+	var cnt int64
+	// the end of the last message read in current generation, we should
+	// resume from here after the read error to avoid dispatching the read
+	// messages again.
+	var readEnd BackendOffset
+	// the messages before this are dispatched already and should be skipped
+	var skipBefore BackendOffset
+	gen := int64(-1)
+	defer func() {
+		if snap != nil {
+			snap.Close()
+		}
+	}()
+	// the higher lane should not make too many confirmed intervals which will
+	// block the default lane reader
+	maxWin := int32(c.option.MaxConfirmWin / 2)
+	for {
+		select {
+		case <-pl.exitChan:
+			return
+		case <-c.exitChan:
+			return
+		default:
+		}
+		if c.IsConsumeDisabled() || atomic.LoadInt32(&c.waitingConfirm) > maxWin {
+			if !pl.wait(lane, time.Millisecond*100) {
+				return
+			}
+			continue
+		}
+		curGen := atomic.LoadInt64(&pl.gen)
+		if snap == nil || curGen != gen {
+			if snap != nil {
+				snap.Close()
+			}
+			confirmed := c.GetConfirmed()
+			snap = NewDiskQueueSnapshot(getBackendName(c.topicName, c.topicPart),
+				path.Join(c.option.DataPath, c.topicName), c.GetChannelEnd())
+			snap.SetQueueStart(confirmed)
+			if curGen != gen || readEnd <= confirmed.Offset() {
+				cnt = confirmed.TotalMsgCnt()
+				readEnd = 0
+				skipBefore = 0
+			} else if err := snap.SeekTo(readEnd); err != nil {
+				nsqLog.LogWarningf("channel (%v): priority lane %v failed to seek to %v - %s",
+					c.GetName(), lane.priority, readEnd, err)
+				cnt = confirmed.TotalMsgCnt()
+				skipBefore = readEnd
+			}
+			gen = curGen
+		}
+		end := c.GetChannelEnd()
+		snap.UpdateQueueEnd(end)
+		var data ReadResult
+		// the snapshot read position has no message count, so we check the end
+		// by the offset
+		if snap.GetCurrentReadQueueOffset().Offset() >= end.Offset() {
+			data.Err = io.EOF
+		} else {
+			data = snap.ReadOne()
+		}
+		if data.Err == io.EOF {
+			if !pl.wait(lane, time.Second) {
+				return
+			}
+			continue
+		}
+		if data.Err != nil {
+			nsqLog.LogWarningf("channel (%v): priority lane %v failed to read message - %s",
+				c.GetName(), lane.priority, data.Err)
+			snap.Close()
+			snap = nil
+			if !pl.wait(lane, time.Second) {
+				return
+			}
+			continue
+		}
+		cnt++
+		readEnd = data.Offset + data.MovedSize
+		if data.Offset < skipBefore {
+			continue
+		}
+		atomic.StoreInt64(&lane.readOffset, int64(data.Offset))
+		msg, err := decodeMessage(data.Data, c.IsExt())
+		if err != nil {
+			nsqLog.LogErrorf("channel (%v): priority lane failed to decode message - %s - %v", c.GetName(), err, data)
+			continue
+		}
+		if getMsgPriority(msg, len(pl.lanes)) != lane.priority {
+			continue
+		}
+		msg.Offset = data.Offset
+		msg.RawMoveSize = data.MovedSize
+		msg.queueCntIndex = cnt
+		atomic.AddUint64(&lane.readCount, 1)
+		select {
+		case lane.msgChan <- laneMessage{msg: msg, gen: gen}:
+			select {
+			case pl.readyChan <- true:
+			default:
+			}
+		case <-pl.exitChan:
+			return
+		case <-c.exitChan:
+			return
+		}
+	}
+}
+
+// get the lane of the message, the priority is in the json ext header
+func getMsgPriority(msg *Message, lanes int) int {
+	if msg.ExtVer != ext.JSON_HEADER_EXT_VER {
+		return 0
+	}
+	v := gjson.GetBytes(msg.ExtBytes, ext.MSG_PRIORITY_KEY)
+	if !v.Exists() {
+		return 0
+	}
+	p := int(v.Int())
+	if p < 0 {
+		return 0
+	}
+	if p >= lanes {
+		return lanes - 1
+	}
+	return p
+}
+
+func (c *Channel) getPriorityLanes() *priorityLanes {
+	pl, _ := c.priorityLanes.Load().(*priorityLanes)
+	if pl == nil || c.IsOrdered() {
+		return nil
+	}
+	return pl
+}
+
+func (c *Channel) GetPriorityLanes() int {
+	pl, _ := c.priorityLanes.Load().(*priorityLanes)
+	if pl == nil {
+		return 0
+	}
+	return len(pl.lanes)
+}
+
+// SetPriorityLanes changes the number of the priority lanes, 0 or 1 will
+// disable the priority dispatch.
+func (c *Channel) SetPriorityLanes(num int) error {
+	if num < 0 || num > MaxPriorityLanes {
+		return ErrInvalidPriorityLanes
+	}
+	if num == 1 {
+		num = 0
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.Exiting() {
+		return ErrExiting
+	}
+	old, _ := c.priorityLanes.Load().(*priorityLanes)
+	if old == nil && num == 0 || old != nil && len(old.lanes) == num {
+		return nil
+	}
+	if old != nil {
+		old.stop()
+	}
+	var pl *priorityLanes
+	if num > 0 {
+		pl = newPriorityLanes(c, num)
+		pl.start()
+	}
+	c.priorityLanes.Store(pl)
+	nsqLog.Logf("channel %v priority lanes changed to %v", c.GetName(), num)
+	// the default reader should read again since the lane of the messages changed
+	select {
+	case c.readerChanged <- resetChannelData{BackendOffset(-1), 0, false}:
+	default:
+	}
+	return nil
+}
+
+func (c *Channel) GetPriorityLaneStats() []PriorityLaneStats {
+	pl, _ := c.priorityLanes.Load().(*priorityLanes)
+	if pl == nil {
+		return nil
+	}
+	return pl.stats()
+}
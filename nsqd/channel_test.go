@@ -2,10 +2,13 @@ package nsqd
 
 import (
 	//"github.com/youzan/nsq/internal/levellogger"
+	"fmt"
 	"os"
 	"strconv"
 	"testing"
 	"time"
+
+	"github.com/youzan/nsq/internal/ext"
 )
 
 type fakeConsumer struct {
@@ -353,6 +356,276 @@ func TestChannelDepthTimestamp(t *testing.T) {
 	equal(t, channel.DepthTimestamp(), int64(0))
 }
 
+func TestChannelDeadLetterConf(t *testing.T) {
+	opts := NewOptions()
+	opts.SyncEvery = 1
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_dlq" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopicIgnPart(topicName)
+	channel := topic.GetChannel("channel")
+
+	equal(t, channel.GetDeadLetterTopic(), topicName+"_channel_DLQ")
+	msg := NewMessage(0, []byte("test"))
+	msg.Attempts = 100
+	equal(t, channel.IsExceedMaxAttempts(msg), false)
+
+	channel.SetDeadLetterConf(DeadLetterConf{MaxAttempts: 3, Topic: "test_dlq"})
+	equal(t, channel.GetDeadLetterTopic(), "test_dlq")
+	msg.Attempts = 3
+	equal(t, channel.IsExceedMaxAttempts(msg), false)
+	msg.Attempts = 4
+	equal(t, channel.IsExceedMaxAttempts(msg), true)
+
+	// should be restored from the channel meta
+	topic.SaveChannelMeta()
+	channel.SetDeadLetterConf(DeadLetterConf{})
+	equal(t, channel.GetDeadLetterConf().MaxAttempts, uint32(0))
+	topic.LoadChannelMeta()
+	equal(t, channel.GetDeadLetterConf(), DeadLetterConf{MaxAttempts: 3, Topic: "test_dlq"})
+}
+
+func TestChannelExtFilter(t *testing.T) {
+	opts := NewOptions()
+	opts.SyncEvery = 1
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_ext_filter" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopicWithExt(topicName, 0)
+	channel := topic.GetChannel("channel")
+
+	filter := ExtFilterData{Type: 1, FilterExtKey: "k", FilterData: "a"}
+	err := channel.SetExtFilter(filter)
+	equal(t, err, nil)
+	err = channel.SetExtFilter(ExtFilterData{Type: 2, FilterExtKey: "k", FilterData: "("})
+	nequal(t, err, nil)
+	equal(t, channel.GetExtFilter(), filter)
+
+	msgs := make([]*Message, 0, 10)
+	for i := 0; i < 10; i++ {
+		header := `{"k":"b"}`
+		if i%2 == 0 {
+			header = `{"k":"a"}`
+		}
+		msg := NewMessageWithExt(0, []byte(strconv.Itoa(i)), ext.JSON_HEADER_EXT_VER, []byte(header))
+		msgs = append(msgs, msg)
+	}
+	topic.PutMessages(msgs)
+	topic.flush(true)
+
+	for i := 0; i < 5; i++ {
+		outputMsg := <-channel.clientMsgChan
+		equal(t, string(outputMsg.Body), strconv.Itoa(i*2))
+		equal(t, string(outputMsg.ExtBytes), `{"k":"a"}`)
+	}
+
+	// should be restored from the channel meta
+	topic.SaveChannelMeta()
+	channel.SetExtFilter(ExtFilterData{})
+	equal(t, channel.GetExtFilter().Type, 0)
+	topic.LoadChannelMeta()
+	equal(t, channel.GetExtFilter(), filter)
+}
+
+func TestChannelMsgExpired(t *testing.T) {
+	opts := NewOptions()
+	opts.SyncEvery = 1
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_msg_expired" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopicWithExt(topicName, 0)
+	channel := topic.GetChannel("channel")
+
+	now := time.Now()
+	msgs := make([]*Message, 0, 10)
+	for i := 0; i < 10; i++ {
+		header := fmt.Sprintf(`{"##expire_at":%d}`, now.Add(time.Hour).Unix())
+		if i%2 == 0 {
+			header = fmt.Sprintf(`{"##expire_at":"%d"}`, now.Add(-time.Second).Unix())
+		}
+		msg := NewMessageWithExt(0, []byte(strconv.Itoa(i)), ext.JSON_HEADER_EXT_VER, []byte(header))
+		msgs = append(msgs, msg)
+	}
+	topic.PutMessages(msgs)
+	topic.flush(true)
+
+	for i := 0; i < 5; i++ {
+		outputMsg := <-channel.clientMsgChan
+		equal(t, string(outputMsg.Body), strconv.Itoa(i*2+1))
+	}
+	equal(t, NewChannelStats(channel, nil, 0).ExpiredCount, uint64(5))
+
+	// the topic default ttl only used for the message without expire header
+	dyConf := topic.GetDynamicInfo()
+	dyConf.Ext = true
+	dyConf.MsgTTL = 10
+	topic.SetDynamicInfo(dyConf, nil)
+	equal(t, channel.GetMsgTTL(), int64(10))
+	msg := NewMessageWithExt(0, []byte("body"), ext.JSON_HEADER_EXT_VER, []byte(`{"k":"a"}`))
+	msg.Timestamp = now.UnixNano()
+	equal(t, channel.IsMsgExpired(msg, now.Add(time.Second)), false)
+	equal(t, channel.IsMsgExpired(msg, now.Add(time.Second*10)), true)
+	msg = NewMessageWithExt(0, []byte("body"), ext.JSON_HEADER_EXT_VER,
+		[]byte(fmt.Sprintf(`{"##expire_at":%d}`, now.Add(time.Minute).Unix())))
+	msg.Timestamp = now.UnixNano()
+	equal(t, channel.IsMsgExpired(msg, now.Add(time.Second*10)), false)
+	equal(t, topic.GetChannel("channel2").GetMsgTTL(), int64(10))
+}
+
+func TestChannelPriorityLanes(t *testing.T) {
+	opts := NewOptions()
+	opts.SyncEvery = 1
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_priority_lanes" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopicWithExt(topicName, 0)
+	channel := topic.GetChannel("channel")
+	nequal(t, channel.SetPriorityLanes(MaxPriorityLanes+1), nil)
+	equal(t, channel.SetPriorityLanes(2), nil)
+	equal(t, channel.GetPriorityLanes(), 2)
+
+	msgs := make([]*Message, 0, 53)
+	for i := 0; i < 50; i++ {
+		msg := NewMessageWithExt(0, []byte("low"), ext.JSON_HEADER_EXT_VER, []byte(`{"k":"a"}`))
+		msgs = append(msgs, msg)
+	}
+	for i := 0; i < 3; i++ {
+		// the priority larger than lanes should be in the highest lane
+		msg := NewMessageWithExt(0, []byte("high"), ext.JSON_HEADER_EXT_VER,
+			[]byte(fmt.Sprintf(`{"##priority":%d}`, i+1)))
+		msgs = append(msgs, msg)
+	}
+	topic.PutMessages(msgs)
+	topic.flush(true)
+	// wait the high lane reader buffered all the high priority messages
+	highLane := channel.getPriorityLanes().lanes[1]
+	start := time.Now()
+	for len(highLane.msgChan) < 3 {
+		if time.Since(start) > time.Second*5 {
+			t.Fatalf("high priority messages not buffered: %v", len(highLane.msgChan))
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// the message pump may hold one low message waiting for the client before
+	// the high lane is ready, all the others should be dispatched after the high messages.
+	highCnt := 0
+	for i := 0; i < 53; i++ {
+		outputMsg := <-channel.clientMsgChan
+		if string(outputMsg.Body) == "high" {
+			highCnt++
+		} else if highCnt < 3 && i >= 1 {
+			t.Fatalf("high priority message not dispatched before the backlog: %v", i)
+		}
+	}
+	equal(t, highCnt, 3)
+	stats := NewChannelStats(channel, nil, 0).PriorityLanes
+	equal(t, len(stats), 2)
+	// the message may be read again while resetting the reader
+	equal(t, stats[0].ReadCount >= uint64(50), true)
+	equal(t, stats[1].ReadCount >= uint64(3), true)
+
+	// should be restored from the channel meta
+	topic.SaveChannelMeta()
+	channel.SetPriorityLanes(0)
+	equal(t, channel.GetPriorityLanes(), 0)
+	equal(t, len(NewChannelStats(channel, nil, 0).PriorityLanes), 0)
+	topic.LoadChannelMeta()
+	equal(t, channel.GetPriorityLanes(), 2)
+}
+
+func TestChannelShardingKeyOrder(t *testing.T) {
+	opts := NewOptions()
+	opts.SyncEvery = 1
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_sharding_key" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopicWithExt(topicName, 0)
+	channel := topic.GetChannel("channel")
+
+	keys := []string{"a", "a", "b", "", "a", "b", ""}
+	msgs := make([]*Message, 0, len(keys))
+	for i, k := range keys {
+		header := `{"k":"v"}`
+		if k != "" {
+			header = fmt.Sprintf(`{"##sharding_key":"%s"}`, k)
+		}
+		msg := NewMessageWithExt(0, []byte(k+strconv.Itoa(i)), ext.JSON_HEADER_EXT_VER, []byte(header))
+		msgs = append(msgs, msg)
+	}
+	topic.PutMessages(msgs)
+	topic.flush(true)
+
+	readMsg := func() *Message {
+		select {
+		case msg := <-channel.clientMsgChan:
+			channel.StartInFlightTimeout(msg, NewFakeConsumer(0), "", opts.MsgTimeout)
+			return msg
+		case <-time.After(time.Second):
+			return nil
+		}
+	}
+	// the messages with the same key should wait for the previous in flight
+	inflight := make(map[string]*Message)
+	for _, body := range []string{"a0", "b2", "3", "6"} {
+		msg := readMsg()
+		nequal(t, msg, nil)
+		equal(t, string(msg.Body), body)
+		inflight[body] = msg
+	}
+	equal(t, readMsg(), (*Message)(nil))
+	equal(t, NewChannelStats(channel, nil, 0).KeyWaitingCount, int64(3))
+
+	// the requeued message still owns the key
+	err := channel.RequeueMessage(0, "", inflight["a0"].ID, 0, true)
+	equal(t, err, nil)
+	msg := readMsg()
+	equal(t, string(msg.Body), "a0")
+	equal(t, readMsg(), (*Message)(nil))
+
+	_, _, _, _, err = channel.FinishMessage(0, "", msg.ID)
+	equal(t, err, nil)
+	msg = readMsg()
+	equal(t, string(msg.Body), "a1")
+	_, _, _, _, err = channel.FinishMessage(0, "", inflight["b2"].ID)
+	equal(t, err, nil)
+	msg2 := readMsg()
+	equal(t, string(msg2.Body), "b5")
+	equal(t, readMsg(), (*Message)(nil))
+	_, _, _, _, err = channel.FinishMessage(0, "", msg.ID)
+	equal(t, err, nil)
+	msg = readMsg()
+	equal(t, string(msg.Body), "a4")
+	equal(t, NewChannelStats(channel, nil, 0).KeyWaitingCount, int64(0))
+
+	// the reader should hold while too many messages waiting on the key
+	for i := 0; i < maxKeyWaitingMsgs; i++ {
+		m := NewMessageWithExt(MessageID(1000+i), []byte("a"), ext.JSON_HEADER_EXT_VER, []byte(`{"##sharding_key":"a"}`))
+		equal(t, channel.tryLockMsgKey(m), false)
+	}
+	equal(t, channel.isKeyWaitingFull(), true)
+	channel.inFlightMutex.Lock()
+	channel.unlockMsgKey(msg)
+	channel.inFlightMutex.Unlock()
+	equal(t, channel.isKeyWaitingFull(), false)
+	equal(t, channel.GetKeyWaitingCount(), int64(maxKeyWaitingMsgs-1))
+}
+
 func TestRangeTree(t *testing.T) {
 	//tr := NewIntervalTree()
 	tr := NewIntervalSkipList()
@@ -6,6 +6,7 @@ import (
 	"crypto/tls"
 	"fmt"
 	"net"
+	"net/url"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -19,6 +20,10 @@ import (
 const defaultBufferSize = 4 * 1024
 const slowDownThreshold = 5
 
+// MaxProducerIDLen is the max length of the producer id for the duplicated
+// pub detection.
+const MaxProducerIDLen = 128
+
 const (
 	stateInit = iota
 	stateDisconnected
@@ -47,6 +52,8 @@ type IdentifyDataV2 struct {
 	DesiredTag          string        `json:"desired_tag,omitempty"`
 	ExtendSupport       bool          `json:"extend_support"`
 	ExtFilter           ExtFilterData `json:"ext_filter"`
+	TxCheckBackURL      string        `json:"tx_check_back_url,omitempty"`
+	ProducerID          string        `json:"producer_id,omitempty"`
 }
 
 type identifyEvent struct {
@@ -131,6 +138,8 @@ type ClientV2 struct {
 	isExtendSupport int32
 	TagMsgChannel   chan *Message
 	extFilter       ExtFilterData
+	txCheckBackURL  string
+	producerID      string
 }
 
 func NewClientV2(id int64, conn net.Conn, opts *Options, tls *tls.Config) *ClientV2 {
@@ -274,8 +283,24 @@ func (c *ClientV2) Identify(data IdentifyDataV2) error {
 	if data.ExtendSupport {
 		c.SetExtendSupport()
 	}
+	if data.ExtFilter.Type == 5 {
+		// reject the invalid compound filter early, otherwise the client
+		// will receive all the messages without filter.
+		if _, err := NewExtFilter(data.ExtFilter); err != nil {
+			return err
+		}
+	}
 	c.SetExtFilter(data.ExtFilter)
 
+	err = c.SetTxCheckBackURL(data.TxCheckBackURL)
+	if err != nil {
+		return err
+	}
+	err = c.SetProducerID(data.ProducerID)
+	if err != nil {
+		return err
+	}
+
 	c.metaLock.RLock()
 	ie := identifyEvent{
 		OutputBufferTimeout: time.Duration(atomic.LoadInt64(&c.outputBufferTimeout)),
@@ -643,6 +668,52 @@ func (c *ClientV2) UnsetDesiredTag() {
 	c.desiredTag = ""
 }
 
+func (c *ClientV2) GetTxCheckBackURL() string {
+	c.metaLock.RLock()
+	defer c.metaLock.RUnlock()
+	return c.txCheckBackURL
+}
+
+// the producer will be checked back by this url for the
+// transaction message which is not committed or rolled back in time.
+func (c *ClientV2) SetTxCheckBackURL(checkURL string) error {
+	if checkURL == "" {
+		return nil
+	}
+	u, err := url.ParseRequestURI(checkURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("tx check back url should be http or https: %v", checkURL)
+	}
+	c.metaLock.Lock()
+	c.txCheckBackURL = checkURL
+	c.metaLock.Unlock()
+	return nil
+}
+
+func (c *ClientV2) GetProducerID() string {
+	c.metaLock.RLock()
+	defer c.metaLock.RUnlock()
+	return c.producerID
+}
+
+// the producer id is used with the producer sequence in the pub ext header
+// to detect the duplicated pub retried by the producer.
+func (c *ClientV2) SetProducerID(producerID string) error {
+	if producerID == "" {
+		return nil
+	}
+	if len(producerID) > MaxProducerIDLen {
+		return fmt.Errorf("producer id too long: %v", len(producerID))
+	}
+	c.metaLock.Lock()
+	c.producerID = producerID
+	c.metaLock.Unlock()
+	return nil
+}
+
 func (c *ClientV2) SetDesiredTag(tagStr string) error {
 	if tagStr == "" {
 		return nil
@@ -24,6 +24,7 @@ var (
 	bucketDelayedMsgIndex = []byte("delayed_message_index")
 	bucketMeta            = []byte("meta")
 	CompactThreshold      = 1024 * 1024 * 16
+	ErrTxMessageNotFound  = errors.New("transaction message not found")
 )
 
 const (
@@ -58,7 +59,7 @@ func IsValidDelayedMessage(m *Message) bool {
 	} else if m.DelayedType == PubDelayed {
 		return m.DelayedTs > 0
 	} else if m.DelayedType == TransactionDelayed {
-		return true
+		return m.DelayedTs > 0
 	}
 	return false
 }
@@ -646,6 +647,11 @@ func (q *DelayQueue) put(m *Message, rawData []byte, trace bool, checkSize int64
 	if m.ID <= 0 {
 		m.ID = q.nextMsgID()
 	}
+	if (m.DelayedType == PubDelayed || m.DelayedType == TransactionDelayed) && m.DelayedOrigID <= 0 {
+		// delayed pub and transaction have no original message, so we use the delayed id
+		// as the index to make the confirm the same as channel delayed.
+		m.DelayedOrigID = m.ID
+	}
 
 	var offset BackendOffset
 	var writeBytes int32
@@ -1009,6 +1015,12 @@ func (q *DelayQueue) PeekRecentDelayedPub(now int64, results []Message) (int, er
 	return q.PeekRecentTimeoutWithFilter(results, now, PubDelayed, "")
 }
 
+// peek the prepared transaction messages which are not committed or
+// rolled back before the check timeout
+func (q *DelayQueue) PeekRecentTransactionTimeout(now int64, results []Message) (int, error) {
+	return q.PeekRecentTimeoutWithFilter(results, now, TransactionDelayed, "")
+}
+
 func (q *DelayQueue) PeekAll(results []Message) (int, error) {
 	return q.PeekRecentTimeoutWithFilter(results, time.Now().Add(time.Hour*24*365).UnixNano(), -1, "")
 }
@@ -1077,6 +1089,33 @@ func (q *DelayQueue) IsChannelMessageDelayed(msgID MessageID, ch string) bool {
 	return found
 }
 
+// get the prepared transaction message by the id returned from prepare
+func (q *DelayQueue) GetTransactionMessage(id MessageID) (*Message, error) {
+	var msg *Message
+	indexKey := getDelayedMsgDBIndexKey(TransactionDelayed, "", id)
+	err := q.getStore().View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketDelayedMsgIndex).Get(indexKey)
+		if v == nil || len(v) < 1+8+8 {
+			return ErrTxMessageNotFound
+		}
+		ts := int64(binary.BigEndian.Uint64(v[1 : 1+8]))
+		msgKey := getDelayedMsgDBKey(TransactionDelayed, "", ts, id)
+		mv := tx.Bucket(bucketDelayedMsg).Get(msgKey)
+		if mv == nil {
+			return ErrTxMessageNotFound
+		}
+		buf := make([]byte, len(mv))
+		copy(buf, mv)
+		m, err := DecodeDelayedMessage(buf, q.IsExt())
+		if err != nil {
+			return err
+		}
+		msg = m
+		return nil
+	})
+	return msg, err
+}
+
 func (q *DelayQueue) GetOldestConsumedState(chList []string, includeOthers bool) (RecentKeyList, map[int]uint64, map[string]uint64) {
 	db := q.getStore()
 	prefixList := make([][]byte, 0, len(chList)+2)
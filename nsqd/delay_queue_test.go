@@ -339,6 +339,110 @@ func TestDelayQueuePeekRecent(t *testing.T) {
 	}
 }
 
+func TestDelayQueuePubDelayedPeekAndConfirm(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-delay-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.SyncEvery = 1
+
+	dq, err := NewDelayQueue("test", 0, tmpDir, opts, nil, false)
+	test.Nil(t, err)
+	defer dq.Close()
+	cnt := 10
+	for i := 0; i < cnt; i++ {
+		msg := NewMessage(0, []byte("body"))
+		msg.DelayedType = PubDelayed
+		msg.DelayedTs = time.Now().Add(time.Millisecond * 500).UnixNano()
+		_, _, _, _, err := dq.PutDelayMessage(msg)
+		test.Nil(t, err)
+	}
+	newCnt, _ := dq.GetCurrentDelayedCnt(PubDelayed, "")
+	test.Equal(t, cnt, int(newCnt))
+
+	ret := make([]Message, cnt)
+	n, err := dq.PeekRecentDelayedPub(time.Now().UnixNano(), ret)
+	test.Nil(t, err)
+	test.Equal(t, 0, n)
+
+	time.Sleep(time.Second)
+	n, err = dq.PeekRecentDelayedPub(time.Now().UnixNano(), ret)
+	test.Nil(t, err)
+	test.Equal(t, cnt, n)
+	for _, m := range ret[:n] {
+		test.Equal(t, int32(PubDelayed), m.DelayedType)
+		test.Equal(t, m.ID, m.DelayedOrigID)
+		test.Equal(t, true, m.DelayedTs <= time.Now().UnixNano())
+		err = dq.ConfirmedMessage(&m)
+		test.Nil(t, err)
+	}
+	newCnt, _ = dq.GetCurrentDelayedCnt(PubDelayed, "")
+	test.Equal(t, 0, int(newCnt))
+	n, err = dq.PeekRecentDelayedPub(time.Now().UnixNano(), ret)
+	test.Nil(t, err)
+	test.Equal(t, 0, n)
+}
+
+func TestDelayQueueTransactionMsg(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-delay-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.SyncEvery = 1
+
+	dq, err := NewDelayQueue("test", 0, tmpDir, opts, nil, false)
+	test.Nil(t, err)
+	defer dq.Close()
+	cnt := 10
+	ids := make([]MessageID, 0, cnt)
+	for i := 0; i < cnt; i++ {
+		msg := NewMessage(0, []byte("body"))
+		msg.DelayedType = TransactionDelayed
+		msg.DelayedTs = time.Now().Add(time.Millisecond * 500).UnixNano()
+		msg.DelayedData = []byte("http://127.0.0.1:8080/check")
+		id, _, _, _, err := dq.PutDelayMessage(msg)
+		test.Nil(t, err)
+		ids = append(ids, id)
+	}
+	newCnt, _ := dq.GetCurrentDelayedCnt(TransactionDelayed, "")
+	test.Equal(t, cnt, int(newCnt))
+
+	ret := make([]Message, cnt)
+	n, err := dq.PeekRecentTransactionTimeout(time.Now().UnixNano(), ret)
+	test.Nil(t, err)
+	test.Equal(t, 0, n)
+	// transaction message should not be peeked as delayed pub
+	time.Sleep(time.Second)
+	n, err = dq.PeekRecentDelayedPub(time.Now().UnixNano(), ret)
+	test.Nil(t, err)
+	test.Equal(t, 0, n)
+	n, err = dq.PeekRecentTransactionTimeout(time.Now().UnixNano(), ret)
+	test.Nil(t, err)
+	test.Equal(t, cnt, n)
+
+	for _, id := range ids {
+		m, err := dq.GetTransactionMessage(id)
+		test.Nil(t, err)
+		test.Equal(t, id, m.ID)
+		test.Equal(t, []byte("body"), m.Body)
+		test.Equal(t, []byte("http://127.0.0.1:8080/check"), m.DelayedData)
+		err = dq.ConfirmedMessage(m)
+		test.Nil(t, err)
+		_, err = dq.GetTransactionMessage(id)
+		test.Equal(t, ErrTxMessageNotFound, err)
+	}
+	newCnt, _ = dq.GetCurrentDelayedCnt(TransactionDelayed, "")
+	test.Equal(t, 0, int(newCnt))
+}
+
 func TestDelayQueueConfirmMsg(t *testing.T) {
 	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-delay-%d", time.Now().UnixNano()))
 	if err != nil {
@@ -24,7 +24,7 @@ type DiskQueueSnapshot struct {
 	dataPath string
 	exitFlag int32
 
-	readFile *os.File
+	readFile *queueSegmentFile
 	reader   *bufio.Reader
 }
 
@@ -43,7 +43,7 @@ func NewDiskQueueSnapshot(readFrom string, dataPath string, endInfo BackendQueue
 
 func (d *DiskQueueSnapshot) getCurrentFileEnd(offset diskQueueOffset) (int64, error) {
 	curFileName := d.fileName(offset.FileNum)
-	f, err := os.Stat(curFileName)
+	f, err := statQueueFile(curFileName)
 	if err != nil {
 		return 0, err
 	}
@@ -224,7 +224,7 @@ func (d *DiskQueueSnapshot) ReadRaw(size int32) ([]byte, error) {
 	CheckFileOpen:
 		if d.readFile == nil {
 			curFileName := d.fileName(d.readPos.EndOffset.FileNum)
-			d.readFile, err = os.OpenFile(curFileName, os.O_RDONLY, 0600)
+			d.readFile, err = openQueueFileForRead(curFileName)
 			if err != nil {
 				return result, err
 			}
@@ -315,7 +315,7 @@ CheckFileOpen:
 	result.Offset = d.readPos.virtualEnd
 	if d.readFile == nil {
 		curFileName := d.fileName(d.readPos.EndOffset.FileNum)
-		d.readFile, result.Err = os.OpenFile(curFileName, os.O_RDONLY, 0600)
+		d.readFile, result.Err = openQueueFileForRead(curFileName)
 		if result.Err != nil {
 			return result
 		}
@@ -356,6 +356,7 @@ CheckFileOpen:
 		return result
 	}
 
+	msgSize, compressed := decodeRecordSize(msgSize)
 	if msgSize <= 0 || msgSize > MAX_POSSIBLE_MSG_SIZE {
 		// this file is corrupt and we have no reasonable guarantee on
 		// where a new message should begin
@@ -372,6 +373,14 @@ CheckFileOpen:
 		d.readFile = nil
 		return result
 	}
+	if compressed {
+		result.Data, result.Err = decompressRecord(result.Data)
+		if result.Err != nil {
+			d.readFile.Close()
+			d.readFile = nil
+			return result
+		}
+	}
 
 	result.Offset = d.readPos.virtualEnd
 
@@ -0,0 +1,125 @@
+package nsqd
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// the compression for the topic disk queue record, empty means no compression
+const (
+	CompressNone   = ""
+	CompressSnappy = "snappy"
+	CompressZstd   = "zstd"
+)
+
+const (
+	compressCodecNone   = 0
+	compressCodecSnappy = 1
+	compressCodecZstd   = 2
+)
+
+// the high bit of the record size header on disk is used to mark the record
+// is compressed, and the first byte of the compressed record is the codec, so
+// the reader can decode the record without knowing the topic compression.
+// The older nsqd can not read the compressed record, so the compression should
+// be disabled and the compressed data consumed before downgrading.
+const compressedRecordFlag = uint32(1 << 31)
+
+var (
+	ErrCompressCodecInvalid = errors.New("invalid compression codec")
+	ErrDecompressTooLarge   = errors.New("decompressed record is too large")
+)
+
+var (
+	zstdOnce    sync.Once
+	zstdInitErr error
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+func IsValidCompression(c string) bool {
+	switch c {
+	case CompressNone, CompressSnappy, CompressZstd:
+		return true
+	}
+	return false
+}
+
+func getCompressCodec(c string) int32 {
+	switch c {
+	case CompressSnappy:
+		return compressCodecSnappy
+	case CompressZstd:
+		return compressCodecZstd
+	}
+	return compressCodecNone
+}
+
+func initZstd() error {
+	zstdOnce.Do(func() {
+		// the encoded data should be the same on all the replicas, so we use
+		// the fixed level and single goroutine to make the output stable.
+		zstdEncoder, zstdInitErr = zstd.NewWriter(nil,
+			zstd.WithEncoderLevel(zstd.SpeedDefault),
+			zstd.WithEncoderConcurrency(1))
+		if zstdInitErr != nil {
+			return
+		}
+		zstdDecoder, zstdInitErr = zstd.NewReader(nil,
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxMemory(MAX_POSSIBLE_MSG_SIZE))
+	})
+	return zstdInitErr
+}
+
+// compress the record data, the returned data is prefixed with the codec.
+func compressRecord(codec int32, data []byte) ([]byte, error) {
+	switch codec {
+	case compressCodecSnappy:
+		buf := make([]byte, 1+snappy.MaxEncodedLen(len(data)))
+		buf[0] = byte(codec)
+		return buf[:1+len(snappy.Encode(buf[1:], data))], nil
+	case compressCodecZstd:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 1, 1+len(data)/2)
+		buf[0] = byte(codec)
+		return zstdEncoder.EncodeAll(data, buf), nil
+	}
+	return nil, ErrCompressCodecInvalid
+}
+
+func decompressRecord(data []byte) ([]byte, error) {
+	if len(data) < 1 {
+		return nil, ErrCompressCodecInvalid
+	}
+	switch int32(data[0]) {
+	case compressCodecSnappy:
+		n, err := snappy.DecodedLen(data[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n > MAX_POSSIBLE_MSG_SIZE {
+			return nil, ErrDecompressTooLarge
+		}
+		return snappy.Decode(make([]byte, n), data[1:])
+	case compressCodecZstd:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		return zstdDecoder.DecodeAll(data[1:], nil)
+	}
+	return nil, ErrCompressCodecInvalid
+}
+
+// return the record size on disk and whether the record is compressed
+func decodeRecordSize(sizeHeader int32) (int32, bool) {
+	if uint32(sizeHeader)&compressedRecordFlag != 0 {
+		return int32(uint32(sizeHeader) &^ compressedRecordFlag), true
+	}
+	return sizeHeader, false
+}
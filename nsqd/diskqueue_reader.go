@@ -107,7 +107,7 @@ type diskQueueReader struct {
 
 	confirmedQueueInfo diskQueueEndInfo
 
-	readFile   *os.File
+	readFile   *queueSegmentFile
 	readBuffer *bytes.Buffer
 
 	exitChan        chan int
@@ -152,7 +152,7 @@ func newDiskQueueReader(readFrom string, metaname string, dataPath string, maxBy
 
 func getQueueSegmentEnd(dataRoot string, readFrom string, offset diskQueueOffset) (int64, error) {
 	curFileName := GetQueueFileName(dataRoot, readFrom, offset.FileNum)
-	f, err := os.Stat(curFileName)
+	f, err := statQueueFile(curFileName)
 	if err != nil {
 		return 0, err
 	}
@@ -430,7 +430,7 @@ func (d *diskQueueReader) TryReadOne() (ReadResult, bool) {
 			if rerr != nil {
 				nsqLog.LogErrorf("reading from diskqueue(%s) at %d of %s - %s, current end: %v",
 					d.readerMetaName, d.readQueueInfo, d.fileName(d.readQueueInfo.EndOffset.FileNum), dataRead.Err, d.queueEndInfo)
-				if rerr != ErrReadQueueCountMissing && d.autoSkipError {
+				if rerr != ErrReadQueueCountMissing && rerr != ErrArchivedSegmentRestoring && d.autoSkipError {
 					d.handleReadError()
 					continue
 				}
@@ -523,7 +523,7 @@ func stepOffset(dataRoot string, readFrom string, cur diskQueueEndInfo, step Bac
 				return newOffset.EndOffset, ErrMoveOffsetInvalid
 			}
 			var f os.FileInfo
-			f, err = os.Stat(GetQueueFileName(dataRoot, readFrom, newOffset.EndOffset.FileNum))
+			f, err = statQueueFile(GetQueueFileName(dataRoot, readFrom, newOffset.EndOffset.FileNum))
 			if err != nil {
 				nsqLog.LogErrorf("stat data file error %v, %v: %v", step, newOffset, err)
 				if os.IsNotExist(err) {
@@ -839,7 +839,7 @@ CheckFileOpen:
 	result.Offset = d.readQueueInfo.Offset()
 	if d.readFile == nil {
 		curFileName := d.fileName(d.readQueueInfo.EndOffset.FileNum)
-		d.readFile, result.Err = os.OpenFile(curFileName, os.O_RDONLY, 0644)
+		d.readFile, result.Err = openQueueFileForRead(curFileName)
 		if result.Err != nil {
 			return result
 		}
@@ -923,6 +923,7 @@ CheckFileOpen:
 		return result
 	}
 
+	msgSize, compressed := decodeRecordSize(msgSize)
 	if msgSize <= 0 || msgSize > MAX_POSSIBLE_MSG_SIZE {
 		// this file is corrupt and we have no reasonable guarantee on
 		// where a new message should begin
@@ -949,6 +950,13 @@ CheckFileOpen:
 
 		return result
 	}
+	if compressed {
+		result.Data, result.Err = decompressRecord(result.Data)
+		if result.Err != nil {
+			nsqLog.LogWarningf("DISKQUEUE(%s): decompress %v error %v", d.readerMetaName, d.readQueueInfo, result.Err)
+			return result
+		}
+	}
 
 	result.Offset = d.readQueueInfo.Offset()
 
@@ -1083,6 +1091,50 @@ func (d *diskQueueReader) retrieveMetaData() error {
 	return nil
 }
 
+// GetChannelConfirmedForRead reads the confirmed position of the channel from
+// the reader meta file, used by the tools to read the channel data offline.
+func GetChannelConfirmedForRead(topicName string, part int, channel string, dataPath string) (BackendQueueEnd, error) {
+	d := &diskQueueReader{
+		readFrom:       getBackendName(topicName, part),
+		readerMetaName: getBackendReaderName(topicName, part, channel),
+		dataPath:       dataPath,
+	}
+	err := d.retrieveMetaData()
+	if err != nil {
+		return nil, err
+	}
+	confirmed := d.confirmedQueueInfo
+	return &confirmed, nil
+}
+
+// FixChannelConfirmedForRead resets the confirmed position of the channel to
+// the queue end if it is beyond the end, used by the tools to fix the channel
+// meta offline after the queue truncated.
+func FixChannelConfirmedForRead(topicName string, part int, channel string, dataPath string, end BackendQueueEnd) (bool, error) {
+	diskEnd, ok := end.(*diskQueueEndInfo)
+	if !ok {
+		return false, ErrInvalidOffset
+	}
+	d := &diskQueueReader{
+		readFrom:       getBackendName(topicName, part),
+		readerMetaName: getBackendReaderName(topicName, part, channel),
+		dataPath:       dataPath,
+	}
+	err := d.retrieveMetaData()
+	if err != nil {
+		return false, err
+	}
+	if d.confirmedQueueInfo.Offset() <= diskEnd.Offset() &&
+		d.queueEndInfo.Offset() <= diskEnd.Offset() {
+		return false, nil
+	}
+	if d.confirmedQueueInfo.Offset() > diskEnd.Offset() {
+		d.confirmedQueueInfo = *diskEnd
+	}
+	d.queueEndInfo = *diskEnd
+	return true, d.persistMetaData()
+}
+
 // persistMetaData atomically writes state to the filesystem
 func (d *diskQueueReader) persistMetaData() error {
 	var f *os.File
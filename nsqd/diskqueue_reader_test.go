@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"os"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -382,3 +383,151 @@ func TestDiskQueueSnapshotReader(t *testing.T) {
 	test.Equal(t, 100, len(data))
 	// remove some begin of queue, and test queue start
 }
+
+func TestDiskQueueReaderCompressed(t *testing.T) {
+	dqName := "test_disk_queue" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024*16, 4, 1<<12, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	msg := []byte(strings.Repeat(`{"key":"value"}`, 100))
+	small := []byte("test")
+	msgNum := 100
+	var plainSize int64
+	for i := 0; i < msgNum; i++ {
+		switch i % 3 {
+		case 0:
+			dqWriter.SetCompression(CompressNone)
+		case 1:
+			dqWriter.SetCompression(CompressSnappy)
+		case 2:
+			dqWriter.SetCompression(CompressZstd)
+		}
+		_, wsize, _, err := dqWriter.Put(msg)
+		test.Nil(t, err)
+		if i%3 != 0 {
+			test.Equal(t, true, int(wsize) < len(msg))
+		}
+		plainSize += int64(len(msg) + 4)
+		// the record not smaller after compressed should be written as it is
+		_, wsize, _, err = dqWriter.Put(small)
+		test.Nil(t, err)
+		test.Equal(t, int32(len(small)+4), wsize)
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+	test.Equal(t, true, int64(end.Offset()) < plainSize)
+
+	dqReader := newDiskQueueReader(dqName, dqName, tmpDir, 1024*16, 4, 1<<12, 1, 2*time.Second, nil, true)
+	defer dqReader.Close()
+	dqReader.UpdateQueueEnd(end, false)
+	snap := NewDiskQueueSnapshot(dqName, tmpDir, end)
+	defer snap.Close()
+	for i := 0; i < msgNum*2; i++ {
+		expected := msg
+		if i%2 == 1 {
+			expected = small
+		}
+		msgOut, _ := dqReader.TryReadOne()
+		test.Nil(t, msgOut.Err)
+		equal(t, msgOut.Data, expected)
+		snapOut := snap.ReadOne()
+		test.Nil(t, snapOut.Err)
+		equal(t, snapOut.Data, expected)
+		test.Equal(t, msgOut.Offset, snapOut.Offset)
+		test.Equal(t, msgOut.MovedSize, snapOut.MovedSize)
+	}
+	test.Equal(t, end.Offset(), dqReader.(*diskQueueReader).readQueueInfo.Offset())
+}
+
+func TestGetChannelConfirmedForRead(t *testing.T) {
+	topicName := "test_disk_queue_confirmed" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	dqName := getBackendName(topicName, 0)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	msg := []byte("test")
+	for i := 0; i < 10; i++ {
+		dqWriter.Put(msg)
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+
+	_, err = GetChannelConfirmedForRead(topicName, 0, "ch", tmpDir)
+	test.NotNil(t, err)
+
+	dqReader := newDiskQueueReader(dqName, getBackendReaderName(topicName, 0, "ch"),
+		tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	dqReader.UpdateQueueEnd(end, false)
+	var msgOut ReadResult
+	for i := 0; i < 3; i++ {
+		msgOut, _ = dqReader.TryReadOne()
+		equal(t, msgOut.Data, msg)
+	}
+	err = dqReader.ConfirmRead(msgOut.Offset+msgOut.MovedSize, msgOut.CurCnt)
+	test.Nil(t, err)
+	dqReader.Close()
+
+	confirmed, err := GetChannelConfirmedForRead(topicName, 0, "ch", tmpDir)
+	test.Nil(t, err)
+	test.Equal(t, msgOut.Offset+msgOut.MovedSize, confirmed.Offset())
+	test.Equal(t, msgOut.CurCnt, confirmed.TotalMsgCnt())
+}
+
+func TestFixChannelConfirmedForRead(t *testing.T) {
+	topicName := "test_disk_queue_fix_confirmed" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	dqName := getBackendName(topicName, 0)
+	queue, _ := NewDiskQueueWriter(dqName, tmpDir, 1024, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	msg := []byte("test")
+	for i := 0; i < 5; i++ {
+		dqWriter.Put(msg)
+	}
+	dqWriter.Flush()
+	truncatedEnd := dqWriter.GetQueueWriteEnd()
+	for i := 0; i < 5; i++ {
+		dqWriter.Put(msg)
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+
+	dqReader := newDiskQueueReader(dqName, getBackendReaderName(topicName, 0, "ch"),
+		tmpDir, 1024, 4, 1<<10, 1, 2*time.Second, nil, true)
+	dqReader.UpdateQueueEnd(end, false)
+	var msgOut ReadResult
+	for i := 0; i < 8; i++ {
+		msgOut, _ = dqReader.TryReadOne()
+		equal(t, msgOut.Data, msg)
+	}
+	err = dqReader.ConfirmRead(msgOut.Offset+msgOut.MovedSize, msgOut.CurCnt)
+	test.Nil(t, err)
+	dqReader.Close()
+
+	fixed, err := FixChannelConfirmedForRead(topicName, 0, "ch", tmpDir, end)
+	test.Nil(t, err)
+	test.Equal(t, false, fixed)
+
+	fixed, err = FixChannelConfirmedForRead(topicName, 0, "ch", tmpDir, truncatedEnd)
+	test.Nil(t, err)
+	test.Equal(t, true, fixed)
+	confirmed, err := GetChannelConfirmedForRead(topicName, 0, "ch", tmpDir)
+	test.Nil(t, err)
+	test.Equal(t, truncatedEnd.Offset(), confirmed.Offset())
+	test.Equal(t, truncatedEnd.TotalMsgCnt(), confirmed.TotalMsgCnt())
+
+	fixed, err = FixChannelConfirmedForRead(topicName, 0, "ch", tmpDir, truncatedEnd)
+	test.Nil(t, err)
+	test.Equal(t, false, fixed)
+}
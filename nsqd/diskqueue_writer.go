@@ -66,6 +66,8 @@ type diskQueueWriter struct {
 	maxMsgSize      int32
 	exitFlag        int32
 	needSync        bool
+	// the codec used to compress the new written record
+	compressCodec int32
 
 	writeFile    *os.File
 	bufferWriter *bufio.Writer
@@ -175,6 +177,16 @@ func (d *diskQueueWriter) Put(data []byte) (BackendOffset, int32, int64, error)
 	return offset, writeBytes, e.TotalMsgCnt(), werr
 }
 
+// SetCompression changes the compression for the records written after, the
+// records already written will be kept as it is since each record has its own codec.
+func (d *diskQueueWriter) SetCompression(c string) {
+	atomic.StoreInt32(&d.compressCodec, getCompressCodec(c))
+}
+
+func (d *diskQueueWriter) IsCompressEnabled() bool {
+	return atomic.LoadInt32(&d.compressCodec) != compressCodecNone
+}
+
 func (d *diskQueueWriter) RollbackWriteV2(offset BackendOffset, diffCnt uint64) (diskQueueEndInfo, error) {
 	d.Lock()
 	defer d.Unlock()
@@ -351,6 +363,13 @@ func (d *diskQueueWriter) CleanOldDataByRetention(cleanEndInfo BackendQueueOffse
 		} else {
 			nsqLog.Logf("DISKQUEUE(%s): removed data file: %v", d.name, fn)
 		}
+		removeArchivedLocalFiles(fn)
+		if a := getSegmentArchiver(); a != nil {
+			innerErr = a.Remove(archiveKey(fn))
+			if innerErr != nil {
+				nsqLog.LogErrorf("diskqueue(%s) failed to remove archived data file %v - %s", d.name, fn, innerErr)
+			}
+		}
 
 		//remove queue meta file
 		if i <= cleanMetaFileNum {
@@ -369,6 +388,63 @@ func (d *diskQueueWriter) CleanOldDataByRetention(cleanEndInfo BackendQueueOffse
 	return newStart, nil
 }
 
+// ArchiveOldSegments moves the sealed segment files not modified after the
+// archiveBefore to the archive, the queue start is not changed so the archived
+// data can still be read by restoring from the archive.
+func (d *diskQueueWriter) ArchiveOldSegments(archiveBefore time.Time) (int, error) {
+	a := getSegmentArchiver()
+	if a == nil {
+		return 0, nil
+	}
+	d.RLock()
+	startFileNum := d.diskQueueStart.EndOffset.FileNum
+	endFileNum := d.diskReadEnd.EndOffset.FileNum
+	d.RUnlock()
+
+	archived := 0
+	for i := startFileNum; i < endFileNum; i++ {
+		fn := d.fileName(i)
+		// the restored segment should be cleaned if not used recently
+		cleanRestoredSegment(fn)
+		stat, err := os.Stat(fn)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// already archived
+				continue
+			}
+			return archived, err
+		}
+		if stat.ModTime().After(archiveBefore) {
+			break
+		}
+		err = a.Archive(archiveKey(fn), fn)
+		if err != nil {
+			nsqLog.LogErrorf("diskqueue(%s) failed to archive data file %v to %v - %s", d.name, fn, a, err)
+			return archived, err
+		}
+		d.RLock()
+		// the segment may be cleaned while archiving
+		cleaned := i < d.diskQueueStart.EndOffset.FileNum
+		d.RUnlock()
+		if cleaned {
+			a.Remove(archiveKey(fn))
+			break
+		}
+		// keep the size locally, so the reader can stat it without restoring
+		err = writeArchivedMeta(fn, stat.Size())
+		if err != nil {
+			return archived, err
+		}
+		err = os.Remove(fn)
+		if err != nil && !os.IsNotExist(err) {
+			return archived, err
+		}
+		archived++
+		nsqLog.Logf("DISKQUEUE(%s): archived data file: %v to %v", d.name, fn, a)
+	}
+	return archived, nil
+}
+
 func (d *diskQueueWriter) closeCurrentFile() {
 	if d.bufferWriter != nil {
 		d.bufferWriter.Flush()
@@ -590,6 +666,10 @@ func (d *diskQueueWriter) cleanOldData() error {
 		if innerErr != nil && !os.IsNotExist(innerErr) {
 			nsqLog.LogErrorf("diskqueue(%s) failed to remove data file - %s", d.name, innerErr)
 		}
+		removeArchivedLocalFiles(fn)
+		if a := getSegmentArchiver(); a != nil {
+			a.Remove(archiveKey(fn))
+		}
 	}
 
 	d.diskWriteEnd.EndOffset.FileNum++
@@ -683,7 +763,19 @@ func (d *diskQueueWriter) writeOne(data []byte, isRaw bool, msgCnt int32) (Backe
 			return 0, 0, nil, fmt.Errorf("invalid message write size (%d) maxMsgSize=%d", dataLen, d.maxMsgSize)
 		}
 
-		err = binary.Write(d.bufferWriter, binary.BigEndian, dataLen)
+		sizeHeader := uint32(dataLen)
+		if codec := atomic.LoadInt32(&d.compressCodec); codec != compressCodecNone {
+			cdata, cerr := compressRecord(codec, data)
+			if cerr != nil {
+				nsqLog.LogWarningf("DISKQUEUE(%s): compress record failed %s", d.name, cerr)
+			} else if len(cdata) < len(data) {
+				// only keep the compressed record if we can save the space
+				data = cdata
+				dataLen = int32(len(cdata))
+				sizeHeader = uint32(dataLen) | compressedRecordFlag
+			}
+		}
+		err = binary.Write(d.bufferWriter, binary.BigEndian, sizeHeader)
 		if err != nil {
 			d.sync()
 			if d.writeFile != nil {
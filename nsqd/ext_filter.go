@@ -1,8 +1,10 @@
 package nsqd
 
 import (
+	"encoding/json"
 	"errors"
 	"regexp"
+	"strconv"
 
 	"github.com/gobwas/glob"
 	"github.com/tidwall/gjson"
@@ -24,15 +26,34 @@ import (
 //	"filter_ext_key":"xx",
 //	"filter_data":"glob rule",
 // }
+// {
+//	"ver":5,
+//	"filter_data":"{\"op\":\"and\",\"children\":[{\"op\":\"equal\",\"key\":\"k1\",\"value\":\"v1\"},
+//	  {\"op\":\"not\",\"children\":[{\"op\":\"range\",\"key\":\"k2\",\"min\":1,\"max\":10}]}]}",
+// }
 // ver is used to extend other filter type
-// currently support equal, regexp, glob
-// TODO: maybe support multi ext key rule chains
+// currently support equal, regexp, glob, multi equal and the compound expression tree
+// which can combine the rules on multi ext keys,
 // such as, filter if match_rule1(ext_key1) and match_rule2(ext_key2) or match_rule3(ext_key3)
 var (
 	ErrNotSupportedFilter = errors.New("the filter type not supported")
 	ErrInvalidFilter      = errors.New("invalid filter rule")
 )
 
+const (
+	ExtFilterOpAnd    = "and"
+	ExtFilterOpOr     = "or"
+	ExtFilterOpNot    = "not"
+	ExtFilterOpEqual  = "equal"
+	ExtFilterOpRegexp = "regexp"
+	ExtFilterOpGlob   = "glob"
+	ExtFilterOpRange  = "range"
+	ExtFilterOpExists = "exists"
+
+	maxExtFilterExprDepth = 8
+	maxExtFilterExprNodes = 64
+)
+
 type ExtFilterData struct {
 	Type           int               `json:"type,omitempty"`
 	Inverse        bool              `json:"inverse,omitempty"`
@@ -46,6 +67,18 @@ type MultiFilterData struct {
 	FilterData   string `json:"filter_data,omitempty"`
 }
 
+// the compound filter expression, the key is the gjson path in the json ext header.
+// and/or/not use the children as the sub expressions, the others are the predicates
+// on the key. The range is inclusive and the min or max can be omitted.
+type ExtFilterExpr struct {
+	Op       string          `json:"op"`
+	Key      string          `json:"key,omitempty"`
+	Value    string          `json:"value,omitempty"`
+	Min      *float64        `json:"min,omitempty"`
+	Max      *float64        `json:"max,omitempty"`
+	Children []ExtFilterExpr `json:"children,omitempty"`
+}
+
 type IExtFilter interface {
 	Match(msg *Message) bool
 }
@@ -143,9 +176,142 @@ func (f *extMultiFilter) Match(msg *Message) bool {
 	return false
 }
 
+type extNotFilter struct {
+	filter IExtFilter
+}
+
+func (f *extNotFilter) Match(msg *Message) bool {
+	return !f.filter.Match(msg)
+}
+
+type extRangeFilter struct {
+	min    *float64
+	max    *float64
+	extKey string
+}
+
+func (f *extRangeFilter) Match(msg *Message) bool {
+	if msg.ExtVer != ext.JSON_HEADER_EXT_VER {
+		return false
+	}
+	filterData := gjson.GetBytes(msg.ExtBytes, f.extKey)
+	var v float64
+	switch filterData.Type {
+	case gjson.Number:
+		v = filterData.Float()
+	case gjson.String:
+		var err error
+		v, err = strconv.ParseFloat(filterData.String(), 64)
+		if err != nil {
+			return false
+		}
+	default:
+		return false
+	}
+	if f.min != nil && v < *f.min {
+		return false
+	}
+	if f.max != nil && v > *f.max {
+		return false
+	}
+	return true
+}
+
+type extExistsFilter struct {
+	extKey string
+}
+
+func (f *extExistsFilter) Match(msg *Message) bool {
+	if msg.ExtVer != ext.JSON_HEADER_EXT_VER {
+		return false
+	}
+	return gjson.GetBytes(msg.ExtBytes, f.extKey).Exists()
+}
+
+func newExtExprFilter(expr *ExtFilterExpr, depth int, nodes *int) (IExtFilter, error) {
+	*nodes++
+	if depth > maxExtFilterExprDepth || *nodes > maxExtFilterExprNodes {
+		return nil, ErrInvalidFilter
+	}
+	var err error
+	switch expr.Op {
+	case ExtFilterOpAnd, ExtFilterOpOr:
+		if len(expr.Children) == 0 {
+			return nil, ErrInvalidFilter
+		}
+		mf := &extMultiFilter{relation: "all"}
+		if expr.Op == ExtFilterOpOr {
+			mf.relation = "any"
+		}
+		for i := range expr.Children {
+			cf, err := newExtExprFilter(&expr.Children[i], depth+1, nodes)
+			if err != nil {
+				return nil, err
+			}
+			mf.chainFilters = append(mf.chainFilters, cf)
+		}
+		return mf, nil
+	case ExtFilterOpNot:
+		if len(expr.Children) != 1 {
+			return nil, ErrInvalidFilter
+		}
+		cf, err := newExtExprFilter(&expr.Children[0], depth+1, nodes)
+		if err != nil {
+			return nil, err
+		}
+		return &extNotFilter{filter: cf}, nil
+	}
+	if expr.Key == "" || len(expr.Children) > 0 {
+		return nil, ErrInvalidFilter
+	}
+	switch expr.Op {
+	case ExtFilterOpEqual:
+		// empty value will match all in the exactly filter, which is not expected in the expression
+		if expr.Value == "" {
+			return nil, ErrInvalidFilter
+		}
+		return &extExactlyFilter{match: expr.Value, extKey: expr.Key}, nil
+	case ExtFilterOpRegexp:
+		crf := &extReFilter{extKey: expr.Key}
+		crf.re, err = regexp.Compile(expr.Value)
+		if err != nil {
+			return nil, err
+		}
+		return crf, nil
+	case ExtFilterOpGlob:
+		cgf := &extGlobFilter{extKey: expr.Key}
+		cgf.globF, err = glob.Compile(expr.Value)
+		if err != nil {
+			return nil, err
+		}
+		return cgf, nil
+	case ExtFilterOpRange:
+		if expr.Min == nil && expr.Max == nil {
+			return nil, ErrInvalidFilter
+		}
+		if expr.Min != nil && expr.Max != nil && *expr.Min > *expr.Max {
+			return nil, ErrInvalidFilter
+		}
+		return &extRangeFilter{min: expr.Min, max: expr.Max, extKey: expr.Key}, nil
+	case ExtFilterOpExists:
+		return &extExistsFilter{extKey: expr.Key}, nil
+	}
+	return nil, ErrNotSupportedFilter
+}
+
 func NewExtFilter(filter ExtFilterData) (IExtFilter, error) {
 	var cf IExtFilter
 	var err error
+	if filter.Type == 5 {
+		// the expression tree is encoded as json in the filter data
+		var expr ExtFilterExpr
+		err = json.Unmarshal([]byte(filter.FilterData), &expr)
+		if err != nil {
+			return nil, ErrInvalidFilter
+		}
+		nodes := 0
+		return newExtExprFilter(&expr, 1, &nodes)
+	}
 	if filter.FilterExtKey == "" {
 		return nil, ErrInvalidFilter
 	}
@@ -0,0 +1,68 @@
+package nsqd
+
+import (
+	"testing"
+
+	"github.com/youzan/nsq/internal/ext"
+	"github.com/youzan/nsq/internal/test"
+)
+
+func TestExtFilterExprMatch(t *testing.T) {
+	expr := `{"op":"or","children":[
+		{"op":"and","children":[
+			{"op":"equal","key":"k1","value":"v1"},
+			{"op":"range","key":"k2","min":1,"max":10},
+			{"op":"not","children":[{"op":"exists","key":"k3"}]}
+		]},
+		{"op":"glob","key":"k4","value":"abc*"},
+		{"op":"regexp","key":"k5.sub","value":"^x[0-9]+$"}
+	]}`
+	f, err := NewExtFilter(ExtFilterData{Type: 5, FilterData: expr})
+	test.Nil(t, err)
+
+	cases := []struct {
+		header  string
+		matched bool
+	}{
+		{`{"k1":"v1","k2":5}`, true},
+		{`{"k1":"v1","k2":"10"}`, true},
+		{`{"k1":"v1","k2":11}`, false},
+		{`{"k1":"v1","k2":5,"k3":""}`, false},
+		{`{"k1":"v2","k2":5}`, false},
+		{`{"k4":"abcd"}`, true},
+		{`{"k4":"bcd"}`, false},
+		{`{"k5":{"sub":"x12"}}`, true},
+		{`{"k5":{"sub":"x1a"}}`, false},
+	}
+	for _, c := range cases {
+		msg := NewMessageWithExt(0, []byte("body"), ext.JSON_HEADER_EXT_VER, []byte(c.header))
+		test.Equal(t, c.matched, f.Match(msg))
+	}
+	msg := NewMessageWithExt(0, []byte("body"), ext.NO_EXT_VER, nil)
+	test.Equal(t, false, f.Match(msg))
+}
+
+func TestExtFilterExprInvalid(t *testing.T) {
+	invalids := []string{
+		``,
+		`{"op":"and"}`,
+		`{"op":"not","children":[{"op":"exists","key":"a"},{"op":"exists","key":"b"}]}`,
+		`{"op":"equal","key":"a"}`,
+		`{"op":"equal","value":"a"}`,
+		`{"op":"range","key":"a"}`,
+		`{"op":"range","key":"a","min":10,"max":1}`,
+		`{"op":"regexp","key":"a","value":"("}`,
+		`{"op":"unknown","key":"a","value":"a"}`,
+	}
+	for _, expr := range invalids {
+		_, err := NewExtFilter(ExtFilterData{Type: 5, FilterData: expr})
+		test.NotNil(t, err)
+	}
+	// too deep expression
+	expr := `{"op":"exists","key":"a"}`
+	for i := 0; i < maxExtFilterExprDepth; i++ {
+		expr = `{"op":"not","children":[` + expr + `]}`
+	}
+	_, err := NewExtFilter(ExtFilterData{Type: 5, FilterData: expr})
+	test.NotNil(t, err)
+}
@@ -5,9 +5,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strconv"
 	"sync/atomic"
 	"time"
 
+	"github.com/tidwall/gjson"
 	"github.com/youzan/nsq/internal/ext"
 )
 
@@ -130,6 +132,23 @@ func (m *Message) GetClientID() int64 {
 	return 0
 }
 
+// GetProducerSeq returns the producer id and sequence in the json ext header,
+// return false if the message has no producer sequence.
+func (m *Message) GetProducerSeq() (string, uint64, bool) {
+	if m.ExtVer != ext.JSON_HEADER_EXT_VER {
+		return "", 0, false
+	}
+	rets := gjson.GetManyBytes(m.ExtBytes, ext.MSG_PRODUCER_ID_KEY, ext.MSG_PRODUCER_SEQ_KEY)
+	if rets[0].Type != gjson.String || rets[0].Str == "" || rets[1].Type != gjson.String {
+		return "", 0, false
+	}
+	seq, err := strconv.ParseUint(rets[1].Str, 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return rets[0].Str, seq, true
+}
+
 func (m *Message) WriteToClient(w io.Writer, writeExt bool, writeDetail bool) (int64, error) {
 	// for client, we no need write the compatible version info to message
 	return m.internalWriteTo(w, writeExt, false, writeDetail)
@@ -262,7 +281,7 @@ func (m *Message) WriteDelayedTo(w io.Writer, writeExt bool) (int64, error) {
 	if err != nil {
 		return total, err
 	}
-	if m.DelayedType == PubDelayed {
+	if m.DelayedType == PubDelayed || m.DelayedType == TransactionDelayed {
 		binary.BigEndian.PutUint32(buf[:4], uint32(len(m.DelayedData)))
 		n, err = w.Write(buf[:4])
 		total += int64(n)
@@ -328,6 +347,41 @@ func DecodeMessage(b []byte, ext bool) (*Message, error) {
 	return decodeMessage(b, ext)
 }
 
+// DecodeRawMessages decodes the raw data written to the topic disk queue,
+// the raw data may contain several records with the size header. The offset
+// and the size on disk of each message will be set from the start offset of
+// the raw data.
+func DecodeRawMessages(rawData []byte, isExt bool, offset BackendOffset) ([]*Message, error) {
+	var msgs []*Message
+	pos := 0
+	for pos < len(rawData) {
+		if len(rawData)-pos < 4 {
+			return msgs, fmt.Errorf("invalid raw data size header at %v", pos)
+		}
+		size, compressed := decodeRecordSize(int32(binary.BigEndian.Uint32(rawData[pos : pos+4])))
+		if size <= 0 || int(size) > len(rawData)-pos-4 {
+			return msgs, fmt.Errorf("invalid raw data record size %v at %v", size, pos)
+		}
+		data := rawData[pos+4 : pos+4+int(size)]
+		if compressed {
+			var err error
+			data, err = decompressRecord(data)
+			if err != nil {
+				return msgs, err
+			}
+		}
+		msg, err := decodeMessage(data, isExt)
+		if err != nil {
+			return msgs, err
+		}
+		msg.Offset = offset + BackendOffset(pos)
+		msg.RawMoveSize = BackendOffset(size + 4)
+		msgs = append(msgs, msg)
+		pos += int(size) + 4
+	}
+	return msgs, nil
+}
+
 // note: the message body is using the origin buffer, so never modify the buffer after decode.
 // decodeMessage deserializes data (as []byte) and creates a new Message
 // message format:
@@ -435,7 +489,7 @@ func DecodeDelayedMessage(b []byte, isExt bool) (*Message, error) {
 
 	msg.DelayedChannel = string(b[pos : pos+int(nameLen)])
 	pos += int(nameLen)
-	if msg.DelayedType == PubDelayed {
+	if msg.DelayedType == PubDelayed || msg.DelayedType == TransactionDelayed {
 		if len(b) < pos+4 {
 			return nil, fmt.Errorf("invalid delayed message buffer size (%d)", len(b))
 		}
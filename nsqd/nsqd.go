@@ -9,6 +9,7 @@ import (
 	"net"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -19,6 +20,7 @@ import (
 	"github.com/youzan/nsq/internal/dirlock"
 	"github.com/youzan/nsq/internal/http_api"
 	"github.com/youzan/nsq/internal/levellogger"
+	"github.com/youzan/nsq/internal/metricsink"
 	"github.com/youzan/nsq/internal/protocol"
 	"github.com/youzan/nsq/internal/statsd"
 	"github.com/youzan/nsq/internal/util"
@@ -134,6 +136,22 @@ func New(opts *Options) *NSQD {
 	}
 	nsqLog.Logf("broadcast option: %s, %s", opts.BroadcastAddress, opts.BroadcastInterface)
 
+	if !metricsink.IsValidType(opts.MetricsSink) {
+		nsqLog.LogErrorf("FATAL: unknown --metrics-sink %v", opts.MetricsSink)
+		os.Exit(1)
+	}
+
+	if opts.ArchiveURL != "" {
+		// use the node id as the key prefix to avoid conflict with other nodes
+		archiver, err := NewSegmentArchiver(opts.ArchiveURL, strconv.FormatInt(opts.ID, 10))
+		if err != nil {
+			nsqLog.LogErrorf("FATAL: invalid --archive-url %v: %v", opts.ArchiveURL, err)
+			os.Exit(1)
+		}
+		nsqLog.Infof("old topic segments will be archived to %v after %v", archiver, opts.ArchiveAfter)
+		SetSegmentArchiver(archiver)
+	}
+
 	if opts.StatsdPrefix != "" {
 		var port string
 		if opts.ReverseProxyPort != "" {
@@ -256,6 +274,9 @@ func (n *NSQD) GetTopicMapCopy() map[string]map[int]*Topic {
 
 func (n *NSQD) Start() {
 	n.waitGroup.Wrap(func() { n.queueScanLoop() })
+	if n.GetOpts().ArchiveURL != "" {
+		n.waitGroup.Wrap(func() { n.archiveLoop() })
+	}
 	n.persistWaitGroup.Wrap(func() { n.persistLoop() })
 }
 
@@ -928,6 +949,28 @@ exit:
 	fastTimer.Stop()
 }
 
+func (n *NSQD) archiveLoop() {
+	ticker := time.NewTicker(archiveCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			archiveAfter := n.GetOpts().ArchiveAfter
+			for _, topics := range n.GetTopicMapCopy() {
+				for _, t := range topics {
+					err := t.TryArchiveOldData(archiveAfter)
+					if err != nil {
+						nsqLog.Warningf("topic %v archive old data failed: %v", t.GetFullName(), err)
+					}
+				}
+			}
+		case <-n.exitChan:
+			nsqLog.Logf("ARCHIVE: closing")
+			return
+		}
+	}
+}
+
 func (n *NSQD) IsAuthEnabled() bool {
 	return len(n.GetOpts().AuthHTTPAddresses) != 0
 }
@@ -23,6 +23,7 @@ type Options struct {
 	Verbose                    bool          `flag:"verbose"`
 	ClusterID                  string        `flag:"cluster-id"`
 	ClusterLeadershipAddresses string        `flag:"cluster-leadership-addresses" cfg:"cluster_leadership_addresses"`
+	ClusterLeadershipType      string        `flag:"cluster-leadership-type" cfg:"cluster_leadership_type"`
 	TCPAddress                 string        `flag:"tcp-address"`
 	RPCPort                    string        `flag:"rpc-port"`
 	ReverseProxyPort           string        `flag:"reverse-proxy-port"`
@@ -30,6 +31,7 @@ type Options struct {
 	HTTPSAddress               string        `flag:"https-address"`
 	BroadcastAddress           string        `flag:"broadcast-address"`
 	BroadcastInterface         string        `flag:"broadcast-interface"`
+	Zone                       string        `flag:"zone" cfg:"zone"`
 	NSQLookupdTCPAddresses     []string      `flag:"lookupd-tcp-address" cfg:"nsqlookupd_tcp_addresses"`
 	AuthHTTPAddresses          []string      `flag:"auth-http-address" cfg:"auth_http_addresses"`
 	LookupPingInterval         time.Duration `flag:"lookup-ping-interval" arg:"5s"`
@@ -56,6 +58,9 @@ type Options struct {
 	MaxConfirmWin     int64         `flag:"max-confirm-win"`
 	ClientTimeout     time.Duration
 	ReqToEndThreshold time.Duration `flag:"req-to-end-threshold"`
+	MaxPubDelay       time.Duration `flag:"max-pub-delay"`
+	TxCheckTimeout    time.Duration `flag:"tx-check-timeout"`
+	TxMaxCheckCount   int           `flag:"tx-max-check-count"`
 
 	// client overridable configuration options
 	MaxHeartbeatInterval   time.Duration `flag:"max-heartbeat-interval"`
@@ -69,6 +74,7 @@ type Options struct {
 	StatsdProtocol string        `flag:"statsd-protocol"`
 	StatsdInterval time.Duration `flag:"statsd-interval" arg:"60s"`
 	StatsdMemStats bool          `flag:"statsd-mem-stats"`
+	MetricsSink    string        `flag:"metrics-sink"`
 
 	// e2e message latency
 	E2EProcessingLatencyWindowTime  time.Duration `flag:"e2e-processing-latency-window-time"`
@@ -94,9 +100,15 @@ type Options struct {
 
 	RetentionDays         int32 `flag:"retention-days" cfg:"retention_days"`
 	RetentionSizePerDay         int64 `flag:"retention-size-per-day" cfg:"retention_size_per_day"`
+	// archive the old segments to the archive-url instead of keeping on local disk
+	ArchiveURL            string        `flag:"archive-url" cfg:"archive_url"`
+	ArchiveAfter          time.Duration `flag:"archive-after" cfg:"archive_after"`
 	StartAsFixMode        bool  `flag:"start-as-fix-mode"`
 	AllowExtCompatible    bool  `flag:"allow-ext-compatible" cfg:"allow_ext_compatible"`
 	AllowSubExtCompatible bool  `flag:"allow-sub-ext-compatible" cfg:"allow_sub_ext_compatible"`
+	// the bytes per second while pulling data from leader to catchup, 0 means no limit
+	CatchupRateLimit      int64 `flag:"catchup-rate-limit" cfg:"catchup_rate_limit"`
+	TopicCatchupRateLimit int64 `flag:"topic-catchup-rate-limit" cfg:"topic_catchup_rate_limit"`
 }
 
 func NewOptions() *Options {
@@ -114,6 +126,7 @@ func NewOptions() *Options {
 
 		ClusterID:                  "nsq-clusterid-test-only",
 		ClusterLeadershipAddresses: "",
+		ClusterLeadershipType:      "etcd",
 		TCPAddress:                 "0.0.0.0:4150",
 		HTTPAddress:                "0.0.0.0:4151",
 		HTTPSAddress:               "0.0.0.0:4152",
@@ -142,6 +155,9 @@ func NewOptions() *Options {
 		MaxReqTimeout:     3 * 24 * time.Hour,
 		ClientTimeout:     60 * time.Second,
 		ReqToEndThreshold: 15 * time.Minute,
+		MaxPubDelay:       7 * 24 * time.Hour,
+		TxCheckTimeout:    30 * time.Second,
+		TxMaxCheckCount:   10,
 
 		MaxHeartbeatInterval:   60 * time.Second,
 		MaxRdyCount:            2500,
@@ -153,6 +169,7 @@ func NewOptions() *Options {
 		StatsdProtocol: "udp",
 		StatsdInterval: 60 * time.Second,
 		StatsdMemStats: true,
+		MetricsSink:    "statsd",
 
 		E2EProcessingLatencyWindowTime: time.Duration(10 * time.Minute),
 
@@ -167,6 +184,7 @@ func NewOptions() *Options {
 		Logger:   &levellogger.GLogger{},
 
 		RetentionDays: int32(DEFAULT_RETENTION_DAYS),
+		ArchiveAfter:  time.Hour * 24,
 	}
 
 	return opts
@@ -0,0 +1,452 @@
+package nsqd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/youzan/nsq/internal/ext"
+)
+
+const (
+	otlpScopeName        = "nsqd.msgtracer"
+	otlpServiceName      = "nsqd"
+	otlpSpanBufferSize   = 10240
+	otlpExportBatchSize  = 512
+	otlpExportInterval   = time.Second
+	otlpHTTPTimeout      = time.Second * 5
+	otlpFileSchemePrefix = "file://"
+
+	// the span kind defined by the opentelemetry protocol
+	otlpSpanKindInternal = 1
+	otlpSpanKindProducer = 4
+	otlpSpanKindConsumer = 5
+
+	otlpStatusCodeError = 2
+)
+
+// span names exported by the otlp tracer
+const (
+	SpanPub     = "pub"
+	SpanEnqueue = "enqueue"
+	SpanDeliver = "deliver"
+	SpanFin     = "fin"
+	SpanReq     = "req"
+	SpanTimeout = "timeout"
+)
+
+// IsOTLPTracerAddr returns whether the remote tracer address should use the otlp exporter,
+// the http(s) url will be posted with the otlp/json payload and the file url will be
+// appended with one payload each line.
+func IsOTLPTracerAddr(remote string) bool {
+	return strings.HasPrefix(remote, "http://") || strings.HasPrefix(remote, "https://") ||
+		strings.HasPrefix(remote, otlpFileSchemePrefix)
+}
+
+type otlpAnyValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+func otlpStringAttr(k string, v string) otlpKeyValue {
+	return otlpKeyValue{Key: k, Value: otlpAnyValue{StringValue: &v}}
+}
+
+// the 64 bit integer is encoded as string in otlp/json
+func otlpIntAttr(k string, v int64) otlpKeyValue {
+	s := strconv.FormatInt(v, 10)
+	return otlpKeyValue{Key: k, Value: otlpAnyValue{IntValue: &s}}
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            *otlpStatus    `json:"status,omitempty"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope   `json:"scope"`
+	Spans []*otlpSpan `json:"spans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTraceData struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type spanExporter interface {
+	Export(data []byte) error
+	Close() error
+}
+
+type otlpHTTPExporter struct {
+	url    string
+	client *http.Client
+}
+
+func (e *otlpHTTPExporter) Export(data []byte) error {
+	rsp, err := e.client.Post(e.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	ioutil.ReadAll(rsp.Body)
+	if rsp.StatusCode/100 != 2 {
+		return fmt.Errorf("export spans to %v failed: %v", e.url, rsp.Status)
+	}
+	return nil
+}
+
+func (e *otlpHTTPExporter) Close() error {
+	return nil
+}
+
+// write each export request as one json line
+type otlpFileExporter struct {
+	f *os.File
+}
+
+func (e *otlpFileExporter) Export(data []byte) error {
+	_, err := e.f.Write(append(data, '\n'))
+	return err
+}
+
+func (e *otlpFileExporter) Close() error {
+	return e.f.Close()
+}
+
+func newSpanExporter(remote string) (spanExporter, error) {
+	if strings.HasPrefix(remote, otlpFileSchemePrefix) {
+		path := strings.TrimPrefix(remote, otlpFileSchemePrefix)
+		if path == "" {
+			return nil, errors.New("empty otlp tracer file path")
+		}
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		return &otlpFileExporter{f: f}, nil
+	}
+	return &otlpHTTPExporter{
+		url:    remote,
+		client: &http.Client{Timeout: otlpHTTPTimeout},
+	}, nil
+}
+
+// this tracer will convert the trace info to the opentelemetry spans and
+// export them in batch with the otlp/json format. The trace id is taken from the
+// ##trace_id in the json ext header, if no trace id, the trace id will be
+// generated from the topic and message id so all the spans of
+// the same message can be grouped together.
+type OTLPMsgTracer struct {
+	remoteAddr string
+	exporter   spanExporter
+	resource   otlpResource
+	spanChan   chan *otlpSpan
+	quitChan   chan struct{}
+	wg         sync.WaitGroup
+	startOnce  sync.Once
+	stopOnce   sync.Once
+	dropped    int64
+	exported   int64
+}
+
+func NewOTLPMsgTracer(remote string) (*OTLPMsgTracer, error) {
+	exporter, err := newSpanExporter(remote)
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	return &OTLPMsgTracer{
+		remoteAddr: remote,
+		exporter:   exporter,
+		resource: otlpResource{
+			Attributes: []otlpKeyValue{
+				otlpStringAttr("service.name", otlpServiceName),
+				otlpStringAttr("host.name", hostname),
+			},
+		},
+		spanChan: make(chan *otlpSpan, otlpSpanBufferSize),
+		quitChan: make(chan struct{}),
+	}, nil
+}
+
+func (self *OTLPMsgTracer) Start() {
+	self.startOnce.Do(func() {
+		self.wg.Add(1)
+		go self.exportLoop()
+	})
+}
+
+// stop the export loop and flush all the buffered spans
+func (self *OTLPMsgTracer) Stop() {
+	self.stopOnce.Do(func() {
+		close(self.quitChan)
+		self.wg.Wait()
+		self.exporter.Close()
+		nsqLog.Logf("otlp tracer stopped, exported spans: %v, dropped spans: %v",
+			atomic.LoadInt64(&self.exported), atomic.LoadInt64(&self.dropped))
+	})
+}
+
+func (self *OTLPMsgTracer) exportLoop() {
+	defer self.wg.Done()
+	ticker := time.NewTicker(otlpExportInterval)
+	defer ticker.Stop()
+	batch := make([]*otlpSpan, 0, otlpExportBatchSize)
+	for {
+		select {
+		case s := <-self.spanChan:
+			batch = append(batch, s)
+			if len(batch) >= otlpExportBatchSize {
+				batch = self.flush(batch)
+			}
+		case <-ticker.C:
+			batch = self.flush(batch)
+		case <-self.quitChan:
+			for {
+				select {
+				case s := <-self.spanChan:
+					batch = append(batch, s)
+					if len(batch) >= otlpExportBatchSize {
+						batch = self.flush(batch)
+					}
+				default:
+					self.flush(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (self *OTLPMsgTracer) flush(batch []*otlpSpan) []*otlpSpan {
+	if len(batch) == 0 {
+		return batch
+	}
+	data, err := self.encode(batch)
+	if err == nil {
+		err = self.exporter.Export(data)
+	}
+	if err != nil {
+		nsqLog.Warningf("export %v spans to %v error: %v", len(batch), self.remoteAddr, err)
+		atomic.AddInt64(&self.dropped, int64(len(batch)))
+	} else {
+		atomic.AddInt64(&self.exported, int64(len(batch)))
+	}
+	return batch[:0]
+}
+
+func (self *OTLPMsgTracer) encode(spans []*otlpSpan) ([]byte, error) {
+	data := otlpTraceData{
+		ResourceSpans: []otlpResourceSpans{
+			{
+				Resource: self.resource,
+				ScopeSpans: []otlpScopeSpans{
+					{
+						Scope: otlpScope{Name: otlpScopeName},
+						Spans: spans,
+					},
+				},
+			},
+		},
+	}
+	return json.Marshal(data)
+}
+
+// the span should never block the message write and read, it will be dropped
+// if the export can not catch up.
+func (self *OTLPMsgTracer) addSpan(s *otlpSpan) {
+	select {
+	case self.spanChan <- s:
+	default:
+		atomic.AddInt64(&self.dropped, 1)
+	}
+}
+
+func (self *OTLPMsgTracer) newSpan(name string, kind int, traceID string, start int64, end int64) *otlpSpan {
+	return &otlpSpan{
+		TraceID:           traceID,
+		SpanID:            newOTLPSpanID(),
+		Name:              name,
+		Kind:              kind,
+		StartTimeUnixNano: strconv.FormatInt(start, 10),
+		EndTimeUnixNano:   strconv.FormatInt(end, 10),
+	}
+}
+
+func (self *OTLPMsgTracer) TracePub(topic string, part int, pubMethod string, traceID uint64, msg *Message, diskOffset BackendOffset, currentCnt int64) {
+	now := time.Now().UnixNano()
+	if traceID == 0 {
+		traceID = getMsgTraceID(msg)
+	}
+	msgID := msg.ID
+	if msg.DelayedOrigID > 0 {
+		msgID = msg.DelayedOrigID
+	}
+	s := self.newSpan(SpanEnqueue, otlpSpanKindInternal, formatOTLPTraceID(topic, traceID, msgID), now, now)
+	s.Attributes = []otlpKeyValue{
+		otlpStringAttr("messaging.system", "nsq"),
+		otlpStringAttr("messaging.destination", topic),
+		otlpIntAttr("messaging.nsq.partition", int64(part)),
+		otlpIntAttr("messaging.message_id", int64(msg.ID)),
+		otlpStringAttr("messaging.nsq.pub_method", pubMethod),
+		otlpIntAttr("messaging.nsq.offset", int64(diskOffset)),
+		otlpIntAttr("messaging.nsq.count", currentCnt),
+	}
+	if msg.DelayedType >= MinDelayedType {
+		s.Attributes = append(s.Attributes,
+			otlpIntAttr("messaging.nsq.delayed_type", int64(msg.DelayedType)),
+			otlpIntAttr("messaging.nsq.delayed_ts", msg.DelayedTs),
+			otlpStringAttr("messaging.nsq.delayed_channel", msg.DelayedChannel))
+	}
+	self.addSpan(s)
+}
+
+func (self *OTLPMsgTracer) TracePubClient(topic string, part int, traceID uint64, msgID MessageID, diskOffset BackendOffset, clientID string) {
+	now := time.Now().UnixNano()
+	s := self.newSpan(SpanPub, otlpSpanKindProducer, formatOTLPTraceID(topic, traceID, msgID), now, now)
+	s.Attributes = []otlpKeyValue{
+		otlpStringAttr("messaging.system", "nsq"),
+		otlpStringAttr("messaging.destination", topic),
+		otlpIntAttr("messaging.nsq.partition", int64(part)),
+		otlpIntAttr("messaging.message_id", int64(msgID)),
+		otlpIntAttr("messaging.nsq.offset", int64(diskOffset)),
+		otlpStringAttr("messaging.nsq.client", clientID),
+	}
+	self.addSpan(s)
+}
+
+// the consume state is mapped to the span name, the cost is used as the span
+// duration, for the deliver span it is the time from the message published.
+func (self *OTLPMsgTracer) TraceSub(topic string, channel string, state string, traceID uint64, msg *Message, clientID string, cost int64) {
+	name, kind := getSubSpanName(state)
+	now := time.Now().UnixNano()
+	if traceID == 0 {
+		traceID = getMsgTraceID(msg)
+	}
+	msgID := msg.ID
+	if msg.DelayedOrigID > 0 {
+		msgID = msg.DelayedOrigID
+	}
+	s := self.newSpan(name, kind, formatOTLPTraceID(topic, traceID, msgID), now-cost, now)
+	s.Attributes = []otlpKeyValue{
+		otlpStringAttr("messaging.system", "nsq"),
+		otlpStringAttr("messaging.destination", topic),
+		otlpStringAttr("messaging.nsq.channel", channel),
+		otlpIntAttr("messaging.message_id", int64(msg.ID)),
+		otlpIntAttr("messaging.nsq.offset", int64(msg.Offset)),
+		otlpIntAttr("messaging.nsq.attempts", int64(msg.Attempts)),
+		otlpStringAttr("messaging.nsq.state", state),
+		otlpStringAttr("messaging.nsq.client", clientID),
+	}
+	if name == SpanTimeout {
+		s.Status = &otlpStatus{Code: otlpStatusCodeError, Message: state}
+	}
+	self.addSpan(s)
+}
+
+func getSubSpanName(state string) (string, int) {
+	switch state {
+	case "START":
+		return SpanDeliver, otlpSpanKindConsumer
+	case "FIN", "FIN_INTERNAL":
+		return SpanFin, otlpSpanKindConsumer
+	case "REQ", "REQ_DEFER":
+		return SpanReq, otlpSpanKindConsumer
+	case "TIMEOUT", "DELAY_TIMEOUT", "DELAY_QUEUE_TIMEOUT":
+		return SpanTimeout, otlpSpanKindConsumer
+	}
+	return strings.ToLower(state), otlpSpanKindInternal
+}
+
+// the trace id is passed in as the decimal string in the json ext header
+func getMsgTraceID(msg *Message) uint64 {
+	if msg.TraceID != 0 {
+		return msg.TraceID
+	}
+	if msg.ExtVer != ext.JSON_HEADER_EXT_VER || len(msg.ExtBytes) == 0 {
+		return 0
+	}
+	v := gjson.GetBytes(msg.ExtBytes, ext.TRACE_ID_KEY)
+	if !v.Exists() {
+		return 0
+	}
+	traceID, err := strconv.ParseUint(v.String(), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return traceID
+}
+
+// the 128 bit otlp trace id, the high 64 bits is zero if the trace id is given,
+// otherwise it is hashed from the topic and the low 64 bits is the message id.
+func formatOTLPTraceID(topic string, traceID uint64, msgID MessageID) string {
+	var buf [16]byte
+	if traceID != 0 {
+		binary.BigEndian.PutUint64(buf[8:], traceID)
+	} else {
+		h := fnv.New64a()
+		h.Write([]byte(topic))
+		binary.BigEndian.PutUint64(buf[:8], h.Sum64())
+		binary.BigEndian.PutUint64(buf[8:], uint64(msgID))
+	}
+	return hex.EncodeToString(buf[:])
+}
+
+var spanIDRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+var spanIDLock sync.Mutex
+
+func newOTLPSpanID() string {
+	var buf [8]byte
+	spanIDLock.Lock()
+	v := spanIDRand.Uint64()
+	spanIDLock.Unlock()
+	// the all zero span id is invalid
+	if v == 0 {
+		v = 1
+	}
+	binary.BigEndian.PutUint64(buf[:], v)
+	return hex.EncodeToString(buf[:])
+}
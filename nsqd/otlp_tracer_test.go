@@ -0,0 +1,61 @@
+package nsqd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+
+	"github.com/youzan/nsq/internal/ext"
+	"github.com/youzan/nsq/internal/test"
+)
+
+func TestOTLPMsgTracerFileExport(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "nsq-test-")
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	fileName := path.Join(tmpDir, "trace.json")
+	test.Equal(t, true, IsOTLPTracerAddr("file://"+fileName))
+	test.Equal(t, true, IsOTLPTracerAddr("http://127.0.0.1:4318/v1/traces"))
+	test.Equal(t, false, IsOTLPTracerAddr("127.0.0.1:1234"))
+
+	tracer, err := NewOTLPMsgTracer("file://" + fileName)
+	test.Nil(t, err)
+	tracer.Start()
+
+	header := `{"##trace_id":"123456","k":"v"}`
+	msg := NewMessageWithExt(1, []byte("body"), ext.JSON_HEADER_EXT_VER, []byte(header))
+	tracer.TracePubClient("test", 0, 123456, msg.ID, 10, "client")
+	tracer.TracePub("test", 0, "PUB", 0, msg, 10, 1)
+	tracer.TraceSub("test", "ch", "START", 0, msg, "client", 100)
+	tracer.TraceSub("test", "ch", "TIMEOUT", 0, msg, "client", 100)
+	// no trace id
+	msg2 := NewMessage(2, []byte("body"))
+	tracer.TraceSub("test", "ch", "FIN", 0, msg2, "client", 100)
+	tracer.Stop()
+
+	data, err := ioutil.ReadFile(fileName)
+	test.Nil(t, err)
+	var traceData otlpTraceData
+	err = json.Unmarshal(data, &traceData)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(traceData.ResourceSpans))
+	spans := traceData.ResourceSpans[0].ScopeSpans[0].Spans
+	test.Equal(t, 5, len(spans))
+	names := []string{SpanPub, SpanEnqueue, SpanDeliver, SpanTimeout, SpanFin}
+	traceID := formatOTLPTraceID("test", 123456, msg.ID)
+	for i, s := range spans {
+		test.Equal(t, names[i], s.Name)
+		test.Equal(t, 16, len(s.SpanID))
+		if i < 4 {
+			test.Equal(t, traceID, s.TraceID)
+		}
+	}
+	test.Equal(t, formatOTLPTraceID("test", 0, msg2.ID), spans[4].TraceID)
+	test.NotNil(t, spans[3].Status)
+	start, _ := strconv.ParseInt(spans[2].StartTimeUnixNano, 10, 64)
+	end, _ := strconv.ParseInt(spans[2].EndTimeUnixNano, 10, 64)
+	test.Equal(t, int64(100), end-start)
+}
@@ -0,0 +1,589 @@
+package nsqd
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// the restored archive segment will be removed after not accessed for this
+	restoredSegmentKeep = time.Hour
+	restoredSegmentExt  = ".restored"
+	// the local meta file for the archived segment, which keeps the segment size
+	archivedMetaExt      = ".archived"
+	archiveCheckInterval = time.Minute * 10
+	// the max time waiting the archived segment restored while reading, the restore
+	// will go on in background after timeout.
+	restoreWaitTimeout = time.Second * 3
+	// the failed restore will not be retried in this interval
+	restoreRetryInterval = time.Minute
+)
+
+var (
+	ErrArchivedSegmentNotFound  = errors.New("archived segment not found")
+	ErrArchivedSegmentRestoring = errors.New("archived segment is restoring")
+)
+
+// SegmentArchiver is the backend to store the old sealed topic segment files,
+// the key is like "topic/topic-0.diskqueue.000001.dat"
+type SegmentArchiver interface {
+	String() string
+	Archive(key string, localFile string) error
+	Fetch(key string, localFile string) error
+	Remove(key string) error
+}
+
+type archiverHolder struct {
+	a SegmentArchiver
+}
+
+var segArchiver atomic.Value
+
+func init() {
+	segArchiver.Store(archiverHolder{})
+}
+
+func SetSegmentArchiver(a SegmentArchiver) {
+	segArchiver.Store(archiverHolder{a})
+}
+
+func getSegmentArchiver() SegmentArchiver {
+	return segArchiver.Load().(archiverHolder).a
+}
+
+// NewSegmentArchiver creates the archiver from url, the file:///path or the
+// plain path will archive to a local directory, and the
+// s3://access:secret@host:port/bucket/prefix?region=xx&secure=true will archive
+// to the S3 compatible object store (such as minio).
+// All the keys will be prefixed with the keyPrefix.
+func NewSegmentArchiver(archiveURL string, keyPrefix string) (SegmentArchiver, error) {
+	u, err := url.Parse(archiveURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "", "file":
+		if u.Path == "" {
+			return nil, errors.New("missing archive directory")
+		}
+		return newDirArchiver(path.Join(u.Path, keyPrefix))
+	case "s3":
+		return newS3Archiver(u, keyPrefix)
+	}
+	return nil, fmt.Errorf("unsupported archive url: %v", archiveURL)
+}
+
+func archiveKey(fileName string) string {
+	return path.Join(path.Base(path.Dir(fileName)), path.Base(fileName))
+}
+
+type restoredSegment struct {
+	// the readers opened the restored file
+	refs       int
+	lastAccess time.Time
+	// closed while the restore is done
+	restoring chan struct{}
+	err       error
+	failedAt  time.Time
+}
+
+var closedRestoreChan = make(chan struct{})
+
+func init() {
+	close(closedRestoreChan)
+}
+
+// the restored segments state, used to restore the segment only once for
+// the concurrent readers and to clean the restored file not used.
+var restoredSegments = struct {
+	sync.Mutex
+	m map[string]*restoredSegment
+}{m: make(map[string]*restoredSegment)}
+
+// the opened queue segment file, the restored segment will be referenced until closed.
+type queueSegmentFile struct {
+	*os.File
+	restored string
+	closed   bool
+}
+
+func (f *queueSegmentFile) Close() error {
+	err := f.File.Close()
+	if f.restored != "" && !f.closed {
+		releaseRestoredSegment(f.restored)
+	}
+	f.closed = true
+	return err
+}
+
+func releaseRestoredSegment(fileName string) {
+	restoredSegments.Lock()
+	if st, ok := restoredSegments.m[fileName]; ok {
+		st.refs--
+		st.lastAccess = time.Now()
+	}
+	restoredSegments.Unlock()
+}
+
+// start restoring the segment in background if not restored, return the chan
+// which will be closed after restored.
+func startRestoreSegment(a SegmentArchiver, fileName string) (*restoredSegment, chan struct{}) {
+	restoredSegments.Lock()
+	defer restoredSegments.Unlock()
+	st, ok := restoredSegments.m[fileName]
+	if !ok {
+		st = &restoredSegment{}
+		restoredSegments.m[fileName] = st
+	}
+	st.lastAccess = time.Now()
+	if st.restoring != nil {
+		return st, st.restoring
+	}
+	if _, err := os.Stat(fileName + restoredSegmentExt); err == nil {
+		return st, nil
+	}
+	if st.err != nil && time.Since(st.failedAt) < restoreRetryInterval {
+		// the restore failed recently, return the last error without fetching again
+		return st, closedRestoreChan
+	}
+	done := make(chan struct{})
+	st.restoring = done
+	st.err = nil
+	go func() {
+		err := restoreSegment(a, fileName)
+		restoredSegments.Lock()
+		st.err = err
+		if err != nil {
+			st.failedAt = time.Now()
+		}
+		st.restoring = nil
+		restoredSegments.Unlock()
+		close(done)
+	}()
+	return st, done
+}
+
+func restoreSegment(a SegmentArchiver, fileName string) error {
+	restoredName := fileName + restoredSegmentExt
+	tmpName := fmt.Sprintf("%s.%d.tmp", restoredName, rand.Int())
+	err := a.Fetch(archiveKey(fileName), tmpName)
+	if err != nil {
+		os.Remove(tmpName)
+		if err != ErrArchivedSegmentNotFound {
+			nsqLog.LogWarningf("restore segment %v from archive %v failed: %v", fileName, a, err)
+		}
+		return err
+	}
+	err = os.Rename(tmpName, restoredName)
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	nsqLog.Logf("segment %v restored from archive %v", fileName, a)
+	return nil
+}
+
+// check if the segment has been archived by the local archive meta, the
+// missing segment without the meta will not be restored from the archive.
+func isSegmentArchived(fileName string) bool {
+	_, err := os.Stat(fileName + archivedMetaExt)
+	return err == nil
+}
+
+// open the queue segment file for read, if the local file has been archived
+// the archived file will be restored to local. The restore is done in background
+// and ErrArchivedSegmentRestoring is returned if not restored in restoreWaitTimeout.
+func openQueueFileForRead(fileName string) (*queueSegmentFile, error) {
+	f, err := os.OpenFile(fileName, os.O_RDONLY, 0644)
+	if err == nil {
+		return &queueSegmentFile{File: f}, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	a := getSegmentArchiver()
+	if a == nil || !isSegmentArchived(fileName) {
+		return nil, err
+	}
+	st, done := startRestoreSegment(a, fileName)
+	if done != nil {
+		select {
+		case <-done:
+		case <-time.After(restoreWaitTimeout):
+			return nil, ErrArchivedSegmentRestoring
+		}
+		restoredSegments.Lock()
+		restoreErr := st.err
+		restoredSegments.Unlock()
+		if restoreErr == ErrArchivedSegmentNotFound {
+			return nil, err
+		}
+		if restoreErr != nil {
+			return nil, restoreErr
+		}
+	}
+	restoredSegments.Lock()
+	defer restoredSegments.Unlock()
+	f, restoreErr := os.OpenFile(fileName+restoredSegmentExt, os.O_RDONLY, 0644)
+	if restoreErr != nil {
+		return nil, restoreErr
+	}
+	st.refs++
+	st.lastAccess = time.Now()
+	return &queueSegmentFile{File: f, restored: fileName}, nil
+}
+
+type archivedFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (fi *archivedFileInfo) Name() string       { return fi.name }
+func (fi *archivedFileInfo) Size() int64        { return fi.size }
+func (fi *archivedFileInfo) Mode() os.FileMode  { return 0644 }
+func (fi *archivedFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *archivedFileInfo) IsDir() bool        { return false }
+func (fi *archivedFileInfo) Sys() interface{}   { return nil }
+
+func writeArchivedMeta(fileName string, size int64) error {
+	return ioutil.WriteFile(fileName+archivedMetaExt, []byte(strconv.FormatInt(size, 10)), 0644)
+}
+
+func readArchivedMeta(fileName string) (os.FileInfo, error) {
+	metaName := fileName + archivedMetaExt
+	stat, err := os.Stat(metaName)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(metaName)
+	if err != nil {
+		return nil, err
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &archivedFileInfo{name: path.Base(fileName), size: size, modTime: stat.ModTime()}, nil
+}
+
+// stat the queue segment file, the archived segment will use the size
+// in the local archive meta without restoring it.
+func statQueueFile(fileName string) (os.FileInfo, error) {
+	stat, err := os.Stat(fileName)
+	if err == nil || !os.IsNotExist(err) {
+		return stat, err
+	}
+	a := getSegmentArchiver()
+	if a == nil {
+		return stat, err
+	}
+	archivedStat, metaErr := readArchivedMeta(fileName)
+	if metaErr == nil {
+		return archivedStat, nil
+	}
+	if os.IsNotExist(metaErr) {
+		// not archived, the segment is not exist
+		return stat, err
+	}
+	if restoredStat, restoreErr := os.Stat(fileName + restoredSegmentExt); restoreErr == nil {
+		return restoredStat, nil
+	}
+	// the archive meta is broken, restore it for the next stat
+	st, done := startRestoreSegment(a, fileName)
+	if done == nil {
+		return os.Stat(fileName + restoredSegmentExt)
+	}
+	select {
+	case <-done:
+	case <-time.After(restoreWaitTimeout):
+		return nil, ErrArchivedSegmentRestoring
+	}
+	restoredSegments.Lock()
+	restoreErr := st.err
+	restoredSegments.Unlock()
+	if restoreErr != nil {
+		return nil, err
+	}
+	return os.Stat(fileName + restoredSegmentExt)
+}
+
+// remove the restored segment if no reader opened and not accessed recently.
+func cleanRestoredSegment(fileName string) {
+	restoredName := fileName + restoredSegmentExt
+	restoredSegments.Lock()
+	defer restoredSegments.Unlock()
+	st, ok := restoredSegments.m[fileName]
+	if !ok {
+		if _, err := os.Stat(restoredName); err != nil {
+			return
+		}
+		// restored before restart, start to track the access from now
+		restoredSegments.m[fileName] = &restoredSegment{lastAccess: time.Now()}
+		return
+	}
+	if st.refs > 0 || st.restoring != nil || time.Since(st.lastAccess) < restoredSegmentKeep {
+		return
+	}
+	os.Remove(restoredName)
+	delete(restoredSegments.m, fileName)
+}
+
+// remove all the local files for the archived segment while the segment is cleaned
+func removeArchivedLocalFiles(fileName string) {
+	restoredSegments.Lock()
+	delete(restoredSegments.m, fileName)
+	restoredSegments.Unlock()
+	os.Remove(fileName + restoredSegmentExt)
+	os.Remove(fileName + archivedMetaExt)
+}
+
+func copyFile(from string, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmpName := fmt.Sprintf("%s.%d.tmp", to, rand.Int())
+	dst, err := os.OpenFile(tmpName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Sync()
+	}
+	dst.Close()
+	if err == nil {
+		err = os.Rename(tmpName, to)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+	}
+	return err
+}
+
+type dirArchiver struct {
+	dir string
+}
+
+func newDirArchiver(dir string) (*dirArchiver, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &dirArchiver{dir: dir}, nil
+}
+
+func (d *dirArchiver) String() string {
+	return "dir:" + d.dir
+}
+
+func (d *dirArchiver) Archive(key string, localFile string) error {
+	target := filepath.Join(d.dir, key)
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+	return copyFile(localFile, target)
+}
+
+func (d *dirArchiver) Fetch(key string, localFile string) error {
+	err := copyFile(filepath.Join(d.dir, key), localFile)
+	if os.IsNotExist(err) {
+		return ErrArchivedSegmentNotFound
+	}
+	return err
+}
+
+func (d *dirArchiver) Remove(key string) error {
+	err := os.Remove(filepath.Join(d.dir, key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// s3Archiver uses the path style url and the aws signature v4 with unsigned
+// payload, which is supported by aws s3 and minio.
+type s3Archiver struct {
+	endpoint  string
+	bucket    string
+	prefix    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func newS3Archiver(u *url.URL, keyPrefix string) (*s3Archiver, error) {
+	parts := strings.SplitN(strings.Trim(u.Path, "/"), "/", 2)
+	if u.Host == "" || parts[0] == "" {
+		return nil, errors.New("missing s3 endpoint or bucket")
+	}
+	s := &s3Archiver{
+		endpoint: "http://" + u.Host,
+		bucket:   parts[0],
+		region:   u.Query().Get("region"),
+		client:   &http.Client{Timeout: time.Minute * 5},
+	}
+	if u.Query().Get("secure") == "true" {
+		s.endpoint = "https://" + u.Host
+	}
+	if len(parts) > 1 {
+		s.prefix = parts[1]
+	}
+	s.prefix = path.Join(s.prefix, keyPrefix)
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	if u.User != nil {
+		s.accessKey = u.User.Username()
+		s.secretKey, _ = u.User.Password()
+	}
+	return s, nil
+}
+
+func (s *s3Archiver) String() string {
+	return fmt.Sprintf("s3:%s/%s/%s", s.endpoint, s.bucket, s.prefix)
+}
+
+func (s *s3Archiver) objectURL(key string) string {
+	return s.endpoint + "/" + path.Join(s.bucket, s.prefix, key)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func (s *s3Archiver) sign(req *http.Request) {
+	if s.accessKey == "" {
+		return
+	}
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payloadHash := "UNSIGNED-PAYLOAD"
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalReq := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host + "\n" +
+			"x-amz-content-sha256:" + payloadHash + "\n" +
+			"x-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	reqHash := sha256.Sum256([]byte(canonicalReq))
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	strToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(reqHash[:])
+
+	signKey := hmacSHA256([]byte("AWS4"+s.secretKey), day)
+	signKey = hmacSHA256(signKey, s.region)
+	signKey = hmacSHA256(signKey, "s3")
+	signKey = hmacSHA256(signKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signKey, strToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func (s *s3Archiver) do(req *http.Request) (*http.Response, error) {
+	s.sign(req)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrArchivedSegmentNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3 %v %v got status %v: %s", req.Method, req.URL, resp.StatusCode, body)
+	}
+	return resp, nil
+}
+
+func (s *s3Archiver) Archive(key string, localFile string) error {
+	f, err := os.Open(localFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PUT", s.objectURL(key), f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = stat.Size()
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Archiver) Fetch(key string, localFile string) error {
+	req, err := http.NewRequest("GET", s.objectURL(key), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	f, err := os.OpenFile(localFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, resp.Body)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	return err
+}
+
+func (s *s3Archiver) Remove(key string) error {
+	req, err := http.NewRequest("DELETE", s.objectURL(key), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req)
+	if err == ErrArchivedSegmentNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,203 @@
+package nsqd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/youzan/nsq/internal/test"
+)
+
+func TestDiskQueueArchiveToDir(t *testing.T) {
+	dqName := "test_disk_queue" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	archiver, err := NewSegmentArchiver("file://"+path.Join(tmpDir, "archive"), "1")
+	test.Nil(t, err)
+	SetSegmentArchiver(archiver)
+	defer SetSegmentArchiver(nil)
+
+	dataPath := path.Join(tmpDir, "topic")
+	os.MkdirAll(dataPath, 0755)
+	queue, _ := NewDiskQueueWriter(dqName, dataPath, 1024, 4, 1<<10, 1)
+	dqWriter := queue.(*diskQueueWriter)
+	defer dqWriter.Close()
+
+	msg := []byte("test")
+	msgNum := 1000
+	for i := 0; i < msgNum; i++ {
+		dqWriter.Put(msg)
+	}
+	dqWriter.Flush()
+	end := dqWriter.GetQueueWriteEnd()
+
+	origStat, err := os.Stat(dqWriter.fileName(0))
+	test.Nil(t, err)
+	cnt, err := dqWriter.ArchiveOldSegments(time.Now().Add(-time.Hour))
+	test.Nil(t, err)
+	test.Equal(t, 0, cnt)
+	cnt, err = dqWriter.ArchiveOldSegments(time.Now().Add(time.Second))
+	test.Nil(t, err)
+	test.Equal(t, true, cnt > 1)
+	_, err = os.Stat(dqWriter.fileName(0))
+	test.Equal(t, true, os.IsNotExist(err))
+	_, err = os.Stat(path.Join(tmpDir, "archive", "1", archiveKey(dqWriter.fileName(0))))
+	test.Nil(t, err)
+	// stat should use the archive meta without restoring
+	stat, err := statQueueFile(dqWriter.fileName(0))
+	test.Nil(t, err)
+	test.Equal(t, origStat.Size(), stat.Size())
+	_, err = os.Stat(dqWriter.fileName(0) + restoredSegmentExt)
+	test.Equal(t, true, os.IsNotExist(err))
+
+	// read from the begin should restore from archive
+	snap := NewDiskQueueSnapshot(dqName, dataPath, end)
+	defer snap.Close()
+	for i := 0; i < msgNum; i++ {
+		ret := snap.ReadOne()
+		test.Nil(t, ret.Err)
+		equal(t, ret.Data, msg)
+	}
+	err = snap.ResetSeekTo(BackendOffset(8 * 10))
+	test.Nil(t, err)
+	ret := snap.ReadOne()
+	test.Nil(t, ret.Err)
+	test.Equal(t, BackendOffset(8*10), ret.Offset)
+	_, err = os.Stat(dqWriter.fileName(0) + restoredSegmentExt)
+	test.Nil(t, err)
+
+	// the restored segment opened by the reader should not be cleaned
+	fn := dqWriter.fileName(0)
+	expireAccess := func() {
+		restoredSegments.Lock()
+		restoredSegments.m[fn].lastAccess = time.Now().Add(-restoredSegmentKeep * 2)
+		restoredSegments.Unlock()
+	}
+	expireAccess()
+	cleanRestoredSegment(fn)
+	_, err = os.Stat(fn + restoredSegmentExt)
+	test.Nil(t, err)
+	snap.Close()
+	cleanRestoredSegment(fn)
+	_, err = os.Stat(fn + restoredSegmentExt)
+	test.Nil(t, err)
+	expireAccess()
+	cleanRestoredSegment(fn)
+	_, err = os.Stat(fn + restoredSegmentExt)
+	test.Equal(t, true, os.IsNotExist(err))
+
+	// clean by retention should remove the archived segments
+	cleanEnd := &diskQueueEndInfo{}
+	cleanEnd.EndOffset.FileNum = 2
+	_, err = dqWriter.CleanOldDataByRetention(cleanEnd, false, 0)
+	test.Nil(t, err)
+	_, err = os.Stat(path.Join(tmpDir, "archive", "1", archiveKey(dqWriter.fileName(0))))
+	test.Equal(t, true, os.IsNotExist(err))
+	_, err = os.Stat(dqWriter.fileName(0) + restoredSegmentExt)
+	test.Equal(t, true, os.IsNotExist(err))
+}
+
+func TestS3Archiver(t *testing.T) {
+	var lock sync.Mutex
+	objects := make(map[string][]byte)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		auth := req.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=access/") ||
+			req.Header.Get("x-amz-content-sha256") != "UNSIGNED-PAYLOAD" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		switch req.Method {
+		case "PUT":
+			data, _ := ioutil.ReadAll(req.Body)
+			objects[req.URL.Path] = data
+		case "GET":
+			data, ok := objects[req.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(data)
+		case "DELETE":
+			delete(objects, req.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer ts.Close()
+
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	archiver, err := NewSegmentArchiver("s3://access:secret@"+strings.TrimPrefix(ts.URL, "http://")+"/bucket/nsq", "2")
+	test.Nil(t, err)
+
+	localFile := path.Join(tmpDir, "test.dat")
+	err = ioutil.WriteFile(localFile, []byte("segment data"), 0644)
+	test.Nil(t, err)
+	err = archiver.Archive("topic/test.dat", localFile)
+	test.Nil(t, err)
+	_, ok := objects["/bucket/nsq/2/topic/test.dat"]
+	test.Equal(t, true, ok)
+
+	fetched := path.Join(tmpDir, "fetched.dat")
+	err = archiver.Fetch("topic/test.dat", fetched)
+	test.Nil(t, err)
+	data, err := ioutil.ReadFile(fetched)
+	test.Nil(t, err)
+	test.Equal(t, "segment data", string(data))
+
+	test.Nil(t, archiver.Remove("topic/test.dat"))
+	err = archiver.Fetch("topic/test.dat", fetched)
+	test.Equal(t, ErrArchivedSegmentNotFound, err)
+}
+
+type countFetchArchiver struct {
+	SegmentArchiver
+	fetched int32
+}
+
+func (c *countFetchArchiver) Fetch(key string, localFile string) error {
+	atomic.AddInt32(&c.fetched, 1)
+	return c.SegmentArchiver.Fetch(key, localFile)
+}
+
+func TestSegmentRestoreOnlyArchived(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	dirArchiver, err := NewSegmentArchiver("file://"+path.Join(tmpDir, "archive"), "1")
+	test.Nil(t, err)
+	archiver := &countFetchArchiver{SegmentArchiver: dirArchiver}
+	SetSegmentArchiver(archiver)
+	defer SetSegmentArchiver(nil)
+
+	fn := path.Join(tmpDir, "topic", "test.diskqueue.000000.dat")
+	os.MkdirAll(path.Dir(fn), 0755)
+	// the missing segment without the archive meta should not be restored
+	_, err = statQueueFile(fn)
+	test.Equal(t, true, os.IsNotExist(err))
+	_, err = openQueueFileForRead(fn)
+	test.Equal(t, true, os.IsNotExist(err))
+	test.Equal(t, int32(0), atomic.LoadInt32(&archiver.fetched))
+
+	// the failed restore should not be fetched again in the retry interval
+	test.Nil(t, writeArchivedMeta(fn, 10))
+	defer removeArchivedLocalFiles(fn)
+	_, err = openQueueFileForRead(fn)
+	test.Equal(t, true, os.IsNotExist(err))
+	_, err = openQueueFileForRead(fn)
+	test.Equal(t, true, os.IsNotExist(err))
+	test.Equal(t, int32(1), atomic.LoadInt32(&archiver.fetched))
+}
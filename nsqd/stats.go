@@ -35,6 +35,8 @@ type TopicStats struct {
 	Clients              []ClientPubStats `json:"client_pub_stats"`
 	MsgSizeStats         []int64          `json:"msg_size_stats"`
 	MsgWriteLatencyStats []int64          `json:"msg_write_latency_stats"`
+	MsgSizeSum           int64            `json:"msg_size_sum"`
+	MsgWriteLatencySum   int64            `json:"msg_write_latency_sum"`
 	IsMultiOrdered       bool             `json:"is_multi_ordered"`
 	IsExt                bool             `json:"is_ext"`
 	StatsdName           string           `json:"statsd_name"`
@@ -64,6 +66,8 @@ func NewTopicStats(t *Topic, channels []ChannelStats, filterClients bool) TopicS
 		Clients:              clients,
 		MsgSizeStats:         t.detailStats.GetMsgSizeStats(),
 		MsgWriteLatencyStats: t.detailStats.GetMsgWriteLatencyStats(),
+		MsgSizeSum:           atomic.LoadInt64(&t.detailStats.msgStats.MsgSizeSum),
+		MsgWriteLatencySum:   atomic.LoadInt64(&t.detailStats.msgStats.MsgWriteLatencySum),
 		IsMultiOrdered:       t.IsOrdered(),
 		IsExt:                t.IsExt(),
 		StatsdName:           statsdName,
@@ -86,6 +90,7 @@ type ChannelStats struct {
 	MessageCount  uint64        `json:"message_count"`
 	RequeueCount  uint64        `json:"requeue_count"`
 	TimeoutCount  uint64        `json:"timeout_count"`
+	ExpiredCount  uint64        `json:"expired_count"`
 	Clients       []ClientStats `json:"clients"`
 	ClientNum     int64         `json:"client_num"`
 	Paused        bool          `json:"paused"`
@@ -94,9 +99,20 @@ type ChannelStats struct {
 	DelayedQueueCount  uint64 `json:"delayed_queue_count"`
 	DelayedQueueRecent string `json:"delayed_queue_recent"`
 
+	// the messages moved to the dead letter topic and the failed ones
+	DeadLetterCount       uint64 `json:"dead_letter_count"`
+	DeadLetterFailedCount uint64 `json:"dead_letter_failed_count"`
+
+	PriorityLanes []PriorityLaneStats `json:"priority_lanes,omitempty"`
+	// the messages waiting for the previous message with the same sharding key
+	KeyWaitingCount int64 `json:"key_waiting_count"`
+
 	E2eProcessingLatency    *quantile.Result `json:"e2e_processing_latency"`
 	MsgConsumeLatencyStats  []int64          `json:"msg_consume_latency_stats"`
 	MsgDeliveryLatencyStats []int64          `json:"msg_delivery_latency_stats"`
+	// the sum of the latency in milliseconds
+	MsgConsumeLatencySum  int64 `json:"msg_consume_latency_sum"`
+	MsgDeliveryLatencySum int64 `json:"msg_delivery_latency_sum"`
 }
 
 func NewChannelStats(c *Channel, clients []ClientStats, clientNum int) ChannelStats {
@@ -133,16 +149,24 @@ func NewChannelStats(c *Channel, clients []ClientStats, clientNum int) ChannelSt
 		RequeueCount:       atomic.LoadUint64(&c.requeueCount),
 		DeferredCount:      int(atomic.LoadInt64(&c.deferredCount)),
 		TimeoutCount:       atomic.LoadUint64(&c.timeoutCount),
+		ExpiredCount:       atomic.LoadUint64(&c.expiredCount),
+		KeyWaitingCount:    c.GetKeyWaitingCount(),
 		Clients:            clients,
 		ClientNum:          int64(clientNum),
 		Paused:             c.IsPaused(),
 		Skipped:            c.IsSkipped(),
 		DelayedQueueCount:  dqCnt,
 		DelayedQueueRecent: time.Unix(0, recentTs).String(),
+		PriorityLanes:      c.GetPriorityLaneStats(),
+
+		DeadLetterCount:       atomic.LoadUint64(&c.deadLetterCount),
+		DeadLetterFailedCount: atomic.LoadUint64(&c.deadLetterFailedCount),
 
 		E2eProcessingLatency:    c.e2eProcessingLatencyStream.Result(),
 		MsgConsumeLatencyStats:  c.channelStatsInfo.GetChannelLatencyStats(),
 		MsgDeliveryLatencyStats: c.channelStatsInfo.GetDeliveryLatencyStats(),
+		MsgConsumeLatencySum:    atomic.LoadInt64(&c.channelStatsInfo.MsgConsumeLatencySum),
+		MsgDeliveryLatencySum:   atomic.LoadInt64(&c.channelStatsInfo.MsgDeliveryLatencySum),
 	}
 }
 
@@ -307,12 +331,17 @@ type TopicMsgStatsInfo struct {
 	MsgSizeStats [16]int64
 	// <1024us, 2ms, 4ms, 8ms, 16ms, 32ms, 64ms, 128ms, 256ms, 512ms, 1024ms, 2048ms, 4s, 8s
 	MsgWriteLatencyStats [16]int64
+	// the sum of all the message size and write latency (in microseconds)
+	MsgSizeSum         int64
+	MsgWriteLatencySum int64
 }
 
 type ChannelStatsInfo struct {
 	// 16ms, 32ms, 64ms, 128ms, 256ms, 512ms, 1024ms, 2048ms, 4s, 8s, 16s, above
 	MsgConsumeLatencyStats  [12]int64
 	MsgDeliveryLatencyStats [12]int64
+	MsgConsumeLatencySum    int64
+	MsgDeliveryLatencySum   int64
 }
 
 type TopicHistoryStatsInfo struct {
@@ -344,6 +373,7 @@ func (self *ChannelStatsInfo) UpdateChannelLatencyStats(latencyInMillSec int64)
 		bucket = len(self.MsgConsumeLatencyStats) - 1
 	}
 	atomic.AddInt64(&self.MsgConsumeLatencyStats[bucket], 1)
+	atomic.AddInt64(&self.MsgConsumeLatencySum, latencyInMillSec)
 }
 
 func (self *ChannelStatsInfo) UpdateDelivery2ACKStats(latencyInMillSec int64) {
@@ -369,6 +399,7 @@ func (self *ChannelStatsInfo) UpdateDelivery2ACKLatencyStats(latencyInMillSec in
 		bucket = len(self.MsgDeliveryLatencyStats) - 1
 	}
 	atomic.AddInt64(&self.MsgDeliveryLatencyStats[bucket], 1)
+	atomic.AddInt64(&self.MsgDeliveryLatencySum, latencyInMillSec)
 }
 
 func (self *TopicMsgStatsInfo) UpdateMsgSizeStats(msgSize int64) {
@@ -383,6 +414,7 @@ func (self *TopicMsgStatsInfo) UpdateMsgSizeStats(msgSize int64) {
 		bucket = len(self.MsgSizeStats) - 1
 	}
 	atomic.AddInt64(&self.MsgSizeStats[bucket], 1)
+	atomic.AddInt64(&self.MsgSizeSum, msgSize)
 }
 
 func (self *TopicMsgStatsInfo) BatchUpdateMsgLatencyStats(latency int64, num int64) {
@@ -395,6 +427,7 @@ func (self *TopicMsgStatsInfo) BatchUpdateMsgLatencyStats(latency int64, num int
 		bucket = len(self.MsgWriteLatencyStats) - 1
 	}
 	atomic.AddInt64(&self.MsgWriteLatencyStats[bucket], num)
+	atomic.AddInt64(&self.MsgWriteLatencySum, latency*num)
 }
 
 func (self *TopicMsgStatsInfo) UpdateMsgLatencyStats(latency int64) {
@@ -407,6 +440,7 @@ func (self *TopicMsgStatsInfo) UpdateMsgLatencyStats(latency int64) {
 		bucket = len(self.MsgWriteLatencyStats) - 1
 	}
 	atomic.AddInt64(&self.MsgWriteLatencyStats[bucket], 1)
+	atomic.AddInt64(&self.MsgWriteLatencySum, latency)
 }
 
 func (self *TopicMsgStatsInfo) UpdateMsgStats(msgSize int64, latency int64) {
@@ -50,10 +50,16 @@ func writeMessageToBackendWithCheck(writeExt bool, buf *bytes.Buffer, msg *Messa
 		return 0, 0, diskQueueEndInfo{}, err
 	}
 	// there are 4bytes data length on disk.
-	if checkSize > 0 && wsize+4 != checkSize {
+	// the size on disk can only be known after written if compressed
+	if checkSize > 0 && !bq.IsCompressEnabled() && wsize+4 != checkSize {
 		return 0, 0, diskQueueEndInfo{}, fmt.Errorf("message write size mismatch %v vs %v", checkSize, wsize+4)
 	}
-	return bq.PutV2(buf.Bytes())
+	offset, writeBytes, dend, err := bq.PutV2(buf.Bytes())
+	if err == nil && checkSize > 0 && int64(writeBytes) != checkSize {
+		bq.ResetWriteEndV2(offset, dend.TotalMsgCnt()-1)
+		return 0, 0, diskQueueEndInfo{}, fmt.Errorf("message write size mismatch %v vs %v", checkSize, writeBytes)
+	}
+	return offset, writeBytes, dend, err
 }
 
 type MsgIDGenerator interface {
@@ -67,6 +73,11 @@ type TopicDynamicConf struct {
 	SyncEvery    int64
 	OrderedMulti bool
 	Ext          bool
+	Compression  string
+	// the default ttl in seconds for the message, 0 means never expire
+	MsgTTL int64
+	// the json ext header key indexed for searching the message
+	IndexKey string
 }
 
 type PubInfo struct {
@@ -80,9 +91,31 @@ type PubInfo struct {
 type PubInfoChan chan *PubInfo
 
 type ChannelMetaInfo struct {
-	Name    string `json:"name"`
-	Paused  bool   `json:"paused"`
-	Skipped bool   `json:"skipped"`
+	Name       string          `json:"name"`
+	Paused     bool            `json:"paused"`
+	Skipped    bool            `json:"skipped"`
+	DeadLetter *DeadLetterConf `json:"dead_letter,omitempty"`
+	ExtFilter  *ExtFilterData  `json:"ext_filter,omitempty"`
+	// the number of the priority lanes, 0 means disabled
+	PriorityLanes int `json:"priority_lanes,omitempty"`
+}
+
+func newChannelMetaInfo(channel *Channel) ChannelMetaInfo {
+	meta := ChannelMetaInfo{
+		Name:    channel.name,
+		Paused:  channel.IsPaused(),
+		Skipped: channel.IsSkipped(),
+	}
+	dl := channel.GetDeadLetterConf()
+	if dl.MaxAttempts > 0 || dl.Topic != "" {
+		meta.DeadLetter = &dl
+	}
+	filter := channel.GetExtFilter()
+	if filter.Type != 0 {
+		meta.ExtFilter = &filter
+	}
+	meta.PriorityLanes = channel.GetPriorityLanes()
+	return meta
 }
 
 type Topic struct {
@@ -125,6 +158,7 @@ type Topic struct {
 	delayedQueue atomic.Value
 	isExt        int32
 	saveMutex    sync.Mutex
+	msgIndex     atomic.Value
 }
 
 func (t *Topic) setExt() {
@@ -367,6 +401,7 @@ func (t *Topic) MarkAsRemoved() (string, error) {
 	t.removeHistoryStat()
 	t.RemoveChannelMeta()
 	t.removeMagicCode()
+	t.closeMsgIndex(true)
 	if t.GetDelayedQueue() != nil {
 		t.GetDelayedQueue().Delete()
 	}
@@ -401,8 +436,24 @@ func (t *Topic) SetTrace(enable bool) {
 	}
 }
 
+func getChannelMetaFileName(dataPath string, part int) string {
+	return path.Join(dataPath, "channel_meta"+strconv.Itoa(part))
+}
+
 func (t *Topic) getChannelMetaFileName() string {
-	return path.Join(t.dataPath, "channel_meta"+strconv.Itoa(t.partition))
+	return getChannelMetaFileName(t.dataPath, t.partition)
+}
+
+// LoadChannelMetaForRead loads the channel meta of the topic partition in the
+// topic data path, used by the tools to check the data offline.
+func LoadChannelMetaForRead(dataPath string, part int) ([]*ChannelMetaInfo, error) {
+	data, err := ioutil.ReadFile(getChannelMetaFileName(dataPath, part))
+	if err != nil {
+		return nil, err
+	}
+	channels := make([]*ChannelMetaInfo, 0)
+	err = json.Unmarshal(data, &channels)
+	return channels, err
 }
 
 func (t *Topic) LoadChannelMeta() error {
@@ -436,6 +487,19 @@ func (t *Topic) LoadChannelMeta() error {
 		if ch.Skipped {
 			channel.Skip()
 		}
+		if ch.DeadLetter != nil {
+			channel.SetDeadLetterConf(*ch.DeadLetter)
+		}
+		if ch.ExtFilter != nil {
+			err = channel.SetExtFilter(*ch.ExtFilter)
+			if err != nil {
+				nsqLog.LogWarningf("channel %v ext filter %v init failed: %v", channelName, ch.ExtFilter, err)
+			}
+		}
+		err = channel.SetPriorityLanes(ch.PriorityLanes)
+		if err != nil {
+			nsqLog.LogWarningf("channel %v priority lanes %v init failed: %v", channelName, ch.PriorityLanes, err)
+		}
 	}
 	return nil
 }
@@ -446,12 +510,7 @@ func (t *Topic) GetChannelMeta() []ChannelMetaInfo {
 	for _, channel := range t.channelMap {
 		channel.RLock()
 		if !channel.ephemeral {
-			meta := ChannelMetaInfo{
-				Name:    channel.name,
-				Paused:  channel.IsPaused(),
-				Skipped: channel.IsSkipped(),
-			}
-			channels = append(channels, meta)
+			channels = append(channels, newChannelMetaInfo(channel))
 		}
 		channel.RUnlock()
 	}
@@ -466,12 +525,8 @@ func (t *Topic) SaveChannelMeta() error {
 	for _, channel := range t.channelMap {
 		channel.RLock()
 		if !channel.ephemeral {
-			meta := &ChannelMetaInfo{
-				Name:    channel.name,
-				Paused:  channel.IsPaused(),
-				Skipped: channel.IsSkipped(),
-			}
-			channels = append(channels, meta)
+			meta := newChannelMetaInfo(channel)
+			channels = append(channels, &meta)
 		}
 		channel.RUnlock()
 	}
@@ -633,10 +688,16 @@ func (t *Topic) SetDynamicInfo(dynamicConf TopicDynamicConf, idGen MsgIDGenerato
 	if dynamicConf.Ext {
 		t.setExt()
 	}
+	t.dynamicConf.Compression = dynamicConf.Compression
+	t.backend.SetCompression(dynamicConf.Compression)
+	atomic.StoreInt64(&t.dynamicConf.MsgTTL, dynamicConf.MsgTTL)
+	t.dynamicConf.IndexKey = dynamicConf.IndexKey
+	t.setMsgIndexKeyNoLock(dynamicConf.IndexKey)
 	nsqLog.Logf("topic dynamic configure changed to %v", dynamicConf)
 	t.channelLock.RLock()
 	for _, ch := range t.channelMap {
 		ch.SetExt(dynamicConf.Ext)
+		ch.SetMsgTTL(dynamicConf.MsgTTL)
 	}
 	t.channelLock.RUnlock()
 	t.Unlock()
@@ -724,6 +785,7 @@ func (t *Topic) getOrCreateChannel(channelName string) (*Channel, bool) {
 
 		channel.UpdateQueueEnd(readEnd, false)
 		channel.SetDelayedQueue(t.GetDelayedQueue())
+		channel.SetMsgTTL(atomic.LoadInt64(&t.dynamicConf.MsgTTL))
 		if t.IsWriteDisabled() {
 			channel.DisableConsume(true)
 		}
@@ -911,6 +973,16 @@ func (t *Topic) PutRawDataOnReplica(rawData []byte, offset BackendOffset, checkS
 	if atomic.LoadInt32(&t.dynamicConf.AutoCommit) == 1 {
 		t.UpdateCommittedOffset(&dend)
 	}
+	if idx := t.getMsgIndex(); idx != nil {
+		// the raw data from the leader or catchup should also be indexed
+		msgs, err := DecodeRawMessages(rawData, t.IsExt(), offset)
+		if err != nil {
+			nsqLog.LogWarningf("topic %v: failed to decode raw data for index at %v: %v", t.GetFullName(), offset, err)
+		}
+		for _, m := range msgs {
+			idx.add(m, m.Offset)
+		}
+	}
 
 	return &dend, nil
 }
@@ -946,14 +1018,18 @@ func (t *Topic) PutMessagesOnReplica(msgs []*Message, offset BackendOffset, chec
 
 	var dend diskQueueEndInfo
 	var err error
+	var moffset BackendOffset
 	wsize := int32(0)
 	wsizeTotal := int32(0)
 	for _, m := range msgs {
-		_, _, wsize, dend, err = t.put(m, false, 0)
+		_, moffset, wsize, dend, err = t.put(m, false, 0)
 		if err != nil {
 			t.ResetBackendEndNoLock(wend.Offset(), wend.TotalMsgCnt())
 			return nil, err
 		}
+		// keep the position of each message in the batch for the caller
+		m.Offset = moffset
+		m.RawMoveSize = BackendOffset(wsize)
 		wsizeTotal += wsize
 	}
 	if checkSize > 0 && int64(wsizeTotal) != checkSize {
@@ -988,6 +1064,9 @@ func (t *Topic) PutMessagesNoLock(msgs []*Message) (MessageID, BackendOffset, in
 		}
 		diskEnd = end
 		batchBytes += bytes
+		// keep the position of each message in the batch for the caller
+		m.Offset = offset
+		m.RawMoveSize = BackendOffset(bytes)
 		if firstOffset == BackendOffset(-1) {
 			firstOffset = offset
 			firstMsgID = id
@@ -1021,14 +1100,15 @@ func (t *Topic) put(m *Message, trace bool, checkSize int64) (MessageID, Backend
 	if atomic.LoadInt32(&t.dynamicConf.AutoCommit) == 1 {
 		t.UpdateCommittedOffset(&dend)
 	}
+	if idx := t.getMsgIndex(); idx != nil {
+		idx.add(m, offset)
+	}
 
 	if trace {
 		if m.TraceID != 0 || atomic.LoadInt32(&t.EnableTrace) == 1 || nsqLog.Level() >= levellogger.LOG_DETAIL {
 			nsqMsgTracer.TracePub(t.GetTopicName(), t.GetTopicPart(), "PUB", m.TraceID, m, offset, dend.TotalMsgCnt())
 		}
 	}
-	// TODO: handle delayed type for dpub and transaction message
-	// should remove from delayed queue after written on disk file
 	return m.ID, offset, writeBytes, dend, nil
 }
 
@@ -1129,6 +1209,7 @@ func (t *Topic) exit(deleted bool) error {
 		if t.GetDelayedQueue() != nil {
 			t.GetDelayedQueue().Delete()
 		}
+		t.closeMsgIndex(true)
 		// empty the queue (deletes the backend files, too)
 		t.Empty()
 		t.removeHistoryStat()
@@ -1156,6 +1237,7 @@ func (t *Topic) exit(deleted bool) error {
 	if t.GetDelayedQueue() != nil {
 		t.GetDelayedQueue().Close()
 	}
+	t.closeMsgIndex(false)
 	return t.backend.Close()
 }
 
@@ -1385,6 +1467,18 @@ func (t *Topic) TryCleanOldData(retentionSize int64, noRealClean bool, maxCleanO
 	return t.backend.CleanOldDataByRetention(cleanEndInfo, noRealClean, maxCleanOffset)
 }
 
+// TryArchiveOldData moves the segments older than archiveAfter to the archive
+func (t *Topic) TryArchiveOldData(archiveAfter time.Duration) error {
+	if archiveAfter <= 0 {
+		return nil
+	}
+	cnt, err := t.backend.ArchiveOldSegments(time.Now().Add(-1 * archiveAfter))
+	if cnt > 0 {
+		nsqLog.Infof("topic %v archived %v segments older than %v", t.GetFullName(), cnt, archiveAfter)
+	}
+	return err
+}
+
 func (t *Topic) ResetBackendWithQueueStartNoLock(queueStartOffset int64, queueStartCnt int64) error {
 	if !t.IsWriteDisabled() {
 		nsqLog.Warningf("reset the topic %v backend only allow while write disabled", t.GetFullName())
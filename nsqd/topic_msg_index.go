@@ -0,0 +1,398 @@
+package nsqd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/absolute8511/bolt"
+	"github.com/tidwall/gjson"
+	"github.com/youzan/nsq/internal/ext"
+)
+
+var (
+	bucketMsgIndex       = []byte("msg_index")
+	bucketMsgIndexOffset = []byte("msg_index_offset")
+	bucketMsgIndexMeta   = []byte("msg_index_meta")
+	msgIndexKeyName      = []byte("index_key")
+
+	ErrMsgIndexNotEnabled = errors.New("message index is not enabled for the topic")
+)
+
+const (
+	// the max length of the indexed value, the longer value will be ignored
+	MaxMsgIndexValueLen   = 512
+	msgIndexFlushInterval = time.Millisecond * 200
+	msgIndexCleanInterval = time.Minute * 10
+	// the pending index will be flushed at once while exceeded the count or
+	// the size, and the new index will be dropped while the pending exceeded
+	// the max size which means the flush is too slow.
+	maxMsgIndexPending         = 10000
+	flushMsgIndexPendingBytes  = 1024 * 1024 * 4
+	maxMsgIndexPendingBytes    = flushMsgIndexPendingBytes * 4
+	msgIndexEntryOverheadBytes = 32
+)
+
+func getMsgIndexDBName(topicName string, part int) string {
+	return GetTopicFullName(topicName, part) + ".msgindex.db"
+}
+
+type msgIndexEntry struct {
+	value  string
+	id     MessageID
+	offset BackendOffset
+}
+
+// MsgIndexResult is the message found by the index value, the channels
+// which have confirmed the message are also returned.
+type MsgIndexResult struct {
+	ID                MessageID     `json:"id"`
+	TraceID           uint64        `json:"trace_id"`
+	Partition         int           `json:"partition"`
+	Offset            BackendOffset `json:"offset"`
+	Timestamp         int64         `json:"timestamp"`
+	ConfirmedChannels []string      `json:"confirmed_channels"`
+}
+
+// topicMsgIndex indexes the value of the configured json ext header key to
+// the message offset in the local bolt db. The index is written in batch
+// asynchronously, so the newest messages may not be searched immediately.
+// Since the written data may be rolled back or cleaned, the searched message
+// should be verified by reading the topic data.
+type topicMsgIndex struct {
+	key      string
+	t        *Topic
+	db       *bolt.DB
+	lock     sync.Mutex
+	pending  []msgIndexEntry
+	flushC   chan struct{}
+	exitChan chan struct{}
+	wg       sync.WaitGroup
+
+	// the size of the pending index and the count of the dropped index
+	// since last flush
+	pendingBytes int
+	dropped      int
+}
+
+func newTopicMsgIndex(t *Topic, key string) (*topicMsgIndex, error) {
+	ro := &bolt.Options{
+		Timeout:  time.Second,
+		ReadOnly: false,
+	}
+	db, err := bolt.Open(path.Join(t.dataPath, getMsgIndexDBName(t.tname, t.partition)), 0644, ro)
+	if err != nil {
+		return nil, err
+	}
+	db.NoSync = true
+	err = db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(bucketMsgIndexMeta)
+		if err != nil {
+			return err
+		}
+		if string(meta.Get(msgIndexKeyName)) != key {
+			// the old index is useless since the key changed
+			for _, b := range [][]byte{bucketMsgIndex, bucketMsgIndexOffset} {
+				if tx.Bucket(b) != nil {
+					if err := tx.DeleteBucket(b); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		for _, b := range [][]byte{bucketMsgIndex, bucketMsgIndexOffset} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return meta.Put(msgIndexKeyName, []byte(key))
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	idx := &topicMsgIndex{
+		key:      key,
+		t:        t,
+		db:       db,
+		flushC:   make(chan struct{}, 1),
+		exitChan: make(chan struct{}),
+	}
+	idx.wg.Add(1)
+	go idx.loop()
+	return idx, nil
+}
+
+func encodeMsgIndexKey(value string, offset BackendOffset) []byte {
+	k := make([]byte, len(value)+1+8)
+	copy(k, value)
+	binary.BigEndian.PutUint64(k[len(value)+1:], uint64(offset))
+	return k
+}
+
+func encodeOffsetKey(offset BackendOffset) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(offset))
+	return k
+}
+
+// add the message to the pending index, should be called after the message
+// written to the topic.
+func (idx *topicMsgIndex) add(msg *Message, offset BackendOffset) {
+	if msg.ExtVer != ext.JSON_HEADER_EXT_VER {
+		return
+	}
+	v := gjson.GetBytes(msg.ExtBytes, idx.key)
+	if !v.Exists() {
+		return
+	}
+	value := v.String()
+	if value == "" || len(value) > MaxMsgIndexValueLen || bytes.IndexByte([]byte(value), 0) >= 0 {
+		return
+	}
+	entrySize := len(value) + msgIndexEntryOverheadBytes
+	idx.lock.Lock()
+	if idx.pendingBytes+entrySize > maxMsgIndexPendingBytes {
+		idx.dropped++
+		idx.lock.Unlock()
+		return
+	}
+	idx.pending = append(idx.pending, msgIndexEntry{value: value, id: msg.ID, offset: offset})
+	idx.pendingBytes += entrySize
+	needFlush := len(idx.pending) >= maxMsgIndexPending || idx.pendingBytes >= flushMsgIndexPendingBytes
+	idx.lock.Unlock()
+	if needFlush {
+		select {
+		case idx.flushC <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (idx *topicMsgIndex) flush() error {
+	idx.lock.Lock()
+	pending := idx.pending
+	dropped := idx.dropped
+	idx.pending = nil
+	idx.pendingBytes = 0
+	idx.dropped = 0
+	idx.lock.Unlock()
+	if dropped > 0 {
+		nsqLog.LogWarningf("topic %v dropped %v message index since too much pending", idx.t.GetFullName(), dropped)
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	return idx.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketMsgIndex)
+		ob := tx.Bucket(bucketMsgIndexOffset)
+		for _, e := range pending {
+			// the value should be valid until the tx committed
+			idBuf := make([]byte, 8)
+			binary.BigEndian.PutUint64(idBuf, uint64(e.id))
+			err := b.Put(encodeMsgIndexKey(e.value, e.offset), idBuf)
+			if err != nil {
+				return err
+			}
+			err = ob.Put(encodeOffsetKey(e.offset), []byte(e.value))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// remove the index of the messages cleaned from the topic
+func (idx *topicMsgIndex) cleanBefore(offset BackendOffset) (int, error) {
+	cnt := 0
+	err := idx.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketMsgIndex)
+		ob := tx.Bucket(bucketMsgIndexOffset)
+		c := ob.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			o := BackendOffset(binary.BigEndian.Uint64(k))
+			if o >= offset {
+				break
+			}
+			err := b.Delete(encodeMsgIndexKey(string(v), o))
+			if err != nil {
+				return err
+			}
+			err = c.Delete()
+			if err != nil {
+				return err
+			}
+			cnt++
+		}
+		return nil
+	})
+	return cnt, err
+}
+
+func (idx *topicMsgIndex) search(value string, limit int) ([]msgIndexEntry, error) {
+	var rets []msgIndexEntry
+	prefix := append([]byte(value), 0)
+	err := idx.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketMsgIndex).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			if len(k) != len(prefix)+8 || len(v) != 8 {
+				continue
+			}
+			rets = append(rets, msgIndexEntry{
+				value:  value,
+				offset: BackendOffset(binary.BigEndian.Uint64(k[len(prefix):])),
+				id:     MessageID(binary.BigEndian.Uint64(v)),
+			})
+			if limit > 0 && len(rets) >= limit {
+				break
+			}
+		}
+		return nil
+	})
+	return rets, err
+}
+
+func (idx *topicMsgIndex) loop() {
+	defer idx.wg.Done()
+	flushTicker := time.NewTicker(msgIndexFlushInterval)
+	defer flushTicker.Stop()
+	cleanTicker := time.NewTicker(msgIndexCleanInterval)
+	defer cleanTicker.Stop()
+	for {
+		select {
+		case <-idx.exitChan:
+			return
+		case <-idx.flushC:
+		case <-flushTicker.C:
+		case <-cleanTicker.C:
+			cnt, err := idx.cleanBefore(BackendOffset(idx.t.GetQueueReadStart()))
+			if err != nil {
+				nsqLog.LogWarningf("topic %v failed to clean message index: %v", idx.t.GetFullName(), err)
+			} else if cnt > 0 {
+				nsqLog.Logf("topic %v cleaned %v message index", idx.t.GetFullName(), cnt)
+			}
+		}
+		err := idx.flush()
+		if err != nil {
+			nsqLog.LogWarningf("topic %v failed to write message index: %v", idx.t.GetFullName(), err)
+		}
+	}
+}
+
+func (idx *topicMsgIndex) close(remove bool) {
+	close(idx.exitChan)
+	idx.wg.Wait()
+	if !remove {
+		idx.flush()
+	}
+	fileName := idx.db.Path()
+	idx.db.Sync()
+	idx.db.Close()
+	if remove {
+		os.Remove(fileName)
+	}
+}
+
+func (t *Topic) getMsgIndex() *topicMsgIndex {
+	idx, _ := t.msgIndex.Load().(*topicMsgIndex)
+	return idx
+}
+
+// change the index key should be protected by the topic lock
+func (t *Topic) setMsgIndexKeyNoLock(key string) {
+	old := t.getMsgIndex()
+	if old != nil && old.key == key {
+		return
+	}
+	if old != nil {
+		t.msgIndex.Store((*topicMsgIndex)(nil))
+		old.close(key == "")
+	}
+	if key == "" {
+		return
+	}
+	idx, err := newTopicMsgIndex(t, key)
+	if err != nil {
+		nsqLog.LogErrorf("topic %v failed to init message index by %v: %v", t.GetFullName(), key, err)
+		return
+	}
+	t.msgIndex.Store(idx)
+	nsqLog.Logf("topic %v message index enabled by key: %v", t.GetFullName(), key)
+}
+
+func (t *Topic) closeMsgIndex(remove bool) {
+	idx := t.getMsgIndex()
+	if idx != nil {
+		t.msgIndex.Store((*topicMsgIndex)(nil))
+		idx.close(remove)
+	} else if remove {
+		os.Remove(path.Join(t.dataPath, getMsgIndexDBName(t.tname, t.partition)))
+	}
+}
+
+// SearchMessagesByIndex searches the messages by the value of the indexed ext
+// header key, the newest indexed messages may be delayed for a while.
+func (t *Topic) SearchMessagesByIndex(value string, limit int) ([]MsgIndexResult, error) {
+	idx := t.getMsgIndex()
+	if idx == nil {
+		return nil, ErrMsgIndexNotEnabled
+	}
+	entries, err := idx.search(value, limit)
+	if err != nil {
+		return nil, err
+	}
+	rets := make([]MsgIndexResult, 0, len(entries))
+	if len(entries) == 0 {
+		return rets, nil
+	}
+	snap := t.GetDiskQueueSnapshot()
+	defer snap.Close()
+	channels := t.GetChannelMapCopy()
+	for _, e := range entries {
+		err := snap.SeekTo(e.offset)
+		if err != nil {
+			continue
+		}
+		data := snap.ReadOne()
+		if data.Err != nil {
+			continue
+		}
+		msg, err := decodeMessage(data.Data, t.IsExt())
+		// the message may be rolled back and rewritten
+		if err != nil || msg.ID != e.id {
+			continue
+		}
+		r := MsgIndexResult{
+			ID:                msg.ID,
+			TraceID:           msg.TraceID,
+			Partition:         t.GetTopicPart(),
+			Offset:            e.offset,
+			Timestamp:         msg.Timestamp,
+			ConfirmedChannels: make([]string, 0),
+		}
+		for name, ch := range channels {
+			if ch.isOffsetConfirmed(e.offset, data.MovedSize) {
+				r.ConfirmedChannels = append(r.ConfirmedChannels, name)
+			}
+		}
+		rets = append(rets, r)
+	}
+	return rets, nil
+}
+
+// check if the message at the offset is confirmed without tracing
+func (c *Channel) isOffsetConfirmed(offset BackendOffset, movedSize BackendOffset) bool {
+	if c.GetConfirmed().Offset() >= offset+movedSize {
+		return true
+	}
+	c.confirmMutex.Lock()
+	ok := c.confirmedMsgs.IsCompleteOverlap(&queueInterval{start: int64(offset),
+		end: int64(offset + movedSize)})
+	c.confirmMutex.Unlock()
+	return ok
+}
@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"github.com/absolute8511/glog"
+	"github.com/youzan/nsq/internal/ext"
 	"github.com/youzan/nsq/internal/test"
 )
 
@@ -669,3 +670,151 @@ func BenchmarkTopicToChannelPut(b *testing.B) {
 		topic.PutMessage(msg)
 	}
 }
+
+func TestTopicSearchMessagesByIndex(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopicWithExt("test_msg_index", 0)
+	channel := topic.GetChannel("ch")
+	topic.GetChannel("ch2")
+	_, err := topic.SearchMessagesByIndex("order1", 10)
+	test.Equal(t, ErrMsgIndexNotEnabled, err)
+
+	dyConf := topic.GetDynamicInfo()
+	dyConf.Ext = true
+	dyConf.IndexKey = "order_id"
+	topic.SetDynamicInfo(dyConf, nil)
+	for i := 0; i < 10; i++ {
+		header := `{"order_id":"order` + strconv.Itoa(i%2) + `"}`
+		msg := NewMessageWithExt(0, []byte(strconv.Itoa(i)), ext.JSON_HEADER_EXT_VER, []byte(header))
+		_, _, _, _, err := topic.PutMessage(msg)
+		test.Nil(t, err)
+	}
+	msg := NewMessageWithExt(0, []byte("noindex"), ext.JSON_HEADER_EXT_VER, []byte(`{"k":"v"}`))
+	topic.PutMessage(msg)
+	topic.ForceFlush()
+	topic.getMsgIndex().flush()
+
+	rets, err := topic.SearchMessagesByIndex("order1", 10)
+	test.Nil(t, err)
+	test.Equal(t, 5, len(rets))
+	for i := 1; i < len(rets); i++ {
+		test.Equal(t, true, rets[i].Offset > rets[i-1].Offset)
+	}
+	test.Equal(t, 0, len(rets[0].ConfirmedChannels))
+	rets, err = topic.SearchMessagesByIndex("order0", 2)
+	test.Nil(t, err)
+	test.Equal(t, 2, len(rets))
+	rets, err = topic.SearchMessagesByIndex("order", 10)
+	test.Nil(t, err)
+	test.Equal(t, 0, len(rets))
+
+	// the confirmed channels should be returned
+	for i := 0; i < 2; i++ {
+		m := <-channel.clientMsgChan
+		channel.ConfirmBackendQueue(m)
+	}
+	rets, err = topic.SearchMessagesByIndex("order1", 10)
+	test.Nil(t, err)
+	test.Equal(t, []string{"ch"}, rets[0].ConfirmedChannels)
+	test.Equal(t, 0, len(rets[1].ConfirmedChannels))
+
+	// the index should be reloaded after restart and removed after disabled
+	topic.closeMsgIndex(false)
+	topic.setMsgIndexKeyNoLock("order_id")
+	rets, err = topic.SearchMessagesByIndex("order1", 10)
+	test.Nil(t, err)
+	test.Equal(t, 5, len(rets))
+	dyConf.IndexKey = ""
+	topic.SetDynamicInfo(dyConf, nil)
+	_, err = os.Stat(path.Join(topic.dataPath, getMsgIndexDBName(topic.tname, topic.partition)))
+	test.Equal(t, true, os.IsNotExist(err))
+}
+
+func TestTopicDecodeRawMessages(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopicWithExt("test_decode_raw", 0)
+	topic.PutMessage(NewMessageWithExt(0, []byte("first"), ext.JSON_HEADER_EXT_VER, []byte(`{"k":"v"}`)))
+	msgs := make([]*Message, 0, 3)
+	for i := 0; i < 3; i++ {
+		header := `{"##producer_id":"p1","##producer_seq":"` + strconv.Itoa(i) + `"}`
+		msgs = append(msgs, NewMessageWithExt(0, []byte(strconv.Itoa(i)), ext.JSON_HEADER_EXT_VER, []byte(header)))
+	}
+	_, offset, size, _, _, err := topic.PutMessages(msgs)
+	test.Nil(t, err)
+	topic.ForceFlush()
+
+	snap := topic.GetDiskQueueSnapshot()
+	defer snap.Close()
+	err = snap.SeekTo(offset)
+	test.Nil(t, err)
+	rawData, err := snap.ReadRaw(size)
+	test.Nil(t, err)
+	decoded, err := DecodeRawMessages(rawData, true, offset)
+	test.Nil(t, err)
+	test.Equal(t, len(msgs), len(decoded))
+	for i, m := range decoded {
+		test.Equal(t, msgs[i].ID, m.ID)
+		test.Equal(t, msgs[i].Offset, m.Offset)
+		test.Equal(t, msgs[i].RawMoveSize, m.RawMoveSize)
+		test.Equal(t, msgs[i].Body, m.Body)
+		producerID, seq, ok := m.GetProducerSeq()
+		test.Equal(t, true, ok)
+		test.Equal(t, "p1", producerID)
+		test.Equal(t, uint64(i), seq)
+	}
+	_, err = DecodeRawMessages(rawData[:len(rawData)-1], true, offset)
+	test.NotNil(t, err)
+}
+
+func TestTopicMsgIndexOnReplicaRawData(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	leader := nsqd.GetTopicWithExt("test_msg_index_raw", 0)
+	replica := nsqd.GetTopicWithExt("test_msg_index_raw", 1)
+	dyConf := replica.GetDynamicInfo()
+	dyConf.Ext = true
+	dyConf.IndexKey = "order_id"
+	replica.SetDynamicInfo(dyConf, nil)
+
+	msgs := make([]*Message, 0, 4)
+	for i := 0; i < 4; i++ {
+		header := `{"order_id":"order` + strconv.Itoa(i%2) + `"}`
+		msgs = append(msgs, NewMessageWithExt(0, []byte(strconv.Itoa(i)), ext.JSON_HEADER_EXT_VER, []byte(header)))
+	}
+	_, offset, size, _, _, err := leader.PutMessages(msgs)
+	test.Nil(t, err)
+	leader.ForceFlush()
+	snap := leader.GetDiskQueueSnapshot()
+	defer snap.Close()
+	err = snap.SeekTo(offset)
+	test.Nil(t, err)
+	rawData, err := snap.ReadRaw(size)
+	test.Nil(t, err)
+
+	replica.Lock()
+	_, err = replica.PutRawDataOnReplica(rawData, offset, int64(size), int32(len(msgs)))
+	replica.Unlock()
+	test.Nil(t, err)
+	replica.ForceFlush()
+	replica.getMsgIndex().flush()
+
+	rets, err := replica.SearchMessagesByIndex("order1", 10)
+	test.Nil(t, err)
+	test.Equal(t, 2, len(rets))
+	test.Equal(t, msgs[1].ID, rets[0].ID)
+	test.Equal(t, msgs[3].Offset, rets[1].Offset)
+}
@@ -35,10 +35,30 @@ type TraceLogItemInfo struct {
 	Action    string `json:"action"`
 }
 
+// the http(s) or file url will use the otlp tracer, otherwise the flume tracer is used
 func SetRemoteMsgTracer(remote string) {
-	if remote != "" {
+	if remote == "" {
+		return
+	}
+	if IsOTLPTracerAddr(remote) {
+		tracer, err := NewOTLPMsgTracer(remote)
+		if err != nil {
+			nsqLog.LogErrorf("init otlp tracer %v failed: %v", remote, err)
+			return
+		}
+		nsqMsgTracer = tracer
+	} else {
 		nsqMsgTracer = NewRemoteMsgTracer(remote)
 	}
+	nsqMsgTracer.Start()
+}
+
+func StopMsgTracer() {
+	if s, ok := nsqMsgTracer.(interface {
+		Stop()
+	}); ok {
+		s.Stop()
+	}
 }
 
 // just print the trace log
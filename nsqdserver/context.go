@@ -17,6 +17,11 @@ const (
 	FailedOnNotWritable = consistence.ErrFailedOnNotWritable
 )
 
+var (
+	ErrTxInProgress       = errors.New("transaction message is being committed or rolled back")
+	ErrTxAlreadyCommitted = errors.New("transaction message has been committed")
+)
+
 type context struct {
 	clientIDSequence int64
 	nsqd             *nsqd.NSQD
@@ -25,6 +30,9 @@ type context struct {
 	httpAddr         *net.TCPAddr
 	tcpAddr          *net.TCPAddr
 	reverseProxyPort string
+	delayedPubMoving delayedMoveTracker
+	txEnding         delayedMoveTracker
+	deadLetterJobs   chan deadLetterJob
 }
 
 func (c *context) getOpts() *nsqd.Options {
@@ -42,6 +50,9 @@ func (c *context) nextClientID() int64 {
 func (c *context) swapOpts(other *nsqd.Options) {
 	c.nsqd.SwapOpts(other)
 	consistence.SetCoordLogLevel(other.LogLevel)
+	if c.nsqdCoord != nil {
+		c.nsqdCoord.SetCatchupRateLimit(other.CatchupRateLimit, other.TopicCatchupRateLimit)
+	}
 }
 
 func (c *context) triggerOptsNotification() {
@@ -174,6 +185,212 @@ func (c *context) PutMessage(topic *nsqd.Topic,
 	return c.nsqdCoord.PutMessageToCluster(topic, msg)
 }
 
+func (c *context) PutDelayedMessage(topic *nsqd.Topic,
+	body []byte, extContent ext.IExtContent, traceID uint64, delay time.Duration) (nsqd.MessageID, nsqd.BackendOffset, int32, nsqd.BackendQueueEnd, error) {
+	if topic.IsOrdered() {
+		return 0, 0, 0, nil, errors.New("ordered topic can not pub delayed message")
+	}
+	var msg *nsqd.Message
+	if !topic.IsExt() {
+		msg = nsqd.NewMessage(0, body)
+	} else {
+		msg = nsqd.NewMessageWithExt(0, body, extContent.ExtVersion(), extContent.GetBytes())
+	}
+	msg.TraceID = traceID
+	msg.DelayedType = nsqd.PubDelayed
+	msg.DelayedTs = time.Now().Add(delay).UnixNano()
+	return c.PutMessageObj(topic, msg)
+}
+
+func (c *context) PutDelayedMessages(topic *nsqd.Topic, msgs []*nsqd.Message, delay time.Duration) (nsqd.MessageID, nsqd.BackendOffset, int32, error) {
+	if topic.IsOrdered() {
+		return 0, 0, 0, errors.New("ordered topic can not pub delayed message")
+	}
+	// the delayed queue has no batch write, so we put one by one
+	firstID := nsqd.MessageID(0)
+	firstOffset := nsqd.BackendOffset(0)
+	totalSize := int32(0)
+	delayedTs := time.Now().Add(delay).UnixNano()
+	for i, msg := range msgs {
+		msg.DelayedType = nsqd.PubDelayed
+		msg.DelayedTs = delayedTs
+		id, offset, rawSize, _, err := c.PutMessageObj(topic, msg)
+		if err != nil {
+			return firstID, firstOffset, totalSize, err
+		}
+		if i == 0 {
+			firstID = id
+			firstOffset = offset
+		}
+		totalSize += rawSize
+	}
+	return firstID, firstOffset, totalSize, nil
+}
+
+func (c *context) ConfirmDelayedMessages(topic *nsqd.Topic, msgs []*nsqd.Message) error {
+	if c.nsqdCoord == nil {
+		dq := topic.GetDelayedQueue()
+		if dq == nil {
+			return nil
+		}
+		for _, msg := range msgs {
+			err := dq.ConfirmedMessage(msg)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return c.nsqdCoord.ConfirmDelayedMessagesToCluster(topic, msgs)
+}
+
+func newMessageFromDelayed(topic *nsqd.Topic, delayedMsg *nsqd.Message) *nsqd.Message {
+	var msg *nsqd.Message
+	if !topic.IsExt() {
+		msg = nsqd.NewMessage(0, delayedMsg.Body)
+	} else {
+		msg = nsqd.NewMessageWithExt(0, delayedMsg.Body, delayedMsg.ExtVer, delayedMsg.ExtBytes)
+	}
+	msg.TraceID = delayedMsg.TraceID
+	return msg
+}
+
+// put the prepared transaction message to the delayed queue, it will be invisible
+// to the consumers until committed. The producer will be checked back by the checkURL
+// if it is not committed or rolled back before the check timeout.
+func (c *context) PutTransactionMessage(topic *nsqd.Topic,
+	body []byte, extContent ext.IExtContent, traceID uint64, checkURL string) (nsqd.MessageID, nsqd.BackendOffset, int32, nsqd.BackendQueueEnd, error) {
+	if topic.IsOrdered() {
+		return 0, 0, 0, nil, errors.New("ordered topic can not pub transaction message")
+	}
+	var msg *nsqd.Message
+	if !topic.IsExt() {
+		msg = nsqd.NewMessage(0, body)
+	} else {
+		msg = nsqd.NewMessageWithExt(0, body, extContent.ExtVersion(), extContent.GetBytes())
+	}
+	msg.TraceID = traceID
+	msg.DelayedType = nsqd.TransactionDelayed
+	msg.DelayedTs = time.Now().Add(c.getOpts().TxCheckTimeout).UnixNano()
+	msg.DelayedData = []byte(checkURL)
+	return c.PutMessageObj(topic, msg)
+}
+
+func (c *context) getTransactionMessage(topic *nsqd.Topic, id nsqd.MessageID) (*nsqd.Message, error) {
+	dq := topic.GetDelayedQueue()
+	if dq == nil {
+		return nil, nsqd.ErrTxMessageNotFound
+	}
+	return dq.GetTransactionMessage(id)
+}
+
+// make the prepared transaction message visible to the consumers
+func (c *context) CommitTransactionMessage(topic *nsqd.Topic, id nsqd.MessageID) error {
+	return c.endTransactionMessage(topic, id, true)
+}
+
+// drop the prepared transaction message
+func (c *context) RollbackTransactionMessage(topic *nsqd.Topic, id nsqd.MessageID) error {
+	return c.endTransactionMessage(topic, id, false)
+}
+
+// commit or rollback the transaction message. The message id is claimed before
+// publishing, so the concurrent commit and rollback (including the check back)
+// on the same message will not publish it more than once.
+func (c *context) endTransactionMessage(topic *nsqd.Topic, id nsqd.MessageID, commit bool) error {
+	fullName := topic.GetFullName()
+	published, ok := c.txEnding.claim(fullName, id)
+	if !ok {
+		return ErrTxInProgress
+	}
+	// get after claimed, so we will not see the message ended by others
+	txMsg, err := c.getTransactionMessage(topic, id)
+	if err != nil {
+		c.txEnding.release(fullName, id, err == nsqd.ErrTxMessageNotFound)
+		return err
+	}
+	if commit && !published {
+		_, _, _, err = c.PutMessages(topic, []*nsqd.Message{newMessageFromDelayed(topic, txMsg)})
+		if err != nil {
+			c.txEnding.release(fullName, id, false)
+			return err
+		}
+		c.txEnding.markPublished(fullName, id)
+		published = true
+	}
+	err = c.ConfirmDelayedMessages(topic, []*nsqd.Message{txMsg})
+	c.txEnding.release(fullName, id, err == nil)
+	if err != nil {
+		return err
+	}
+	if !commit && published {
+		return ErrTxAlreadyCommitted
+	}
+	return nil
+}
+
+// move the delayed pub messages which are due to the topic queue,
+// return the number of messages moved. The messages published but failed to
+// confirm will not be published again in the next move.
+func (c *context) moveDueDelayedPubMessages(topic *nsqd.Topic, now int64, results []nsqd.Message) (int, error) {
+	dq := topic.GetDelayedQueue()
+	if dq == nil {
+		return 0, nil
+	}
+	cnt, err := dq.PeekRecentDelayedPub(now, results)
+	if err != nil {
+		return 0, err
+	}
+	fullName := topic.GetFullName()
+	peeked := make(map[nsqd.MessageID]bool, cnt)
+	for i := 0; i < cnt; i++ {
+		peeked[results[i].ID] = true
+	}
+	c.delayedPubMoving.prune(fullName, peeked)
+	if cnt == 0 {
+		return 0, nil
+	}
+	delayedMsgs := make([]*nsqd.Message, 0, cnt)
+	msgs := make([]*nsqd.Message, 0, cnt)
+	toPublish := make([]*nsqd.Message, 0, cnt)
+	for i := 0; i < cnt; i++ {
+		delayedMsg := &results[i]
+		published, ok := c.delayedPubMoving.claim(fullName, delayedMsg.ID)
+		if !ok {
+			continue
+		}
+		delayedMsgs = append(delayedMsgs, delayedMsg)
+		if !published {
+			msgs = append(msgs, newMessageFromDelayed(topic, delayedMsg))
+			toPublish = append(toPublish, delayedMsg)
+		}
+	}
+	defer func() {
+		for _, m := range delayedMsgs {
+			c.delayedPubMoving.release(fullName, m.ID, err == nil)
+		}
+	}()
+	if len(msgs) > 0 {
+		_, _, _, err = c.PutMessages(topic, msgs)
+		if err != nil {
+			nsqd.NsqLogger().LogWarningf("topic %v put due delayed messages failed: %v", fullName, err)
+			return 0, err
+		}
+		for _, m := range toPublish {
+			c.delayedPubMoving.markPublished(fullName, m.ID)
+		}
+	}
+	if len(delayedMsgs) == 0 {
+		return 0, nil
+	}
+	err = c.ConfirmDelayedMessages(topic, delayedMsgs)
+	if err != nil {
+		nsqd.NsqLogger().LogWarningf("topic %v confirm due delayed messages failed: %v", fullName, err)
+		return 0, err
+	}
+	return cnt, nil
+}
+
 func (c *context) PutMessages(topic *nsqd.Topic, msgs []*nsqd.Message) (nsqd.MessageID, nsqd.BackendOffset, int32, error) {
 	if c.nsqdCoord == nil {
 		id, offset, rawSize, _, _, err := topic.PutMessages(msgs)
@@ -242,6 +459,34 @@ func (c *context) UpdateChannelState(ch *nsqd.Channel, paused int, skipped int)
 	return nil
 }
 
+func (c *context) UpdateChannelExtFilter(ch *nsqd.Channel, filter nsqd.ExtFilterData) error {
+	var err error
+	if c.nsqdCoord == nil {
+		err = ch.SetExtFilter(filter)
+	} else {
+		err = c.nsqdCoord.UpdateChannelExtFilterToCluster(ch, filter)
+	}
+	if err != nil {
+		nsqd.NsqLogger().Logf("failed to update channel(%v) ext filter: %v, topic %v, err: %v", ch.GetName(), filter, ch.GetTopicName(), err)
+		return err
+	}
+	return nil
+}
+
+func (c *context) UpdateChannelPriorityLanes(ch *nsqd.Channel, lanes int) error {
+	var err error
+	if c.nsqdCoord == nil {
+		err = ch.SetPriorityLanes(lanes)
+	} else {
+		err = c.nsqdCoord.UpdateChannelPriorityLanesToCluster(ch, lanes)
+	}
+	if err != nil {
+		nsqd.NsqLogger().Logf("failed to update channel(%v) priority lanes: %v, topic %v, err: %v", ch.GetName(), lanes, ch.GetTopicName(), err)
+		return err
+	}
+	return nil
+}
+
 func (c *context) EmptyChannelDelayedQueue(ch *nsqd.Channel) error {
 	if c.nsqdCoord == nil {
 		if ch.GetDelayedQueue() != nil {
@@ -304,29 +549,38 @@ func (c *context) SetChannelOffset(ch *nsqd.Channel, startFrom *ConsumeOffset, f
 		return 0, 0, err
 	}
 	nsqd.NsqLogger().Logf("%v searched log : %v, offset: %v:%v", startFrom, l, queueOffset, cnt)
+	err = c.setChannelConsumeOffset(ch, queueOffset, cnt, force)
+	if err != nil {
+		return 0, 0, err
+	}
+	return queueOffset, cnt, nil
+}
+
+func (c *context) setChannelConsumeOffset(ch *nsqd.Channel, queueOffset int64, cnt int64, force bool) error {
+	var err error
 	if c.nsqdCoord == nil {
 		err = ch.SetConsumeOffset(nsqd.BackendOffset(queueOffset), cnt, force)
 		if err != nil {
 			if err != nsqd.ErrSetConsumeOffsetNotFirstClient {
-				nsqd.NsqLogger().Logf("failed to set the consume offset: %v, err:%v", startFrom, err)
-				return 0, 0, err
+				nsqd.NsqLogger().Logf("failed to set the consume offset: %v:%v, err:%v", queueOffset, cnt, err)
+				return err
 			}
-			nsqd.NsqLogger().Logf("the consume offset: %v can only be set by the first client", startFrom)
+			nsqd.NsqLogger().Logf("the consume offset: %v:%v can only be set by the first client", queueOffset, cnt)
 		}
 	} else {
 		err = c.nsqdCoord.SetChannelConsumeOffsetToCluster(ch, queueOffset, cnt, force)
 		if err != nil {
 			if coordErr, ok := err.(*consistence.CommonCoordErr); ok {
 				if coordErr.IsEqual(consistence.ErrLocalSetChannelOffsetNotFirstClient) {
-					nsqd.NsqLogger().Logf("the consume offset: %v can only be set by the first client", startFrom)
-					return queueOffset, cnt, nil
+					nsqd.NsqLogger().Logf("the consume offset: %v:%v can only be set by the first client", queueOffset, cnt)
+					return nil
 				}
 			}
-			nsqd.NsqLogger().Logf("failed to set the consume offset: %v (%v:%v), err: %v ", startFrom, queueOffset, cnt, err)
-			return 0, 0, err
+			nsqd.NsqLogger().Logf("failed to set the consume offset: %v:%v, err: %v ", queueOffset, cnt, err)
+			return err
 		}
 	}
-	return queueOffset, cnt, nil
+	return nil
 }
 
 func (c *context) internalPubLoop(topic *nsqd.Topic) {
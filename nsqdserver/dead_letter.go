@@ -0,0 +1,319 @@
+package nsqdserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/youzan/nsq/consistence"
+	"github.com/youzan/nsq/internal/ext"
+	"github.com/youzan/nsq/internal/protocol"
+	"github.com/youzan/nsq/nsqd"
+)
+
+var (
+	errDeadLetterTopicNotExt = errors.New("dead letter topic should be ext topic")
+	errDeadLetterOrdered     = errors.New("ordered topic can not use dead letter")
+)
+
+const (
+	DeadLetterReasonTimeout = "timeout"
+	DeadLetterReasonRequeue = "requeued by client"
+
+	defaultDLQReplayCount = 1000
+
+	deadLetterQueueSize   = 1000
+	deadLetterMoveWorkers = 4
+	// the delay before delivering again while failed to move the message to the dead letter topic
+	deadLetterRetryDelay = time.Second * 10
+)
+
+type deadLetterJob struct {
+	ch     *nsqd.Channel
+	msg    *nsqd.Message
+	reason string
+}
+
+func (c *context) UpdateChannelDeadLetter(ch *nsqd.Channel, conf nsqd.DeadLetterConf) error {
+	if c.nsqdCoord == nil {
+		ch.SetDeadLetterConf(conf)
+		return nil
+	}
+	err := c.nsqdCoord.UpdateChannelDeadLetterToCluster(ch, conf)
+	if err != nil {
+		nsqd.NsqLogger().Logf("failed to update channel(%v) dead letter: %v, topic %v, err: %v",
+			ch.GetName(), conf, ch.GetTopicName(), err)
+		return err
+	}
+	return nil
+}
+
+// the dead letter topic partition should be the same as the channel topic partition
+// and the leader should be on this node.
+func (c *context) getDeadLetterTopic(ch *nsqd.Channel) (*nsqd.Topic, error) {
+	return c.getDeadLetterTopicPartition(ch.GetDeadLetterTopic(), ch.GetTopicPart())
+}
+
+func (c *context) getDeadLetterTopicPartition(name string, partition int) (*nsqd.Topic, error) {
+	topic, err := c.getExistingTopic(name, partition)
+	if err != nil {
+		return nil, err
+	}
+	if !topic.IsExt() {
+		return nil, errDeadLetterTopicNotExt
+	}
+	if !c.checkForMasterWrite(name, partition) {
+		return nil, consistence.ErrNotTopicLeader.ToErrorType()
+	}
+	return topic, nil
+}
+
+// the channel in the dead letter topic used as the replay cursor. The dead letter topic
+// may be shared by the channels with the same name in different topics, so the cursor
+// is named by both the topic and the channel (the partition is the same as the dead letter
+// topic). The hash is used if the name is too long or ephemeral.
+func getDeadLetterCursorName(topicName string, channelName string) string {
+	name := topicName + "." + channelName
+	if protocol.IsValidChannelName(name) && !protocol.IsEphemeral(name) {
+		return name
+	}
+	h := fnv.New64a()
+	h.Write([]byte(topicName))
+	h.Write([]byte{0})
+	h.Write([]byte(channelName))
+	return fmt.Sprintf("dlq-%016x", h.Sum64())
+}
+
+func getMessageJsonHeader(msg *nsqd.Message) (map[string]interface{}, error) {
+	header := make(map[string]interface{})
+	if msg.ExtVer != ext.JSON_HEADER_EXT_VER || len(msg.ExtBytes) == 0 {
+		return header, nil
+	}
+	err := json.Unmarshal(msg.ExtBytes, &header)
+	return header, err
+}
+
+// queue the in flight message to be moved to the dead letter topic, so the cluster
+// write will not block the delivery to the client. Return false if the dead letter
+// topic is not ready or too many messages are waiting, and the message should be
+// delivered as normal.
+func (c *context) moveToDeadLetterAsync(ch *nsqd.Channel, msg *nsqd.Message, reason string) bool {
+	if _, err := c.getDeadLetterTopic(ch); err != nil {
+		ch.UpdateDeadLetterStats(false)
+		nsqd.NsqLogger().Logf("channel %v-%v message %v dead letter topic %v not ready: %v, deliver as normal",
+			ch.GetTopicName(), ch.GetName(), msg.ID, ch.GetDeadLetterTopic(), err)
+		return false
+	}
+	select {
+	case c.deadLetterJobs <- deadLetterJob{ch: ch, msg: msg.GetCopy(), reason: reason}:
+		return true
+	default:
+		ch.UpdateDeadLetterStats(false)
+		nsqd.NsqLogger().Logf("channel %v-%v message %v too much waiting for dead letter, deliver as normal",
+			ch.GetTopicName(), ch.GetName(), msg.ID)
+		return false
+	}
+}
+
+// move the message to the dead letter topic, the message will be requeued
+// with a delay if failed.
+func (c *context) handleDeadLetterJob(job deadLetterJob) {
+	err := c.MoveToDeadLetter(job.ch, job.msg, job.reason)
+	if err == nil {
+		return
+	}
+	nsqd.NsqLogger().Logf("channel %v-%v move message %v to dead letter failed: %v, fallback to requeue",
+		job.ch.GetTopicName(), job.ch.GetName(), job.msg.ID, err)
+	clientID := job.msg.GetClientID()
+	err = job.ch.RequeueMessage(clientID, "", job.msg.ID, deadLetterRetryDelay, false)
+	if err != nil {
+		err = job.ch.RequeueMessage(clientID, "", job.msg.ID, 0, true)
+	}
+	if err != nil {
+		// the message will be delivered again after the in flight timeout
+		nsqd.NsqLogger().Logf("channel %v-%v requeue message %v failed: %v",
+			job.ch.GetTopicName(), job.ch.GetName(), job.msg.ID, err)
+	}
+}
+
+// move the in flight message to the dead letter topic with the original ext header,
+// attempts and the reason, and finish it in the channel.
+func (c *context) MoveToDeadLetter(ch *nsqd.Channel, msg *nsqd.Message, reason string) error {
+	err := c.moveToDeadLetter(ch, msg, reason)
+	ch.UpdateDeadLetterStats(err == nil)
+	return err
+}
+
+func (c *context) moveToDeadLetter(ch *nsqd.Channel, msg *nsqd.Message, reason string) error {
+	topic, err := c.getExistingTopic(ch.GetTopicName(), ch.GetTopicPart())
+	if err != nil {
+		return err
+	}
+	if topic.IsOrdered() {
+		return errDeadLetterOrdered
+	}
+	if !c.checkForMasterWrite(topic.GetTopicName(), topic.GetTopicPart()) {
+		return consistence.ErrNotTopicLeader.ToErrorType()
+	}
+	dlqTopic, err := c.getDeadLetterTopic(ch)
+	if err != nil {
+		return err
+	}
+	header, err := getMessageJsonHeader(msg)
+	if err != nil {
+		return err
+	}
+	header[ext.DLQ_ORIG_TOPIC_KEY] = topic.GetTopicName()
+	header[ext.DLQ_ORIG_PARTITION_KEY] = strconv.Itoa(topic.GetTopicPart())
+	header[ext.DLQ_ORIG_CHANNEL_KEY] = ch.GetName()
+	header[ext.DLQ_ORIG_ID_KEY] = strconv.FormatUint(uint64(msg.ID), 10)
+	header[ext.DLQ_ATTEMPTS_KEY] = strconv.Itoa(int(msg.Attempts))
+	header[ext.DLQ_REASON_KEY] = reason
+	headerBytes, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	dlqMsg := nsqd.NewMessageWithExt(0, msg.Body, ext.JSON_HEADER_EXT_VER, headerBytes)
+	dlqMsg.TraceID = msg.TraceID
+
+	// the replay cursor should be created before the dead letter is written.
+	dlqTopic.GetChannel(getDeadLetterCursorName(topic.GetTopicName(), ch.GetName()))
+	_, _, _, _, err = c.PutMessageObj(dlqTopic, dlqMsg)
+	if err != nil {
+		nsqd.NsqLogger().LogWarningf("channel %v put message %v to dead letter topic %v failed: %v",
+			ch.GetName(), msg.ID, dlqTopic.GetFullName(), err)
+		return err
+	}
+	nsqd.NsqLogger().Logf("channel %v-%v message %v moved to dead letter topic %v, attempts %v, reason: %v",
+		topic.GetFullName(), ch.GetName(), msg.ID, dlqTopic.GetFullName(), msg.Attempts, reason)
+	return c.FinishMessage(ch, msg.GetClientID(), "", msg.ID)
+}
+
+// replay the messages in the dead letter topic back to the channel as the
+// channel delayed messages, only this channel will consume them again.
+func (c *context) ReplayDeadLetter(ch *nsqd.Channel, maxCnt int) (int, error) {
+	topic, err := c.getExistingTopic(ch.GetTopicName(), ch.GetTopicPart())
+	if err != nil {
+		return 0, err
+	}
+	if topic.IsOrdered() {
+		return 0, errDeadLetterOrdered
+	}
+	if !c.checkForMasterWrite(topic.GetTopicName(), topic.GetTopicPart()) {
+		return 0, consistence.ErrNotTopicLeader.ToErrorType()
+	}
+	dlqTopic, err := c.getDeadLetterTopic(ch)
+	if err != nil {
+		return 0, err
+	}
+	cursor, err := dlqTopic.GetExistingChannel(getDeadLetterCursorName(topic.GetTopicName(), ch.GetName()))
+	if err != nil {
+		// no any dead letter
+		return 0, nil
+	}
+	confirmed := cursor.GetConfirmed()
+	snap := dlqTopic.GetDiskQueueSnapshot()
+	defer snap.Close()
+	err = snap.SeekTo(confirmed.Offset())
+	if err != nil {
+		return 0, err
+	}
+	offset := int64(confirmed.Offset())
+	cnt := confirmed.TotalMsgCnt()
+	replayed := 0
+	partStr := strconv.Itoa(topic.GetTopicPart())
+	for i := 0; i < maxCnt; i++ {
+		ret := snap.ReadOne()
+		if ret.Err != nil {
+			if ret.Err != io.EOF {
+				err = ret.Err
+			}
+			break
+		}
+		var dlqMsg *nsqd.Message
+		dlqMsg, err = nsqd.DecodeMessage(ret.Data, dlqTopic.IsExt())
+		if err != nil {
+			break
+		}
+		var header map[string]interface{}
+		header, err = getMessageJsonHeader(dlqMsg)
+		if err != nil {
+			break
+		}
+		if header[ext.DLQ_ORIG_TOPIC_KEY] == topic.GetTopicName() &&
+			header[ext.DLQ_ORIG_PARTITION_KEY] == partStr &&
+			header[ext.DLQ_ORIG_CHANNEL_KEY] == ch.GetName() {
+			err = c.replayDeadLetterMessage(topic, ch, dlqMsg, header)
+			if err != nil {
+				break
+			}
+			replayed++
+		}
+		offset = int64(ret.Offset + ret.MovedSize)
+		cnt++
+	}
+	if offset != int64(confirmed.Offset()) {
+		setErr := c.setChannelConsumeOffset(cursor, offset, cnt, true)
+		if setErr != nil && err == nil {
+			err = setErr
+		}
+	}
+	nsqd.NsqLogger().Logf("channel %v-%v replayed %v messages from dead letter topic %v, cursor %v:%v, err: %v",
+		topic.GetFullName(), ch.GetName(), replayed, dlqTopic.GetFullName(), offset, cnt, err)
+	return replayed, err
+}
+
+func (c *context) replayDeadLetterMessage(topic *nsqd.Topic, ch *nsqd.Channel, dlqMsg *nsqd.Message,
+	header map[string]interface{}) error {
+	origIDStr, _ := header[ext.DLQ_ORIG_ID_KEY].(string)
+	origID, err := strconv.ParseUint(origIDStr, 10, 64)
+	if err != nil {
+		return err
+	}
+	for k := range header {
+		if strings.HasPrefix(k, ext.DLQ_KEY_PREFIX) {
+			delete(header, k)
+		}
+	}
+	var msg *nsqd.Message
+	if topic.IsExt() && len(header) > 0 {
+		headerBytes, err := json.Marshal(header)
+		if err != nil {
+			return err
+		}
+		msg = nsqd.NewMessageWithExt(0, dlqMsg.Body, ext.JSON_HEADER_EXT_VER, headerBytes)
+	} else if topic.IsExt() {
+		msg = nsqd.NewMessageWithExt(0, dlqMsg.Body, ext.NO_EXT_VER, nil)
+	} else {
+		msg = nsqd.NewMessage(0, dlqMsg.Body)
+	}
+	msg.TraceID = dlqMsg.TraceID
+	msg.DelayedType = nsqd.ChannelDelayed
+	msg.DelayedTs = time.Now().UnixNano()
+	msg.DelayedOrigID = nsqd.MessageID(origID)
+	msg.DelayedChannel = ch.GetName()
+	_, _, _, _, err = c.PutMessageObj(topic, msg)
+	return err
+}
+
+// drop all the messages in the dead letter topic for the channel
+func (c *context) PurgeDeadLetter(ch *nsqd.Channel) error {
+	dlqTopic, err := c.getDeadLetterTopic(ch)
+	if err != nil {
+		return err
+	}
+	cursor, err := dlqTopic.GetExistingChannel(getDeadLetterCursorName(ch.GetTopicName(), ch.GetName()))
+	if err != nil {
+		return nil
+	}
+	var startFrom ConsumeOffset
+	startFrom.OffsetType = offsetSpecialType
+	startFrom.OffsetValue = -1
+	_, _, err = c.SetChannelOffset(cursor, &startFrom, true)
+	return err
+}
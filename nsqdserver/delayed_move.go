@@ -0,0 +1,99 @@
+package nsqdserver
+
+import (
+	"sync"
+
+	"github.com/youzan/nsq/nsqd"
+)
+
+type delayedMoveState struct {
+	claimed bool
+	// published to the topic queue but not confirmed in the delayed queue yet
+	published bool
+}
+
+// delayedMoveTracker tracks the delayed messages being moved from the delayed queue
+// to the topic queue. The message published but failed to confirm is kept, so
+// the next move for it will only retry the confirm instead of publishing again.
+// The state is kept in memory, so it will not survive the restart or leader change.
+type delayedMoveTracker struct {
+	sync.Mutex
+	// topic full name -> delayed message id -> state
+	msgs map[string]map[nsqd.MessageID]*delayedMoveState
+}
+
+// claim the delayed message before moving it, return false if the message
+// is being moved by others. published will be true if the message has been
+// published to the topic before.
+func (t *delayedMoveTracker) claim(topic string, id nsqd.MessageID) (published bool, ok bool) {
+	t.Lock()
+	defer t.Unlock()
+	if t.msgs == nil {
+		t.msgs = make(map[string]map[nsqd.MessageID]*delayedMoveState)
+	}
+	topicMsgs, ok := t.msgs[topic]
+	if !ok {
+		topicMsgs = make(map[nsqd.MessageID]*delayedMoveState)
+		t.msgs[topic] = topicMsgs
+	}
+	st, ok := topicMsgs[id]
+	if !ok {
+		st = &delayedMoveState{}
+		topicMsgs[id] = st
+	}
+	if st.claimed {
+		return st.published, false
+	}
+	st.claimed = true
+	return st.published, true
+}
+
+func (t *delayedMoveTracker) markPublished(topic string, id nsqd.MessageID) {
+	t.Lock()
+	defer t.Unlock()
+	if st, ok := t.msgs[topic][id]; ok {
+		st.published = true
+	}
+}
+
+// release the claimed message, the state will be removed if the message is
+// confirmed in the delayed queue or not published yet.
+func (t *delayedMoveTracker) release(topic string, id nsqd.MessageID, confirmed bool) {
+	t.Lock()
+	defer t.Unlock()
+	topicMsgs, ok := t.msgs[topic]
+	if !ok {
+		return
+	}
+	st, ok := topicMsgs[id]
+	if !ok {
+		return
+	}
+	if confirmed || !st.published {
+		delete(topicMsgs, id)
+		if len(topicMsgs) == 0 {
+			delete(t.msgs, topic)
+		}
+		return
+	}
+	st.claimed = false
+}
+
+// remove the states not claimed and not in the given messages, which means
+// they have been confirmed by others (such as the previous leader).
+func (t *delayedMoveTracker) prune(topic string, ids map[nsqd.MessageID]bool) {
+	t.Lock()
+	defer t.Unlock()
+	topicMsgs, ok := t.msgs[topic]
+	if !ok {
+		return
+	}
+	for id, st := range topicMsgs {
+		if !st.claimed && !ids[id] {
+			delete(topicMsgs, id)
+		}
+	}
+	if len(topicMsgs) == 0 {
+		delete(t.msgs, topic)
+	}
+}
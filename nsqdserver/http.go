@@ -24,6 +24,7 @@ import (
 	"github.com/youzan/nsq/internal/ext"
 	"github.com/youzan/nsq/internal/http_api"
 	"github.com/youzan/nsq/internal/levellogger"
+	"github.com/youzan/nsq/internal/prom"
 	"github.com/youzan/nsq/internal/protocol"
 	"github.com/youzan/nsq/internal/version"
 	"github.com/youzan/nsq/nsqd"
@@ -62,10 +63,14 @@ func newHTTPServer(ctx *context, tlsEnabled bool, tlsRequired bool) *httpServer
 	router.Handle("POST", "/pub_ext", http_api.Decorate(s.doPUBExt, http_api.NegotiateVersion))
 	router.Handle("POST", "/pubtrace", http_api.Decorate(s.doPUBTrace, http_api.V1))
 	router.Handle("POST", "/mpub", http_api.Decorate(s.doMPUB, http_api.NegotiateVersion))
+	router.Handle("POST", "/dpub", http_api.Decorate(s.doDPUB, http_api.NegotiateVersion))
 	router.Handle("GET", "/stats", http_api.Decorate(s.doStats, log, http_api.NegotiateVersion))
+	router.Handle("GET", "/metrics", http_api.Decorate(s.doMetrics, http_api.PlainText))
 	router.Handle("GET", "/coordinator/stats", http_api.Decorate(s.doCoordStats, log, http_api.V1))
 	router.Handle("GET", "/message/stats", http_api.Decorate(s.doMessageStats, log, http_api.V1))
+	router.Handle("GET", "/channel/lag", http_api.Decorate(s.doChannelLag, log, http_api.V1))
 	router.Handle("GET", "/message/get", http_api.Decorate(s.doMessageGet, log, http_api.V1))
+	router.Handle("GET", "/message/search", http_api.Decorate(s.doMessageSearch, log, http_api.V1))
 	router.Handle("POST", "/message/finish", http_api.Decorate(s.doMessageFinish, log, http_api.V1))
 	router.Handle("GET", "/message/historystats", http_api.Decorate(s.doMessageHistoryStats, log, http_api.V1))
 	router.Handle("POST", "/message/trace/enable", http_api.Decorate(s.enableMessageTrace, log, http_api.V1))
@@ -81,6 +86,12 @@ func newHTTPServer(ctx *context, tlsEnabled bool, tlsRequired bool) *httpServer
 	router.Handle("POST", "/channel/emptydelayed", http_api.Decorate(s.doEmptyChannelDelayed, log, http_api.V1))
 	router.Handle("POST", "/channel/setoffset", http_api.Decorate(s.doSetChannelOffset, log, http_api.V1))
 	router.Handle("POST", "/channel/setorder", http_api.Decorate(s.doSetChannelOrder, log, http_api.V1))
+	router.Handle("POST", "/channel/setfilter", http_api.Decorate(s.doSetChannelFilter, log, http_api.V1))
+	router.Handle("POST", "/channel/dlq/config", http_api.Decorate(s.doSetChannelDeadLetter, log, http_api.V1))
+	router.Handle("POST", "/channel/dlq/replay", http_api.Decorate(s.doReplayChannelDLQ, log, http_api.V1))
+	router.Handle("POST", "/channel/dlq/purge", http_api.Decorate(s.doPurgeChannelDLQ, log, http_api.V1))
+	router.Handle("POST", "/channel/redeliver", http_api.Decorate(s.doRedeliverChannelMessage, log, http_api.V1))
+	router.Handle("POST", "/channel/priority/config", http_api.Decorate(s.doSetChannelPriorityLanes, log, http_api.V1))
 	router.Handle("GET", "/config/:opt", http_api.Decorate(s.doConfig, log, http_api.V1))
 	router.Handle("PUT", "/config/:opt", http_api.Decorate(s.doConfig, log, http_api.V1))
 	router.Handle("PUT", "/delayqueue/enable", http_api.Decorate(s.doEnableDelayedQueue, log, http_api.V1))
@@ -251,17 +262,34 @@ func (s *httpServer) doGreedyCleanTopic(w http.ResponseWriter, req *http.Request
 }
 
 func (s *httpServer) doPUBTrace(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
-	return s.internalPUB(w, req, ps, true, false)
+	return s.internalPUB(w, req, ps, true, false, 0)
 }
 func (s *httpServer) doPUB(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
-	return s.internalPUB(w, req, ps, false, false)
+	return s.internalPUB(w, req, ps, false, false, 0)
 }
 
 func (s *httpServer) doPUBExt(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
-	return s.internalPUB(w, req, ps, false, true)
+	return s.internalPUB(w, req, ps, false, true, 0)
 }
 
-func (s *httpServer) internalPUB(w http.ResponseWriter, req *http.Request, ps httprouter.Params, enableTrace bool, pubExt bool) (interface{}, error) {
+func (s *httpServer) doDPUB(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	delayStr := req.URL.Query().Get("delay_ms")
+	delayMs, err := strconv.ParseInt(delayStr, 10, 64)
+	if err != nil {
+		nsqd.NsqLogger().Logf("delay invalid %v, %v", delayStr, err)
+		return nil, http_api.Err{400, "INVALID_DELAY"}
+	}
+	delay := time.Duration(delayMs) * time.Millisecond
+	if delay <= 0 || delay > s.ctx.getOpts().MaxPubDelay {
+		return nil, http_api.Err{400, "INVALID_DELAY"}
+	}
+	// the optional json header is passed the same as pub_ext
+	pubExt := req.URL.Query().Get("ext") != ""
+	return s.internalPUB(w, req, ps, false, pubExt, delay)
+}
+
+func (s *httpServer) internalPUB(w http.ResponseWriter, req *http.Request, ps httprouter.Params, enableTrace bool, pubExt bool,
+	delay time.Duration) (interface{}, error) {
 	startPub := time.Now().UnixNano()
 	// do not support chunked for http pub, use tcp pub instead.
 	if req.ContentLength > s.ctx.getOpts().MaxMsgSize {
@@ -392,7 +420,7 @@ func (s *httpServer) internalPUB(w http.ResponseWriter, req *http.Request, ps ht
 				return nil, http_api.Err{400, ext.E_EXT_NOT_SUPPORT}
 			}
 		}
-		if needTraceRsp || atomic.LoadInt32(&topic.EnableTrace) == 1 {
+		if needTraceRsp || atomic.LoadInt32(&topic.EnableTrace) == 1 || delay > 0 {
 			asyncAction = false
 		}
 
@@ -401,6 +429,8 @@ func (s *httpServer) internalPUB(w http.ResponseWriter, req *http.Request, ps ht
 		rawSize := int32(0)
 		if asyncAction {
 			err = internalPubAsync(nil, b, topic, extContent)
+		} else if delay > 0 {
+			id, offset, rawSize, _, err = s.ctx.PutDelayedMessage(topic, body, extContent, traceID, delay)
 		} else {
 			id, offset, rawSize, _, err = s.ctx.PutMessage(topic, body, extContent, traceID)
 		}
@@ -645,6 +675,220 @@ func (s *httpServer) doSetChannelOrder(w http.ResponseWriter, req *http.Request,
 	return nil, nil
 }
 
+// the body is the json of the ext filter data, the empty body or filter type 0 will clear the filter.
+func (s *httpServer) doSetChannelFilter(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	_, topic, channelName, err := s.getExistingTopicChannelFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+	if !topic.IsExt() {
+		return nil, http_api.Err{400, "TOPIC_NOT_EXT"}
+	}
+	readMax := s.ctx.getOpts().MaxMsgSize + 1
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, readMax))
+	if err != nil {
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+	if int64(len(body)) == readMax {
+		return nil, http_api.Err{413, "INVALID_VALUE"}
+	}
+	var filter nsqd.ExtFilterData
+	if len(body) > 0 {
+		err = json.Unmarshal(body, &filter)
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_FILTER"}
+		}
+	}
+	if filter.Type != 0 {
+		// validate before sync to the replicas
+		_, err = nsqd.NewExtFilter(filter)
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_FILTER: " + err.Error()}
+		}
+	}
+	err = s.ctx.UpdateChannelExtFilter(channel, filter)
+	if err != nil {
+		nsqd.NsqLogger().LogErrorf("failure in %s - %s", req.URL.Path, err)
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+	topic.SaveChannelMeta()
+	return nil, nil
+}
+
+func (s *httpServer) doSetChannelPriorityLanes(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicChannelFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+	if !topic.IsExt() {
+		return nil, http_api.Err{400, "TOPIC_NOT_EXT"}
+	}
+	if topic.IsOrdered() {
+		return nil, http_api.Err{400, "ORDERED_TOPIC_NOT_SUPPORTED"}
+	}
+	lanes, err := strconv.Atoi(reqParams.Get("lanes"))
+	if err != nil || lanes < 0 || lanes > nsqd.MaxPriorityLanes {
+		return nil, http_api.Err{400, "INVALID_PRIORITY_LANES"}
+	}
+	err = s.ctx.UpdateChannelPriorityLanes(channel, lanes)
+	if err != nil {
+		nsqd.NsqLogger().LogErrorf("failure in %s - %s", req.URL.Path, err)
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+	topic.SaveChannelMeta()
+	return nil, nil
+}
+
+func (s *httpServer) doSetChannelDeadLetter(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicChannelFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+	if topic.IsOrdered() {
+		return nil, http_api.Err{400, "ORDERED_TOPIC_NOT_SUPPORTED"}
+	}
+	maxAttempts, err := strconv.ParseUint(reqParams.Get("max_attempts"), 10, 32)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_MAX_ATTEMPTS"}
+	}
+	conf := nsqd.DeadLetterConf{
+		MaxAttempts: uint32(maxAttempts),
+		Topic:       reqParams.Get("dlq_topic"),
+	}
+	if conf.Topic != "" && !protocol.IsValidTopicName(conf.Topic) {
+		return nil, http_api.Err{400, "INVALID_DLQ_TOPIC"}
+	}
+	if conf.MaxAttempts > 0 {
+		// the dead letter partition with the same partition id should be ready on this node
+		dlqTopic := conf.Topic
+		if dlqTopic == "" {
+			dlqTopic = nsqd.GetDefaultDeadLetterTopic(topic.GetTopicName(), channelName)
+		}
+		_, err = s.ctx.getDeadLetterTopicPartition(dlqTopic, topic.GetTopicPart())
+		if err != nil {
+			nsqd.NsqLogger().Logf("dead letter topic %v-%v not ready: %v", dlqTopic, topic.GetTopicPart(), err)
+			return nil, http_api.Err{400, "DLQ_TOPIC_NOT_READY"}
+		}
+	}
+	err = s.ctx.UpdateChannelDeadLetter(channel, conf)
+	if err != nil {
+		nsqd.NsqLogger().LogErrorf("failure in %s - %s", req.URL.Path, err)
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+	topic.SaveChannelMeta()
+	return nil, nil
+}
+
+func (s *httpServer) doReplayChannelDLQ(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicChannelFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+	maxCnt := defaultDLQReplayCount
+	if cntStr := reqParams.Get("count"); cntStr != "" {
+		maxCnt, err = strconv.Atoi(cntStr)
+		if err != nil || maxCnt <= 0 {
+			return nil, http_api.Err{400, "INVALID_COUNT"}
+		}
+	}
+	replayed, err := s.ctx.ReplayDeadLetter(channel, maxCnt)
+	if err != nil {
+		nsqd.NsqLogger().LogErrorf("failure in %s - %s", req.URL.Path, err)
+		return nil, http_api.Err{500, err.Error()}
+	}
+	return struct {
+		Replayed int `json:"replayed"`
+	}{replayed}, nil
+}
+
+func (s *httpServer) doPurgeChannelDLQ(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	_, topic, channelName, err := s.getExistingTopicChannelFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+	err = s.ctx.PurgeDeadLetter(channel)
+	if err != nil {
+		nsqd.NsqLogger().LogErrorf("failure in %s - %s", req.URL.Path, err)
+		return nil, http_api.Err{500, err.Error()}
+	}
+	return nil, nil
+}
+
+// redeliver the history message to the channel, the partition will be got
+// from the message id if not given.
+func (s *httpServer) doRedeliverChannelMessage(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		nsqd.NsqLogger().LogErrorf("failed to parse request params - %s", err)
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+	topicName, topicPart, channelName, err := http_api.GetTopicPartitionChannelArgs(reqParams)
+	if err != nil {
+		return nil, http_api.Err{400, err.Error()}
+	}
+	msgID, err := strconv.ParseInt(reqParams.Get("msgid"), 10, 64)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_MSGID"}
+	}
+	if topicPart == -1 {
+		topicPart = consistence.GetPartitionFromMsgID(msgID)
+	}
+	var delay time.Duration
+	if delayStr := reqParams.Get("delay"); delayStr != "" {
+		delayMs, err := strconv.ParseInt(delayStr, 10, 64)
+		if err != nil || delayMs < 0 || time.Duration(delayMs)*time.Millisecond > maxRedeliverDelay {
+			return nil, http_api.Err{400, "INVALID_DELAY"}
+		}
+		delay = time.Duration(delayMs) * time.Millisecond
+	}
+	topic, err := s.ctx.getExistingTopic(topicName, topicPart)
+	if err != nil {
+		return nil, http_api.Err{404, E_TOPIC_NOT_EXIST}
+	}
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+	operator := req.RemoteAddr
+	if op := reqParams.Get("operator"); op != "" {
+		operator = op + "@" + req.RemoteAddr
+	}
+	err = s.ctx.RedeliverMessage(topic, channel, nsqd.MessageID(msgID), delay, operator)
+	if err == errRedeliverNotFound {
+		return nil, http_api.Err{404, "MESSAGE_NOT_FOUND"}
+	}
+	if err != nil {
+		nsqd.NsqLogger().LogErrorf("failure in %s - %s", req.URL.Path, err)
+		return nil, http_api.Err{500, err.Error()}
+	}
+	return nil, nil
+}
+
 func (s *httpServer) doSetChannelOffset(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	_, topic, channelName, err := s.getExistingTopicChannelFromQuery(req)
 	if err != nil {
@@ -996,6 +1240,114 @@ func (s *httpServer) doMessageGet(w http.ResponseWriter, req *http.Request, ps h
 	}{msg.ID, msg.TraceID, string(msg.Body), msg.Timestamp, msg.Attempts, ret.Offset, ret.CurCnt}, nil
 }
 
+// search the messages by the value of the indexed ext header key, all the
+// local partitions will be searched if no partition given.
+func (s *httpServer) doMessageSearch(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		nsqd.NsqLogger().LogErrorf("failed to parse request params - %s", err)
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+	topicName := reqParams.Get("topic")
+	key := reqParams.Get("key")
+	if topicName == "" || key == "" {
+		return nil, http_api.Err{400, "MISSING_ARG_TOPIC_OR_KEY"}
+	}
+	limit := 100
+	if limitStr := reqParams.Get("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 || limit > 1000 {
+			return nil, http_api.Err{400, "INVALID_ARG_LIMIT"}
+		}
+	}
+	var topics []*nsqd.Topic
+	if partStr := reqParams.Get("partition"); partStr != "" {
+		part, err := strconv.Atoi(partStr)
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_ARG_PARTITION"}
+		}
+		t, err := s.ctx.getExistingTopic(topicName, part)
+		if err != nil {
+			return nil, http_api.Err{404, E_TOPIC_NOT_EXIST}
+		}
+		topics = append(topics, t)
+	} else {
+		for _, t := range s.ctx.getPartitions(topicName) {
+			topics = append(topics, t)
+		}
+		if len(topics) == 0 {
+			return nil, http_api.Err{404, E_TOPIC_NOT_EXIST}
+		}
+	}
+	msgs := make([]nsqd.MsgIndexResult, 0)
+	for _, t := range topics {
+		rets, err := t.SearchMessagesByIndex(key, limit)
+		if err == nsqd.ErrMsgIndexNotEnabled {
+			return nil, http_api.Err{400, "MESSAGE_INDEX_NOT_ENABLED"}
+		}
+		if err != nil {
+			nsqd.NsqLogger().LogErrorf("topic %v search message by %v failed: %v", t.GetFullName(), key, err)
+			return nil, http_api.Err{500, err.Error()}
+		}
+		msgs = append(msgs, rets...)
+	}
+	return struct {
+		Messages []nsqd.MsgIndexResult `json:"messages"`
+	}{msgs}, nil
+}
+
+func (s *httpServer) doChannelLag(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, t, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+	var channels []*nsqd.Channel
+	chName := reqParams.Get("channel")
+	if chName != "" {
+		ch, err := t.GetExistingChannel(chName)
+		if err != nil {
+			return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+		}
+		channels = append(channels, ch)
+	} else {
+		for _, ch := range t.GetChannelMapCopy() {
+			channels = append(channels, ch)
+		}
+	}
+	commitLogCnt := int64(-1)
+	if s.ctx.nsqdCoord != nil {
+		commitLogCnt, err = s.ctx.nsqdCoord.GetCommitLogMsgCnt(t.GetTopicName(), t.GetTopicPart())
+		if err != nil {
+			nsqd.NsqLogger().Logf("topic %v get commit log count failed: %v", t.GetFullName(), err)
+			commitLogCnt = -1
+		}
+	}
+	now := time.Now().UnixNano()
+	lags := make([]*clusterinfo.ChannelPartitionLag, 0, len(channels))
+	for _, ch := range channels {
+		confirmed := ch.GetConfirmed()
+		end := ch.GetChannelEnd()
+		lag := &clusterinfo.ChannelPartitionLag{
+			TopicName:       t.GetTopicName(),
+			TopicPartition:  strconv.Itoa(t.GetTopicPart()),
+			ChannelName:     ch.GetName(),
+			ConfirmedOffset: int64(confirmed.Offset()),
+			ConfirmedCount:  confirmed.TotalMsgCnt(),
+			EndOffset:       int64(end.Offset()),
+			EndCount:        end.TotalMsgCnt(),
+			CommitLogCount:  commitLogCnt,
+			DepthTimestamp:  ch.DepthTimestamp(),
+		}
+		lag.LagCount = lag.EndCount - lag.ConfirmedCount
+		lag.LagBytes = lag.EndOffset - lag.ConfirmedOffset
+		if lag.LagCount > 0 && lag.DepthTimestamp > 0 && now > lag.DepthTimestamp {
+			lag.LagTimeMs = (now - lag.DepthTimestamp) / int64(time.Millisecond)
+		}
+		lags = append(lags, lag)
+	}
+	return lags, nil
+}
+
 func (s *httpServer) doMessageStats(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	_, t, chName, err := s.getExistingTopicChannelFromQuery(req)
 	if err != nil {
@@ -1091,6 +1443,11 @@ func (s *httpServer) doCoordStats(w http.ResponseWriter, req *http.Request, ps h
 	return nil, http_api.Err{500, "Coordinator is disabled."}
 }
 
+func (s *httpServer) doMetrics(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	w.Header().Set("Content-Type", prom.ContentType)
+	return s.ctx.collectMetrics(), nil
+}
+
 func (s *httpServer) doStats(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	reqParams, err := url.ParseQuery(req.URL.RawQuery)
 	if err != nil {
@@ -1263,6 +1620,20 @@ func (s *httpServer) doConfig(w http.ResponseWriter, req *http.Request, ps httpr
 				return nil, http_api.Err{400, "INVALID_VALUE"}
 			}
 			nsqd.NsqLogger().Logf("sub ext compatible set to : %v", opts.AllowSubExtCompatible)
+		case "catchup_rate_limit":
+			err := json.Unmarshal(body, &opts.CatchupRateLimit)
+			if err != nil || opts.CatchupRateLimit < 0 {
+				nsqd.NsqLogger().Logf("invalid value : %v", string(body))
+				return nil, http_api.Err{400, "INVALID_VALUE"}
+			}
+			nsqd.NsqLogger().Logf("catchup rate limit set to : %v", opts.CatchupRateLimit)
+		case "topic_catchup_rate_limit":
+			err := json.Unmarshal(body, &opts.TopicCatchupRateLimit)
+			if err != nil || opts.TopicCatchupRateLimit < 0 {
+				nsqd.NsqLogger().Logf("invalid value : %v", string(body))
+				return nil, http_api.Err{400, "INVALID_VALUE"}
+			}
+			nsqd.NsqLogger().Logf("topic catchup rate limit set to : %v", opts.TopicCatchupRateLimit)
 		default:
 			return nil, http_api.Err{400, "INVALID_OPTION"}
 		}
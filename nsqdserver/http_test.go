@@ -19,7 +19,9 @@ import (
 	"strings"
 
 	"github.com/youzan/go-nsq"
+	"github.com/youzan/nsq/internal/clusterinfo"
 	"github.com/youzan/nsq/internal/ext"
+	"github.com/youzan/nsq/internal/http_api"
 	"github.com/youzan/nsq/internal/test"
 	"github.com/youzan/nsq/internal/version"
 	"github.com/youzan/nsq/nsqd"
@@ -141,6 +143,33 @@ func TestHTTPChangeConfig(t *testing.T) {
 	test.Equal(t, 200, resp.StatusCode)
 	test.Equal(t, false, nsqd.GetOpts().AllowExtCompatible)
 	test.Equal(t, false, nsqd.GetOpts().AllowSubExtCompatible)
+
+	url = fmt.Sprintf("http://%s/config/catchup_rate_limit", httpAddr)
+	req, err = http.NewRequest("PUT", url, strings.NewReader("1048576"))
+	if err != nil {
+		t.FailNow()
+	}
+	resp, err = client.Do(req)
+	if err != nil {
+		t.FailNow()
+	}
+	defer resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	test.Equal(t, int64(1048576), nsqd.GetOpts().CatchupRateLimit)
+	test.Equal(t, int64(0), nsqd.GetOpts().TopicCatchupRateLimit)
+
+	url = fmt.Sprintf("http://%s/config/topic_catchup_rate_limit", httpAddr)
+	req, err = http.NewRequest("PUT", url, strings.NewReader("-1"))
+	if err != nil {
+		t.FailNow()
+	}
+	resp, err = client.Do(req)
+	if err != nil {
+		t.FailNow()
+	}
+	defer resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+	test.Equal(t, int64(0), nsqd.GetOpts().TopicCatchupRateLimit)
 }
 
 func TestHTTPPubExt(t *testing.T) {
@@ -1158,3 +1187,122 @@ func BenchmarkFetchNodeHourlyPubsize(b *testing.B) {
 		}
 	}
 }
+
+func TestHTTPChannelLag(t *testing.T) {
+	opts := nsqd.NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, httpAddr, nsqdNs, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	topicName := "test_http_channel_lag" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqdNs.GetTopicIgnPart(topicName)
+	topic.GetChannel("ch")
+	for i := 0; i < 2; i++ {
+		msg := nsqd.NewMessage(0, []byte("test body"))
+		topic.PutMessage(msg)
+	}
+	topic.ForceFlush()
+
+	url := fmt.Sprintf("http://%s/channel/lag?topic=%s&partition=%v", httpAddr, topicName, topic.GetTopicPart())
+	var lags []*clusterinfo.ChannelPartitionLag
+	_, err := http_api.NewClient(nil).GETV1(url, &lags)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(lags))
+	test.Equal(t, "ch", lags[0].ChannelName)
+	test.Equal(t, int64(0), lags[0].ConfirmedCount)
+	test.Equal(t, int64(2), lags[0].EndCount)
+	test.Equal(t, int64(2), lags[0].LagCount)
+	test.Equal(t, lags[0].EndOffset, lags[0].LagBytes)
+
+	url = fmt.Sprintf("http://%s/channel/lag?topic=%s&partition=%v&channel=notexist", httpAddr, topicName, topic.GetTopicPart())
+	_, err = http_api.NewClient(nil).GETV1(url, &lags)
+	test.NotNil(t, err)
+}
+
+func TestHTTPChannelRedeliverInvalid(t *testing.T) {
+	opts := nsqd.NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, httpAddr, nsqdNs, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	topicName := "test_http_channel_redeliver" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqdNs.GetTopicIgnPart(topicName)
+	topic.GetChannel("ch")
+	id, _, _, _, err := topic.PutMessage(nsqd.NewMessage(0, []byte("test body")))
+	test.Nil(t, err)
+	topic.ForceFlush()
+
+	client := http_api.NewClient(nil)
+	url := fmt.Sprintf("http://%s/channel/redeliver?topic=%s&partition=%v&channel=ch&msgid=invalid",
+		httpAddr, topicName, topic.GetTopicPart())
+	code, err := client.POSTV1(url)
+	test.NotNil(t, err)
+	test.Equal(t, 400, code)
+
+	url = fmt.Sprintf("http://%s/channel/redeliver?topic=%s&partition=%v&channel=notexist&msgid=%v",
+		httpAddr, topicName, topic.GetTopicPart(), id)
+	code, err = client.POSTV1(url)
+	test.NotNil(t, err)
+	test.Equal(t, 404, code)
+
+	url = fmt.Sprintf("http://%s/channel/redeliver?topic=%s&partition=%v&channel=ch&msgid=%v",
+		httpAddr, topicName, topic.GetTopicPart(), id+1)
+	code, err = client.POSTV1(url)
+	test.NotNil(t, err)
+	test.Equal(t, 404, code)
+
+	url = fmt.Sprintf("http://%s/channel/redeliver?topic=%s&partition=%v&channel=ch&msgid=%v&delay=-1",
+		httpAddr, topicName, topic.GetTopicPart(), id)
+	code, err = client.POSTV1(url)
+	test.NotNil(t, err)
+	test.Equal(t, 400, code)
+}
+
+func TestHTTPChannelRedeliver(t *testing.T) {
+	opts := nsqd.NewOptions()
+	opts.Logger = newTestLogger(t)
+	opts.QueueScanInterval = time.Millisecond * 10
+	tcpAddr, httpAddr, nsqdNs, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	topicName := "test_http_channel_redeliver" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqdNs.GetTopicIgnPart(topicName)
+	topic.GetChannel("ch")
+	_, err := topic.GetOrCreateDelayedQueueNoLock(nil)
+	test.Nil(t, err)
+	msgBody := []byte("test body")
+	id, _, _, _, err := topic.PutMessage(nsqd.NewMessage(0, msgBody))
+	test.Nil(t, err)
+	topic.ForceFlush()
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+	_, err = nsq.Ready(1).WriteTo(conn)
+	test.Nil(t, err)
+
+	msgOut := recvNextMsgAndCheck(t, conn, len(msgBody), 0, false)
+	test.Equal(t, msgBody, msgOut.Body)
+	test.Equal(t, uint64(id), msgOut.GetFullMsgID())
+	_, err = nsq.Finish(nsq.MessageID(msgOut.GetFullMsgID())).WriteTo(conn)
+	test.Nil(t, err)
+
+	client := http_api.NewClient(nil)
+	url := fmt.Sprintf("http://%s/channel/redeliver?topic=%s&partition=%v&channel=ch&msgid=%v&operator=test",
+		httpAddr, topicName, topic.GetTopicPart(), id)
+	code, err := client.POSTV1(url)
+	test.Nil(t, err)
+	test.Equal(t, 200, code)
+
+	// the finished message should be delivered again with the same id
+	msgOut = recvNextMsgAndCheck(t, conn, len(msgBody), 0, false)
+	test.Equal(t, msgBody, msgOut.Body)
+	test.Equal(t, uint64(id), msgOut.GetFullMsgID())
+	_, err = nsq.Finish(nsq.MessageID(msgOut.GetFullMsgID())).WriteTo(conn)
+	test.Nil(t, err)
+}
@@ -0,0 +1,163 @@
+package nsqdserver
+
+import (
+	"runtime"
+	"strconv"
+
+	"github.com/youzan/nsq/internal/prom"
+	"github.com/youzan/nsq/internal/quantile"
+	"github.com/youzan/nsq/nsqd"
+)
+
+const metricsPrefix = "nsq_"
+
+var (
+	// the message size stats: <100bytes, <1KB, 2KB, 4KB, ..., above
+	msgSizeBounds = append([]float64{100}, prom.ExponentialBounds(1024, 2, 14)...)
+	// the message write latency stats in seconds: <1024us, 2ms, 4ms, ..., above
+	msgWriteLatencyBounds = prom.ExponentialBounds(0.001024, 2, 15)
+	// the channel consume and delivery latency stats in seconds: 16ms, 32ms, ..., 16s, above
+	msgConsumeLatencyBounds = prom.ExponentialBounds(0.016, 2, 11)
+)
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func addE2eLatency(e *prom.Exposition, name string, help string, r *quantile.Result, labels prom.Labels) {
+	if r == nil {
+		return
+	}
+	for _, item := range r.Percentiles {
+		l := make(prom.Labels, len(labels)+1)
+		for k, v := range labels {
+			l[k] = v
+		}
+		l["quantile"] = strconv.FormatFloat(item["quantile"], 'g', -1, 64)
+		e.Gauge(name, help, item["value"]/1e9, l)
+	}
+}
+
+// collect the metrics of topics, channels, coordinator and the runtime
+// in the prometheus text exposition format.
+func (c *context) collectMetrics() []byte {
+	e := prom.NewExposition(metricsPrefix)
+	e.Gauge("healthy", "whether the nsqd is healthy", boolToFloat(c.isHealthy()), nil)
+
+	stats := c.getStats(false, "", true)
+	for _, t := range stats {
+		tl := prom.Labels{"topic": t.TopicName, "partition": t.TopicPartition}
+		e.Gauge("topic_is_leader", "whether this node is the leader of the topic partition", boolToFloat(t.IsLeader), tl)
+		e.Counter("topic_message_count", "total messages published to the topic partition", float64(t.MessageCount), tl)
+		e.Gauge("topic_depth_bytes", "the data size of the topic partition", float64(t.Depth), tl)
+		e.Gauge("topic_backend_start_bytes", "the oldest offset of the topic partition queue", float64(t.BackendStart), tl)
+		e.Gauge("topic_hourly_pub_bytes", "the data size published in current hour", float64(t.HourlyPubSize), tl)
+		addE2eLatency(e, "topic_e2e_processing_latency_seconds", "the e2e processing latency quantiles of the topic",
+			t.E2eProcessingLatency, tl)
+		e.Histogram("topic_message_size_bytes", "the message size distribution of the topic",
+			msgSizeBounds, t.MsgSizeStats, float64(t.MsgSizeSum), tl)
+		e.Histogram("topic_write_latency_seconds", "the message write latency distribution of the topic",
+			msgWriteLatencyBounds, t.MsgWriteLatencyStats, float64(t.MsgWriteLatencySum)/1e6, tl)
+
+		for _, ch := range t.Channels {
+			cl := prom.Labels{"topic": t.TopicName, "partition": t.TopicPartition, "channel": ch.ChannelName}
+			e.Gauge("channel_depth", "the message count waiting to be consumed", float64(ch.Depth), cl)
+			e.Gauge("channel_depth_bytes", "the message size waiting to be consumed", float64(ch.DepthSize), cl)
+			e.Gauge("channel_backend_depth", "the backend depth of the channel", float64(ch.BackendDepth), cl)
+			e.Gauge("channel_in_flight_count", "the in flight message count", float64(ch.InFlightCount), cl)
+			e.Gauge("channel_deferred_count", "the deferred message count", float64(ch.DeferredCount), cl)
+			e.Gauge("channel_delayed_queue_count", "the message count in the delayed queue", float64(ch.DelayedQueueCount), cl)
+			e.Gauge("channel_key_waiting_count", "the message count waiting for the same sharding key", float64(ch.KeyWaitingCount), cl)
+			e.Gauge("channel_clients", "the client count of the channel", float64(ch.ClientNum), cl)
+			e.Gauge("channel_paused", "whether the channel is paused", boolToFloat(ch.Paused), cl)
+			e.Gauge("channel_skipped", "whether the channel is skipped", boolToFloat(ch.Skipped), cl)
+			e.Counter("channel_message_count", "total messages of the channel", float64(ch.MessageCount), cl)
+			e.Counter("channel_requeue_count", "total requeued messages of the channel", float64(ch.RequeueCount), cl)
+			e.Counter("channel_timeout_count", "total timeout messages of the channel", float64(ch.TimeoutCount), cl)
+			e.Counter("channel_expired_count", "total expired messages of the channel", float64(ch.ExpiredCount), cl)
+			e.Counter("channel_dead_letter_count", "total messages moved to the dead letter topic", float64(ch.DeadLetterCount), cl)
+			e.Counter("channel_dead_letter_failed_count", "total messages failed to move to the dead letter topic", float64(ch.DeadLetterFailedCount), cl)
+			addE2eLatency(e, "channel_e2e_processing_latency_seconds", "the e2e processing latency quantiles of the channel",
+				ch.E2eProcessingLatency, cl)
+			e.Histogram("channel_consume_latency_seconds", "the message consume latency distribution of the channel",
+				msgConsumeLatencyBounds, ch.MsgConsumeLatencyStats, float64(ch.MsgConsumeLatencySum)/1e3, cl)
+			e.Histogram("channel_delivery2ack_latency_seconds", "the latency distribution from delivery to ack",
+				msgConsumeLatencyBounds, ch.MsgDeliveryLatencyStats, float64(ch.MsgDeliveryLatencySum)/1e3, cl)
+		}
+	}
+
+	topics := c.nsqd.GetTopicMapCopy()
+	for _, partitions := range topics {
+		for _, t := range partitions {
+			dq := t.GetDelayedQueue()
+			if dq == nil {
+				continue
+			}
+			sz, err := dq.GetDBSize()
+			if err != nil {
+				continue
+			}
+			tl := prom.Labels{"topic": t.GetTopicName(), "partition": strconv.Itoa(t.GetTopicPart())}
+			e.Gauge("delayed_queue_db_bytes", "the db file size of the delayed queue", float64(sz), tl)
+		}
+	}
+
+	c.collectCoordMetrics(e, stats)
+
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	e.Gauge("mem_heap_objects", "the number of allocated heap objects", float64(memStats.HeapObjects), nil)
+	e.Gauge("mem_heap_idle_bytes", "the heap idle bytes", float64(memStats.HeapIdle), nil)
+	e.Gauge("mem_heap_in_use_bytes", "the heap in use bytes", float64(memStats.HeapInuse), nil)
+	e.Gauge("mem_next_gc_bytes", "the heap size of the next gc", float64(memStats.NextGC), nil)
+	e.Counter("mem_gc_runs", "total gc runs", float64(memStats.NumGC), nil)
+	e.Gauge("goroutines", "the number of goroutines", float64(runtime.NumGoroutine()), nil)
+	return e.Bytes()
+}
+
+func (c *context) collectCoordMetrics(e *prom.Exposition, stats []nsqd.TopicStats) {
+	if c.nsqdCoord == nil {
+		return
+	}
+	coordStats := c.nsqdCoord.Stats("", -1)
+	if coordStats.RpcStats != nil {
+		rs := coordStats.RpcStats
+		e.Counter("coord_rpc_calls", "total coordinator rpc calls", float64(rs.RPCCalls), nil)
+		e.Counter("coord_rpc_bytes_written", "total bytes written by coordinator rpc", float64(rs.BytesWritten), nil)
+		e.Counter("coord_rpc_bytes_read", "total bytes read by coordinator rpc", float64(rs.BytesRead), nil)
+		e.Counter("coord_rpc_read_errors", "total read errors of coordinator rpc", float64(rs.ReadErrors), nil)
+		e.Counter("coord_rpc_write_errors", "total write errors of coordinator rpc", float64(rs.WriteErrors), nil)
+	}
+	errStats := coordStats.ErrStats
+	errHelp := "total coordinator errors by type"
+	e.Counter("coord_errors", errHelp, float64(errStats.WriteEpochError), prom.Labels{"type": "write_epoch"})
+	e.Counter("coord_errors", errHelp, float64(errStats.WriteNotLeaderError), prom.Labels{"type": "write_not_leader"})
+	e.Counter("coord_errors", errHelp, float64(errStats.WriteQuorumError), prom.Labels{"type": "write_quorum"})
+	e.Counter("coord_errors", errHelp, float64(errStats.WriteBusyError), prom.Labels{"type": "write_busy"})
+	e.Counter("coord_errors", errHelp, float64(errStats.RpcCheckFailed), prom.Labels{"type": "rpc_check_failed"})
+	e.Counter("coord_errors", errHelp, float64(errStats.LeadershipError), prom.Labels{"type": "leadership"})
+	e.Counter("coord_errors", errHelp, float64(errStats.TopicCoordMissingError), prom.Labels{"type": "topic_coord_missing"})
+	e.Counter("coord_errors", errHelp, float64(errStats.LocalErr), prom.Labels{"type": "local"})
+	for k, v := range errStats.OtherCoordErrs {
+		e.Counter("coord_other_errors", "total other coordinator errors", float64(v), prom.Labels{"error": k})
+	}
+	cs := coordStats.CatchupStats
+	e.Counter("coord_catchup_pulled_bytes", "total bytes pulled from leader while catching up", float64(cs.PulledBytes), nil)
+	e.Counter("coord_catchup_throttled_seconds", "total time waited by the catchup rate limit", float64(cs.ThrottledTimeMs)/1000, nil)
+
+	for _, t := range stats {
+		part, err := strconv.Atoi(t.TopicPartition)
+		if err != nil {
+			continue
+		}
+		for _, tcStat := range c.nsqdCoord.Stats(t.TopicName, part).TopicCoordStats {
+			tl := prom.Labels{"topic": t.TopicName, "partition": t.TopicPartition}
+			e.Gauge("topic_isr_count", "the isr node count of the topic partition", float64(len(tcStat.ISRStats)), tl)
+			e.Gauge("topic_catchup_count", "the catchup node count of the topic partition", float64(len(tcStat.CatchupStats)), tl)
+			e.Counter("topic_catchup_throttled_seconds", "the time waited by the catchup rate limit of the topic partition", float64(tcStat.CatchupThrottledTimeMs)/1000, tl)
+		}
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"os"
 	"strconv"
 	"sync/atomic"
+	"time"
 
 	"github.com/youzan/nsq/consistence"
 	"github.com/youzan/nsq/nsqd"
@@ -29,6 +30,10 @@ type NsqdServer struct {
 	exitChan      chan int
 }
 
+const (
+	delayedPubScanBatch = 100
+)
+
 const (
 	TLSNotRequired = iota
 	TLSRequiredExceptHTTP
@@ -93,6 +98,7 @@ func NewNsqdServer(opts *nsqd.Options) (*nsqd.NSQD, *NsqdServer) {
 	s := &NsqdServer{}
 	ctx := &context{}
 	ctx.nsqd = nsqdInstance
+	ctx.deadLetterJobs = make(chan deadLetterJob, deadLetterQueueSize)
 	_, tcpPort, _ := net.SplitHostPort(opts.TCPAddress)
 	_, httpPort, _ := net.SplitHostPort(opts.HTTPAddress)
 	rpcport := opts.RPCPort
@@ -104,8 +110,14 @@ func NewNsqdServer(opts *nsqd.Options) (*nsqd.NSQD, *NsqdServer) {
 		}
 		coord := consistence.NewNsqdCoordinator(opts.ClusterID, ip, tcpPort, rpcport, httpPort,
 			strconv.FormatInt(opts.ID, 10), opts.DataPath, nsqdInstance)
-		l := consistence.NewNsqdEtcdMgr(opts.ClusterLeadershipAddresses)
-		coord.SetLeadershipMgr(l)
+		coord.SetNodeZone(opts.Zone)
+		coord.SetCatchupRateLimit(opts.CatchupRateLimit, opts.TopicCatchupRateLimit)
+		if opts.ClusterLeadershipType == "raft" {
+			coord.SetLeadershipMgr(consistence.NewNsqdRaftMgr(opts.ClusterLeadershipAddresses))
+		} else {
+			l := consistence.NewNsqdEtcdMgr(opts.ClusterLeadershipAddresses)
+			coord.SetLeadershipMgr(l)
+		}
 		ctx.nsqdCoord = coord
 	} else {
 		nsqd.NsqLogger().LogWarningf("Start without nsqd coordinator enabled")
@@ -224,7 +236,66 @@ func (s *NsqdServer) Main() {
 		s.lookupLoop(opts.LookupPingInterval, s.ctx.nsqd.MetaNotifyChan, s.ctx.nsqd.OptsNotificationChan, s.exitChan)
 	})
 
+	s.waitGroup.Wrap(s.delayedPubScanLoop)
+	s.waitGroup.Wrap(s.txCheckBackLoop)
+	for i := 0; i < deadLetterMoveWorkers; i++ {
+		s.waitGroup.Wrap(s.deadLetterLoop)
+	}
+
 	if opts.StatsdAddress != "" {
 		s.waitGroup.Wrap(s.statsdLoop)
 	}
 }
+
+// deadLetterLoop moves the messages exceeding the max attempts to the dead letter topic
+func (s *NsqdServer) deadLetterLoop() {
+	for {
+		select {
+		case job := <-s.ctx.deadLetterJobs:
+			s.ctx.handleDeadLetterJob(job)
+		case <-s.exitChan:
+			return
+		}
+	}
+}
+
+// delayedPubScanLoop moves the delayed pub messages to the topic queue
+// while they are due. Only the leader of the topic partition will do this.
+func (s *NsqdServer) delayedPubScanLoop() {
+	ticker := time.NewTicker(s.ctx.getOpts().QueueScanInterval)
+	defer ticker.Stop()
+	results := make([]nsqd.Message, delayedPubScanBatch)
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.exitChan:
+			return
+		}
+		if atomic.LoadInt32(&nsqd.EnableDelayedQueue) != 1 {
+			continue
+		}
+		now := time.Now().UnixNano()
+		topics := s.ctx.nsqd.GetTopicMapCopy()
+		for _, partitions := range topics {
+			for _, t := range partitions {
+				if t.IsOrdered() || t.IsWriteDisabled() || t.Exiting() {
+					continue
+				}
+				if !s.ctx.checkForMasterWrite(t.GetTopicName(), t.GetTopicPart()) {
+					continue
+				}
+				for {
+					select {
+					case <-s.exitChan:
+						return
+					default:
+					}
+					cnt, err := s.ctx.moveDueDelayedPubMessages(t, now, results)
+					if err != nil || cnt < len(results) {
+						break
+					}
+				}
+			}
+		}
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/youzan/nsq/internal/clusterinfo"
 	"github.com/youzan/nsq/internal/http_api"
 	"github.com/youzan/nsq/internal/levellogger"
+	"github.com/youzan/nsq/internal/protocol"
 	"github.com/youzan/nsq/internal/test"
 	nsqdNs "github.com/youzan/nsq/nsqd"
 	"github.com/youzan/nsq/nsqlookupd"
@@ -15,6 +16,7 @@ import (
 	"net"
 	"os"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -273,3 +275,95 @@ func TestCluster(t *testing.T) {
 	producers, _ = data.Get("channel:" + topicName + ":" + partitionStr).Array()
 	test.Equal(t, len(producers), 0)
 }
+
+func TestDelayedPubMoveNotRepublishAfterConfirmFailed(t *testing.T) {
+	opts := nsqdNs.NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+
+	topicName := "test_delayed_pub_confirm_failed" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopicIgnPart(topicName)
+	dq, err := topic.GetOrCreateDelayedQueueNoLock(nil)
+	test.Nil(t, err)
+	// not due for the scan loop, we move it by hand
+	delayedTs := time.Now().Add(time.Hour).UnixNano()
+	msg := nsqdNs.NewMessage(0, []byte("delayed"))
+	msg.DelayedType = nsqdNs.PubDelayed
+	msg.DelayedTs = delayedTs
+	_, _, _, _, err = dq.PutDelayMessage(msg)
+	test.Nil(t, err)
+	results := make([]nsqdNs.Message, 10)
+	n, err := dq.PeekRecentDelayedPub(delayedTs+1, results)
+	test.Nil(t, err)
+	test.Equal(t, 1, n)
+
+	// the previous move published the message but failed to confirm it
+	ctx := nsqdServer.ctx
+	_, ok := ctx.delayedPubMoving.claim(topic.GetFullName(), results[0].ID)
+	test.Equal(t, true, ok)
+	ctx.delayedPubMoving.markPublished(topic.GetFullName(), results[0].ID)
+	ctx.delayedPubMoving.release(topic.GetFullName(), results[0].ID, false)
+
+	// the next move should only confirm it without publishing again
+	n, err = ctx.moveDueDelayedPubMessages(topic, delayedTs+1, results)
+	test.Nil(t, err)
+	test.Equal(t, 1, n)
+	test.Equal(t, uint64(0), topic.TotalMessageCnt())
+	n, err = dq.PeekRecentDelayedPub(delayedTs+1, results)
+	test.Nil(t, err)
+	test.Equal(t, 0, n)
+}
+
+func TestDeadLetterReplaySharedTopic(t *testing.T) {
+	opts := nsqdNs.NewOptions()
+	opts.Logger = newTestLogger(t)
+	_, _, nsqd, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+	ctx := nsqdServer.ctx
+
+	suffix := strconv.Itoa(int(time.Now().Unix()))
+	dlqTopic := nsqd.GetTopicIgnPart("test_dlq_shared" + suffix)
+	dlqTopic.SetDynamicInfo(nsqdNs.TopicDynamicConf{AutoCommit: 1, SyncEvery: 1, Ext: true}, nil)
+	// the channels with the same name in two topics share one dead letter topic
+	topics := []*nsqdNs.Topic{
+		nsqd.GetTopicIgnPart("test_dlq_src1" + suffix),
+		nsqd.GetTopicIgnPart("test_dlq_src2" + suffix),
+	}
+	channels := make([]*nsqdNs.Channel, 0, len(topics))
+	client := nsqdNs.NewClientV2(1, nil, opts, nil)
+	for _, topic := range topics {
+		ch := topic.GetChannel("ch")
+		ch.SetDeadLetterConf(nsqdNs.DeadLetterConf{MaxAttempts: 1, Topic: dlqTopic.GetTopicName()})
+		channels = append(channels, ch)
+		msg := nsqdNs.NewMessage(0, []byte(topic.GetTopicName()))
+		_, _, _, _, err := topic.PutMessage(msg)
+		test.Nil(t, err)
+		_, err = ch.StartInFlightTimeout(msg, client, "", opts.MsgTimeout)
+		test.Nil(t, err)
+		err = ctx.MoveToDeadLetter(ch, msg, DeadLetterReasonTimeout)
+		test.Nil(t, err)
+	}
+	dlqTopic.ForceFlush()
+	test.NotEqual(t, getDeadLetterCursorName(topics[0].GetTopicName(), "ch"),
+		getDeadLetterCursorName(topics[1].GetTopicName(), "ch"))
+
+	// replay the second topic first should not skip the dead letters of the first topic
+	replayed, err := ctx.ReplayDeadLetter(channels[1], defaultDLQReplayCount)
+	test.Nil(t, err)
+	test.Equal(t, 1, replayed)
+	replayed, err = ctx.ReplayDeadLetter(channels[0], defaultDLQReplayCount)
+	test.Nil(t, err)
+	test.Equal(t, 1, replayed)
+	replayed, err = ctx.ReplayDeadLetter(channels[0], defaultDLQReplayCount)
+	test.Nil(t, err)
+	test.Equal(t, 0, replayed)
+
+	// the long name should fall back to the hash
+	longName := strings.Repeat("c", 64)
+	name := getDeadLetterCursorName(longName, longName)
+	test.Equal(t, true, protocol.IsValidChannelName(name))
+	test.NotEqual(t, name, getDeadLetterCursorName(longName, longName[:63]))
+}
@@ -389,6 +389,16 @@ func (p *protocolV2) Exec(client *nsqd.ClientV2, params [][]byte) ([]byte, error
 		return p.MPUB(client, params)
 	case bytes.Equal(params[0], []byte("MPUB_TRACE")):
 		return p.MPUBTRACE(client, params)
+	case bytes.Equal(params[0], []byte("DPUB")):
+		return p.DPUB(client, params)
+	case bytes.Equal(params[0], []byte("DMPUB")):
+		return p.DMPUB(client, params)
+	case bytes.Equal(params[0], []byte("PUB_PREPARE")):
+		return p.PUBPREPARE(client, params)
+	case bytes.Equal(params[0], []byte("TX_COMMIT")):
+		return p.TXCOMMIT(client, params)
+	case bytes.Equal(params[0], []byte("TX_ROLLBACK")):
+		return p.TXROLLBACK(client, params)
 	case bytes.Equal(params[0], []byte("NOP")):
 		return p.NOP(client, params)
 	case bytes.Equal(params[0], []byte("TOUCH")):
@@ -613,6 +623,11 @@ func (p *protocolV2) messagePump(client *nsqd.ClientV2, startedChan chan bool,
 
 			lastActiveTime = time.Now()
 			client.SendingMessage()
+			// the poison message timeout too much times should not be delivered again
+			if subChannel.IsExceedMaxAttempts(msg) &&
+				p.ctx.moveToDeadLetterAsync(subChannel, msg, DeadLetterReasonTimeout) {
+				continue
+			}
 			if subChannel.IsExt() && !extSupport && !extCompatible {
 				// while the topic upgraded to the ext, we should close all the old client
 				// which not support the ext.
@@ -1172,6 +1187,19 @@ func (p *protocolV2) REQ(client *nsqd.ClientV2, params [][]byte) ([]byte, error)
 	// can update the inflight message to the new message put backed at the queue
 
 	msgID := nsqd.GetMessageIDFromFullMsgID(*id)
+	if dlqMsg, ok := client.Channel.ShouldMoveToDeadLetter(client.ID, msgID); ok {
+		// the optional param is the last error reason from the consumer
+		reason := DeadLetterReasonRequeue
+		if len(params) > 3 && len(params[3]) > 0 {
+			reason = string(params[3])
+		}
+		err = p.ctx.MoveToDeadLetter(client.Channel, dlqMsg, reason)
+		if err == nil {
+			return nil, nil
+		}
+		nsqd.NsqLogger().Logf("client %v move message %v to dead letter failed: %v, fallback to requeue",
+			client, msgID, err)
+	}
 	topic, _ := p.ctx.getExistingTopic(client.Channel.GetTopicName(), client.Channel.GetTopicPart())
 	oldMsg, toEnd := client.Channel.ShouldRequeueToEnd(client.ID, client.String(),
 		msgID, timeoutDuration, true)
@@ -1345,15 +1373,136 @@ func (p *protocolV2) PUB(client *nsqd.ClientV2, params [][]byte) ([]byte, error)
 }
 
 func (p *protocolV2) PUBEXT(client *nsqd.ClientV2, params [][]byte) ([]byte, error) {
-	return p.internalPubExtAndTrace(client, params, true, false)
+	return p.internalPubExtAndTrace(client, params, true, false, nil)
 }
 
 func (p *protocolV2) MPUBTRACE(client *nsqd.ClientV2, params [][]byte) ([]byte, error) {
-	return p.internalMPUBAndTrace(client, params, true)
+	return p.internalMPUBAndTrace(client, params, true, 0)
 }
 
 func (p *protocolV2) MPUB(client *nsqd.ClientV2, params [][]byte) ([]byte, error) {
-	return p.internalMPUBAndTrace(client, params, false)
+	return p.internalMPUBAndTrace(client, params, false, 0)
+}
+
+// DPUB <topic> <partition> <delay_ms> [ext]
+// the message will be written to the delayed queue and will be
+// visible to the consumers after the delay. The body has the json
+// header as PUB_EXT if ext is true.
+func (p *protocolV2) DPUB(client *nsqd.ClientV2, params [][]byte) ([]byte, error) {
+	delay, err := p.getPubDelay(params)
+	if err != nil {
+		return nil, err
+	}
+	pubExt, err := getPubExtParam(params, 4)
+	if err != nil {
+		return nil, err
+	}
+	return p.internalPubExtAndTrace(client, params[:3], pubExt, false,
+		&pubDelayedInfo{delayedType: nsqd.PubDelayed, delay: delay})
+}
+
+// DMPUB <topic> <partition> <delay_ms>
+func (p *protocolV2) DMPUB(client *nsqd.ClientV2, params [][]byte) ([]byte, error) {
+	delay, err := p.getPubDelay(params)
+	if err != nil {
+		return nil, err
+	}
+	return p.internalMPUBAndTrace(client, params[:3], false, delay)
+}
+
+// PUB_PREPARE <topic> <partition> [ext]
+// the message will be invisible to the consumers until committed, the response
+// is the same as the traced pub and the message id should be used to commit or rollback.
+// The body has the json header as PUB_EXT if ext is true.
+func (p *protocolV2) PUBPREPARE(client *nsqd.ClientV2, params [][]byte) ([]byte, error) {
+	pubExt, err := getPubExtParam(params, 3)
+	if err != nil {
+		return nil, err
+	}
+	if len(params) > 3 {
+		params = params[:3]
+	}
+	return p.internalPubExtAndTrace(client, params, pubExt, false,
+		&pubDelayedInfo{delayedType: nsqd.TransactionDelayed})
+}
+
+// TX_COMMIT <topic> <partition> <message_id>
+func (p *protocolV2) TXCOMMIT(client *nsqd.ClientV2, params [][]byte) ([]byte, error) {
+	return p.internalTxEnd(client, params, true)
+}
+
+// TX_ROLLBACK <topic> <partition> <message_id>
+func (p *protocolV2) TXROLLBACK(client *nsqd.ClientV2, params [][]byte) ([]byte, error) {
+	return p.internalTxEnd(client, params, false)
+}
+
+func (p *protocolV2) internalTxEnd(client *nsqd.ClientV2, params [][]byte, commit bool) ([]byte, error) {
+	var err error
+	if len(params) < 4 {
+		return nil, protocol.NewFatalClientErr(nil, E_INVALID,
+			fmt.Sprintf("%s insufficient number of parameters", params[0]))
+	}
+	topicName := string(params[1])
+	partition, err := strconv.Atoi(string(params[2]))
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_PARTITION",
+			fmt.Sprintf("topic partition is not valid: %v", err))
+	}
+	id, err := protocol.ByteToBase10(params[3])
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, E_INVALID,
+			fmt.Sprintf("%s could not parse message id %s", params[0], params[3]))
+	}
+	if err = p.CheckAuth(client, "PUB", topicName, ""); err != nil {
+		return nil, err
+	}
+	topic, err := p.ctx.getExistingTopic(topicName, partition)
+	if err != nil {
+		nsqd.NsqLogger().Logf("not existing topic: %v-%v, err:%v", topicName, partition, err.Error())
+		return nil, protocol.NewFatalClientErr(nil, E_TOPIC_NOT_EXIST, "")
+	}
+	if !p.ctx.checkForMasterWrite(topicName, partition) {
+		topic.DisableForSlave()
+		return nil, protocol.NewClientErr(nil, FailedOnNotLeader, "")
+	}
+	if commit {
+		err = p.ctx.CommitTransactionMessage(topic, nsqd.MessageID(id))
+	} else {
+		err = p.ctx.RollbackTransactionMessage(topic, nsqd.MessageID(id))
+	}
+	if err != nil {
+		nsqd.NsqLogger().LogWarningf("topic %v end transaction %v (commit: %v) failed: %v",
+			topic.GetFullName(), id, commit, err)
+		if err == nsqd.ErrTxMessageNotFound {
+			return nil, protocol.NewClientErr(err, "E_TX_NOT_FOUND", err.Error())
+		}
+		if clusterErr, ok := err.(*consistence.CommonCoordErr); ok {
+			if !clusterErr.IsLocalErr() {
+				return nil, protocol.NewClientErr(err, FailedOnNotWritable, "")
+			}
+		}
+		return nil, protocol.NewClientErr(err, "E_TX_FAILED", err.Error())
+	}
+	return okBytes, nil
+}
+
+func (p *protocolV2) getPubDelay(params [][]byte) (time.Duration, error) {
+	if len(params) < 4 {
+		return 0, protocol.NewFatalClientErr(nil, E_INVALID,
+			fmt.Sprintf("%s insufficient number of parameters", params[0]))
+	}
+	delayMs, err := protocol.ByteToBase10(params[3])
+	if err != nil {
+		return 0, protocol.NewFatalClientErr(err, E_INVALID,
+			fmt.Sprintf("%s could not parse delay %s", params[0], params[3]))
+	}
+	delay := time.Duration(delayMs) * time.Millisecond
+	maxDelay := p.ctx.getOpts().MaxPubDelay
+	if delay <= 0 || delay > maxDelay {
+		return 0, protocol.NewFatalClientErr(nil, E_INVALID,
+			fmt.Sprintf("%s delay %v out of range 0-%v", params[0], delay, maxDelay))
+	}
+	return delay, nil
 }
 
 func getTracedReponse(id nsqd.MessageID, traceID uint64, offset nsqd.BackendOffset, rawSize int32) ([]byte, error) {
@@ -1408,18 +1557,39 @@ func internalPubAsync(clientTimer *time.Timer, msgBody *bytes.Buffer, topic *nsq
 	return info.Err
 }
 
+// the optional ext param for the delayed and transaction pub
+func getPubExtParam(params [][]byte, index int) (bool, error) {
+	if len(params) <= index {
+		return false, nil
+	}
+	pubExt, err := strconv.ParseBool(string(params[index]))
+	if err != nil {
+		return false, protocol.NewFatalClientErr(nil, "E_BAD_EXT",
+			fmt.Sprintf("%s ext is not valid: %v", params[0], err))
+	}
+	return pubExt, nil
+}
+
 func isPubExt(pubCmdName []byte) bool {
 	return bytes.Equal(pubCmdName, []byte("PUB_EXT"))
 }
 
 func (p *protocolV2) internalPubAndTrace(client *nsqd.ClientV2, params [][]byte, traceEnable bool) ([]byte, error) {
-	return p.internalPubExtAndTrace(client, params, false, traceEnable)
+	return p.internalPubExtAndTrace(client, params, false, traceEnable, nil)
+}
+
+type pubDelayedInfo struct {
+	delayedType int
+	// only used for the delayed pub
+	delay time.Duration
 }
 
 /**
 pub ext or pub trace or pub, if pubExt is true, traceEnable is ignored.
+if delayed is not nil, the message will be put to the delayed queue.
 */
-func (p *protocolV2) internalPubExtAndTrace(client *nsqd.ClientV2, params [][]byte, pubExt bool, traceEnable bool) ([]byte, error) {
+func (p *protocolV2) internalPubExtAndTrace(client *nsqd.ClientV2, params [][]byte, pubExt bool, traceEnable bool,
+	delayed *pubDelayedInfo) ([]byte, error) {
 	startPub := time.Now().UnixNano()
 	bodyLen, topic, err := p.preparePub(client, params, p.ctx.getOpts().MaxMsgSize, false)
 	if err != nil {
@@ -1488,6 +1658,41 @@ func (p *protocolV2) internalPubExtAndTrace(client *nsqd.ClientV2, params [][]by
 			}
 			needTraceRsp = true
 		}
+		if keyJson, ok := jsonHeader.CheckGet(ext.MSG_SHARDING_KEY); ok {
+			if _, err := keyJson.String(); err != nil {
+				return nil, protocol.NewClientErr(err, "INVALID_SHARDING_KEY", "passin sharding key should be string")
+			}
+		}
+		if seqJson, ok := jsonHeader.CheckGet(ext.MSG_PRODUCER_SEQ_KEY); ok {
+			seqStr, err := seqJson.String()
+			if err != nil {
+				return nil, protocol.NewClientErr(err, "INVALID_PRODUCER_SEQ", "passin producer seq should be string")
+			}
+			_, err = strconv.ParseUint(seqStr, 10, 64)
+			if err != nil {
+				return nil, protocol.NewClientErr(err, "INVALID_PRODUCER_SEQ", "invalid producer seq")
+			}
+			producerID := ""
+			if idJson, ok := jsonHeader.CheckGet(ext.MSG_PRODUCER_ID_KEY); ok {
+				producerID, err = idJson.String()
+				if err != nil || len(producerID) > nsqd.MaxProducerIDLen {
+					return nil, protocol.NewClientErr(err, "INVALID_PRODUCER_ID", "invalid producer id")
+				}
+			} else if producerID = client.GetProducerID(); producerID != "" {
+				// write the producer id from identify to the header, so the
+				// replicas and the new leader can check the duplicated pub
+				jsonHeader.Set(ext.MSG_PRODUCER_ID_KEY, producerID)
+				extJsonBytes, err = jsonHeader.MarshalJSON()
+				if err != nil || len(extJsonBytes) > ext.MaxExtLen {
+					return nil, protocol.NewClientErr(err, ext.E_INVALID_JSON_HEADER, "fail to add producer id to json header")
+				}
+			}
+			if producerID == "" {
+				return nil, protocol.NewClientErr(nil, "INVALID_PRODUCER_ID", "missing producer id for the producer seq")
+			}
+			// the original message id should be returned for the duplicated pub
+			needTraceRsp = true
+		}
 
 		jhe := ext.NewJsonHeaderExt()
 		jhe.SetJsonHeaderBytes(extJsonBytes)
@@ -1496,7 +1701,11 @@ func (p *protocolV2) internalPubExtAndTrace(client *nsqd.ClientV2, params [][]by
 	} else {
 		realBody = messageBody
 	}
-	if needTraceRsp || atomic.LoadInt32(&topic.EnableTrace) == 1 {
+	if delayed != nil && delayed.delayedType == nsqd.TransactionDelayed {
+		// the prepared message id is needed to commit or rollback
+		needTraceRsp = true
+	}
+	if needTraceRsp || atomic.LoadInt32(&topic.EnableTrace) == 1 || delayed != nil {
 		asyncAction = false
 	}
 	if p.ctx.checkForMasterWrite(topicName, partition) {
@@ -1528,6 +1737,11 @@ func (p *protocolV2) internalPubExtAndTrace(client *nsqd.ClientV2, params [][]by
 		rawSize := int32(0)
 		if asyncAction {
 			err = internalPubAsync(client.PubTimeout, messageBodyBuffer, topic, extContent)
+		} else if delayed != nil && delayed.delayedType == nsqd.TransactionDelayed {
+			id, offset, rawSize, _, err = p.ctx.PutTransactionMessage(topic, realBody, extContent, traceID,
+				client.GetTxCheckBackURL())
+		} else if delayed != nil {
+			id, offset, rawSize, _, err = p.ctx.PutDelayedMessage(topic, realBody, extContent, traceID, delayed.delay)
 		} else {
 			id, offset, rawSize, _, err = p.ctx.PutMessage(topic, realBody, extContent, traceID)
 		}
@@ -1563,7 +1777,8 @@ func (p *protocolV2) internalPubExtAndTrace(client *nsqd.ClientV2, params [][]by
 	}
 }
 
-func (p *protocolV2) internalMPUBAndTrace(client *nsqd.ClientV2, params [][]byte, traceEnable bool) ([]byte, error) {
+func (p *protocolV2) internalMPUBAndTrace(client *nsqd.ClientV2, params [][]byte, traceEnable bool,
+	delay time.Duration) ([]byte, error) {
 	startPub := time.Now().UnixNano()
 	_, topic, preErr := p.preparePub(client, params, p.ctx.getOpts().MaxBodySize, true)
 	if preErr != nil {
@@ -1585,7 +1800,15 @@ func (p *protocolV2) internalMPUBAndTrace(client *nsqd.ClientV2, params [][]byte
 	topicName := topic.GetTopicName()
 	partition := topic.GetTopicPart()
 	if p.ctx.checkForMasterWrite(topicName, partition) {
-		id, offset, rawSize, err := p.ctx.PutMessages(topic, messages)
+		var id nsqd.MessageID
+		var offset nsqd.BackendOffset
+		var rawSize int32
+		var err error
+		if delay > 0 {
+			id, offset, rawSize, err = p.ctx.PutDelayedMessages(topic, messages, delay)
+		} else {
+			id, offset, rawSize, err = p.ctx.PutMessages(topic, messages)
+		}
 		//p.ctx.setHealth(err)
 		if err != nil {
 			topic.GetDetailStats().UpdatePubClientStats(client.String(), client.UserAgent, "tcp", int64(len(messages)), true)
@@ -5571,7 +5571,7 @@ func BenchmarkProtocolV2Exec(b *testing.B) {
 	_, _, nsqd, nsqdServer := mustStartNSQD(opts)
 	defer os.RemoveAll(opts.DataPath)
 	defer nsqdServer.Exit()
-	ctx := &context{0, nsqd, nil, nil, nil, nil, ""}
+	ctx := &context{nsqd: nsqd}
 	p := &protocolV2{ctx}
 	c := nsqdNs.NewClientV2(0, nil, ctx.getOpts(), nil)
 	params := [][]byte{[]byte("NOP")}
@@ -6039,3 +6039,70 @@ func BenchmarkProtocolV2MultiSub2(b *testing.B)  { benchmarkProtocolV2MultiSub(b
 func BenchmarkProtocolV2MultiSub4(b *testing.B)  { benchmarkProtocolV2MultiSub(b, 4) }
 func BenchmarkProtocolV2MultiSub8(b *testing.B)  { benchmarkProtocolV2MultiSub(b, 8) }
 func BenchmarkProtocolV2MultiSub16(b *testing.B) { benchmarkProtocolV2MultiSub(b, 16) }
+
+func TestDelayedPubAndPrepareWithJsonExt(t *testing.T) {
+	topicName := "test_delayed_pub_ext" + strconv.Itoa(int(time.Now().Unix()))
+
+	opts := nsqdNs.NewOptions()
+	opts.Logger = newTestLogger(t)
+	tcpAddr, _, nsqd, nsqdServer := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqdServer.Exit()
+	topic := nsqd.GetTopicIgnPart(topicName)
+	topicDynConf := nsqdNs.TopicDynamicConf{
+		AutoCommit: 1,
+		SyncEvery:  1,
+		Ext:        true,
+	}
+	topic.SetDynamicInfo(topicDynConf, nil)
+	topic.GetChannel("ch")
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Equal(t, err, nil)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+
+	jsonHeaderStr := "{\"k1\":\"v1\"}"
+	cmd, err := nsq.PublishWithJsonExt(topicName, "0", make([]byte, 5), []byte(jsonHeaderStr))
+	test.Nil(t, err)
+	cmd.Name = []byte("DPUB")
+	cmd.Params = [][]byte{[]byte(topicName), []byte("0"), []byte("3600000"), []byte("true")}
+	cmd.WriteTo(conn)
+	resp, _ := nsq.ReadResponse(conn)
+	frameType, data, _ := nsq.UnpackResponse(resp)
+	t.Logf("frameType: %d, data: %s", frameType, data)
+	test.Equal(t, frameTypeResponse, frameType)
+
+	cmd.Name = []byte("PUB_PREPARE")
+	cmd.Params = [][]byte{[]byte(topicName), []byte("0"), []byte("true")}
+	cmd.WriteTo(conn)
+	resp, _ = nsq.ReadResponse(conn)
+	frameType, data, _ = nsq.UnpackResponse(resp)
+	t.Logf("frameType: %d, data: %s", frameType, data)
+	test.Equal(t, frameTypeResponse, frameType)
+
+	// the json header should be kept in the delayed queue for both
+	dq := topic.GetDelayedQueue()
+	test.NotNil(t, dq)
+	results := make([]nsqdNs.Message, 10)
+	n, err := dq.PeekAll(results)
+	test.Nil(t, err)
+	test.Equal(t, 2, n)
+	for _, m := range results[:n] {
+		test.Equal(t, uint8(ext.JSON_HEADER_EXT_VER), m.ExtVer)
+		test.Equal(t, jsonHeaderStr, string(m.ExtBytes))
+		test.Equal(t, 5, len(m.Body))
+	}
+
+	// the custom json header is not allowed for the non-ext topic
+	nonExtTopicName := topicName + "_non_ext"
+	nsqd.GetTopicIgnPart(nonExtTopicName).GetChannel("ch")
+	cmd.Name = []byte("DPUB")
+	cmd.Params = [][]byte{[]byte(nonExtTopicName), []byte("0"), []byte("3600000"), []byte("true")}
+	cmd.WriteTo(conn)
+	resp, _ = nsq.ReadResponse(conn)
+	frameType, data, _ = nsq.UnpackResponse(resp)
+	t.Logf("frameType: %d, data: %s", frameType, data)
+	test.Equal(t, frameTypeError, frameType)
+	test.Equal(t, true, strings.Contains(string(data), ext.E_EXT_NOT_SUPPORT))
+}
@@ -0,0 +1,101 @@
+package nsqdserver
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"github.com/youzan/nsq/consistence"
+	"github.com/youzan/nsq/nsqd"
+)
+
+var (
+	errRedeliverOrdered  = errors.New("ordered topic can not redeliver message")
+	errRedeliverNotFound = errors.New("message not found in topic")
+)
+
+const maxRedeliverDelay = time.Hour * 24
+
+// read the message by id from the topic disk queue, the commit log is used to
+// locate the batch which the message belongs to. Without the commit log in
+// the standalone mode, the queue will be scanned from the start.
+func (c *context) readMessageByID(topic *nsqd.Topic, msgID nsqd.MessageID) (*nsqd.Message, error) {
+	snap := topic.GetDiskQueueSnapshot()
+	defer snap.Close()
+	// the max messages to read, the message id is increasing in the queue
+	// so we can stop once the larger id is read
+	maxRead := int64(-1)
+	if c.nsqdCoord != nil {
+		l, realOffset, _, err := c.nsqdCoord.SearchLogByMsgID(topic.GetTopicName(), topic.GetTopicPart(), int64(msgID))
+		if err != nil {
+			return nil, err
+		}
+		if int64(msgID) < l.LogID || int64(msgID) > l.LastMsgLogID {
+			return nil, errRedeliverNotFound
+		}
+		err = snap.SeekTo(nsqd.BackendOffset(realOffset))
+		if err != nil {
+			return nil, err
+		}
+		// the batch written messages share the same commit log
+		maxRead = int64(l.MsgNum)
+	}
+	for i := int64(0); maxRead < 0 || i < maxRead; i++ {
+		ret := snap.ReadOne()
+		if ret.Err == io.EOF {
+			break
+		}
+		if ret.Err != nil {
+			return nil, ret.Err
+		}
+		msg, err := nsqd.DecodeMessage(ret.Data, topic.IsExt())
+		if err != nil {
+			return nil, err
+		}
+		if msg.ID == msgID {
+			msg.Offset = ret.Offset
+			msg.RawMoveSize = ret.MovedSize
+			return msg, nil
+		}
+		if msg.ID > msgID {
+			break
+		}
+	}
+	return nil, errRedeliverNotFound
+}
+
+// RedeliverMessage puts the history message to the delayed queue of the
+// channel, so it will be delivered again only to the channel after the
+// delay. The operator is used to trace who triggered the redelivery.
+func (c *context) RedeliverMessage(topic *nsqd.Topic, ch *nsqd.Channel, msgID nsqd.MessageID,
+	delay time.Duration, operator string) error {
+	if topic.IsOrdered() {
+		return errRedeliverOrdered
+	}
+	if !c.checkForMasterWrite(topic.GetTopicName(), topic.GetTopicPart()) {
+		return consistence.ErrNotTopicLeader.ToErrorType()
+	}
+	origMsg, err := c.readMessageByID(topic, msgID)
+	if err != nil {
+		return err
+	}
+	var msg *nsqd.Message
+	if topic.IsExt() {
+		msg = nsqd.NewMessageWithExt(0, origMsg.Body, origMsg.ExtVer, origMsg.ExtBytes)
+	} else {
+		msg = nsqd.NewMessage(0, origMsg.Body)
+	}
+	msg.TraceID = origMsg.TraceID
+	msg.DelayedType = nsqd.ChannelDelayed
+	msg.DelayedTs = time.Now().Add(delay).UnixNano()
+	msg.DelayedOrigID = origMsg.ID
+	msg.DelayedChannel = ch.GetName()
+	_, _, _, _, err = c.PutMessageObj(topic, msg)
+	if err != nil {
+		return err
+	}
+	nsqd.GetMsgTracer().TraceSub(topic.GetTopicName(), ch.GetName(), "REDELIVER", origMsg.TraceID, origMsg, operator, 0)
+	nsqd.NsqLogger().Logf("channel %v-%v message %v redelivered by %v after %v",
+		topic.GetFullName(), ch.GetName(), msgID, operator, delay)
+	return nil
+}
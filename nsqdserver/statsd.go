@@ -7,7 +7,7 @@ import (
 	"sort"
 	"time"
 
-	"github.com/youzan/nsq/internal/statsd"
+	"github.com/youzan/nsq/internal/metricsink"
 	"github.com/youzan/nsq/nsqd"
 )
 
@@ -36,14 +36,13 @@ func (n *NsqdServer) statsdLoop() {
 			goto exit
 		case <-ticker.C:
 			n.ctx.nsqd.UpdateTopicHistoryStats()
-			client := statsd.NewClient(opts.StatsdAddress, opts.StatsdPrefix)
-			err := client.CreateSocket(opts.StatsdProtocol)
+			client, err := metricsink.New(opts.MetricsSink, opts.StatsdAddress, opts.StatsdProtocol, opts.StatsdPrefix)
 			if err != nil {
-				nsqd.NsqLogger().Logf("failed to create %v socket to statsd(%s)", opts.StatsdProtocol, client)
+				nsqd.NsqLogger().Logf("failed to create %v metrics sink to (%s): %v", opts.MetricsSink, opts.StatsdAddress, err)
 				continue
 			}
 
-			nsqd.NsqLogger().LogDebugf("STATSD: pushing stats to %s, using prefix: %v", client, opts.StatsdPrefix)
+			nsqd.NsqLogger().LogDebugf("STATSD: pushing stats to %v %s, using prefix: %v", opts.MetricsSink, client, opts.StatsdPrefix)
 
 			stats := n.ctx.nsqd.GetStats(false, true)
 			for _, topic := range stats {
@@ -121,6 +120,10 @@ func (n *NsqdServer) statsdLoop() {
 					stat = fmt.Sprintf("topic.%s.channel.%s.timeout_count", statdName, channel.ChannelName)
 					client.Incr(stat, int64(diff))
 
+					diff = channel.ExpiredCount - lastChannel.ExpiredCount
+					stat = fmt.Sprintf("topic.%s.channel.%s.expired_count", statdName, channel.ChannelName)
+					client.Incr(stat, int64(diff))
+
 					// 16ms, 32ms, 64ms, 128ms, 256ms, 512ms, 1024ms, 2048ms, 4s, 8s, 16s, above
 					old500ms := int64(0)
 					for i := 6; i < len(lastChannel.MsgConsumeLatencyStats); i++ {
@@ -212,7 +215,10 @@ func (n *NsqdServer) statsdLoop() {
 				lastMemStats = memStats
 			}
 
-			client.Close()
+			err = client.Close()
+			if err != nil {
+				nsqd.NsqLogger().Logf("STATSD: pushing stats to %v %s failed: %v", opts.MetricsSink, client, err)
+			}
 		}
 	}
 
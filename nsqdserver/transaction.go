@@ -0,0 +1,196 @@
+package nsqdserver
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/youzan/nsq/internal/http_api"
+	"github.com/youzan/nsq/nsqd"
+)
+
+const (
+	txCheckBackBatch    = 100
+	txCheckBackInterval = time.Second
+	// the max concurrent http requests for checking back the producers
+	txCheckBackWorkers = 16
+
+	TxStatusCommit   = "commit"
+	TxStatusRollback = "rollback"
+	TxStatusUnknown  = "unknown"
+)
+
+// the response of the producer check back url, the status should be
+// one of commit, rollback or unknown.
+type txCheckBackResult struct {
+	Status string `json:"status"`
+}
+
+type txCheckState struct {
+	checkCnt  int
+	nextCheck int64
+}
+
+type txCheckBackJob struct {
+	topic    *nsqd.Topic
+	txMsg    nsqd.Message
+	checkCnt int
+}
+
+// txCheckBackLoop checks back the producers for the prepared transaction
+// messages which are not committed or rolled back before the check timeout.
+// Only the leader of the topic partition will do this. The check back requests
+// are done by a bounded worker pool, so a slow producer will not block the others.
+func (s *NsqdServer) txCheckBackLoop() {
+	ticker := time.NewTicker(txCheckBackInterval)
+	defer ticker.Stop()
+	client := http_api.NewClient(nil)
+	results := make([]nsqd.Message, txCheckBackBatch)
+	jobs := make(chan txCheckBackJob, txCheckBackBatch)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer close(jobs)
+	for i := 0; i < txCheckBackWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				select {
+				case <-s.exitChan:
+					// drop the jobs left while exiting
+					continue
+				default:
+				}
+				s.ctx.checkBackTransaction(client, job)
+			}
+		}()
+	}
+	// the check state is kept in memory, so after restart or leader changed
+	// the producer may be checked back more times.
+	states := make(map[string]map[nsqd.MessageID]*txCheckState)
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.exitChan:
+			return
+		}
+		if atomic.LoadInt32(&nsqd.EnableDelayedQueue) != 1 {
+			continue
+		}
+		newStates := make(map[string]map[nsqd.MessageID]*txCheckState, len(states))
+		topics := s.ctx.nsqd.GetTopicMapCopy()
+		for _, partitions := range topics {
+			for _, t := range partitions {
+				select {
+				case <-s.exitChan:
+					return
+				default:
+				}
+				if t.IsOrdered() || t.IsWriteDisabled() || t.Exiting() {
+					continue
+				}
+				if !s.ctx.checkForMasterWrite(t.GetTopicName(), t.GetTopicPart()) {
+					continue
+				}
+				topicStates := s.ctx.scheduleTransactionCheckBack(jobs, t, time.Now().UnixNano(),
+					results, states[t.GetFullName()])
+				if len(topicStates) > 0 {
+					newStates[t.GetFullName()] = topicStates
+				}
+			}
+		}
+		states = newStates
+	}
+}
+
+// schedule the check back for the timeout transaction messages. The check will
+// be retried in the next round if the workers are all busy. Return the check
+// states of the messages still waiting.
+func (c *context) scheduleTransactionCheckBack(jobs chan<- txCheckBackJob, topic *nsqd.Topic, now int64,
+	results []nsqd.Message, states map[nsqd.MessageID]*txCheckState) map[nsqd.MessageID]*txCheckState {
+	dq := topic.GetDelayedQueue()
+	if dq == nil {
+		return nil
+	}
+	cnt, err := dq.PeekRecentTransactionTimeout(now, results)
+	if err != nil || cnt == 0 {
+		return nil
+	}
+	newStates := make(map[nsqd.MessageID]*txCheckState, cnt)
+	for i := 0; i < cnt; i++ {
+		txMsg := results[i]
+		st, ok := states[txMsg.ID]
+		if !ok {
+			st = &txCheckState{}
+		}
+		newStates[txMsg.ID] = st
+		if st.nextCheck > now {
+			continue
+		}
+		select {
+		case jobs <- txCheckBackJob{topic: topic, txMsg: txMsg, checkCnt: st.checkCnt + 1}:
+			st.checkCnt++
+			st.nextCheck = now + int64(c.getOpts().TxCheckTimeout)
+		default:
+		}
+	}
+	return newStates
+}
+
+// check back the producer for the timeout transaction message and commit or rollback
+// it by the check result. The transaction message will be rolled back after
+// the max check count.
+func (c *context) checkBackTransaction(client *http_api.Client, job txCheckBackJob) {
+	topic := job.topic
+	txMsg := &job.txMsg
+	if topic.Exiting() {
+		return
+	}
+	status := checkBackProducer(client, topic, txMsg)
+	if status == TxStatusUnknown && job.checkCnt >= c.getOpts().TxMaxCheckCount {
+		nsqd.NsqLogger().LogWarningf("topic %v transaction message %v rollback since check back too much times: %v",
+			topic.GetFullName(), txMsg.ID, job.checkCnt)
+		status = TxStatusRollback
+	}
+	var err error
+	switch status {
+	case TxStatusCommit:
+		err = c.CommitTransactionMessage(topic, txMsg.ID)
+	case TxStatusRollback:
+		err = c.RollbackTransactionMessage(topic, txMsg.ID)
+	default:
+		return
+	}
+	if err != nil && err != nsqd.ErrTxMessageNotFound {
+		nsqd.NsqLogger().LogWarningf("topic %v transaction message %v %v failed: %v",
+			topic.GetFullName(), txMsg.ID, status, err)
+	}
+}
+
+func checkBackProducer(client *http_api.Client, topic *nsqd.Topic, txMsg *nsqd.Message) string {
+	checkURL := string(txMsg.DelayedData)
+	if checkURL == "" {
+		return TxStatusUnknown
+	}
+	sep := "?"
+	if strings.Contains(checkURL, "?") {
+		sep = "&"
+	}
+	endpoint := fmt.Sprintf("%s%stopic=%s&partition=%d&id=%d", checkURL, sep,
+		url.QueryEscape(topic.GetTopicName()), topic.GetTopicPart(), txMsg.ID)
+	var ret txCheckBackResult
+	_, err := client.GETV1(endpoint, &ret)
+	if err != nil {
+		nsqd.NsqLogger().Logf("topic %v check back transaction message %v failed: %v",
+			topic.GetFullName(), txMsg.ID, err)
+		return TxStatusUnknown
+	}
+	switch ret.Status {
+	case TxStatusCommit, TxStatusRollback:
+		return ret.Status
+	}
+	return TxStatusUnknown
+}
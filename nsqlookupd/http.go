@@ -10,6 +10,7 @@ import (
 	"errors"
 	"runtime"
 	"strconv"
+	"strings"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/youzan/nsq/consistence"
@@ -100,9 +101,19 @@ func newHTTPServer(ctx *Context) *httpServer {
 	router.Handle("GET", "/topics", http_api.Decorate(s.doTopics, log, http_api.NegotiateVersion))
 	router.Handle("GET", "/channels", http_api.Decorate(s.doChannels, log, http_api.NegotiateVersion))
 	router.Handle("GET", "/nodes", http_api.Decorate(s.doNodes, log, http_api.NegotiateVersion))
+	router.Handle("GET", "/topic/lag", http_api.Decorate(s.doTopicLag, log, http_api.V1))
 	router.Handle("GET", "/listlookup", http_api.Decorate(s.doListLookup, debugLog, http_api.NegotiateVersion))
 	router.Handle("GET", "/cluster/stats", http_api.Decorate(s.doClusterStats, debugLog, http_api.V1))
+	router.Handle("GET", "/metrics", http_api.Decorate(s.doMetrics, http_api.PlainText))
 	router.Handle("POST", "/cluster/node/remove", http_api.Decorate(s.doRemoveClusterDataNode, log, http_api.V1))
+	router.Handle("POST", "/cluster/node/decommission", http_api.Decorate(s.doStartNodeDecommission, log, http_api.V1))
+	router.Handle("GET", "/cluster/node/decommission", http_api.Decorate(s.doNodeDecommissionStatus, log, http_api.V1))
+	router.Handle("POST", "/cluster/node/decommission/pause", http_api.Decorate(s.doPauseNodeDecommission, log, http_api.V1))
+	router.Handle("POST", "/cluster/node/decommission/resume", http_api.Decorate(s.doResumeNodeDecommission, log, http_api.V1))
+	router.Handle("GET", "/cluster/balance/plan", http_api.Decorate(s.doClusterBalancePlan, log, http_api.V1))
+	router.Handle("POST", "/cluster/balance/refresh", http_api.Decorate(s.doClusterBalanceRefresh, log, http_api.V1))
+	router.Handle("POST", "/cluster/balance/apply", http_api.Decorate(s.doClusterBalanceApply, log, http_api.V1))
+	router.Handle("POST", "/cluster/balance/cancel", http_api.Decorate(s.doClusterBalanceCancel, log, http_api.V1))
 	router.Handle("POST", "/cluster/upgrade/begin", http_api.Decorate(s.doClusterBeginUpgrade, log, http_api.V1))
 	router.Handle("POST", "/cluster/upgrade/done", http_api.Decorate(s.doClusterFinishUpgrade, log, http_api.V1))
 	router.Handle("POST", "/cluster/lookupd/tombstone", http_api.Decorate(s.doClusterTombstoneLookupd, log, http_api.V1))
@@ -115,6 +126,7 @@ func newHTTPServer(ctx *Context) *httpServer {
 	router.Handle("POST", "/topic/partition/expand", http_api.Decorate(s.doChangeTopicPartitionNum, log, http_api.V1))
 	router.Handle("POST", "/topic/partition/move", http_api.Decorate(s.doMoveTopicParition, log, http_api.V1))
 	router.Handle("POST", "/topic/meta/update", http_api.Decorate(s.doChangeTopicDynamicParam, log, http_api.V1))
+	router.Handle("POST", "/channel/reset", http_api.Decorate(s.doResetChannel, log, http_api.V1))
 	//router.Handle("POST", "/channel/create", http_api.Decorate(s.doCreateChannel, log, http_api.V1))
 	//router.Handle("POST", "/channel/delete", http_api.Decorate(s.doDeleteChannel, log, http_api.V1))
 	router.Handle("POST", "/topic/tombstone", http_api.Decorate(s.doTombstoneTopicProducer, log, http_api.V1))
@@ -421,6 +433,9 @@ func (s *httpServer) doLookup(w http.ResponseWriter, req *http.Request, ps httpr
 				"partition_num":  meta.PartitionNum,
 				"replica":        meta.Replica,
 				"extend_support": meta.Ext,
+				"compression":    meta.Compression,
+				"msg_ttl":        meta.MsgTTL,
+				"index_key":      meta.IndexKey,
 			},
 			"producers":  peers,
 			"partitions": partitionProducers,
@@ -511,6 +526,19 @@ func (s *httpServer) doCreateTopic(w http.ResponseWriter, req *http.Request, ps
 	}
 	allowMultiOrdered := reqParams.Get("orderedmulti")
 	allowExt := reqParams.Get("extend")
+	compression := reqParams.Get("compression")
+	if compression == "none" {
+		compression = ""
+	}
+	msgTTLStr := reqParams.Get("msg_ttl")
+	if msgTTLStr == "" {
+		msgTTLStr = "0"
+	}
+	msgTTL, err := strconv.ParseInt(msgTTLStr, 10, 64)
+	if err != nil {
+		nsqlookupLog.Logf("error message ttl param: %v, %v", msgTTLStr, err)
+		return nil, http_api.Err{400, "INVALID_ARG_TOPIC_MSG_TTL"}
+	}
 
 	if s.ctx.nsqlookupd.coordinator == nil {
 		return nil, http_api.Err{500, "MISSING_COORDINATOR"}
@@ -535,6 +563,9 @@ func (s *httpServer) doCreateTopic(w http.ResponseWriter, req *http.Request, ps
 	if allowExt == "true" {
 		meta.Ext = true
 	}
+	meta.Compression = compression
+	meta.MsgTTL = msgTTL
+	meta.IndexKey = reqParams.Get("index_key")
 	err = s.ctx.nsqlookupd.coordinator.CreateTopic(topicName, meta)
 	if err != nil {
 		nsqlookupLog.LogErrorf("DB: adding topic(%s) failed: %v", topicName, err)
@@ -612,6 +643,47 @@ func (s *httpServer) doChangeTopicPartitionNum(w http.ResponseWriter, req *http.
 	return nil, nil
 }
 
+func (s *httpServer) doResetChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	if s.ctx.nsqlookupd.coordinator == nil {
+		return nil, http_api.Err{500, "MISSING_COORDINATOR"}
+	}
+	reqParams, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	topicName := reqParams.Get("topic")
+	if topicName == "" {
+		return nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
+	}
+	channelName := reqParams.Get("channel")
+	if channelName == "" {
+		return nil, http_api.Err{400, "MISSING_ARG_CHANNEL"}
+	}
+	tsStr := reqParams.Get("timestamp")
+	if tsStr == "" {
+		return nil, http_api.Err{400, "MISSING_ARG_TIMESTAMP"}
+	}
+	ts, err := strconv.ParseInt(tsStr, 10, 64)
+	if err != nil || ts < 0 {
+		return nil, http_api.Err{400, "INVALID_ARG_TIMESTAMP"}
+	}
+
+	results, err := s.ctx.nsqlookupd.coordinator.ResetChannelByTimestamp(topicName, channelName, ts)
+	if err != nil {
+		nsqlookupLog.Logf("reset topic %v channel %v to %v failed: %v", topicName, channelName, ts, err)
+		if results == nil {
+			return nil, http_api.Err{500, err.Error()}
+		}
+	}
+	return struct {
+		Topic      string                           `json:"topic"`
+		Channel    string                           `json:"channel"`
+		Timestamp  int64                            `json:"timestamp"`
+		Partitions []consistence.ChannelResetResult `json:"partitions"`
+	}{topicName, channelName, ts, results}, nil
+}
+
 func (s *httpServer) doChangeTopicDynamicParam(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	if s.ctx.nsqlookupd.coordinator == nil {
 		return nil, http_api.Err{500, "MISSING_COORDINATOR"}
@@ -626,37 +698,44 @@ func (s *httpServer) doChangeTopicDynamicParam(w http.ResponseWriter, req *http.
 		return nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
 	}
 
+	change := consistence.NewTopicMetaParamChange()
 	replicatorStr := reqParams.Get("replicator")
-	replicator := -1
 	if replicatorStr != "" {
-		replicator, err = GetValidReplicator(replicatorStr)
+		change.Replica, err = GetValidReplicator(replicatorStr)
 		if err != nil {
 			return nil, http_api.Err{400, "INVALID_ARG_TOPIC_REPLICATOR"}
 		}
 	}
 
 	syncEveryStr := reqParams.Get("syncdisk")
-	syncEvery := -1
 	if syncEveryStr != "" {
-		syncEvery, err = strconv.Atoi(syncEveryStr)
+		change.SyncEvery, err = strconv.Atoi(syncEveryStr)
 		if err != nil {
-			nsqlookupLog.Logf("error sync disk param: %v, %v", syncEvery, err)
+			nsqlookupLog.Logf("error sync disk param: %v, %v", syncEveryStr, err)
 			return nil, http_api.Err{400, "INVALID_ARG_TOPIC_SYNC_DISK"}
 		}
 	}
 	retentionDaysStr := reqParams.Get("retention")
-	retentionDays := -1
 	if retentionDaysStr != "" {
-		retentionDays, err = strconv.Atoi(retentionDaysStr)
+		change.RetentionDay, err = strconv.Atoi(retentionDaysStr)
 		if err != nil {
 			nsqlookupLog.Logf("error retention param: %v, %v", retentionDaysStr, err)
 			return nil, http_api.Err{400, err.Error()}
 		}
 	}
-	upgradeExtStr := reqParams.Get("upgradeext")
+	change.UpgradeExt = reqParams.Get("upgradeext") == "true"
+	change.Compression = reqParams.Get("compression")
+	msgTTLStr := reqParams.Get("msg_ttl")
+	if msgTTLStr != "" {
+		change.MsgTTL, err = strconv.ParseInt(msgTTLStr, 10, 64)
+		if err != nil || change.MsgTTL < 0 {
+			nsqlookupLog.Logf("error message ttl param: %v, %v", msgTTLStr, err)
+			return nil, http_api.Err{400, "INVALID_ARG_TOPIC_MSG_TTL"}
+		}
+	}
+	change.IndexKey = reqParams.Get("index_key")
 
-	err = s.ctx.nsqlookupd.coordinator.ChangeTopicMetaParam(topicName, syncEvery,
-		retentionDays, replicator, upgradeExtStr)
+	err = s.ctx.nsqlookupd.coordinator.ChangeTopicMetaParam(topicName, change)
 	if err != nil {
 		return nil, http_api.Err{400, err.Error()}
 	}
@@ -739,6 +818,148 @@ func (s *httpServer) doRemoveClusterDataNode(w http.ResponseWriter, req *http.Re
 	return nil, nil
 }
 
+func (s *httpServer) doStartNodeDecommission(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	if s.ctx.nsqlookupd.coordinator == nil {
+		return nil, http_api.Err{500, "MISSING_COORDINATOR"}
+	}
+	reqParams, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+	nid := reqParams.Get("node")
+	if nid == "" {
+		return nil, http_api.Err{400, "MISSING_ARG_NODE"}
+	}
+	maxConcurrent := 0
+	if str := reqParams.Get("max_concurrent"); str != "" {
+		maxConcurrent, err = strconv.Atoi(str)
+		if err != nil || maxConcurrent < 0 {
+			return nil, http_api.Err{400, "INVALID_ARG_MAX_CONCURRENT"}
+		}
+	}
+	catchupRate := int64(0)
+	if str := reqParams.Get("catchup_rate"); str != "" {
+		catchupRate, err = strconv.ParseInt(str, 10, 64)
+		if err != nil || catchupRate < 0 {
+			return nil, http_api.Err{400, "INVALID_ARG_CATCHUP_RATE"}
+		}
+	}
+	err = s.ctx.nsqlookupd.coordinator.StartNodeDecommission(nid, maxConcurrent, catchupRate)
+	if err != nil {
+		return nil, http_api.Err{400, err.Error()}
+	}
+	return nil, nil
+}
+
+func (s *httpServer) doNodeDecommissionStatus(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	if s.ctx.nsqlookupd.coordinator == nil {
+		return nil, http_api.Err{500, "MISSING_COORDINATOR"}
+	}
+	reqParams, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+	nid := reqParams.Get("node")
+	if nid == "" {
+		return nil, http_api.Err{400, "MISSING_ARG_NODE"}
+	}
+	status, err := s.ctx.nsqlookupd.coordinator.GetNodeDecommissionStatus(nid)
+	if err != nil {
+		return nil, http_api.Err{400, err.Error()}
+	}
+	return status, nil
+}
+
+func (s *httpServer) doPauseNodeDecommission(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	return s.pauseNodeDecommission(req, true)
+}
+
+func (s *httpServer) doResumeNodeDecommission(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	return s.pauseNodeDecommission(req, false)
+}
+
+func (s *httpServer) pauseNodeDecommission(req *http.Request, pause bool) (interface{}, error) {
+	if s.ctx.nsqlookupd.coordinator == nil {
+		return nil, http_api.Err{500, "MISSING_COORDINATOR"}
+	}
+	reqParams, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+	nid := reqParams.Get("node")
+	if nid == "" {
+		return nil, http_api.Err{400, "MISSING_ARG_NODE"}
+	}
+	err = s.ctx.nsqlookupd.coordinator.PauseNodeDecommission(nid, pause)
+	if err != nil {
+		return nil, http_api.Err{400, err.Error()}
+	}
+	return nil, nil
+}
+
+func (s *httpServer) doClusterBalancePlan(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	if s.ctx.nsqlookupd.coordinator == nil {
+		return nil, http_api.Err{500, "MISSING_COORDINATOR"}
+	}
+	plan, err := s.ctx.nsqlookupd.coordinator.GetBalancePlan()
+	if err != nil {
+		return nil, http_api.Err{400, err.Error()}
+	}
+	return plan, nil
+}
+
+func (s *httpServer) doClusterBalanceRefresh(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	if s.ctx.nsqlookupd.coordinator == nil {
+		return nil, http_api.Err{500, "MISSING_COORDINATOR"}
+	}
+	plan, err := s.ctx.nsqlookupd.coordinator.RefreshBalancePlan()
+	if err != nil {
+		return nil, http_api.Err{400, err.Error()}
+	}
+	return plan, nil
+}
+
+func (s *httpServer) doClusterBalanceApply(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	if s.ctx.nsqlookupd.coordinator == nil {
+		return nil, http_api.Err{500, "MISSING_COORDINATOR"}
+	}
+	reqParams, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+	planID, err := strconv.ParseInt(reqParams.Get("plan_id"), 10, 64)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_ARG_PLAN_ID"}
+	}
+	var stepIDs []int
+	stepsStr := reqParams.Get("steps")
+	if stepsStr != "" {
+		for _, str := range strings.Split(stepsStr, ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(str))
+			if err != nil {
+				return nil, http_api.Err{400, "INVALID_ARG_STEPS"}
+			}
+			stepIDs = append(stepIDs, id)
+		}
+	}
+	err = s.ctx.nsqlookupd.coordinator.ApplyBalancePlan(planID, stepIDs)
+	if err != nil {
+		return nil, http_api.Err{400, err.Error()}
+	}
+	return nil, nil
+}
+
+func (s *httpServer) doClusterBalanceCancel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	if s.ctx.nsqlookupd.coordinator == nil {
+		return nil, http_api.Err{500, "MISSING_COORDINATOR"}
+	}
+	err := s.ctx.nsqlookupd.coordinator.CancelBalancePlan()
+	if err != nil {
+		return nil, http_api.Err{400, err.Error()}
+	}
+	return nil, nil
+}
+
 func (s *httpServer) doTombstoneTopicProducer(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	reqParams, err := url.ParseQuery(req.URL.RawQuery)
 	if err != nil {
@@ -0,0 +1,47 @@
+package nsqlookupd
+
+import (
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/youzan/nsq/internal/prom"
+)
+
+const metricsPrefix = "nsqlookupd_"
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (s *httpServer) doMetrics(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	e := prom.NewExposition(metricsPrefix)
+	coord := s.ctx.nsqlookupd.coordinator
+	if coord != nil {
+		e.Gauge("coord_is_leader", "whether this lookupd is the leader of the cluster", boolToFloat(coord.IsMineLeader()), nil)
+		e.Gauge("coord_cluster_stable", "whether the cluster is stable", boolToFloat(coord.IsClusterStable()), nil)
+	}
+	db := s.ctx.nsqlookupd.DB
+	e.Gauge("nsqd_nodes", "the number of registered nsqd nodes", float64(len(db.GetAllPeerClients())), nil)
+	topics := db.FindTopics()
+	e.Gauge("topics", "the number of registered topics", float64(len(topics)), nil)
+	for _, t := range topics {
+		producers := db.FindTopicProducers(t, "*")
+		partitions := make(map[string]struct{}, len(producers))
+		for _, p := range producers {
+			partitions[p.PartitionID] = struct{}{}
+		}
+		tl := prom.Labels{"topic": t}
+		e.Gauge("topic_producers", "the number of registered producers of the topic", float64(len(producers)), tl)
+		e.Gauge("topic_partitions", "the number of registered partitions of the topic", float64(len(partitions)), tl)
+		channels := make(map[string]struct{})
+		for _, ch := range db.FindChannelRegs(t, "*") {
+			channels[ch.Channel] = struct{}{}
+		}
+		e.Gauge("topic_channels", "the number of registered channels of the topic", float64(len(channels)), tl)
+	}
+	w.Header().Set("Content-Type", prom.ContentType)
+	return e.Bytes(), nil
+}
@@ -96,7 +96,10 @@ func (l *NSQLookupd) Main() {
 		node.ID = consistence.GenNsqLookupNodeID(&node, "nsqlookup")
 
 		nsqlookupLog.Logf("balance interval is: %v", l.opts.BalanceInterval)
-		coordOpts := &consistence.Options{}
+		coordOpts := &consistence.Options{
+			PrimaryZone:   l.opts.PrimaryZone,
+			BalanceDryRun: l.opts.BalanceDryRun,
+		}
 
 		if len(l.opts.BalanceInterval) == 2 {
 			coordOpts.BalanceStart, err = strconv.Atoi(l.opts.BalanceInterval[0])
@@ -116,8 +119,18 @@ func (l *NSQLookupd) Main() {
 		l.coordinator = consistence.NewNsqLookupCoordinator(l.opts.ClusterID, &node, coordOpts)
 		l.Unlock()
 		// set etcd leader manager here
-		leadership := consistence.NewNsqLookupdEtcdMgr(l.opts.ClusterLeadershipAddresses)
-		l.coordinator.SetLeadershipMgr(leadership)
+		if l.opts.ClusterLeadershipType == "raft" {
+			store, err := consistence.NewRaftKVStore(net.JoinHostPort(node.NodeIP, node.RpcPort),
+				l.opts.ClusterLeadershipAddresses, l.opts.DataPath)
+			if err != nil {
+				nsqlookupLog.LogErrorf("FATAL: init raft leadership failed - %s", err)
+				os.Exit(1)
+			}
+			l.coordinator.SetLeadershipMgr(consistence.NewNsqLookupdRaftMgr(store))
+		} else {
+			leadership := consistence.NewNsqLookupdEtcdMgr(l.opts.ClusterLeadershipAddresses)
+			l.coordinator.SetLeadershipMgr(leadership)
+		}
 		err = l.coordinator.Start()
 		if err != nil {
 			nsqlookupLog.LogErrorf("FATAL: start coordinator failed - %s", err)
@@ -20,10 +20,16 @@ type Options struct {
 
 	ClusterID                  string `flag:"cluster-id"`
 	ClusterLeadershipAddresses string `flag:"cluster-leadership-addresses" cfg:"cluster_leadership_addresses"`
+	// etcd or raft, the raft leadership is embedded in nsqlookupd and the
+	// leadership addresses should be the rpc addresses of all the nsqlookupd
+	ClusterLeadershipType string `flag:"cluster-leadership-type" cfg:"cluster_leadership_type"`
+	DataPath              string `flag:"data-path" cfg:"data_path"`
 
 	InactiveProducerTimeout  time.Duration `flag:"inactive-producer-timeout"`
 	NsqdPingTimeout          time.Duration `flag:"nsqd-ping-timeout"`
 	BalanceInterval          []string      `flag:"balance-interval"`
+	PrimaryZone              string        `flag:"primary-zone" cfg:"primary_zone"`
+	BalanceDryRun            bool          `flag:"balance-dry-run" cfg:"balance_dry_run"`
 	AllowWriteWithNoChannels bool          `flag:"allow-write-with-nochannels"`
 
 	LogLevel int32  `flag:"log-level" cfg:"log_level"`
@@ -45,6 +51,7 @@ func NewOptions() *Options {
 
 		ClusterLeadershipAddresses: "",
 		ClusterID:                  "nsq-clusterid-test-only",
+		ClusterLeadershipType:      "etcd",
 
 		InactiveProducerTimeout: 60 * time.Second,
 		NsqdPingTimeout:         15 * time.Second,
@@ -0,0 +1,91 @@
+package nsqlookupd
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/youzan/nsq/internal/clusterinfo"
+	"github.com/youzan/nsq/internal/http_api"
+)
+
+// get the leader of each topic partition from the registrations, the leader is
+// checked with the cluster info if the coordinator is enabled.
+func (s *httpServer) getTopicPartitionLeaders(topicName string) map[string]*PeerInfo {
+	registrations := s.ctx.nsqlookupd.DB.FindTopicProducers(topicName, "*")
+	registrations = registrations.FilterByActive(s.ctx.nsqlookupd.opts.InactiveProducerTimeout, false)
+	leaders := make(map[string]*PeerInfo)
+	for _, r := range registrations {
+		pid, err := strconv.Atoi(r.PartitionID)
+		if err != nil || pid < 0 {
+			continue
+		}
+		if s.ctx.nsqlookupd.coordinator != nil &&
+			!s.ctx.nsqlookupd.coordinator.IsTopicLeader(topicName, pid, r.ProducerNode.peerInfo.DistributedID) {
+			continue
+		}
+		leaders[r.PartitionID] = r.ProducerNode.peerInfo
+	}
+	return leaders
+}
+
+// query the channel lag from all the partition leaders of the topic
+func (s *httpServer) doTopicLag(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+	topicName := reqParams.Get("topic")
+	if topicName == "" {
+		return nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
+	}
+	channelName := reqParams.Get("channel")
+
+	leaders := s.getTopicPartitionLeaders(topicName)
+	if len(leaders) == 0 {
+		return nil, http_api.Err{404, "TOPIC_NOT_FOUND"}
+	}
+
+	client := http_api.NewClient(nil)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	var partLags []*clusterinfo.ChannelPartitionLag
+	var errs []string
+	for pid, peer := range leaders {
+		wg.Add(1)
+		go func(pid string, peer *PeerInfo) {
+			defer wg.Done()
+			addr := net.JoinHostPort(peer.BroadcastAddress, strconv.Itoa(peer.HTTPPort))
+			endpoint := fmt.Sprintf("http://%s/channel/lag?topic=%s&partition=%s",
+				addr, url.QueryEscape(topicName), pid)
+			if channelName != "" {
+				endpoint += "&channel=" + url.QueryEscape(channelName)
+			}
+			var resp []*clusterinfo.ChannelPartitionLag
+			_, err := client.GETV1(endpoint, &resp)
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				nsqlookupLog.Logf("query channel lag from %v failed: %v", endpoint, err)
+				errs = append(errs, fmt.Sprintf("partition %v on %v: %v", pid, addr, err))
+				return
+			}
+			for _, l := range resp {
+				l.Node = addr
+			}
+			partLags = append(partLags, resp...)
+		}(pid, peer)
+	}
+	wg.Wait()
+
+	if len(errs) == len(leaders) {
+		return nil, http_api.Err{502, "QUERY_NSQD_FAILED"}
+	}
+	topicLag := clusterinfo.NewTopicLag(topicName, partLags)
+	topicLag.Errors = errs
+	return topicLag, nil
+}